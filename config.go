@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// config contains settings read from onedriver's config file. These are
+// settings that are rarely changed or awkward to pass on the command line.
+type config struct {
+	// Scopes are OAuth2 scopes to request in addition to the ones onedriver
+	// always needs, like "Sites.Read.All" to list SharePoint sites with
+	// --all-drives.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// UploadLimit limits the combined speed of all uploads (in KB/s), so that
+	// uploads do not saturate a slow or shared connection. Can be changed while
+	// running with "onedriver upload-limit".
+	UploadLimit uint64 `json:"uploadLimit,omitempty"`
+
+	// DownloadLimit is UploadLimit for downloads, which are also kept from
+	// saturating the connection when prefetching. Can be changed while running
+	// with "onedriver download-limit".
+	DownloadLimit uint64 `json:"downloadLimit,omitempty"`
+
+	// EvictionPolicy decides which files are removed from the cache first when
+	// it grows past --max-cache-size: "lru" (the default), "lfu", or "size".
+	EvictionPolicy string `json:"evictionPolicy,omitempty"`
+
+	// Exclude leaves items matching these patterns out of the filesystem, like
+	// "Backups/" or "*.iso" (see odfs.Options.Exclude).
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// loadConfig reads the config file at path. A missing config file is not an
+// error, the defaults are used instead.
+func loadConfig(path string) config {
+	var conf config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"path": path,
+				"err":  err,
+			}).Warn("Could not read config file, using defaults.")
+		}
+		return conf
+	}
+	if err = json.Unmarshal(data, &conf); err != nil {
+		log.WithFields(log.Fields{
+			"path": path,
+			"err":  err,
+		}).Fatal("Could not parse config file.")
+	}
+	return conf
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	odfs "github.com/jstaf/onedriver/fs"
+)
+
+// commands are subcommands that talk to a running instance of onedriver over its
+// control socket.
+var commands = map[string]func(client *rpc.Client, args []string) error{
+	"queue":             queueCommand,
+	"events":            eventsCommand,
+	"status":            statusCommand,
+	"dehydrate":         dehydrateCommand,
+	"evict":             dehydrateCommand,
+	"verify":            verifyCommand,
+	"conflicts":         conflictsCommand,
+	"analyze":           analyzeCommand,
+	"cp":                cpCommand,
+	"upload-limit":      uploadLimitCommand,
+	"download-limit":    downloadLimitCommand,
+	"cache":             cacheCommand,
+	"prefetch-metadata": prefetchMetadataCommand,
+	"resync":            resyncCommand,
+	"pause":             pauseCommand,
+	"pending":           pendingCommand,
+	"trash":             trashCommand,
+	"resume":            resumeCommand,
+}
+
+func controlSocket(cacheDir string) string {
+	return filepath.Join(cacheDir, "control.sock")
+}
+
+// runCommand runs a subcommand against the instance of onedriver using
+// cacheDir, then exits.
+func runCommand(cacheDir string, name string, args []string) {
+	client, err := rpc.Dial("unix", controlSocket(cacheDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to onedriver, is it running? (%s)\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+	if err = commands[name](client, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func queueCommand(client *rpc.Client, args []string) error {
+	noTarget := map[string]string{
+		"pause":  "Control.QueuePause",
+		"resume": "Control.QueueResume",
+	}
+	if len(args) == 0 || (args[0] != "list" && noTarget[args[0]] == "" && len(args) != 2) {
+		return fmt.Errorf("Usage: onedriver queue list|pause|resume\n" +
+			"       onedriver queue retry|cancel|prioritize <id or name>")
+	}
+	if method, exists := noTarget[args[0]]; exists {
+		var reply string
+		if err := client.Call(method, &odfs.QueueArgs{}, &reply); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", args[0], reply)
+		return nil
+	}
+
+	if args[0] == "list" {
+		var uploads []odfs.UploadStatus
+		if err := client.Call("Control.QueueList", &odfs.QueueArgs{}, &uploads); err != nil {
+			return err
+		}
+		if len(uploads) == 0 {
+			fmt.Println("No uploads in queue.")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSIZE\tSTATE\tPROGRESS\tRETRIES\tERROR")
+		for _, upload := range uploads {
+			progress := 100.0
+			if upload.Size > 0 {
+				progress = 100 * float64(upload.Sent) / float64(upload.Size)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%.0f%%\t%d\t%s\n", upload.ID, upload.Name,
+				upload.Size, upload.State, progress, upload.Retries, upload.Error)
+		}
+		return w.Flush()
+	}
+
+	methods := map[string]string{
+		"retry":      "Control.QueueRetry",
+		"cancel":     "Control.QueueCancel",
+		"prioritize": "Control.QueuePrioritize",
+	}
+	method, exists := methods[args[0]]
+	if !exists {
+		return fmt.Errorf("Unknown queue command \"%s\".", args[0])
+	}
+	var id string
+	if err := client.Call(method, &odfs.QueueArgs{Target: args[1]}, &id); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", args[0], id)
+	return nil
+}
+
+func eventsCommand(client *rpc.Client, args []string) error {
+	var eventArgs odfs.EventArgs
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: onedriver events [count]")
+	} else if len(args) == 1 {
+		limit, err := strconv.Atoi(args[0])
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("Invalid number of events \"%s\".", args[0])
+		}
+		eventArgs.Limit = limit
+	}
+	var events string
+	if err := client.Call("Control.Events", &eventArgs, &events); err != nil {
+		return err
+	}
+	fmt.Print(events)
+	return nil
+}
+
+func statusCommand(client *rpc.Client, args []string) error {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "watch") {
+		return fmt.Errorf("Usage: onedriver status [watch]")
+	}
+	var drives []odfs.DriveStatus
+	if err := client.Call("Control.Status", &odfs.StatusArgs{}, &drives); err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		return watchStatus(client, drives)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DRIVE\tSTATE\tSYNC\tUPLOADS")
+	for _, drive := range drives {
+		state := "online"
+		if drive.Offline {
+			state = "offline"
+		}
+		sync := "never"
+		if drive.SyncPaused {
+			sync = "paused"
+		} else if drive.Delta.Running {
+			sync = fmt.Sprintf("syncing, %d changes in %d pages so far (%s)",
+				drive.Delta.Items, drive.Delta.Pages,
+				time.Since(drive.Delta.Started).Round(time.Second))
+		} else if !drive.Delta.Finished.IsZero() {
+			sync = fmt.Sprintf("%d changes, %s ago", drive.Delta.Items,
+				time.Since(drive.Delta.Finished).Round(time.Second))
+		}
+		uploads := strconv.Itoa(drive.Uploads)
+		if drive.Failed > 0 {
+			uploads += fmt.Sprintf(", %d failed", drive.Failed)
+		}
+		if drive.Paused {
+			uploads += " (paused)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", drive.Drive, state, sync, uploads)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	downloads := make([]odfs.Download, 0)
+	for _, drive := range drives {
+		downloads = append(downloads, drive.Downloads...)
+	}
+	if len(downloads) > 0 {
+		fmt.Println("\nDownloading:")
+		for _, download := range downloads {
+			fmt.Printf("  %3d%%  %s\n", download.Cached*100/download.Size, download.Path)
+		}
+	}
+
+	recent := make([]odfs.Activity, 0)
+	for _, drive := range drives {
+		recent = append(recent, drive.Recent...)
+	}
+	if len(recent) == 0 {
+		return nil
+	}
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].Time.After(recent[j].Time)
+	})
+	fmt.Println("\nRecent activity:")
+	for _, activity := range recent {
+		fmt.Printf("  %s  %-8s  %s\n", activity.Time.Format("15:04:05"),
+			activity.Action, activity.Name)
+	}
+	return nil
+}
+
+// watchStatus prints the status of every drive as a line of JSON each time it
+// changes, for use by status indicators like resources/onedriver-tray.sh. Runs
+// until onedriver exits.
+func watchStatus(client *rpc.Client, drives []odfs.DriveStatus) error {
+	var printed []byte
+	for {
+		line, _ := json.Marshal(drives)
+		if !bytes.Equal(line, printed) { // WatchStatus also returns on timeout
+			fmt.Println(string(line))
+			printed = line
+		}
+		args := odfs.WatchArgs{Last: drives, Timeout: time.Minute}
+		if err := client.Call("Control.WatchStatus", &args, &drives); err != nil {
+			return err
+		}
+	}
+}
+
+func dehydrateCommand(client *rpc.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: onedriver dehydrate|evict <path>...")
+	}
+	for _, path := range args {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		var result odfs.DehydrateResult
+		if err = client.Call("Control.Dehydrate", &odfs.PathArgs{Path: abs}, &result); err != nil {
+			return err
+		}
+		fmt.Printf("%s: removed %d cached files (%.1f MB)\n", path, result.Files,
+			float64(result.Bytes)/(1024*1024))
+	}
+	return nil
+}
+
+func pendingCommand(client *rpc.Client, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: onedriver pending")
+	}
+	var drives []odfs.Pending
+	if err := client.Call("Control.Pending", &odfs.StatusArgs{}, &drives); err != nil {
+		return err
+	}
+	count := 0
+	for _, drive := range drives {
+		if len(drives) > 1 {
+			fmt.Printf("== %s ==\n", drive.Drive)
+		}
+		if len(drive.Local) > 0 {
+			fmt.Println("Not uploaded yet:")
+			for _, change := range drive.Local {
+				fmt.Printf("  %-10s  %s\n", change.Change, change.Path)
+				if change.Error != "" {
+					fmt.Printf("              %s\n", change.Error)
+				}
+			}
+		}
+		if len(drive.Conflicts) > 0 {
+			fmt.Println("Conflicts (see \"onedriver conflicts\"):")
+			for _, conflict := range drive.Conflicts {
+				fmt.Printf("  %s\n", conflict.Path)
+			}
+		}
+		if len(drive.Remote) > 0 {
+			fmt.Println("Changed on the server, not applied yet:")
+			for _, change := range drive.Remote {
+				fmt.Printf("  %-10s  %s\n", change.Change, change.Path)
+			}
+		}
+		if !drive.Checked {
+			fmt.Println("Offline, could not check for changes on the server.")
+		}
+		count += len(drive.Local) + len(drive.Conflicts) + len(drive.Remote)
+	}
+	if count > 0 {
+		return fmt.Errorf("%d changes are not synced yet.", count)
+	}
+	fmt.Println("Everything is synced.")
+	return nil
+}
+
+func trashCommand(client *rpc.Client, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		var trash []odfs.TrashedFile
+		if err := client.Call("Control.TrashList", &odfs.StatusArgs{}, &trash); err != nil {
+			return err
+		}
+		if len(trash) == 0 {
+			fmt.Println("The local trash is empty.")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDELETED\tSIZE\tPATH")
+		for _, trashed := range trash {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", trashed.ID,
+				trashed.Deleted.Format("2006-01-02 15:04"), formatSize(trashed.Size),
+				trashed.Path)
+		}
+		return w.Flush()
+	case len(args) == 1 && args[0] == "empty":
+		var removed int
+		if err := client.Call("Control.TrashEmpty", &odfs.StatusArgs{}, &removed); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d files from the local trash.\n", removed)
+		return nil
+	case len(args) > 1 && args[0] == "restore":
+		for _, id := range args[1:] {
+			var path string
+			if err := client.Call("Control.TrashRestore", &odfs.TrashArgs{ID: id}, &path); err != nil {
+				return err
+			}
+			fmt.Printf("%s: restored to %s\n", id, path)
+		}
+		return nil
+	}
+	return fmt.Errorf("Usage: onedriver trash list|empty\n" +
+		"       onedriver trash restore <id>...")
+}
+
+func pauseCommand(client *rpc.Client, args []string) error {
+	return switchSync(client, args, "Control.PauseSync")
+}
+
+func resumeCommand(client *rpc.Client, args []string) error {
+	return switchSync(client, args, "Control.ResumeSync")
+}
+
+// switchSync pauses or resumes syncing with method.
+func switchSync(client *rpc.Client, args []string, method string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: onedriver pause|resume")
+	}
+	var reply string
+	if err := client.Call(method, &odfs.StatusArgs{}, &reply); err != nil {
+		return err
+	}
+	fmt.Println(reply)
+	return nil
+}
+
+func resyncCommand(client *rpc.Client, args []string) error {
+	if len(args) == 0 || (args[0] != "metadata" && args[0] != "all") {
+		return fmt.Errorf("Usage: onedriver resync metadata|all [path]...")
+	}
+	resyncArgs := odfs.ResyncArgs{Content: args[0] == "all"}
+	paths := args[1:]
+	if len(paths) == 0 {
+		paths = []string{""} // every drive
+	}
+	for _, path := range paths {
+		resyncArgs.Path = path
+		if path != "" {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			resyncArgs.Path = abs
+		}
+		var result odfs.ResyncResult
+		if err := client.Call("Control.Resync", &resyncArgs, &result); err != nil {
+			return err
+		}
+		if path == "" {
+			path = "all drives"
+		}
+		fmt.Printf("%s: %d items refreshed, %d added, %d removed\n", path,
+			result.Refreshed, result.Added, result.Removed)
+		for _, kept := range result.Kept {
+			fmt.Printf("  %s: has changes that were not uploaded yet, left alone\n", kept)
+		}
+	}
+	return nil
+}
+
+func verifyCommand(client *rpc.Client, args []string) error {
+	if len(args) > 0 {
+		return verifyPaths(client, args)
+	}
+	var corrections []odfs.Correction
+	if err := client.Call("Control.VerifyCache", &odfs.VerifyArgs{}, &corrections); err != nil {
+		return err
+	}
+	if len(corrections) == 0 {
+		fmt.Println("All cached files match the server.")
+		return nil
+	}
+	for _, correction := range corrections {
+		fmt.Printf("%s: %s, removed from cache\n", correction.Path, correction.Reason)
+	}
+	return nil
+}
+
+// verifyPaths checks the local content of each path against the server, and asks
+// the user which copy to keep for every file that does not match.
+func verifyPaths(client *rpc.Client, paths []string) error {
+	stdin := bufio.NewReader(os.Stdin)
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		var mismatches []odfs.Mismatch
+		if err = client.Call("Control.VerifyPath", &odfs.PathArgs{Path: abs}, &mismatches); err != nil {
+			return err
+		}
+		if len(mismatches) == 0 {
+			fmt.Printf("%s: matches the server.\n", path)
+			continue
+		}
+
+		for _, mismatch := range mismatches {
+			fmt.Printf("%s: %s\n", mismatch.Path, mismatch.Reason)
+			fmt.Printf("  local:  %s  %s\n", formatSize(mismatch.LocalSize), mismatch.LocalHash)
+			fmt.Printf("  remote: %s  %s\n", formatSize(mismatch.RemoteSize), mismatch.RemoteHash)
+			fmt.Print("Keep the [l]ocal or [r]emote copy, or [s]kip? ")
+			answer, _ := stdin.ReadString('\n')
+			keep := ""
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "l", "local":
+				keep = odfs.KeepLocal
+			case "r", "remote":
+				keep = odfs.KeepRemote
+			default:
+				fmt.Println("Skipped.")
+				continue
+			}
+			var resolved string
+			if err = client.Call("Control.Resolve",
+				&odfs.ResolveArgs{ID: mismatch.ID, Keep: keep}, &resolved); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not keep the %s copy: %s\n", keep, err)
+				continue
+			}
+			fmt.Printf("Kept the %s copy.\n", keep)
+		}
+	}
+	return nil
+}
+
+// conflictsCommand asks the user which version to keep of every file waiting for
+// a version to be picked (see --conflict-strategy=prompt).
+func conflictsCommand(client *rpc.Client, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: onedriver conflicts")
+	}
+	var conflicts []odfs.Conflict
+	if err := client.Call("Control.Conflicts", &odfs.StatusArgs{}, &conflicts); err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("No conflicts to resolve.")
+		return nil
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	for _, conflict := range conflicts {
+		fmt.Printf("%s: changed both locally and on the server (%s)\n", conflict.Path,
+			conflict.Time.Format("2006-01-02 15:04"))
+		fmt.Print("Keep the [l]ocal or [r]emote version, [b]oth, or [s]kip? ")
+		answer, _ := stdin.ReadString('\n')
+		keep := ""
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "l", "local":
+			keep = odfs.KeepLocal
+		case "r", "remote":
+			keep = odfs.KeepRemote
+		case "b", "both":
+			keep = odfs.KeepBoth
+		default:
+			fmt.Println("Skipped.")
+			continue
+		}
+		var resolved string
+		if err := client.Call("Control.ResolveConflict",
+			&odfs.ResolveArgs{ID: conflict.ID, Keep: keep}, &resolved); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not keep the %s version: %s\n", keep, err)
+			continue
+		}
+		if keep == odfs.KeepBoth {
+			fmt.Println("Kept both versions.")
+		} else {
+			fmt.Printf("Kept the %s version.\n", keep)
+		}
+	}
+	return nil
+}
+
+// formatSize formats a size in bytes for humans.
+func formatSize(size uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func cacheCommand(client *rpc.Client, args []string) error {
+	if len(args) != 1 || args[0] != "stats" {
+		return fmt.Errorf("Usage: onedriver cache stats")
+	}
+	var stats []odfs.CacheStats
+	if err := client.Call("Control.CacheStats", &odfs.StatusArgs{}, &stats); err != nil {
+		return err
+	}
+	for n, drive := range stats {
+		if len(stats) > 1 {
+			if n > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("== %s ==\n", drive.Drive)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		size := formatSize(drive.Size)
+		if drive.MaxSize > 0 {
+			size += fmt.Sprintf(" of %s (%d%%)", formatSize(drive.MaxSize),
+				drive.Size*100/drive.MaxSize)
+		}
+		fmt.Fprintf(w, "Size on disk:\t%s\n", size)
+		fmt.Fprintf(w, "Cached files:\t%d (%d partly downloaded)\n", drive.Files, drive.Partial)
+		hits := "no files opened yet"
+		if opened := drive.Hits + drive.Misses; opened > 0 {
+			hits = fmt.Sprintf("%d%% (%d of %d files opened were cached)",
+				drive.Hits*100/opened, drive.Hits, opened)
+		}
+		fmt.Fprintf(w, "Hit ratio:\t%s\n", hits)
+		fmt.Fprintf(w, "Evicted:\t%d files (%s)\n", drive.Evicted, formatSize(drive.EvictedSize))
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prefetchMetadataCommand(client *rpc.Client, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: onedriver prefetch-metadata")
+	}
+	fmt.Println("Fetching the metadata of every item, this may take a while for large drives...")
+	var added int
+	if err := client.Call("Control.PrefetchMetadata", &odfs.StatusArgs{}, &added); err != nil {
+		return err
+	}
+	fmt.Printf("Added %d items, the whole drive can now be browsed offline.\n", added)
+	return nil
+}
+
+func analyzeCommand(client *rpc.Client, args []string) error {
+	analyzeArgs := odfs.AnalyzeArgs{Months: 12, Limit: 20}
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: onedriver analyze [months]")
+	} else if len(args) == 1 {
+		months, err := strconv.Atoi(args[0])
+		if err != nil || months <= 0 {
+			return fmt.Errorf("Invalid number of months \"%s\".", args[0])
+		}
+		analyzeArgs.Months = months
+	}
+	var analyses []odfs.Analysis
+	if err := client.Call("Control.Analyze", &analyzeArgs, &analyses); err != nil {
+		return err
+	}
+
+	for _, analysis := range analyses {
+		if len(analyses) > 1 {
+			fmt.Printf("== %s ==\n\n", analysis.Drive)
+		}
+		fmt.Printf("Analyzed %d files (only folders that have been opened are included).\n",
+			analysis.Files)
+
+		fmt.Println("\nLargest files:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, item := range analysis.Largest {
+			fmt.Fprintf(w, "  %s\t%s\n", formatSize(item.Size), item.Path)
+		}
+		w.Flush()
+
+		fmt.Println("\nDuplicate files:")
+		if len(analysis.Duplicates) == 0 {
+			fmt.Println("  none found")
+		}
+		for _, group := range analysis.Duplicates {
+			fmt.Printf("  %d copies of %s (%s wasted):\n", len(group),
+				formatSize(group[0].Size), formatSize(group[0].Size*uint64(len(group)-1)))
+			for _, item := range group {
+				fmt.Printf("    %s\n", item.Path)
+			}
+		}
+
+		fmt.Printf("\nFiles not modified in %d months (%s in total):\n",
+			analyzeArgs.Months, formatSize(analysis.StaleSize))
+		if len(analysis.Stale) == 0 {
+			fmt.Println("  none found")
+		}
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, item := range analysis.Stale {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", item.ModTime.Format("2006-01-02"),
+				formatSize(item.Size), item.Path)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+	return nil
+}
+
+func cpCommand(client *rpc.Client, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: onedriver cp <source> <dest>")
+	}
+	var copyArgs odfs.CopyArgs
+	var err error
+	if copyArgs.Source, err = filepath.Abs(args[0]); err != nil {
+		return err
+	}
+	if copyArgs.Dest, err = filepath.Abs(args[1]); err != nil {
+		return err
+	}
+	var id int
+	if err = client.Call("Control.StartCopy", &copyArgs, &id); err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	jobArgs := odfs.CopyJobArgs{ID: id}
+	for {
+		select {
+		case <-interrupt:
+			jobArgs.Cancel = true
+		case <-time.After(500 * time.Millisecond):
+		}
+		var progress odfs.CopyProgress
+		if err = client.Call("Control.CopyStatus", &jobArgs, &progress); err != nil {
+			return err
+		}
+		fmt.Printf("\rCopying to %s: %.0f%%", progress.Dest, progress.Percent)
+		if progress.Done {
+			fmt.Println()
+			if progress.Error != "" {
+				if jobArgs.Cancel {
+					return fmt.Errorf("Stopped waiting for the copy, but the " +
+						"server may still finish it.")
+				}
+				return fmt.Errorf("Copy failed: %s", progress.Error)
+			}
+			return nil
+		}
+	}
+}
+
+func uploadLimitCommand(client *rpc.Client, args []string) error {
+	return limitCommand(client, args, "upload", "Uploads", "Control.UploadLimit")
+}
+
+func downloadLimitCommand(client *rpc.Client, args []string) error {
+	return limitCommand(client, args, "download", "Downloads", "Control.DownloadLimit")
+}
+
+// limitCommand shows or changes the limit on uploads or downloads (direction,
+// and what they are called in messages) with a Control method.
+func limitCommand(client *rpc.Client, args []string, direction string, transfers string,
+	method string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: onedriver %s-limit [KB/s]", direction)
+	}
+	limitArgs := odfs.LimitArgs{Rate: -1}
+	if len(args) == 1 {
+		rate, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid %s limit \"%s\", must be a number of KB/s.",
+				direction, args[0])
+		}
+		limitArgs.Rate = int64(rate * 1024)
+	}
+	var limit uint64
+	if err := client.Call(method, &limitArgs, &limit); err != nil {
+		return err
+	}
+	if limit == 0 {
+		fmt.Printf("%s are not limited.\n", transfers)
+	} else {
+		fmt.Printf("%s are limited to %d KB/s.\n", transfers, limit/1024)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxActivity is the number of recent changes remembered for status reports.
+const maxActivity = 20
+
+// Activity is a change recently synced to or from the server, as shown in the
+// "recent activity" menu of a status indicator.
+type Activity struct {
+	Time   time.Time
+	Action string // uploaded, created, modified, renamed, deleted, or conflict
+	Name   string
+}
+
+// activityLog remembers the most recent changes.
+type activityLog struct {
+	mutex   sync.Mutex
+	entries []Activity
+}
+
+// add records a change, forgetting the oldest one if the log is full.
+func (a *activityLog) add(action string, name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.entries = append(a.entries, Activity{Time: time.Now(), Action: action, Name: name})
+	if len(a.entries) > maxActivity {
+		a.entries = a.entries[len(a.entries)-maxActivity:]
+	}
+}
+
+// list returns the recorded changes, oldest first.
+func (a *activityLog) list() []Activity {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]Activity{}, a.entries...)
+}
+
+// RecentActivity returns the most recent changes synced to or from the server
+// (most recent first).
+func (c *Cache) RecentActivity() []Activity {
+	recent := append(c.activity.list(), c.uploads.activity.list()...)
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].Time.After(recent[j].Time)
+	})
+	if len(recent) > maxActivity {
+		recent = recent[:maxActivity]
+	}
+	return recent
+}
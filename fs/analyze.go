@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// AnalyzedItem is a file listed in an Analysis.
+type AnalyzedItem struct {
+	Path    string
+	Size    uint64
+	ModTime time.Time
+}
+
+// Analysis reports on how the space on a drive is used, based only on the
+// metadata already in the cache. Folders that were never opened are not
+// included, since nothing about their contents is known.
+type Analysis struct {
+	Drive      string           // the API path of the drive
+	Files      int              // how many files were analyzed
+	Largest    []AnalyzedItem   // largest files first
+	Duplicates [][]AnalyzedItem // groups of identical files, most wasted space first
+	Stale      []AnalyzedItem   // files not modified since the cutoff, oldest first
+	StaleSize  uint64           // total size of all stale files
+}
+
+// contentHash returns the hash used to find duplicate files, or "" if the
+// server never reported one.
+func contentHash(inode *Inode) string {
+	inode.mutex.RLock()
+	defer inode.mutex.RUnlock()
+	if inode.DriveItem.File == nil {
+		return ""
+	}
+	if hash := inode.DriveItem.File.Hashes.SHA1Hash; hash != "" {
+		return hash
+	}
+	return inode.DriveItem.File.Hashes.QuickXorHash
+}
+
+// Analyze reports on the largest files, duplicate files, and files that have
+// not been modified since staleBefore. Each list is cut off after limit entries.
+func (c *Cache) Analyze(staleBefore time.Time, limit int) Analysis {
+	ids := make([]string, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).ForEach(func(k, v []byte) error {
+			if string(k) != "root" { // duplicate entry for the root item
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+
+	analysis := Analysis{Drive: c.drive.Path()}
+	files := make([]AnalyzedItem, 0)
+	byHash := make(map[string][]AnalyzedItem)
+	for _, id := range ids {
+		inode := c.GetID(id)
+		if inode == nil || inode.IsDir() || isLocalID(id) {
+			continue
+		}
+		path, ok := c.relativePath(inode)
+		if !ok {
+			continue
+		}
+		item := AnalyzedItem{
+			Path:    "/" + path,
+			Size:    inode.Size(),
+			ModTime: time.Unix(int64(inode.ModTime()), 0),
+		}
+		files = append(files, item)
+		if hash := contentHash(inode); hash != "" && item.Size > 0 {
+			byHash[hash] = append(byHash[hash], item)
+		}
+		if item.ModTime.Before(staleBefore) {
+			analysis.Stale = append(analysis.Stale, item)
+			analysis.StaleSize += item.Size
+		}
+	}
+	analysis.Files = len(files)
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	analysis.Largest = files
+	if len(analysis.Largest) > limit {
+		analysis.Largest = analysis.Largest[:limit]
+	}
+
+	for _, group := range byHash {
+		if len(group) > 1 {
+			sort.Slice(group, func(i, j int) bool {
+				return group[i].Path < group[j].Path
+			})
+			analysis.Duplicates = append(analysis.Duplicates, group)
+		}
+	}
+	wasted := func(group []AnalyzedItem) uint64 {
+		return group[0].Size * uint64(len(group)-1)
+	}
+	sort.Slice(analysis.Duplicates, func(i, j int) bool {
+		return wasted(analysis.Duplicates[i]) > wasted(analysis.Duplicates[j])
+	})
+	if len(analysis.Duplicates) > limit {
+		analysis.Duplicates = analysis.Duplicates[:limit]
+	}
+
+	sort.Slice(analysis.Stale, func(i, j int) bool {
+		return analysis.Stale[i].ModTime.Before(analysis.Stale[j].ModTime)
+	})
+	if len(analysis.Stale) > limit {
+		analysis.Stale = analysis.Stale[:limit]
+	}
+	return analysis
+}
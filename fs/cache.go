@@ -18,42 +18,98 @@ import (
 // Cache caches Inodes for a filesystem. This cache never expires so that local
 // changes can persist. Should be created using the NewCache() constructor.
 type Cache struct {
-	metadata  sync.Map
-	db        *bolt.DB
-	root      string // the id of the filesystem's root item
-	deltaLink string
-	uploads   *UploadManager
+	metadata   sync.Map
+	db         *bolt.DB
+	root       string // the id of the filesystem's root item
+	deltaLink  string
+	deltaStart string        // starts tracking changes to the part of the drive mounted
+	changed    chan struct{} // wakes DeltaLoop early, see NotifyChanged
+	syncPause  *pauseGate    // see PauseSync
+	opts       Options
+	drive      graph.Drive // the drive that all items in this cache live on
+	uploads    *UploadManager
+	downloads  *downloadManager
+	sealer     *sealer        // encrypts metadata on disk, may be nil
+	cipher     *contentCipher // encrypts content on disk, may be nil
+	inos       sync.Map       // inode numbers already loaded from disk
+	activity   activityLog    // changes from the server, see also uploads.activity
+	special    sync.Map       // IDs of special folders, by name
+	evicting   int32          // set while content is being evicted, see requestEviction
+	thumbnails thumbnailCache // thumbnails fetched from the server
+	counters   cacheCounters  // see Stats
+
+	caps graph.Capabilities // what the type of drive supports, see detectCapabilities
 
 	sync.RWMutex
-	auth    *graph.Auth
-	offline bool
+	auth     *graph.Auth
+	offline  bool
+	progress DeltaProgress
 }
 
 // boltdb buckets
 var (
-	bucketContent  = []byte("content")
+	bucketContent  = []byte("content") // only read to migrate, see migrateContent
 	bucketMetadata = []byte("metadata")
 	bucketDelta    = []byte("delta")
 )
 
-// NewCache creates a new Cache
-func NewCache(auth *graph.Auth, dbpath string) *Cache {
+// NewCache creates a new Cache. opts may be nil, in which case the default
+// options are used.
+func NewCache(auth *graph.Auth, dbpath string, opts *Options) *Cache {
+	if opts == nil {
+		opts = &Options{}
+	}
 	db, err := bolt.Open(dbpath, 0600, &bolt.Options{Timeout: time.Second * 5})
 	if err != nil {
 		log.WithFields(log.Fields{"err": err}).Fatal("Could not open DB")
 	}
 	db.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists(bucketContent)
 		tx.CreateBucketIfNotExists(bucketMetadata)
 		tx.CreateBucketIfNotExists(bucketDelta)
+		tx.CreateBucketIfNotExists(bucketFavorites)
+		tx.CreateBucketIfNotExists(bucketUnsynced)
+		tx.CreateBucketIfNotExists(bucketAccess)
+		tx.CreateBucketIfNotExists(bucketTrash)
+		tx.CreateBucketIfNotExists(bucketRenames)
+		tx.CreateBucketIfNotExists(bucketInodes)
+		tx.CreateBucketIfNotExists(bucketInodeIDs)
+		tx.CreateBucketIfNotExists(bucketLocalAttrs)
+		tx.CreateBucketIfNotExists(bucketDirty)
+		tx.CreateBucketIfNotExists(bucketHydration)
+		tx.CreateBucketIfNotExists(bucketUses)
+		tx.CreateBucketIfNotExists(bucketJournal)
+		tx.CreateBucketIfNotExists(bucketConflicts)
 		return nil
 	})
+	sealer, err := newSealer(opts.MetadataKey)
+	if err != nil {
+		log.WithField("err", err).Fatal("Invalid metadata key.")
+	}
+	contentCipher, err := newContentCipher(opts.ContentKey)
+	if err != nil {
+		log.WithField("err", err).Fatal("Invalid content key.")
+	}
 	cache := &Cache{
-		auth: auth,
-		db:   db,
+		auth:      auth,
+		db:        db,
+		opts:      *opts,
+		drive:     graph.Drive{ID: opts.DriveID},
+		sealer:    sealer,
+		cipher:    contentCipher,
+		downloads: newDownloadManager(opts.MaxDownloads),
+		changed:   make(chan struct{}, 1),
+		syncPause: newPauseGate(),
+	}
+	cache.sealExisting()
+	if err := os.MkdirAll(contentDir(db), 0700); err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("Could not create content cache")
 	}
+	cache.migrateContent()
+	cache.removePartialDownloads()
+	cache.encryptExisting()
+	cache.pruneShared()
 
-	rootItem, err := graph.GetItem("root", auth)
+	rootItem, err := getRootItem(cache.drive, opts, auth)
 	root := NewInodeDriveItem(rootItem)
 	if err != nil {
 		if graph.IsOffline(err) {
@@ -84,18 +140,43 @@ func NewCache(auth *graph.Auth, dbpath string) *Cache {
 			}).Fatal("Could not fetch root item of filesystem!")
 		}
 	}
+	cache.checkRoot(opts)
+	if !root.IsDir() {
+		log.WithFields(log.Fields{
+			"root":   opts.Root,
+			"rootID": opts.RootID,
+		}).Fatal("Filesystem root must be a folder.")
+	}
 	root.cache = cache
 	cache.root = root.ID()
 	cache.InsertID(cache.root, root)
+	cache.detectCapabilities(root)
 
-	cache.uploads = NewUploadManager(2*time.Second, db, auth)
+	cache.uploads = newUploadManager(2*time.Second, db, auth, sealer)
+	cache.uploads.setCipher(contentCipher)
+	if opts.MaxUploads > 0 {
+		cache.uploads.SetMaxUploads(opts.MaxUploads)
+	}
+	cache.uploads.SetUploadDelay(opts.UploadDelay)
+	if opts.RetryPolicy != nil {
+		cache.uploads.SetRetryPolicy(*opts.RetryPolicy)
+	}
+	cache.uploads.OnComplete(cache.uploadComplete)
+	cache.uploads.OnConflict(cache.uploadConflict)
+	if opts.ChunkSize > 0 || opts.AdaptiveChunkSize {
+		chunkSize := opts.ChunkSize
+		if chunkSize == 0 {
+			chunkSize = DefaultChunkSize
+		}
+		cache.uploads.SetChunkSize(chunkSize, opts.AdaptiveChunkSize)
+	}
 
 	if !cache.IsOffline() {
 		// .Trash-UID is used by "gio trash" for user trash, create it if it
 		// does not exist
 		trash := fmt.Sprintf(".Trash-%d", os.Getuid())
 		if child, _ := cache.GetChild(cache.root, trash, auth); child == nil {
-			item, err := graph.Mkdir(trash, cache.root, auth)
+			item, err := cache.drive.Mkdir(trash, cache.root, auth)
 			if err != nil {
 				log.WithField("err", err).Error("Could not create trash folder. " +
 					"Trashing items through the file browser may result in errors.")
@@ -104,15 +185,240 @@ func NewCache(auth *graph.Auth, dbpath string) *Cache {
 			}
 		}
 
+		cache.reconcileRenames(auth)
+
 		// using token=latest because we don't care about existing items - they'll
 		// be downloaded on-demand by the cache
-		cache.deltaLink = "/me/drive/root/delta?token=latest"
+		cache.deltaStart = cache.drive.Path() + "/root/delta?token=latest"
+		if !isDriveRoot(opts) && cache.caps.ScopedDelta {
+			// personal drives can scope delta to a subfolder, business drives
+			// only support delta on the drive root (deltas for items outside
+			// the subtree are skipped by applyDelta since their parents are
+			// never cached)
+			cache.deltaStart = cache.drive.IDPath(root.ID()) + "/delta?token=latest"
+		}
+		cache.deltaLink = cache.resumeDelta()
 	}
 
+	// in case the maximum size was lowered since the last mount
+	if opts.MaxCacheSize > 0 {
+		cache.decayUses()
+	}
+	cache.requestEviction()
+
 	// deltaloop is started manually
 	return cache
 }
 
+func isDriveRoot(opts *Options) bool {
+	return opts.RootID == "" && (opts.Root == "" || opts.Root == "/")
+}
+
+// rootOption describes the folder mounted as the filesystem root, as selected by
+// opts.
+func rootOption(opts *Options) string {
+	if opts.RootID != "" {
+		return "id:" + opts.RootID
+	}
+	if isDriveRoot(opts) || strings.HasPrefix(opts.Root, specialRootPrefix) {
+		return leadingSlash(opts.Root)
+	}
+	return leadingSlash(strings.TrimSuffix(opts.Root, "/"))
+}
+
+// checkRoot stores which folder is mounted as the filesystem root. The cache
+// only holds the root item (and the delta link for it) of the last mount, so an
+// offline start mounting a different folder is refused instead of silently
+// mounting the folder that was mounted before.
+func (c *Cache) checkRoot(opts *Options) {
+	mounted := rootOption(opts)
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDelta)
+		// the path of a folder, so sealed like the metadata
+		stored, _ := c.sealer.open(b.Get([]byte("root")))
+		if !c.IsOffline() {
+			return b.Put([]byte("root"), c.sealer.seal([]byte(mounted)))
+		}
+		if len(stored) > 0 && string(stored) != mounted {
+			log.WithFields(log.Fields{
+				"cached": string(stored),
+				"root":   mounted,
+			}).Fatal("Cannot perform an offline startup with a different --root than " +
+				"the previous session, since only its root is cached.")
+		}
+		return nil
+	})
+}
+
+// getRootItem fetches the item to use as the filesystem root. When mounting a
+// subfolder, its parent ID is wiped so that it behaves like the drive root
+// (there is no parent to insert it under).
+func getRootItem(drive graph.Drive, opts *Options, auth *graph.Auth) (*graph.DriveItem, error) {
+	if isDriveRoot(opts) {
+		return drive.GetItem("root", auth)
+	}
+	var item *graph.DriveItem
+	var err error
+	if opts.RootID != "" {
+		item, err = drive.GetItem(opts.RootID, auth)
+	} else if strings.HasPrefix(opts.Root, specialRootPrefix) {
+		item, err = getSpecialRoot(drive, strings.TrimPrefix(opts.Root, specialRootPrefix), auth)
+	} else {
+		item, err = drive.GetItemPath(leadingSlash(strings.TrimSuffix(opts.Root, "/")), auth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if item.Parent != nil {
+		item.Parent.ID = ""
+	}
+	return item, nil
+}
+
+// detectCapabilities selects the behaviors to use for the type of drive the
+// root item lives on. The type is stored so that a cache can never be reused
+// for a different type of drive, which would mix up hashes among other things.
+func (c *Cache) detectCapabilities(root *Inode) {
+	root.mutex.RLock()
+	driveType := root.DriveItem.Parent.DriveType
+	root.mutex.RUnlock()
+	if driveType == "" && !c.IsOffline() {
+		// not always included in the root item's parent reference
+		if drive, err := graph.GetDriveID(c.drive.ID, c.auth); err == nil {
+			driveType = drive.DriveType
+		}
+	}
+
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDelta)
+		stored := string(b.Get([]byte("driveType")))
+		if driveType == "" {
+			driveType = stored
+		} else if stored != "" && stored != driveType {
+			log.WithFields(log.Fields{
+				"cached": stored,
+				"drive":  driveType,
+			}).Fatal("The type of drive changed since this cache was created " +
+				"(was the account migrated?). Delete the cache with --wipe-cache " +
+				"or use a different --cache-dir.")
+		}
+		return b.Put([]byte("driveType"), []byte(driveType))
+	})
+
+	var err error
+	if c.caps, err = graph.CapabilitiesOf(driveType); err != nil {
+		log.WithField("err", err).Warn("Could not determine the type of drive, " +
+			"assuming it behaves like a business drive.")
+	}
+	log.WithField("driveType", driveType).Debug("Detected drive type.")
+}
+
+// Capabilities returns the behaviors supported by the type of drive the cache's
+// items live on.
+func (c *Cache) Capabilities() graph.Capabilities {
+	return c.caps
+}
+
+// Drive returns the drive that the cache's items live on.
+func (c *Cache) Drive() graph.Drive {
+	return c.drive
+}
+
+// MaxFileSize returns the largest file size that can be uploaded.
+func (c *Cache) MaxFileSize() uint64 {
+	if c.opts.MaxFileSize == 0 {
+		return DefaultMaxFileSize
+	}
+	return c.opts.MaxFileSize
+}
+
+// isWriteThrough returns whether an item should be uploaded synchronously.
+func (c *Cache) isWriteThrough(inode *Inode) bool {
+	if c.opts.WriteThrough {
+		return true
+	}
+	return c.inDirs(inode, c.opts.WriteThroughDirs)
+}
+
+// inDirs returns whether an item is one of dirs (paths relative to the
+// filesystem root) or anything inside them.
+func (c *Cache) inDirs(inode *Inode, dirs []string) bool {
+	if len(dirs) == 0 {
+		return false
+	}
+	path, ok := c.relativePath(inode)
+	if !ok {
+		return false
+	}
+	path = strings.ToLower(path)
+	for _, dir := range dirs {
+		dir = strings.ToLower(strings.Trim(filepath.Clean(dir), "/"))
+		if dir == "" || dir == "." || path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreamed returns whether the content of a file is read straight from the
+// server instead of through the cache (see Options.StreamSize).
+func (c *Cache) isStreamed(inode *Inode) bool {
+	if c.opts.StreamSize > 0 && inode.Size() >= c.opts.StreamSize {
+		return true
+	}
+	return c.inDirs(inode, c.opts.StreamDirs)
+}
+
+// uploadPolicy returns when changes to a file should be uploaded.
+func (c *Cache) uploadPolicy(inode *Inode) UploadPolicy {
+	if c.IsOffline() {
+		// uploaded once back online, see replayJournal
+		return UploadOnInterval
+	}
+	if c.opts.UploadPolicy == "" || c.isWriteThrough(inode) {
+		return UploadOnFlush
+	}
+	return c.opts.UploadPolicy
+}
+
+// uploadComplete remembers the cTag an item got from being uploaded, so that
+// its next upload can tell whether it was changed by someone else since. New
+// files take on the ID they got on the server.
+func (c *Cache) uploadComplete(id string, remote *graph.DriveItem) {
+	if remote == nil {
+		return
+	}
+	created := isLocalID(id) && remote.ID != ""
+	if created {
+		if err := c.MoveID(id, remote.ID); err != nil {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"new": remote.ID,
+				"err": err,
+			}).Warn("Could not give uploaded file its new ID.")
+			return
+		}
+		id = remote.ID
+	}
+	inode := c.GetID(id)
+	if inode == nil {
+		return
+	}
+	if name := inode.Name(); created && remote.Name != "" && remote.Name != name {
+		// an item with the same name already existed (see ConflictRename)
+		inode.SetName(remote.Name)
+		log.WithFields(log.Fields{
+			"name":    name,
+			"renamed": remote.Name,
+		}).Warn("File already existed on the server, the new file was renamed.")
+	}
+	inode.mutex.Lock()
+	if remote.CTag != "" {
+		inode.DriveItem.CTag = remote.CTag
+	}
+	inode.mutex.Unlock()
+}
+
 // GetAuth returns the current auth
 func (c *Cache) GetAuth() *graph.Auth {
 	c.RLock()
@@ -150,10 +456,18 @@ func (c *Cache) GetID(id string) *Inode {
 		var found *Inode
 		c.db.View(func(tx *bolt.Tx) error {
 			data := tx.Bucket(bucketMetadata).Get([]byte(id))
-			var err error
-			if data != nil {
-				found, err = NewInodeJSON(data)
+			if data == nil {
+				return nil
+			}
+			data, err := c.sealer.open(data)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":  id,
+					"err": err,
+				}).Error("Could not decrypt item metadata.")
+				return err
 			}
+			found, err = NewInodeJSON(data)
 			return err
 		})
 		if found != nil {
@@ -173,6 +487,7 @@ func (c *Cache) InsertID(id string, inode *Inode) {
 	inode.mutex.Lock()
 	inode.cache = c
 	inode.mutex.Unlock()
+	c.restoreLocalAttrs(inode)
 	c.metadata.Store(id, inode)
 
 	parentID := inode.ParentID()
@@ -220,24 +535,26 @@ func (c *Cache) InsertChild(parentID string, child *Inode) {
 }
 
 // DeleteID deletes an item from the cache, and removes it from its parent. Must
-// be called before InsertID if being used to rename/move an item.
+// be called before InsertID if being used to rename/move an item, which is why
+// the item's upload (if any) is left alone. Cancel it with
+// UploadManager.CancelUpload if the item is gone for good.
 func (c *Cache) DeleteID(id string) {
 	if inode := c.GetID(id); inode != nil {
-		parent := c.GetID(inode.ParentID())
-		parent.mutex.Lock()
-		for i, childID := range parent.children {
-			if childID == id {
-				parent.children = append(parent.children[:i], parent.children[i+1:]...)
-				if inode.IsDir() {
-					parent.subdir--
+		if parent := c.GetID(inode.ParentID()); parent != nil {
+			parent.mutex.Lock()
+			for i, childID := range parent.children {
+				if childID == id {
+					parent.children = append(parent.children[:i], parent.children[i+1:]...)
+					if inode.IsDir() {
+						parent.subdir--
+					}
+					break
 				}
-				break
 			}
+			parent.mutex.Unlock()
 		}
-		parent.mutex.Unlock()
 	}
 	c.metadata.Delete(id)
-	c.uploads.CancelUpload(id)
 }
 
 // GetChild fetches a named child of an item. Wraps GetChildrenID.
@@ -279,9 +596,10 @@ func (c *Cache) GetChildrenID(id string, auth *graph.Auth) (map[string]*Inode, e
 	// already and can fetch them directly from the cache
 	inode.mutex.RLock()
 	if inode.children != nil {
-		// can potentially have out-of-date child metadata if started offline, but since
-		// changes are disallowed while offline, the children will be back in sync after
-		// the first successful delta fetch (which also brings the fs back online)
+		// can potentially have out-of-date child metadata if started offline, but
+		// the children will be back in sync after the first successful delta fetch
+		// (which also brings the fs back online), once changes made offline have
+		// been replayed (see replayJournal)
 		for _, childID := range inode.children {
 			child := c.GetID(childID)
 			if child == nil {
@@ -291,12 +609,20 @@ func (c *Cache) GetChildrenID(id string, auth *graph.Auth) (map[string]*Inode, e
 			children[strings.ToLower(child.Name())] = child
 		}
 		inode.mutex.RUnlock()
+		if len(c.opts.Exclude) > 0 {
+			// cached before the patterns were added
+			for key, child := range children {
+				if c.isExcluded(inode, child.Name(), child.IsDir()) {
+					delete(children, key)
+				}
+			}
+		}
 		return children, nil
 	}
 	inode.mutex.RUnlock()
 
 	// We haven't fetched the children for this item yet, get them from the server.
-	fetched, err := graph.GetItemChildren(id, auth)
+	fetched, err := c.drive.GetItemChildren(id, auth)
 	if err != nil {
 		if graph.IsOffline(err) {
 			log.WithFields(log.Fields{
@@ -316,7 +642,11 @@ func (c *Cache) GetChildrenID(id string, auth *graph.Auth) (map[string]*Inode, e
 	for _, item := range fetched {
 		// we will always have an id after fetching from the server
 		child := NewInodeDriveItem(item)
+		if c.isExcluded(inode, child.Name(), child.IsDir()) {
+			continue
+		}
 		child.cache = c
+		c.restoreLocalAttrs(child)
 		c.metadata.Store(child.DriveItem.ID, child)
 
 		// store in result map
@@ -445,9 +775,12 @@ func (c *Cache) MoveID(oldID string, newID string) error {
 	inode.mutex.Unlock()
 
 	// now actually perform the metadata+content move
+	c.moveIno(oldID, newID)
+	c.moveLocalAttrs(oldID, newID)
 	c.DeleteID(oldID)
 	c.InsertID(newID, inode)
 	c.MoveContent(oldID, newID)
+	c.moveFavorite(oldID, newID)
 	return nil
 }
 
@@ -471,50 +804,6 @@ func (c *Cache) MovePath(oldPath string, newPath string, auth *graph.Auth) error
 	return nil
 }
 
-// GetContent reads a file's content from disk.
-func (c *Cache) GetContent(id string) []byte {
-	var content []byte // nil
-	c.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketContent)
-		if tmp := b.Get([]byte(id)); tmp != nil {
-			content = make([]byte, len(tmp))
-			copy(content, tmp)
-		}
-		return nil
-	})
-	return content
-}
-
-// InsertContent writes file content to disk.
-func (c *Cache) InsertContent(id string, content []byte) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketContent)
-		return b.Put([]byte(id), content)
-	})
-}
-
-// DeleteContent deletes content from disk.
-func (c *Cache) DeleteContent(id string) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketContent)
-		return b.Delete([]byte(id))
-	})
-}
-
-// MoveContent moves content from one ID to another
-func (c *Cache) MoveContent(oldID string, newID string) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketContent)
-		content := b.Get([]byte(oldID))
-		if content == nil {
-			return errors.New("Content not found for ID: " + oldID)
-		}
-		b.Put([]byte(newID), content)
-		b.Delete([]byte(oldID))
-		return nil
-	})
-}
-
 // SerializeAll dumps all inode metadata currently in the cache to disk. This
 // metadata is only used later if an item could not be found in memory AND the
 // cache is offline. Old metadata is not removed, only overwritten (to avoid an
@@ -524,7 +813,7 @@ func (c *Cache) SerializeAll() {
 	c.metadata.Range(func(key interface{}, value interface{}) bool {
 		c.db.Batch(func(tx *bolt.Tx) error {
 			id := fmt.Sprint(key)
-			contents := value.(*Inode).AsJSON()
+			contents := c.sealer.seal(value.(*Inode).AsJSON())
 			b := tx.Bucket(bucketMetadata)
 			b.Put([]byte(id), contents)
 			if id == c.root {
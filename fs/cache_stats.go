@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"sync"
+	"time"
+)
+
+// CacheStats reports how the content cache of a drive is used, to help choose
+// Options.MaxCacheSize. Counts are since onedriver started.
+type CacheStats struct {
+	Drive       string // the API path of the drive
+	Size        uint64 // disk space used by cached content
+	MaxSize     uint64 // see Options.MaxCacheSize, 0 for no limit
+	Files       int    // files with content in the cache
+	Partial     int    // files of those that are only partly downloaded
+	Hits        uint64 // files opened with their content already cached
+	Misses      uint64 // files opened that had to be downloaded
+	Evicted     uint64 // files evicted to stay under MaxSize
+	EvictedSize uint64 // disk space freed by evicting them
+}
+
+// cacheCounters counts what happens to the content cache for CacheStats, and
+// remembers when a file was last opened for Cache.idle.
+type cacheCounters struct {
+	mutex       sync.Mutex
+	hits        uint64
+	misses      uint64
+	evicted     uint64
+	evictedSize uint64
+	lastOpen    time.Time
+}
+
+// touch records a file being opened.
+func (c *cacheCounters) touch() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastOpen = time.Now()
+}
+
+// lastOpened returns when a file was last opened.
+func (c *cacheCounters) lastOpened() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastOpen
+}
+
+// opened counts a file being opened, and whether its content was cached.
+func (c *cacheCounters) opened(hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// evict counts files being evicted.
+func (c *cacheCounters) evict(files int, size uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.evicted += uint64(files)
+	c.evictedSize += size
+}
+
+// Stats reports on the content cache.
+func (c *Cache) Stats() CacheStats {
+	_, size := c.contentUsage()
+	stats := CacheStats{
+		Drive:   c.drive.Path(),
+		Size:    size,
+		MaxSize: c.opts.MaxCacheSize,
+		Files:   len(c.cachedIDs()),
+		Partial: len(c.hydrationIDs()),
+	}
+	c.counters.mutex.Lock()
+	defer c.counters.mutex.Unlock()
+	stats.Hits = c.counters.hits
+	stats.Misses = c.counters.misses
+	stats.Evicted = c.counters.evicted
+	stats.EvictedSize = c.counters.evictedSize
+	return stats
+}
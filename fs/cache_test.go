@@ -2,14 +2,26 @@
 package fs
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"os"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestRootGet(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_root_get.db")
+	cache := NewCache(auth, "test_root_get.db", nil)
 	root, err := cache.GetPath("/", auth)
 	if err != nil {
 		t.Fatal(err)
@@ -22,7 +34,7 @@ func TestRootGet(t *testing.T) {
 
 func TestRootChildrenUpdate(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_root_children_update.db")
+	cache := NewCache(auth, "test_root_children_update.db", nil)
 	children, err := cache.GetChildrenPath("/", auth)
 	if err != nil {
 		t.Fatal(err)
@@ -35,7 +47,7 @@ func TestRootChildrenUpdate(t *testing.T) {
 
 func TestSubdirGet(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_subdir_get.db")
+	cache := NewCache(auth, "test_subdir_get.db", nil)
 	documents, err := cache.GetPath("/Documents", auth)
 	if err != nil {
 		t.Fatal(err)
@@ -47,7 +59,7 @@ func TestSubdirGet(t *testing.T) {
 
 func TestSubdirChildrenUpdate(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_subdir_children_update.db")
+	cache := NewCache(auth, "test_subdir_children_update.db", nil)
 	children, err := cache.GetChildrenPath("/Documents", auth)
 	failOnErr(t, err)
 
@@ -63,7 +75,7 @@ func TestSubdirChildrenUpdate(t *testing.T) {
 
 func TestSamePointer(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_same_pointer.db")
+	cache := NewCache(auth, "test_same_pointer.db", nil)
 	item, _ := cache.GetPath("/Documents", auth)
 	item2, _ := cache.GetPath("/Documents", auth)
 	if item != item2 {
@@ -73,3 +85,1141 @@ func TestSamePointer(t *testing.T) {
 		t.Fatal("Item was nil!")
 	}
 }
+
+// A cache can be rooted at a subfolder of the drive instead of the drive root.
+func TestSubfolderRoot(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_subfolder_root.db", &Options{Root: "/onedriver_tests"})
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	if root.Name() != "onedriver_tests" {
+		t.Fatalf("Root of cache was \"%s\", not \"onedriver_tests\".\n", root.Name())
+	}
+
+	delta, err := cache.GetPath("/delta", auth)
+	failOnErr(t, err)
+	if delta.ParentID() != root.ID() {
+		t.Fatal("Children of a subfolder root were not resolved relative to it.")
+	}
+}
+
+// Files that were never uploaded during a previous session should be uploaded
+// by ReconcileLocalItems.
+func TestReconcileLocalItems(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_reconcile_local_items.db", nil)
+	parent, err := cache.GetPath("/onedriver_tests", auth)
+	failOnErr(t, err)
+
+	content := []byte("this file never made it to the server")
+	inode := NewInode("reconcile_local_items.txt", 0644|fuse.S_IFREG, parent)
+	inode.DriveItem.Size = uint64(len(content))
+	cache.InsertID(inode.ID(), inode)
+	failOnErr(t, cache.InsertContent(inode.ID(), content))
+	cache.SerializeAll()
+
+	if unsynced := cache.ReconcileLocalItems(auth); len(unsynced) > 0 {
+		t.Fatalf("Items could not be reconciled: %+v\n", unsynced)
+	}
+	if isLocalID(inode.ID()) {
+		t.Fatal("Item still had a local ID after reconciliation.")
+	}
+	item, err := graph.GetItemPath("/onedriver_tests/reconcile_local_items.txt", auth)
+	failOnErr(t, err)
+	if item.Size != uint64(len(content)) {
+		t.Fatalf("Uploaded item had size %d, wanted %d.\n", item.Size, len(content))
+	}
+}
+
+// The most frequently accessed directories should be prefetched first.
+func TestHotDirs(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_hot_dirs.db", &Options{PrefetchDirs: 1})
+	for i := 0; i < 3; i++ {
+		cache.recordAccess("hot")
+	}
+	cache.recordAccess("cold")
+	time.Sleep(time.Second) // access counts are recorded asynchronously
+
+	// without decay, like when warming the cache, "cold" is still there
+	if hot := cache.hotDirs(2, false); len(hot) != 2 {
+		t.Fatalf("Expected access counts to stay, got %v\n", hot)
+	}
+	if hot := cache.hotDirs(1, true); len(hot) != 1 || hot[0] != "hot" {
+		t.Fatalf("Expected [hot], got %v\n", hot)
+	}
+	// "cold" had a count of 1 and should have been dropped
+	if hot := cache.hotDirs(2, true); len(hot) != 1 {
+		t.Fatalf("Expected access counts to decay, got %v\n", hot)
+	}
+}
+
+// Pausing sync should pause uploads and keep the cache from being warmed, until
+// it is resumed.
+func TestPauseSync(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_pause_sync.db", nil)
+	cache.PauseSync()
+	if !cache.SyncPaused() || !cache.uploads.Paused() {
+		t.Fatal("Pausing sync did not pause uploads.")
+	}
+	if cache.idle() {
+		t.Fatal("Cache should not be warmed while sync is paused.")
+	}
+	cache.ResumeSync()
+	if cache.SyncPaused() || cache.uploads.Paused() {
+		t.Fatal("Resuming sync did not resume uploads.")
+	}
+}
+
+// Prefetching metadata should list folders that were never opened, so that
+// they can be browsed offline.
+func TestPrefetchMetadata(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_prefetch_metadata.db", nil)
+	added, err := cache.PrefetchMetadata(auth)
+	failOnErr(t, err)
+	if added == 0 {
+		t.Fatal("No items were added by prefetching metadata.")
+	}
+	dir, err := cache.GetPath("/onedriver_tests", nil)
+	failOnErr(t, err)
+	dir.mutex.RLock()
+	listed := dir.children != nil
+	dir.mutex.RUnlock()
+	if !listed {
+		t.Fatal("Folder that was never opened was not listed.")
+	}
+}
+
+// Resyncing should drop items that are not on the server, and update the rest
+// in place.
+func TestResync(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_resync.db", nil)
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	dir, err := cache.GetPath("/onedriver_tests", auth)
+	failOnErr(t, err)
+	cache.InsertChild(root.ID(), NewInodeDriveItem(&graph.DriveItem{
+		ID:     "resync-stale",
+		Name:   "resync_stale",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		File:   &graph.File{},
+	}))
+
+	result, err := cache.Resync(root, false, auth)
+	failOnErr(t, err)
+	if result.Removed != 1 || cache.GetID("resync-stale") != nil {
+		t.Fatalf("Item not on the server was not removed: %+v\n", result)
+	}
+	if found, err := cache.GetPath("/onedriver_tests", auth); err != nil || found != dir {
+		t.Fatal("Folder was not updated in place.")
+	}
+}
+
+// Renames interrupted by a crash after reaching the server should be picked up
+// by the local copy on the next startup.
+func TestReconcileRenames(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_reconcile_renames.db", nil)
+	parent, err := cache.GetPath("/onedriver_tests", auth)
+	failOnErr(t, err)
+	item, err := graph.Mkdir("reconcile_renames_before", parent.ID(), auth)
+	failOnErr(t, err)
+	cache.InsertID(item.ID, NewInodeDriveItem(item))
+
+	failOnErr(t, cache.journalRename(renameIntent{
+		ID:          item.ID,
+		OldName:     "reconcile_renames_before",
+		OldParentID: parent.ID(),
+		NewName:     "reconcile_renames_after",
+		NewParentID: parent.ID(),
+	}))
+	// "crash" after renaming the item on the server
+	failOnErr(t, graph.Rename(item.ID, "reconcile_renames_after", parent.ID(), auth))
+	cache.reconcileRenames(auth)
+
+	if name := cache.GetID(item.ID).Name(); name != "reconcile_renames_after" {
+		t.Fatalf("Local copy was not renamed, name was \"%s\".\n", name)
+	}
+	if child, _ := cache.GetPath("/onedriver_tests/reconcile_renames_after", auth); child == nil {
+		t.Fatal("Could not find renamed item by path.")
+	}
+}
+
+// Write-through mode can be enabled for only part of the filesystem.
+func TestWriteThroughDirs(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_write_through_dirs.db", &Options{
+		WriteThroughDirs: []string{"/documents/"},
+	})
+	documents, err := cache.GetPath("/Documents", auth)
+	failOnErr(t, err)
+	inside := NewInode("inside.txt", 0644|fuse.S_IFREG, documents)
+	cache.InsertID(inside.ID(), inside)
+	if !cache.isWriteThrough(inside) {
+		t.Fatal("File inside write-through directory was not written through.")
+	}
+
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	outside := NewInode("Documents.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertID(outside.ID(), outside)
+	if cache.isWriteThrough(outside) {
+		t.Fatal("File outside write-through directory was written through.")
+	}
+}
+
+// Files should be streamed past the size threshold or inside stream
+// directories, and cached otherwise.
+func TestStreamedFiles(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_streamed_files.db", &Options{
+		StreamSize: 1024 * 1024,
+		StreamDirs: []string{"Videos"},
+	})
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	small := NewInode("stream-small.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertID(small.ID(), small)
+	if cache.isStreamed(small) {
+		t.Fatal("Small file was streamed.")
+	}
+	large := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "stream-large",
+		Name:   "stream-large.mkv",
+		Size:   2 * 1024 * 1024,
+		File:   &graph.File{},
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+	})
+	cache.InsertChild(root.ID(), large)
+	if !cache.isStreamed(large) {
+		t.Fatal("Large file was not streamed.")
+	}
+
+	videos := NewInode("Videos", 0755|fuse.S_IFDIR, root)
+	cache.InsertChild(root.ID(), videos)
+	inside := NewInode("clip.mp4", 0644|fuse.S_IFREG, videos)
+	cache.InsertChild(videos.ID(), inside)
+	if !cache.isStreamed(inside) {
+		t.Fatal("File inside a stream directory was not streamed.")
+	}
+}
+
+// Exclude patterns should match names anywhere, paths from the root, or only
+// folders, depending on where their slashes are.
+func TestExcluded(t *testing.T) {
+	t.Parallel()
+	patterns := []string{"Backups/", "*.ISO", "Photos/2010*"}
+	tests := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"Backups", true, true},
+		{"Documents/backups", true, true},
+		{"Backups", false, false},
+		{"Documents/Backups.txt", false, false},
+		{"Downloads/ubuntu.iso", false, true},
+		{"photos/2010 trip", true, true},
+		{"Photos/2011 trip", true, false},
+		{"Old/Photos/2010 trip", true, false},
+	}
+	for _, test := range tests {
+		if excluded(test.path, test.isDir, patterns) != test.excluded {
+			t.Errorf("Expected %s to be excluded: %t\n", test.path, test.excluded)
+		}
+	}
+	if ValidExcludePattern("[") || ValidExcludePattern("/") {
+		t.Error("Invalid patterns were accepted.")
+	}
+}
+
+// Excluded items should not be listed.
+func TestExcludedChildren(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_excluded_children.db", &Options{
+		Exclude: []string{"onedriver_tests/"},
+	})
+	children, err := cache.GetChildrenPath("/", auth)
+	failOnErr(t, err)
+	if _, exists := children["onedriver_tests"]; exists {
+		t.Fatal("Excluded folder was listed.")
+	}
+	if _, err = cache.GetPath("/onedriver_tests", auth); err == nil {
+		t.Fatal("Excluded folder could be looked up.")
+	}
+}
+
+// With the interval upload policy, closing a file should only save it to the
+// cache and remember to upload it later, except in write-through mode.
+func TestUploadPolicyInterval(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_upload_policy_interval.db", &Options{
+		UploadPolicy:     UploadOnInterval,
+		WriteThroughDirs: []string{"/Documents"},
+	})
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	inode := NewInode("interval.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertID(inode.ID(), inode)
+	if policy := cache.uploadPolicy(inode); policy != UploadOnInterval {
+		t.Fatalf("Expected the interval upload policy, got \"%s\".\n", policy)
+	}
+
+	content := []byte("saved for later")
+	inode.mutex.Lock()
+	failOnErr(t, inode.openContent())
+	_, err = inode.content.WriteAt(content, 0)
+	failOnErr(t, err)
+	inode.DriveItem.Size = uint64(len(content))
+	inode.hasChanges = true
+	inode.mutex.Unlock()
+	if errno := inode.Flush(context.Background(), nil); errno != 0 {
+		t.Fatal("Flush failed:", errno)
+	}
+	if !inode.HasChanges() {
+		t.Fatal("File was uploaded when closed with the interval upload policy.")
+	}
+	if !bytes.Equal(cache.GetContent(inode.ID()), content) {
+		t.Fatal("Content was not saved to the cache when the file was closed.")
+	}
+	if ids := cache.dirtyIDs(); len(ids) != 1 || ids[0] != inode.ID() {
+		t.Fatalf("File was not scheduled for upload: %v\n", ids)
+	}
+
+	documents, err := cache.GetPath("/Documents", auth)
+	failOnErr(t, err)
+	if cache.uploadPolicy(documents) != UploadOnFlush {
+		t.Fatal("Write-through directory did not use the flush upload policy.")
+	}
+}
+
+// Only the most recent activity is kept.
+func TestActivityLog(t *testing.T) {
+	t.Parallel()
+	var activity activityLog
+	for i := 0; i < maxActivity+5; i++ {
+		activity.add("created", fmt.Sprintf("file%d.txt", i))
+	}
+	recent := activity.list()
+	if len(recent) != maxActivity {
+		t.Fatalf("Expected %d entries, got %d.\n", maxActivity, len(recent))
+	}
+	if last := recent[len(recent)-1].Name; last != fmt.Sprintf("file%d.txt", maxActivity+4) {
+		t.Fatalf("Most recent entry was not last: %s\n", last)
+	}
+}
+
+// Cached content that does not match the server should be discarded.
+func TestVerifyCache(t *testing.T) {
+	t.Parallel()
+	_, err := graph.Put("/me/drive/root:/onedriver_tests/verify_cache.txt:/content",
+		auth, bytes.NewReader([]byte("the server's copy of this file")))
+	failOnErr(t, err)
+
+	cache := NewCache(auth, "test_verify_cache.db", nil)
+	inode, err := cache.GetPath("/onedriver_tests/verify_cache.txt", auth)
+	failOnErr(t, err)
+	failOnErr(t, cache.InsertContent(inode.ID(), []byte("a stale copy")))
+
+	corrections := cache.VerifyCache(auth)
+	if len(corrections) != 1 || corrections[0].ID != inode.ID() {
+		t.Fatalf("Stale content was not corrected: %+v\n", corrections)
+	}
+	if cache.hasContent(inode.ID()) {
+		t.Fatal("Stale content was still cached.")
+	}
+}
+
+// VerifyPath should find local content that differs from the server, and
+// keeping the remote copy should replace it.
+func TestVerifyPath(t *testing.T) {
+	t.Parallel()
+	_, err := graph.Put("/me/drive/root:/onedriver_tests/verify_path.txt:/content",
+		auth, bytes.NewReader([]byte("the server's copy")))
+	failOnErr(t, err)
+
+	cache := NewCache(auth, "test_verify_path.db", nil)
+	inode, err := cache.GetPath("/onedriver_tests/verify_path.txt", auth)
+	failOnErr(t, err)
+	failOnErr(t, cache.InsertContent(inode.ID(), []byte("a corrupted copy")))
+
+	mismatches, err := cache.VerifyPath(inode, auth)
+	failOnErr(t, err)
+	if len(mismatches) != 1 || mismatches[0].ID != inode.ID() {
+		t.Fatalf("Corrupted content was not found: %+v\n", mismatches)
+	}
+
+	failOnErr(t, cache.Resolve(inode, KeepRemote, auth))
+	if content := cache.GetContent(inode.ID()); string(content) != "the server's copy" {
+		t.Fatalf("Content was not replaced with the server's copy, got \"%s\".\n", content)
+	}
+	if mismatches, _ = cache.VerifyPath(inode, auth); len(mismatches) != 0 {
+		t.Fatalf("Content still did not match after resolving: %+v\n", mismatches)
+	}
+}
+
+// Downloads should be checked against the server's hash, and given up on if
+// they keep not matching it.
+func TestFetchContentChecksum(t *testing.T) {
+	t.Parallel()
+	_, err := graph.Put("/me/drive/root:/onedriver_tests/fetch_checksum.txt:/content",
+		auth, bytes.NewReader([]byte("content with a checksum")))
+	failOnErr(t, err)
+
+	cache := NewCache(auth, "test_fetch_checksum.db", nil)
+	inode, err := cache.GetPath("/onedriver_tests/fetch_checksum.txt", auth)
+	failOnErr(t, err)
+	download, _, err := cache.fetchContent(context.Background(), inode.ID(),
+		inode.checksum(), graph.PriorityInteractive, auth)
+	failOnErr(t, err)
+	os.Remove(download)
+
+	download, _, err = cache.fetchContent(context.Background(), inode.ID(),
+		"not the checksum", graph.PriorityInteractive, auth)
+	if err != errChecksumMismatch {
+		t.Fatal("Download that did not match its checksum was not refused:", err)
+	}
+	if download != "" {
+		t.Fatal("Download that did not match its checksum was left behind.")
+	}
+}
+
+// Content cached in the database by earlier versions should be moved to the
+// content directory when the cache is opened.
+func TestMigrateContent(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open("test_migrate_content.db", 0600, nil)
+	failOnErr(t, err)
+	failOnErr(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketContent)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("migrated-item"), []byte("cached by an earlier version"))
+	}))
+	db.Close()
+
+	cache := NewCache(auth, "test_migrate_content.db", nil)
+	content := cache.GetContent("migrated-item")
+	if string(content) != "cached by an earlier version" {
+		t.Fatalf("Content was not migrated, got \"%s\".\n", content)
+	}
+	cache.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketContent) != nil {
+			t.Fatal("Content was left behind in the database.")
+		}
+		return nil
+	})
+}
+
+// Hydrated extents should merge when they overlap or touch, and report the
+// gaps between them.
+func TestExtents(t *testing.T) {
+	t.Parallel()
+	var e extents
+	e = e.add(10, 20).add(30, 40).add(20, 25).add(0, 5)
+	expected := extents{{0, 5}, {10, 25}, {30, 40}}
+	if fmt.Sprint(e) != fmt.Sprint(expected) {
+		t.Fatalf("Expected extents %v, got %v\n", expected, e)
+	}
+	if cached := (&hydration{Size: 50, Extents: e}).cached(); cached != 30 {
+		t.Fatalf("Expected 30 bytes to be cached, got %d\n", cached)
+	}
+	gaps := e.missing(0, 50)
+	expectedGaps := []extent{{5, 10}, {25, 30}, {40, 50}}
+	if fmt.Sprint(gaps) != fmt.Sprint(expectedGaps) {
+		t.Fatalf("Expected gaps %v, got %v\n", expectedGaps, gaps)
+	}
+	if gaps = e.missing(12, 22); len(gaps) != 0 {
+		t.Fatalf("Expected no gaps inside an extent, got %v\n", gaps)
+	}
+
+	h := &hydration{Size: 40, Extents: e}
+	h.resize(35)
+	if h.complete() || fmt.Sprint(h.Extents) != fmt.Sprint(extents{{0, 5}, {10, 25}, {30, 35}}) {
+		t.Fatalf("Truncating did not clip the extents: %v\n", h.Extents)
+	}
+	h.written(3, 12)
+	h.written(25, 30)
+	h.written(50, 60) // past the end, the hole in between is zeroes
+	if !h.complete() || h.Size != 60 {
+		t.Fatalf("Writes did not fill in the gaps: %v (size %d)\n", h.Extents, h.Size)
+	}
+}
+
+// Reads that are interrupted should stop waiting for download slots and for
+// the downloads of others.
+func TestDownloadManagerCancel(t *testing.T) {
+	t.Parallel()
+	d := newDownloadManager(1)
+	failOnErr(t, d.acquire(context.Background()))
+	defer d.giveBack()
+	runs, _ := d.claim("cancel", 0, hydrationBlock)
+	defer d.release("cancel", runs...)
+	_, waits := d.claim("cancel", 0, hydrationBlock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.acquire(ctx); err != context.Canceled {
+		t.Fatalf("Waiting for a slot was not canceled: %v\n", err)
+	}
+	if err := d.wait(ctx, waits); err != context.Canceled {
+		t.Fatalf("Waiting for another download was not canceled: %v\n", err)
+	}
+}
+
+// Seeking for data and holes should land on the cached extents and the gaps
+// between them, with the end of the content as the last hole.
+func TestExtentsSeek(t *testing.T) {
+	t.Parallel()
+	e := extents{{10, 20}, {30, 40}}
+	cases := []struct {
+		off    uint64
+		hole   bool
+		expect uint64
+		ok     bool
+	}{
+		{0, false, 10, true},
+		{15, false, 15, true},
+		{20, false, 30, true},
+		{40, false, 0, false},
+		{0, true, 0, true},
+		{10, true, 20, true},
+		{35, true, 40, true},
+		{50, true, 0, false},
+	}
+	for _, c := range cases {
+		if offset, ok := e.seek(c.off, 50, c.hole); offset != c.expect || ok != c.ok {
+			t.Errorf("Seeking from %d (hole: %t) gave %d, %t, wanted %d, %t.\n",
+				c.off, c.hole, offset, ok, c.expect, c.ok)
+		}
+	}
+}
+
+// Parts of a file that are already being downloaded should be waited for
+// instead of claimed again, and claimed again once their download ends.
+func TestDownloadManagerClaim(t *testing.T) {
+	t.Parallel()
+	d := newDownloadManager(1)
+	runs, waits := d.claim("claim", hydrationBlock, 3*hydrationBlock)
+	if fmt.Sprint(runs) != fmt.Sprint([]extent{{hydrationBlock, 3 * hydrationBlock}}) ||
+		len(waits) != 0 {
+		t.Fatalf("Unexpected first claim: %v %v\n", runs, waits)
+	}
+
+	// overlaps the first claim in the middle, and ends partway through a block
+	other, waits := d.claim("claim", 0, 4*hydrationBlock+10)
+	expected := []extent{{0, hydrationBlock}, {3 * hydrationBlock, 4*hydrationBlock + 10}}
+	if fmt.Sprint(other) != fmt.Sprint(expected) || len(waits) != 1 {
+		t.Fatalf("Expected to claim %v and wait once, got %v %v\n", expected, other, waits)
+	}
+	if more, _ := d.claim("other", 0, hydrationBlock); len(more) != 1 {
+		t.Fatal("Claims of different items should not interfere.")
+	}
+
+	d.release("claim", runs...)
+	select {
+	case <-waits[0]:
+	default:
+		t.Fatal("Releasing a run did not end the wait for it.")
+	}
+	again, waits := d.claim("claim", hydrationBlock, 2*hydrationBlock)
+	if len(again) != 1 || len(waits) != 0 {
+		t.Fatalf("Released blocks could not be claimed again: %v %v\n", again, waits)
+	}
+
+	long, _ := d.claim("long", 0, 2*maxHydrationRequest)
+	if len(long) != 2 || long[0].End != maxHydrationRequest {
+		t.Fatalf("Runs should be split at maxHydrationRequest: %v\n", long)
+	}
+}
+
+// Each eviction policy should put a different file first.
+func TestEvictionPolicies(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	contents := []cachedContent{
+		{id: "recent-huge", size: 1024 * 1024 * 1024, lastUse: now.Add(-time.Hour), uses: 1},
+		{id: "old-popular", size: 1024, lastUse: now.Add(-48 * time.Hour), uses: 50},
+		{id: "rare-small", size: 1024, lastUse: now.Add(-2 * time.Hour), uses: 1},
+	}
+	expected := map[EvictionPolicy]string{
+		EvictLRU:  "old-popular",
+		EvictLFU:  "rare-small",
+		EvictSize: "recent-huge",
+	}
+	for name, id := range expected {
+		policy := evictionPolicies[name]
+		sorted := append([]cachedContent{}, contents...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return policy.first(sorted[i], sorted[j], now)
+		})
+		if sorted[0].id != id {
+			t.Errorf("Policy %s evicted %s first, expected %s.\n", name, sorted[0].id, id)
+		}
+	}
+}
+
+// Cache stats should count cached content and what happened to the cache.
+func TestCacheStats(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_cache_stats.db", nil)
+	failOnErr(t, cache.InsertContent("stats-full", []byte("all of it")))
+	failOnErr(t, cache.InsertContent("stats-partial", make([]byte, 2*hydrationBlock)))
+	failOnErr(t, cache.setHydration("stats-partial",
+		&hydration{Size: 2 * hydrationBlock, Extents: extents{{0, hydrationBlock}}}))
+	cache.counters.opened(true)
+	cache.counters.opened(false)
+	cache.counters.evict(3, 1024)
+
+	stats := cache.Stats()
+	if stats.Files != 2 || stats.Partial != 1 || stats.Size == 0 {
+		t.Fatalf("Cached content was not counted: %+v\n", stats)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Evicted != 3 || stats.EvictedSize != 1024 {
+		t.Fatalf("Counters were not reported: %+v\n", stats)
+	}
+}
+
+// The least recently used content should be evicted once the cache grows past
+// its maximum size, but never content that has not been uploaded yet.
+func TestEvictContent(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_evict_content.db", &Options{MaxCacheSize: 150 * 1024})
+	content := make([]byte, 64*1024)
+	for n, id := range []string{"evict-oldest", "evict-pending", "evict-newest"} {
+		failOnErr(t, cache.InsertContent(id, content))
+		used := time.Now().Add(time.Duration(n-3) * time.Hour)
+		os.Chtimes(cache.contentPath(id), used, used)
+	}
+	cache.markDirty(&Inode{DriveItem: graph.DriveItem{ID: "evict-pending"}, hasChanges: true})
+
+	if count, _ := cache.evictContent(); count != 1 {
+		t.Fatalf("Expected 1 file to be evicted, got %d.\n", count)
+	}
+	if cache.hasContent("evict-oldest") {
+		t.Fatal("Least recently used content was not evicted.")
+	}
+	if !cache.hasContent("evict-pending") || !cache.hasContent("evict-newest") {
+		t.Fatal("Content that was not uploaded or was used recently was evicted.")
+	}
+}
+
+// Cached content of the wrong size should be discarded on startup, along with
+// records of partly downloaded content that is gone.
+func TestCheckContent(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_check_content.db", nil)
+	for _, id := range []string{"check-intact", "check-truncated"} {
+		cache.InsertID(id, NewInodeDriveItem(&graph.DriveItem{
+			ID:   id,
+			Name: id,
+			Size: 10,
+			File: &graph.File{},
+		}))
+	}
+	failOnErr(t, cache.InsertContent("check-intact", []byte("0123456789")))
+	failOnErr(t, cache.InsertContent("check-truncated", []byte("01234")))
+	failOnErr(t, cache.setHydration("check-missing", &hydration{Size: 10}))
+
+	corrections := cache.CheckContent()
+	if len(corrections) != 1 || corrections[0].ID != "check-truncated" {
+		t.Fatalf("Expected only the truncated content to be discarded, got %v\n", corrections)
+	}
+	if cache.hasContent("check-truncated") || !cache.hasContent("check-intact") {
+		t.Fatal("Wrong content was discarded.")
+	}
+	if cache.getHydration("check-missing") != nil {
+		t.Fatal("Record of partly downloaded content that is gone was kept.")
+	}
+}
+
+// Compressed content should take up less space on disk while still reading
+// back the same, and be decompressed when its file is opened.
+func TestCompressContent(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, ContentKeySize)
+	cache := NewCache(auth, "test_compress_content.db",
+		&Options{CompressContent: true, ContentKey: key})
+	content := bytes.Repeat([]byte("a highly compressible document\n"), 4096)
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	for id, data := range map[string][]byte{"compress-text": content, "compress-random": random} {
+		failOnErr(t, cache.InsertContent(id, data))
+		cache.InsertID(id, NewInodeDriveItem(&graph.DriveItem{
+			ID:   id,
+			Name: id,
+			Size: uint64(len(data)),
+			File: &graph.File{},
+		}))
+		cache.compressContent(cache.GetID(id))
+	}
+
+	if st, _ := os.Stat(cache.contentPath("compress-random")); st.Size() < int64(len(random)) {
+		t.Fatal("Content that hardly compresses was compressed.")
+	}
+	st, err := os.Stat(cache.contentPath("compress-text"))
+	failOnErr(t, err)
+	if st.Size() >= int64(len(content))/10 {
+		t.Fatalf("Content was not compressed, %d bytes on disk.\n", st.Size())
+	}
+	if !bytes.Equal(cache.GetContent("compress-text"), content) {
+		t.Fatal("Compressed content did not read back the same.")
+	}
+	if size, err := cache.contentSize("compress-text"); err != nil || size != uint64(len(content)) {
+		t.Fatalf("Wrong size of compressed content: %d (%v)\n", size, err)
+	}
+
+	inode := cache.GetID("compress-text")
+	inode.mutex.Lock()
+	defer inode.mutex.Unlock()
+	failOnErr(t, inode.openContent())
+	defer inode.content.Close()
+	read := make([]byte, len(content))
+	if _, err = inode.content.ReadAt(read, 0); err != nil || !bytes.Equal(read, content) {
+		t.Fatal("Opened content was not decompressed.")
+	}
+}
+
+// Content cached by one mount should be found by another mount sharing its
+// content, and changes to it should stay in the mount that made them.
+func TestSharedContent(t *testing.T) {
+	t.Parallel()
+	shared := "test_shared_content.shared"
+	os.RemoveAll(shared)
+	first := NewCache(auth, "test_shared_content_first.db", &Options{SharedContentDir: shared})
+	second := NewCache(auth, "test_shared_content_second.db", &Options{SharedContentDir: shared})
+	item := graph.DriveItem{ID: "shared-content", Name: "shared-content", CTag: "cTag", File: &graph.File{}}
+	inode := NewInodeDriveItem(&item)
+	first.InsertID(inode.ID(), inode)
+	failOnErr(t, first.InsertContent(inode.ID(), []byte("stored once")))
+	first.shareContent(inode)
+
+	if !second.linkShared("shared-content", "cTag") {
+		t.Fatal("Content cached by the first mount was not found by the second.")
+	}
+	if second.linkShared("shared-content", "other cTag") {
+		t.Fatal("Content of another version of the file was found.")
+	}
+	file, err := second.cipher.openFile(second.contentPath("shared-content"), os.O_RDWR)
+	failOnErr(t, err)
+	_, err = file.WriteAt([]byte("cached"), 0)
+	failOnErr(t, err)
+	file.Close()
+	if content := string(first.GetContent("shared-content")); content != "stored once" {
+		t.Fatalf("Changes made by the second mount reached the first: \"%s\"\n", content)
+	}
+	if content := string(second.GetContent("shared-content")); content != "cached once" {
+		t.Fatalf("Changes were not written: \"%s\"\n", content)
+	}
+}
+
+// Encrypted content should read back the same as it was written, wherever it
+// is written, and holes in sparse files should read as zeroes.
+func TestContentCipher(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, ContentKeySize)
+	key[0] = 1
+	cipher, err := newContentCipher(key)
+	failOnErr(t, err)
+	path := "test_content_cipher.content"
+	os.Remove(path)
+	defer os.Remove(path)
+	file, err := cipher.openFile(path, os.O_RDWR|os.O_CREATE)
+	failOnErr(t, err)
+	defer file.Close()
+	if file.cipher == nil {
+		t.Fatal("New content was not encrypted.")
+	}
+
+	var expected []byte
+	random := rand.New(rand.NewSource(1))
+	for n := 0; n < 500; n++ {
+		offset := random.Intn(4096)
+		switch random.Intn(4) {
+		case 0:
+			size := random.Intn(4096)
+			failOnErr(t, file.Truncate(int64(size)))
+			if size > len(expected) {
+				expected = append(expected, make([]byte, size-len(expected))...)
+			}
+			expected = expected[:size]
+		default:
+			data := make([]byte, 1+random.Intn(100))
+			random.Read(data)
+			_, err = file.WriteAt(data, int64(offset))
+			failOnErr(t, err)
+			if end := offset + len(data); end > len(expected) {
+				expected = append(expected, make([]byte, end-len(expected))...)
+			}
+			copy(expected[offset:], data)
+		}
+		size, err := file.Size()
+		failOnErr(t, err)
+		content := make([]byte, size)
+		if _, err = file.ReadAt(content, 0); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Fatalf("Content did not match after %d operations.\n", n+1)
+		}
+	}
+
+	secret := []byte("nobody should see this")
+	_, err = file.WriteAt(secret, 1000)
+	failOnErr(t, err)
+	raw, err := ioutil.ReadFile(path)
+	failOnErr(t, err)
+	if bytes.Contains(raw, secret) {
+		t.Fatal("Content was stored in plain text.")
+	}
+	if _, err = (*contentCipher)(nil).openFile(path, os.O_RDONLY); err == nil {
+		t.Fatal("Encrypted content was opened without a key.")
+	}
+
+	// rewriting content must not encrypt it the same way twice
+	failOnErr(t, file.Truncate(0))
+	plain := make([]byte, 2*contentChunkSize)
+	_, err = file.WriteAt(plain, 0)
+	failOnErr(t, err)
+	before, err := ioutil.ReadFile(path)
+	failOnErr(t, err)
+	plain[0] = 1
+	_, err = file.WriteAt(plain, 0)
+	failOnErr(t, err)
+	after, err := ioutil.ReadFile(path)
+	failOnErr(t, err)
+	if bytes.Equal(before[contentHeaderSize+chunkNonceSize:contentHeaderSize+chunkNonceSize+16],
+		after[contentHeaderSize+chunkNonceSize:contentHeaderSize+chunkNonceSize+16]) {
+		t.Fatal("Content was encrypted with the same keystream after being rewritten.")
+	}
+}
+
+// Encrypted content that was changed on disk should fail to read instead of
+// being returned, while holes still read as zeroes.
+func TestContentCipherTampered(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, ContentKeySize)
+	key[0] = 1
+	cipher, err := newContentCipher(key)
+	failOnErr(t, err)
+	path := "test_content_cipher_tampered.content"
+	os.Remove(path)
+	defer os.Remove(path)
+	file, err := cipher.openFile(path, os.O_RDWR|os.O_CREATE)
+	failOnErr(t, err)
+	defer file.Close()
+
+	_, err = file.WriteAt([]byte("the end"), 3*contentChunkSize)
+	failOnErr(t, err)
+	content := make([]byte, contentChunkSize)
+	_, err = file.ReadAt(content, contentChunkSize)
+	failOnErr(t, err)
+	if !isZero(content) {
+		t.Fatal("A hole did not read as zeroes.")
+	}
+
+	raw, err := os.OpenFile(path, os.O_RDWR, 0600)
+	failOnErr(t, err)
+	defer raw.Close()
+	_, err = raw.WriteAt([]byte{1}, encryptedSize(3*contentChunkSize)+chunkNonceSize)
+	failOnErr(t, err)
+	if _, err = file.ReadAt(make([]byte, 7), 3*contentChunkSize); err != errContentTampered {
+		t.Fatalf("Changed content was read without an error: %v\n", err)
+	}
+}
+
+// Reads of encrypted content should never see a chunk that is being rewritten
+// halfway, which would fail to authenticate.
+func TestContentCipherConcurrentRead(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, ContentKeySize)
+	cipher, err := newContentCipher(key)
+	failOnErr(t, err)
+	path := "test_content_cipher_concurrent.content"
+	os.Remove(path)
+	defer os.Remove(path)
+	file, err := cipher.openFile(path, os.O_RDWR|os.O_CREATE)
+	failOnErr(t, err)
+	defer file.Close()
+
+	content := make([]byte, 3*contentChunkSize)
+	_, err = file.WriteAt(content, 0)
+	failOnErr(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			file.WriteAt(content, 0)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if _, err = file.ReadAt(make([]byte, 100), contentChunkSize+100); err != nil {
+			t.Fatalf("Read failed while the content was being rewritten: %v\n", err)
+		}
+	}
+	<-done
+}
+
+// Encrypted metadata should round trip, and metadata stored before encryption
+// was enabled should still be readable.
+func TestSealer(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, MetadataKeySize)
+	key[0] = 1
+	s, err := newSealer(key)
+	failOnErr(t, err)
+
+	value := []byte(`{"name":"secret plans.txt"}`)
+	sealed := s.seal(value)
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("Sealed value contained the original value.")
+	}
+	opened, err := s.open(sealed)
+	failOnErr(t, err)
+	if !bytes.Equal(opened, value) {
+		t.Fatalf("Opened \"%s\", wanted \"%s\".\n", opened, value)
+	}
+	if opened, _ = s.open(value); !bytes.Equal(opened, value) {
+		t.Fatal("Unencrypted value was not returned as-is.")
+	}
+
+	var none *sealer
+	if _, err = none.open(sealed); err == nil {
+		t.Fatal("Opened an encrypted value without a key.")
+	}
+}
+
+// Files outside the database that reveal names should be encrypted with the
+// metadata key, and still readable if written before it was set.
+func TestSealedFile(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, MetadataKeySize)
+	key[0] = 1
+	path := "test_sealed_file.json"
+	defer os.Remove(path)
+	layout := []byte(`[{"name":"Secret Team Site"}]`)
+
+	failOnErr(t, ioutil.WriteFile(path, layout, 0600))
+	read, err := ReadSealed(path, key)
+	failOnErr(t, err)
+	if !bytes.Equal(read, layout) {
+		t.Fatal("File written before encryption was enabled was not readable.")
+	}
+	failOnErr(t, WriteSealed(path, layout, key))
+	raw, err := ioutil.ReadFile(path)
+	failOnErr(t, err)
+	if bytes.Contains(raw, []byte("Secret")) {
+		t.Fatal("Sealed file contained the original content.")
+	}
+	read, err = ReadSealed(path, key)
+	failOnErr(t, err)
+	if !bytes.Equal(read, layout) {
+		t.Fatalf("Sealed file did not round trip: \"%s\"\n", read)
+	}
+	if _, err = ReadSealed(path, nil); err == nil {
+		t.Fatal("Sealed file was read without a key.")
+	}
+}
+
+// Inode numbers should survive remounts and changes of item IDs.
+func TestInodeNumbersPersist(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_inode_numbers_persist.db", nil)
+	ino := cache.Ino("local-inode-number")
+	cache.moveIno("local-inode-number", "remote-inode-number")
+	other := cache.Ino("some-other-item")
+	cache.db.Close()
+
+	cache = NewCache(auth, "test_inode_numbers_persist.db", nil)
+	if moved := cache.Ino("remote-inode-number"); moved != ino {
+		t.Fatalf("Inode number was %d after remount, wanted %d.\n", moved, ino)
+	}
+	if cache.Ino("some-other-item") != other {
+		t.Fatal("Inode number of an unmoved item changed after remount.")
+	}
+}
+
+// Identical files should be reported as duplicates by Analyze.
+func TestAnalyzeDuplicates(t *testing.T) {
+	t.Parallel()
+	content := []byte("the same content in two different files")
+	for _, name := range []string{"analyze_dup1.txt", "analyze_dup2.txt"} {
+		_, err := graph.Put("/me/drive/root:/onedriver_tests/"+name+":/content",
+			auth, bytes.NewReader(content))
+		failOnErr(t, err)
+	}
+
+	cache := NewCache(auth, "test_analyze.db", nil)
+	_, err := cache.GetPath("/onedriver_tests/analyze_dup1.txt", auth)
+	failOnErr(t, err)
+
+	analysis := cache.Analyze(time.Now(), 1000)
+	for _, group := range analysis.Duplicates {
+		if group[0].Path == "/onedriver_tests/analyze_dup1.txt" {
+			if len(group) != 2 || group[1].Path != "/onedriver_tests/analyze_dup2.txt" {
+				t.Fatalf("Wrong duplicates: %+v\n", group)
+			}
+			return
+		}
+	}
+	t.Fatalf("Duplicates were not found: %+v\n", analysis.Duplicates)
+}
+
+// Items copied on the server should show up in the cache with the same
+// content.
+func TestServerSideCopy(t *testing.T) {
+	t.Parallel()
+	content := []byte("copy me on the server")
+	_, err := graph.Put("/me/drive/root:/onedriver_tests/copy_src.txt:/content",
+		auth, bytes.NewReader(content))
+	failOnErr(t, err)
+
+	cache := NewCache(auth, "test_copy.db", nil)
+	src, err := cache.GetPath("/onedriver_tests/copy_src.txt", auth)
+	failOnErr(t, err)
+	parent, err := cache.GetPath("/onedriver_tests", auth)
+	failOnErr(t, err)
+
+	copied, err := cache.Copy(context.Background(), src, parent, "copy_dst.txt", nil)
+	failOnErr(t, err)
+	if copied.ID() == src.ID() || copied.Size() != uint64(len(content)) {
+		t.Fatalf("Copy was wrong: %+v\n", copied.DriveItem)
+	}
+	if inode, _ := cache.GetPath("/onedriver_tests/copy_dst.txt", auth); inode != copied {
+		t.Fatal("Copy was not inserted into the cache.")
+	}
+	remote, err := graph.GetItemContent(copied.ID(), auth)
+	failOnErr(t, err)
+	if !bytes.Equal(remote, content) {
+		t.Fatalf("Copied content was \"%s\", wanted \"%s\".\n", remote, content)
+	}
+}
+
+// Permissions should be re-applied to items fetched from the server again.
+func TestModeRestored(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_mode_restored.db", nil)
+	failOnErr(t, cache.storeMode("mode-restored", 0755, false))
+
+	inode := NewInodeDriveItem(&graph.DriveItem{ID: "mode-restored", File: &graph.File{}})
+	cache.restoreLocalAttrs(inode)
+	if inode.Mode() != fuse.S_IFREG|0755 {
+		t.Fatalf("Mode was %s, wanted %s.\n", Octal(inode.Mode()), Octal(fuse.S_IFREG|0755))
+	}
+
+	// default permissions are not stored
+	failOnErr(t, cache.storeMode("mode-restored", 0644, false))
+	if attrs := cache.getLocalAttrs("mode-restored"); !attrs.isEmpty() {
+		t.Fatalf("Default permissions were stored: %+v\n", attrs)
+	}
+}
+
+// Ownership set with chown should be re-applied to items fetched from the
+// server again.
+func TestOwnerRestored(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_owner_restored.db", nil)
+	owner := &fuse.Owner{Uid: 1234, Gid: 5678}
+	failOnErr(t, cache.storeOwner("owner-restored", owner))
+
+	inode := NewInodeDriveItem(&graph.DriveItem{ID: "owner-restored", File: &graph.File{}})
+	cache.restoreLocalAttrs(inode)
+	if inode.Owner() != *owner {
+		t.Fatalf("Owner was %+v, wanted %+v.\n", inode.Owner(), *owner)
+	}
+}
+
+// Files that were not downloaded yet should have their real size, but take up
+// no blocks.
+func TestPlaceholderBlocks(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_placeholder_blocks.db", nil)
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:   "placeholder-blocks",
+		Name: "placeholder-blocks",
+		Size: 64 * 1024,
+		File: &graph.File{},
+	})
+	cache.InsertID(inode.ID(), inode)
+	if attr := inode.makeattr(); attr.Size != 64*1024 || attr.Blocks != 0 {
+		t.Fatalf("Expected a size of 65536 and no blocks, got %d and %d.\n",
+			attr.Size, attr.Blocks)
+	}
+
+	failOnErr(t, cache.InsertContent(inode.ID(), make([]byte, 64*1024)))
+	if attr := inode.makeattr(); attr.Blocks < 64*1024/512 {
+		t.Fatalf("Downloaded content only took up %d blocks.\n", attr.Blocks)
+	}
+}
+
+// Changes to folders made while offline should be journaled in order, except
+// for changes to items that were never uploaded, and point at the IDs folders
+// get once they are created on the server.
+func TestOfflineJournal(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_offline_journal.db", nil)
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	_, err = cache.GetChildrenID(root.ID(), auth)
+	failOnErr(t, err)
+	cache.Lock()
+	cache.offline = true
+	cache.Unlock()
+
+	dir, errno := cache.mkdirOffline(root, "offline_journal", 0755)
+	if errno != 0 {
+		t.Fatalf("Could not create folder offline: %d\n", errno)
+	}
+	if errno = cache.renameOffline(root, "offline_journal", root, "offline_journal_renamed"); errno != 0 {
+		t.Fatalf("Could not rename folder offline: %d\n", errno)
+	}
+	file := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "offline-journal-file",
+		Name:   "offline_journal_file",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		File:   &graph.File{},
+	})
+	cache.InsertChild(root.ID(), file)
+	if errno = cache.renameOffline(root, "offline_journal_file", dir, "moved"); errno != 0 {
+		t.Fatalf("Could not move file offline: %d\n", errno)
+	}
+	cache.rewriteJournal(dir.ID(), "offline-journal-dir")
+
+	entries := cache.journalEntries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 journal entries, got %d: %+v\n", len(entries), entries)
+	}
+	if entries[0].Op != journalMkdir || entries[0].ID != "offline-journal-dir" {
+		t.Fatalf("Expected the folder to be created first, got %+v\n", entries[0])
+	}
+	if entries[1].Op != journalRename || entries[1].ID != file.ID() ||
+		entries[1].NewParentID != "offline-journal-dir" || entries[1].NewName != "moved" {
+		t.Fatalf("Expected the file to be moved into the folder, got %+v\n", entries[1])
+	}
+}
+
+// The same root folder should be described the same way however it was given,
+// so that offline starts are only refused when a different folder is mounted.
+func TestRootOption(t *testing.T) {
+	t.Parallel()
+	same := [][]*Options{
+		{{}, {Root: "/"}},
+		{{Root: "Documents"}, {Root: "/Documents/"}},
+		{{Root: "/Documents", RootID: "some-id"}, {RootID: "some-id"}},
+	}
+	for _, options := range same {
+		if a, b := rootOption(options[0]), rootOption(options[1]); a != b {
+			t.Errorf("Same root was described differently: \"%s\" and \"%s\"\n", a, b)
+		}
+	}
+	if rootOption(&Options{}) == rootOption(&Options{Root: "/Documents"}) {
+		t.Error("The drive root and a subfolder were described the same way.")
+	}
+	if rootOption(&Options{Root: "special:music"}) == rootOption(&Options{Root: "/music"}) {
+		t.Error("A special folder and a folder with its name were described the same way.")
+	}
+}
@@ -0,0 +1,286 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// With ConflictPrompt, files waiting for the user to pick a version are tracked
+// here (by ID, with when the conflict was found), so that neither version is
+// overwritten in the meantime, even across restarts.
+var bucketConflicts = []byte("conflicts")
+
+// KeepBoth settles a Conflict like ConflictKeepBoth (see KeepLocal and
+// KeepRemote for the others).
+const KeepBoth = "both"
+
+// Conflict is a file that was changed both locally and on the server, waiting
+// for the user to pick a version (see ConflictPrompt).
+type Conflict struct {
+	ID   string
+	Path string
+	Time time.Time // when the conflict was found
+}
+
+// conflictCopyName returns the name of the n-th copy made of a file that was
+// changed both locally and on the server, like
+// "notes (conflicted copy from laptop, 2021-03-14).txt", where laptop is the
+// host the copy was made on.
+func conflictCopyName(name string, n int, host string, date time.Time) string {
+	ext := filepath.Ext(name)
+	copy := "conflicted copy"
+	if n > 1 {
+		copy = fmt.Sprintf("conflicted copy %d", n)
+	}
+	suffix := fmt.Sprintf(" (%s from %s, %s)", copy, host, date.Format("2006-01-02"))
+	return strings.TrimSuffix(name, ext) + suffix + ext
+}
+
+// hostname returns the name of this computer, for naming conflict copies.
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	// names of files cannot contain slashes, hostnames should not either
+	return strings.ReplaceAll(host, "/", "_")
+}
+
+// uploadConflict settles the conflict of a file whose upload was refused
+// because the file changed on the server since it was last synced (see
+// UploadManager.OnConflict), as Options.ConflictStrategy says. By default both
+// versions are kept: the content that was being uploaded goes to a new conflict
+// copy next to the file, and the file goes back to the server's version.
+func (c *Cache) uploadConflict(session *UploadSession) {
+	switch c.opts.ConflictStrategy {
+	case ConflictLocalWins, ConflictRemoteWins:
+		// resolving waits for an upload or download
+		go c.pickVersion(session.ID)
+		return
+	case ConflictPrompt:
+		c.addConflict(session.ID)
+		return
+	}
+
+	// the snapshot is removed once this returns, but stays readable while open
+	snapshot, err := session.openSnapshot()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   session.ID,
+			"name": session.Name,
+			"err":  err,
+		}).Error("Could not read content of conflicting upload, it is lost.")
+		return
+	}
+	// uploading the copy queues an upload, which the upload loop this is called
+	// from cannot wait for
+	go func() {
+		defer snapshot.Close()
+		c.keepBoth(session.ID, io.NewSectionReader(snapshot, 0, int64(session.Size)))
+	}()
+}
+
+// keepBoth saves content as a conflict copy of an item, and replaces the
+// item's metadata with the server's. The content is streamed to the copy, since
+// it can be as large as any file.
+func (c *Cache) keepBoth(id string, content io.Reader) {
+	inode := c.GetID(id)
+	if inode == nil {
+		log.WithField("id", id).Error(
+			"File was removed before a conflict copy could be made of it, " +
+				"its local changes are lost.")
+		return
+	}
+	auth := c.GetAuth()
+	parent := c.GetID(inode.ParentID())
+	if parent == nil {
+		log.WithField("id", id).Error("Parent of conflicting file is not in the cache.")
+		return
+	}
+
+	name := inode.Name()
+	host := hostname()
+	now := time.Now()
+	copyName := conflictCopyName(name, 1, host, now)
+	for n := 2; ; n++ {
+		if child, _ := c.GetChild(parent.ID(), copyName, auth); child == nil {
+			break
+		}
+		copyName = conflictCopyName(name, n, host, now)
+	}
+	conflict := NewInode(copyName, inode.Mode(), parent)
+	err := c.insertContentFrom(conflict.ID(), content)
+	var hash string
+	var size uint64
+	if err == nil {
+		hash, size, err = c.hashContent(conflict.ID())
+	}
+	if err != nil {
+		c.DeleteContent(conflict.ID())
+		log.WithFields(log.Fields{
+			"id":   id,
+			"name": name,
+			"err":  err,
+		}).Error("Could not save conflict copy, local changes are lost.")
+		return
+	}
+	conflict.mutex.Lock()
+	conflict.DriveItem.Size = size
+	conflict.DriveItem.File = &graph.File{Hashes: c.Capabilities().HashesOf(hash)}
+	conflict.hasChanges = true
+	conflict.mutex.Unlock()
+	c.storeMode(conflict.ID(), inode.Mode(), false)
+	c.InsertChild(parent.ID(), conflict)
+	c.activity.add("conflict", copyName)
+	log.WithFields(log.Fields{
+		"id":   id,
+		"name": name,
+		"copy": copyName,
+	}).Warn("File was changed both locally and on the server, " +
+		"saving local changes as a conflict copy.")
+	conflict.upload()
+
+	remote, err := c.drive.GetItem(id, auth)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  id,
+			"err": err,
+		}).Error("Could not fetch the server's version of a conflicting file.")
+		return
+	}
+	inode.mutex.Lock()
+	if inode.hasChanges {
+		// changed again since, the next upload will conflict as well
+		inode.mutex.Unlock()
+		return
+	}
+	inode.DriveItem.Size = remote.Size
+	inode.DriveItem.ModTime = remote.ModTime
+	inode.DriveItem.ETag = remote.ETag
+	inode.DriveItem.CTag = remote.CTag
+	inode.DriveItem.File = remote.File
+	inode.closeContent() // downloaded the next time it is opened
+	inode.mutex.Unlock()
+	c.DeleteContent(id)
+}
+
+// pickVersion settles a conflict by keeping the version
+// Options.ConflictStrategy prefers.
+func (c *Cache) pickVersion(id string) {
+	inode := c.GetID(id)
+	if inode == nil {
+		return
+	}
+	keep := KeepLocal
+	if c.opts.ConflictStrategy == ConflictRemoteWins {
+		keep = KeepRemote
+	}
+	log.WithFields(log.Fields{
+		"id":   id,
+		"name": inode.Name(),
+		"keep": keep,
+	}).Warn("File was changed both locally and on the server, keeping one version " +
+		"(see --conflict-strategy).")
+	if err := c.Resolve(inode, keep, c.GetAuth()); err != nil {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"keep": keep,
+			"err":  err,
+		}).Error("Could not settle conflict.")
+	}
+}
+
+// addConflict records that a file is waiting for the user to pick a version.
+func (c *Cache) addConflict(id string) {
+	name := id
+	if inode := c.GetID(id); inode != nil {
+		name = inode.Name()
+	}
+	now, _ := time.Now().MarshalText()
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketConflicts).Put([]byte(id), now)
+	})
+	c.activity.add("conflict", name)
+	log.WithFields(log.Fields{
+		"id":   id,
+		"name": name,
+	}).Warn("File was changed both locally and on the server, keeping both " +
+		"versions until one is picked with \"onedriver conflicts\".")
+}
+
+// removeConflict forgets that a file was waiting for the user to pick a version.
+func (c *Cache) removeConflict(id string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketConflicts).Delete([]byte(id))
+	})
+}
+
+// hasConflict returns whether a file is waiting for the user to pick a version.
+func (c *Cache) hasConflict(id string) bool {
+	found := false
+	c.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(bucketConflicts).Get([]byte(id)) != nil
+		return nil
+	})
+	return found
+}
+
+// Conflicts returns the files waiting for the user to pick a version, oldest
+// first.
+func (c *Cache) Conflicts() []Conflict {
+	conflicts := make([]Conflict, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketConflicts).ForEach(func(k, v []byte) error {
+			conflict := Conflict{ID: string(k)}
+			conflict.Time.UnmarshalText(v)
+			if inode := c.GetID(conflict.ID); inode != nil {
+				conflict.Path = inode.Path()
+			}
+			conflicts = append(conflicts, conflict)
+			return nil
+		})
+	})
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Time.Before(conflicts[j].Time)
+	})
+	return conflicts
+}
+
+// ResolveConflict settles a Conflict by keeping the local version (KeepLocal),
+// the server's (KeepRemote), or both (KeepBoth). Returns once the upload or
+// download is done, if there is one.
+func (c *Cache) ResolveConflict(id string, keep string, auth *graph.Auth) error {
+	if !c.hasConflict(id) {
+		return fmt.Errorf("no conflict for item with ID \"%s\"", id)
+	}
+	inode := c.GetID(id)
+	if inode == nil {
+		c.removeConflict(id)
+		return errors.New("the file no longer exists")
+	}
+	if keep == KeepBoth {
+		content, err := c.openReader(c.contentPath(id))
+		if err != nil {
+			return errors.New("there is no local content to keep")
+		}
+		defer content.Close()
+		c.removeConflict(id)
+		c.keepBoth(id, content)
+		return nil
+	}
+	if err := c.Resolve(inode, keep, auth); err != nil {
+		return err
+	}
+	c.removeConflict(id)
+	return nil
+}
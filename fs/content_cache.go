@@ -0,0 +1,369 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// contentDir returns the directory that holds the cached content of files for
+// the cache using db, in one file per item named after its ID. Keeping content
+// out of the database means that large files are never read into memory as a
+// whole.
+func contentDir(db *bolt.DB) string {
+	return db.Path() + ".content"
+}
+
+// downloadPrefix starts the names of content that is still being downloaded,
+// which are not the ID of any item.
+const downloadPrefix = ".download-"
+
+// contentPath returns the path of the cached content of an item.
+func (c *Cache) contentPath(id string) string {
+	return filepath.Join(contentDir(c.db), id)
+}
+
+// migrateContent moves content cached by earlier versions in the database into
+// the content directory.
+func (c *Cache) migrateContent() {
+	migrated := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketContent)
+		if b == nil {
+			return nil
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			if c.hasContent(string(k)) {
+				return nil // already migrated, the database was not updated
+			}
+			migrated++
+			return c.InsertContent(string(k), v)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket(bucketContent)
+	})
+	if err != nil {
+		log.WithField("err", err).Error("Could not move cached content out of the database.")
+	} else if migrated > 0 {
+		log.WithField("files", migrated).Info("Moved cached content out of the database.")
+	}
+}
+
+// GetContent reads a file's content from disk.
+func (c *Cache) GetContent(id string) []byte {
+	reader, err := c.openReader(c.contentPath(id))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil
+	}
+	return content
+}
+
+// InsertContent writes file content to disk. The content is replaced in place,
+// so that the file sees it if it is open.
+func (c *Cache) InsertContent(id string, content []byte) error {
+	return c.insertContentFrom(id, bytes.NewReader(content))
+}
+
+// insertContentFrom is InsertContent for content read from reader.
+func (c *Cache) insertContentFrom(id string, reader io.Reader) error {
+	file, err := c.cipher.openFile(c.contentPath(id), os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if err = file.Truncate(0); err == nil {
+		_, err = file.readFrom(reader, false)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// DeleteContent deletes content from disk.
+func (c *Cache) DeleteContent(id string) error {
+	c.setHydration(id, nil)
+	if err := os.Remove(c.contentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MoveContent moves content from one ID to another
+func (c *Cache) MoveContent(oldID string, newID string) error {
+	err := os.Rename(c.contentPath(oldID), c.contentPath(newID))
+	if os.IsNotExist(err) {
+		return errors.New("Content not found for ID: " + oldID)
+	} else if err != nil {
+		return err
+	}
+	if h := c.getHydration(oldID); h != nil {
+		c.setHydration(oldID, nil)
+		return c.setHydration(newID, h)
+	}
+	return nil
+}
+
+// copyContent copies the cached content of one item to another. Content that
+// was only partly downloaded is not copied, since the copy is a different
+// version of the content as far as the server is concerned.
+func (c *Cache) copyContent(fromID string, toID string) error {
+	if c.getHydration(fromID) != nil {
+		return errors.New("content was only partly downloaded")
+	}
+	reader, err := c.openReader(c.contentPath(fromID))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := ioutil.TempFile(contentDir(c.db), downloadPrefix+toID+"-")
+	if err != nil {
+		return err
+	}
+	// copied through the cipher, so that the copy gets its own file ID and nonces
+	to, err := c.cipher.wrap(file, true)
+	if err == nil {
+		_, err = to.readFrom(reader, false)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return c.installContent(file.Name(), toID)
+}
+
+// hasContent returns whether an item's content is cached on disk.
+func (c *Cache) hasContent(id string) bool {
+	_, err := os.Stat(c.contentPath(id))
+	return err == nil
+}
+
+// cachedIDs returns the IDs of all items with content cached on disk.
+func (c *Cache) cachedIDs() []string {
+	ids := make([]string, 0)
+	entries, _ := ioutil.ReadDir(contentDir(c.db))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), downloadPrefix) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids
+}
+
+// removePartialDownloads deletes content that was still being downloaded when
+// onedriver last exited.
+func (c *Cache) removePartialDownloads() {
+	dir := contentDir(c.db)
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), downloadPrefix) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// hashFile hashes the content in a file the way the drive does, and returns the
+// hash along with the size of the content.
+func (c *Cache) hashFile(path string) (string, uint64, error) {
+	reader, err := c.openReader(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+	hash, err := c.Capabilities().HashStream(reader)
+	return hash, reader.size, err
+}
+
+// contentSize returns the size of the cached content of an item.
+func (c *Cache) contentSize(id string) (uint64, error) {
+	reader, err := c.openReader(c.contentPath(id))
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return reader.size, nil
+}
+
+// hashContent is hashFile for the cached content of an item.
+func (c *Cache) hashContent(id string) (string, uint64, error) {
+	return c.hashFile(c.contentPath(id))
+}
+
+// downloadAttempts is how many times content that does not match the server's
+// hash is downloaded before giving up on it.
+const downloadAttempts = 3
+
+// errChecksumMismatch is returned when downloaded content keeps not matching
+// the server's hash.
+var errChecksumMismatch = errors.New("downloaded content did not match the server's hash")
+
+// fetchContent downloads the content of an item next to the cached content,
+// without replacing it, and returns the path it was downloaded to along with its
+// size. The caller is responsible for installing or removing the download. The
+// download is checked against checksum (the server's hash of the content, see
+// Inode.checksum) unless it is empty, and downloaded again if it does not match.
+func (c *Cache) fetchContent(ctx context.Context, id string, checksum string,
+	priority graph.Priority, auth *graph.Auth) (string, uint64, error) {
+	if c.opts.SkipHashVerification {
+		checksum = ""
+	}
+	for attempt := 1; ; attempt++ {
+		path, size, err := c.downloadContent(ctx, id, priority, auth)
+		if err != nil || checksum == "" {
+			return path, size, err
+		}
+		// hashed once it is on disk, since it is written in several segments at
+		// once (see graph.SetDownloadSegments) rather than from start to end
+		hash, _, err := c.hashFile(path)
+		if err == nil && strings.EqualFold(hash, checksum) {
+			return path, size, nil
+		}
+		os.Remove(path)
+		log.WithFields(log.Fields{
+			"id":       id,
+			"attempt":  attempt,
+			"hash":     hash,
+			"checksum": checksum,
+		}).Warn("Downloaded content did not match the server's hash.")
+		if attempt == downloadAttempts {
+			return "", 0, errChecksumMismatch
+		}
+	}
+}
+
+// downloadContent downloads the content of an item for fetchContent.
+func (c *Cache) downloadContent(ctx context.Context, id string, priority graph.Priority,
+	auth *graph.Auth) (string, uint64, error) {
+	dir := contentDir(c.db)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+	file, err := ioutil.TempFile(dir, downloadPrefix+id+"-")
+	if err != nil {
+		return "", 0, err
+	}
+	content, err := c.cipher.wrap(file, true)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+	size, err := c.drive.GetItemContentStream(ctx, id, content, priority, auth)
+	if err == nil {
+		// on disk before it replaces the cached content, so that a crash
+		// cannot leave an empty file in its place
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+	return file.Name(), size, nil
+}
+
+// installContent makes a download from fetchContent the cached content of an
+// item. A file with the content open keeps reading the old content until it is
+// reopened.
+func (c *Cache) installContent(path string, id string) error {
+	if err := os.Rename(path, c.contentPath(id)); err != nil {
+		os.Remove(path)
+		return err
+	}
+	c.requestEviction()
+	return nil
+}
+
+// openContent opens the cached content of a file for reading and writing,
+// creating it empty if nothing is cached. Must be called with the mutex held.
+func (i *Inode) openContent() error {
+	if i.content != nil {
+		return nil
+	}
+	file, err := i.cache.cipher.openFile(i.cache.contentPath(i.DriveItem.ID), os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if _, compressed := file.compressedSize(); compressed {
+		if file, err = i.cache.decompressContent(file); err != nil {
+			return err
+		}
+	}
+	i.content = file
+	i.cache.touchContent(i.DriveItem.ID)
+	return nil
+}
+
+// closeContent closes the content of a file if it is open, saving what is
+// cached of it if it was only partly downloaded (see contentClosed otherwise).
+// Must be called with the mutex held.
+func (i *Inode) closeContent() {
+	i.cancelReadahead()
+	if i.content != nil {
+		i.content.Close()
+		i.content = nil
+		if i.hydration == nil && !i.hasChanges {
+			go i.cache.contentClosed(i)
+		}
+	}
+	if i.hydration != nil {
+		i.cache.setHydration(i.DriveItem.ID, i.hydration)
+		i.hydration = nil
+	}
+	i.cache.requestEviction()
+}
+
+// contentClosed compresses (see compressContent) and shares (see shareContent)
+// the content of a file once it is closed with all of it cached and nothing
+// left to upload.
+func (c *Cache) contentClosed(i *Inode) {
+	if c.opts.CompressContent {
+		c.compressContent(i)
+	}
+	c.shareContent(i)
+}
+
+// checksum returns the server's hash of the content of a file, in the hash its
+// type of drive uses, or "" if the server has not reported one.
+func (i *Inode) checksum() string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if i.DriveItem.File == nil {
+		return ""
+	}
+	return i.cache.Capabilities().Checksum(i.DriveItem.File.Hashes)
+}
+
+// rehash recomputes the hashes of the content of a file after it changed. Must
+// be called with the mutex held.
+func (i *Inode) rehash() {
+	hash, _, err := i.cache.hashContent(i.DriveItem.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  i.DriveItem.ID,
+			"err": err,
+		}).Error("Could not hash file content.")
+		return
+	}
+	i.DriveItem.File = &graph.File{Hashes: i.cache.Capabilities().HashesOf(hash)}
+}
@@ -0,0 +1,625 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ContentKeySize is the size of the key used to encrypt cached content
+// (AES-256).
+const ContentKeySize = 32
+
+// encryptedMagic starts every encrypted file of content, followed by its file
+// ID. Files with an older version of it can no longer be read.
+var encryptedMagic = []byte("\x00onedriver-enc2\x00")
+
+// olderEncryptedMagic is what all versions of encryptedMagic start with.
+var olderEncryptedMagic = []byte("\x00onedriver-enc")
+
+// contentHeaderSize is how much comes before the content of an encrypted file.
+const contentHeaderSize = 32
+
+// contentChunkSize is how much content is encrypted together. Each chunk is
+// stored as its nonce, then the encrypted content, then its tag.
+const contentChunkSize = 4096
+
+const (
+	chunkNonceSize = 12
+	chunkOverhead  = chunkNonceSize + 16
+	chunkSlotSize  = contentChunkSize + chunkOverhead
+)
+
+// errContentTampered is returned when encrypted content does not match its tag.
+var errContentTampered = errors.New("encrypted content was modified or is corrupted")
+
+// contentCipher encrypts the content of files in the cache (and the snapshots
+// of uploads) with AES-256-GCM, in chunks of contentChunkSize. Unlike the
+// sealer, this lets any part of a file be read or written without touching the
+// rest of it, which reading and downloading parts of files relies on. Every
+// chunk gets a new random nonce each time it is written, and is authenticated
+// along with the ID of its file and its position in it, so changes to a chunk
+// (or chunks moved around) are noticed when reading it. Holes and the length of
+// the content are not authenticated though: a chunk overwritten with zeroes
+// reads as zeroes, and content cut off at the end of a file is not noticed. A
+// nil contentCipher stores content as-is.
+type contentCipher struct {
+	aead cipher.AEAD
+}
+
+// newContentCipher creates a contentCipher from a key, or returns nil if key is
+// empty.
+func newContentCipher(key []byte) (*contentCipher, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	if len(key) != ContentKeySize {
+		return nil, errors.New("content key must be exactly 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &contentCipher{aead: aead}, nil
+}
+
+// chunkData is what a chunk is authenticated with besides its content: the ID of
+// its file and its index.
+func chunkData(fileID []byte, index uint64) []byte {
+	data := make([]byte, len(fileID)+8)
+	copy(data, fileID)
+	binary.BigEndian.PutUint64(data[len(fileID):], index)
+	return data
+}
+
+// seal encrypts the index-th chunk of a file.
+func (c *contentCipher) seal(fileID []byte, index uint64, plain []byte) ([]byte, error) {
+	nonce := make([]byte, chunkNonceSize)
+	// a nonce of zeroes marks a hole
+	for isZero(nonce) {
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+	}
+	return c.aead.Seal(nonce, nonce, plain, chunkData(fileID, index)), nil
+}
+
+// open decrypts the index-th chunk of a file. Chunks with a nonce of zeroes
+// were never written (they are holes in a sparse file, like the parts of a file
+// that were not downloaded yet), and read as zeroes without being
+// authenticated.
+func (c *contentCipher) open(fileID []byte, index uint64, slot []byte) ([]byte, error) {
+	if len(slot) <= chunkOverhead {
+		return nil, errContentTampered
+	}
+	nonce := slot[:chunkNonceSize]
+	if isZero(nonce) {
+		return make([]byte, len(slot)-chunkOverhead), nil
+	}
+	plain, err := c.aead.Open(nil, nonce, slot[chunkNonceSize:], chunkData(fileID, index))
+	if err != nil {
+		return nil, errContentTampered
+	}
+	return plain, nil
+}
+
+// openFile opens a file of content with os.OpenFile.
+func (c *contentCipher) openFile(path string, flag int) (*contentFile, error) {
+	file, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	f, err := c.wrap(file, writable)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.linked = writable && isLinked(file)
+	return f, nil
+}
+
+// wrap reads and writes the content in an open file through the cipher. Files
+// that are empty and writable are new, and get encrypted. Others stay the way
+// they were written, so that content cached before encryption was enabled is
+// still readable until encryptExisting gets to it.
+func (c *contentCipher) wrap(file *os.File, writable bool) (*contentFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &contentFile{file: file}
+	if info.Size() >= contentHeaderSize {
+		header := make([]byte, contentHeaderSize)
+		if _, err = file.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(header, encryptedMagic) {
+			if c == nil {
+				return nil, errors.New("content is encrypted, but no content key was provided")
+			}
+			f.cipher = c
+			f.fileID = header[len(encryptedMagic):]
+		} else if bytes.HasPrefix(header, olderEncryptedMagic) {
+			return nil, errors.New("content was encrypted by an older version of onedriver")
+		}
+	} else if info.Size() == 0 && writable && c != nil {
+		header := append(append([]byte{}, encryptedMagic...),
+			make([]byte, contentHeaderSize-len(encryptedMagic))...)
+		if _, err = io.ReadFull(rand.Reader, header[len(encryptedMagic):]); err != nil {
+			return nil, err
+		}
+		if _, err = file.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+		f.cipher = c
+		f.fileID = header[len(encryptedMagic):]
+	}
+	return f, nil
+}
+
+// contentFile is an open file of content, which is encrypted if it has a
+// cipher.
+type contentFile struct {
+	file   *os.File
+	cipher *contentCipher // nil if the content is stored as-is
+	fileID []byte         // random, authenticated along with every chunk
+	mutex  sync.RWMutex   // held while writing, which rewrites entire chunks
+
+	linked    bool         // the file has other links, see unshare
+	replaced  []*os.File   // replaced by unshare, closed along with the file
+	fileMutex sync.RWMutex // guards file, which unshare replaces
+}
+
+// current returns the open file.
+func (f *contentFile) current() *os.File {
+	f.fileMutex.RLock()
+	defer f.fileMutex.RUnlock()
+	return f.file
+}
+
+// Name returns the path of the file.
+func (f *contentFile) Name() string {
+	return f.current().Name()
+}
+
+// Close closes the file.
+func (f *contentFile) Close() error {
+	f.fileMutex.Lock()
+	defer f.fileMutex.Unlock()
+	for _, file := range f.replaced {
+		file.Close()
+	}
+	f.replaced = nil
+	return f.file.Close()
+}
+
+// Sync commits the content of the file to disk.
+func (f *contentFile) Sync() error {
+	return f.current().Sync()
+}
+
+// encryptedSize returns how large an encrypted file with size bytes of content
+// is on disk.
+func encryptedSize(size uint64) int64 {
+	stored := contentHeaderSize + size/contentChunkSize*chunkSlotSize
+	if rem := size % contentChunkSize; rem != 0 {
+		stored += rem + chunkOverhead
+	}
+	return int64(stored)
+}
+
+// Size returns the size of the content, without the header and the nonces and
+// tags of encrypted files.
+func (f *contentFile) Size() (uint64, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.size()
+}
+
+// size returns the size of the content like Size. Must be called with the mutex
+// held.
+func (f *contentFile) size() (uint64, error) {
+	info, err := f.current().Stat()
+	if err != nil {
+		return 0, err
+	}
+	if f.cipher == nil {
+		return uint64(info.Size()), nil
+	}
+	if info.Size() < contentHeaderSize {
+		return 0, errors.New("encrypted content is missing its header")
+	}
+	stored := uint64(info.Size()) - contentHeaderSize
+	size := stored / chunkSlotSize * contentChunkSize
+	if rem := stored % chunkSlotSize; rem != 0 {
+		if rem <= chunkOverhead {
+			return 0, errContentTampered
+		}
+		size += rem - chunkOverhead
+	}
+	return size, nil
+}
+
+// readChunk decrypts the index-th chunk of a file with size bytes of content.
+// Returns whether it is a hole too. Must be called with the mutex held, or a
+// chunk being rewritten could be read halfway.
+func (f *contentFile) readChunk(index uint64, size uint64) ([]byte, bool, error) {
+	length := size - index*contentChunkSize
+	if length > contentChunkSize {
+		length = contentChunkSize
+	}
+	slot := make([]byte, length+chunkOverhead)
+	if _, err := f.current().ReadAt(slot, int64(contentHeaderSize+index*chunkSlotSize)); err != nil {
+		if err == io.EOF {
+			err = errContentTampered
+		}
+		return nil, false, err
+	}
+	plain, err := f.cipher.open(f.fileID, index, slot)
+	return plain, err == nil && isZero(slot[:chunkNonceSize]), err
+}
+
+// writeChunk encrypts and writes the index-th chunk of a file. Must be called
+// with the mutex held.
+func (f *contentFile) writeChunk(index uint64, plain []byte) error {
+	slot, err := f.cipher.seal(f.fileID, index, plain)
+	if err != nil {
+		return err
+	}
+	_, err = f.current().WriteAt(slot, int64(contentHeaderSize+index*chunkSlotSize))
+	return err
+}
+
+// ReadAt reads content like io.ReaderAt.
+func (f *contentFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.cipher == nil {
+		return f.current().ReadAt(p, off)
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	offset := uint64(off)
+	if offset >= size {
+		return 0, io.EOF
+	}
+	end := offset + uint64(len(p))
+	if end > size {
+		end = size
+	}
+	copied := 0
+	for index := offset / contentChunkSize; index*contentChunkSize < end; index++ {
+		plain, _, err := f.readChunk(index, size)
+		if err != nil {
+			return copied, err
+		}
+		start := uint64(0)
+		if index == offset/contentChunkSize {
+			start = offset % contentChunkSize
+		}
+		copied += copy(p[copied:], plain[start:])
+	}
+	if copied < len(p) {
+		return copied, io.EOF
+	}
+	return copied, nil
+}
+
+// readFull reads into p like ReadAt, but anything past the end of the content
+// is left as it is.
+func (f *contentFile) readFull(p []byte, off uint64) error {
+	if _, err := f.ReadAt(p, int64(off)); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// growChunk makes the last chunk of a file with size bytes of content limit
+// bytes long (at most a full chunk), before the content grows past it. Its
+// nonce and tag would end up in the middle of its content otherwise. Holes stay
+// holes. Must be called with the mutex held.
+func (f *contentFile) growChunk(size uint64, limit uint64) error {
+	index := size / contentChunkSize
+	if size%contentChunkSize == 0 {
+		return nil
+	}
+	if max := (index + 1) * contentChunkSize; limit > max {
+		limit = max
+	}
+	plain, hole, err := f.readChunk(index, size)
+	if err != nil || hole {
+		return err
+	}
+	grown := make([]byte, limit-index*contentChunkSize)
+	copy(grown, plain)
+	return f.writeChunk(index, grown)
+}
+
+// WriteAt writes content like io.WriterAt.
+func (f *contentFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.unshare(); err != nil {
+		return 0, err
+	}
+	if f.cipher == nil || len(p) == 0 {
+		return f.current().WriteAt(p, off)
+	}
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	offset := uint64(off)
+	end := offset + uint64(len(p))
+	first := offset / contentChunkSize
+	if first > size/contentChunkSize {
+		// the chunks in between are holes, after a full last chunk
+		if err = f.growChunk(size, first*contentChunkSize); err != nil {
+			return 0, err
+		}
+	}
+	newSize := size
+	if end > newSize {
+		newSize = end
+	}
+	// whole chunks are rewritten, along with whatever is around the write
+	for index := first; index*contentChunkSize < end; index++ {
+		start := index * contentChunkSize
+		length := newSize - start
+		if length > contentChunkSize {
+			length = contentChunkSize
+		}
+		plain := make([]byte, length)
+		if start < size && (start < offset || start+length > end) {
+			existing, _, err := f.readChunk(index, size)
+			if err != nil {
+				return 0, err
+			}
+			copy(plain, existing)
+		}
+		from := uint64(0)
+		if start < offset {
+			from = offset - start
+		}
+		copy(plain[from:], p[start+from-offset:])
+		if err = f.writeChunk(index, plain); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Truncate changes the size of the content like os.File.Truncate. Content that
+// is added reads as zeroes, and is left as holes where possible.
+func (f *contentFile) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.unshare(); err != nil {
+		return err
+	}
+	if f.cipher == nil {
+		return f.current().Truncate(size)
+	}
+	current, err := f.size()
+	if err != nil {
+		return err
+	}
+	newSize := uint64(size)
+	if newSize > current {
+		if err = f.growChunk(current, newSize); err != nil {
+			return err
+		}
+		// if the last chunk was grown, this changes nothing
+		return f.current().Truncate(encryptedSize(newSize))
+	}
+	// a chunk cut short is rewritten, since its tag is at its end
+	index := newSize / contentChunkSize
+	var tail []byte
+	hole := true
+	if newSize%contentChunkSize != 0 {
+		if tail, hole, err = f.readChunk(index, current); err != nil {
+			return err
+		}
+	}
+	if err = f.current().Truncate(encryptedSize(newSize)); err != nil {
+		return err
+	}
+	if !hole {
+		return f.writeChunk(index, tail[:newSize%contentChunkSize])
+	}
+	return nil
+}
+
+// reader returns a reader for all of the content.
+func (f *contentFile) reader() (io.Reader, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(f, 0, int64(size)), nil
+}
+
+// readFrom writes everything in reader to the file, from the start. Blocks of
+// zeroes are skipped when skipZeroes is set, which keeps sparse content sparse
+// in a file that is empty to begin with.
+func (f *contentFile) readFrom(reader io.Reader, skipZeroes bool) (uint64, error) {
+	buffer := make([]byte, 1024*1024)
+	var offset uint64
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 && !(skipZeroes && isZero(buffer[:n])) {
+			if _, writeErr := f.WriteAt(buffer[:n], int64(offset)); writeErr != nil {
+				return offset, writeErr
+			}
+		}
+		offset += uint64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if skipZeroes {
+				// the size of the content, if it ended with zeroes
+				return offset, f.Truncate(int64(offset))
+			}
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+	}
+}
+
+// isZero returns whether a slice is all zeroes.
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// keyringPrefix selects a key in the kernel keyring instead of a key file.
+const keyringPrefix = "keyring:"
+
+// secretPrefix selects a key stored with libsecret instead of a key file.
+const secretPrefix = "secret:"
+
+// LoadContentKey reads the key used to encrypt cached content. source is either
+// the path of a key file, which is generated if it does not exist yet,
+// "keyring:" followed by the description of a "user" key in the kernel keyring
+// (added with "keyctl padd user <description> @u < keyfile", for instance), or
+// "secret:" followed by the name of a key stored with libsecret (the GNOME
+// keyring or KWallet) as base64.
+func LoadContentKey(source string) ([]byte, error) {
+	if strings.HasPrefix(source, secretPrefix) {
+		return loadSecretKey(strings.TrimPrefix(source, secretPrefix))
+	}
+	if !strings.HasPrefix(source, keyringPrefix) {
+		return loadKeyFile(source, ContentKeySize)
+	}
+	description := strings.TrimPrefix(source, keyringPrefix)
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", description, 0)
+	if err != nil {
+		id, err = unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	}
+	if err != nil {
+		return nil, errors.New("key \"" + description + "\" is not in the kernel keyring")
+	}
+	key := make([]byte, ContentKeySize+1) // one more, to notice keys that are too long
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != ContentKeySize {
+		return nil, errors.New("content key must be exactly 32 bytes")
+	}
+	return key[:n], nil
+}
+
+// loadSecretKey looks up a key stored with libsecret under the attribute
+// "onedriver" set to name, like one stored with
+// "base64 keyfile | secret-tool store --label=onedriver onedriver <name>".
+// libsecret is reached through secret-tool, rather than linking against it.
+func loadSecretKey(name string) ([]byte, error) {
+	out, err := exec.Command("secret-tool", "lookup", "onedriver", name).Output()
+	if err != nil {
+		return nil, errors.New("key \"" + name + "\" could not be looked up with secret-tool: " +
+			err.Error())
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, errors.New("key \"" + name + "\" is not stored as base64")
+	}
+	if len(key) != ContentKeySize {
+		return nil, errors.New("content key must be exactly 32 bytes")
+	}
+	return key, nil
+}
+
+// encryptExisting encrypts content (and upload snapshots) that was stored before
+// encryption was enabled.
+func (c *Cache) encryptExisting() {
+	if c.cipher == nil {
+		return
+	}
+	encrypted := 0
+	for _, dir := range []string{contentDir(c.db), uploadDir(c.db)} {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), downloadPrefix) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			done, err := c.encryptFile(path)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"path": path,
+					"err":  err,
+				}).Error("Could not encrypt cached content.")
+			} else if done {
+				encrypted++
+			}
+		}
+	}
+	if encrypted > 0 {
+		log.WithField("files", encrypted).Info("Encrypted cached content.")
+	}
+}
+
+// encryptFile replaces a file of content with an encrypted copy, unless it is
+// encrypted already. Returns whether it was replaced.
+func (c *Cache) encryptFile(path string) (bool, error) {
+	from, err := c.cipher.openFile(path, os.O_RDONLY)
+	if err != nil {
+		return false, err
+	}
+	defer from.Close()
+	if from.cipher != nil {
+		return false, nil
+	}
+	reader, err := from.reader()
+	if err != nil {
+		return false, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), downloadPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return false, err
+	}
+	to, err := c.cipher.wrap(file, true)
+	if err == nil {
+		// parts of files that were not downloaded yet are holes
+		_, err = to.readFrom(reader, true)
+	}
+	if err == nil {
+		err = to.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return false, err
+	}
+	return true, nil
+}
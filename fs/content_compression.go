@@ -0,0 +1,257 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Cached content is compressed (when Options.CompressContent is set) once its
+// file is closed with all of its content downloaded and nothing left to upload,
+// and decompressed again when the file is opened. Compressed content starts
+// with compressedMagic and the size of the content, followed by the zstd stream
+// of it. Files of content are encrypted after they are compressed, so the
+// magic is only visible once they are decrypted.
+var compressedMagic = []byte("\x00onedriver-zst1\x00")
+
+// compressedHeaderSize is how much comes before the zstd stream of compressed
+// content.
+const compressedHeaderSize = 24
+
+// minCompressSize is the size of the smallest content worth compressing. Less
+// than this takes up a block on disk either way.
+const minCompressSize = 4096
+
+// compressSample is how much of the content is compressed first, to skip
+// content that hardly compresses (like most photos and videos) early.
+const compressSample = 128 * 1024
+
+// compressedSize returns the size of the content of a file once decompressed,
+// if it is compressed.
+func (f *contentFile) compressedSize() (uint64, bool) {
+	header := make([]byte, compressedHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil || !bytes.HasPrefix(header, compressedMagic) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(header[len(compressedMagic):]), true
+}
+
+// contentReader reads all of the content of a file of content, decompressing
+// it if it is compressed.
+type contentReader struct {
+	io.Reader
+	file    *contentFile
+	decoder *zstd.Decoder // nil if the content is not compressed
+	size    uint64        // of the content once decompressed
+}
+
+// openReader opens a file of content for reading with a contentReader.
+func (c *Cache) openReader(path string) (*contentReader, error) {
+	file, err := c.cipher.openFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newContentReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// newContentReader creates a contentReader for an open file of content, which
+// it closes when it is closed.
+func newContentReader(file *contentFile) (*contentReader, error) {
+	stored, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	size, compressed := file.compressedSize()
+	if !compressed {
+		return &contentReader{
+			Reader: io.NewSectionReader(file, 0, int64(stored)),
+			file:   file,
+			size:   stored,
+		}, nil
+	}
+	decoder, err := zstd.NewReader(
+		io.NewSectionReader(file, compressedHeaderSize, int64(stored)-compressedHeaderSize),
+		zstd.WithDecoderConcurrency(1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &contentReader{Reader: decoder, file: file, decoder: decoder, size: size}, nil
+}
+
+// Close closes the file being read.
+func (r *contentReader) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	return r.file.Close()
+}
+
+// offsetWriter writes to a contentFile from an offset onwards.
+type offsetWriter struct {
+	file   *contentFile
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// compressContent replaces the cached content of a closed file with a
+// compressed copy, unless it is small or hardly compresses. The copy is thrown
+// away if the file was opened or its content replaced in the meantime.
+func (c *Cache) compressContent(i *Inode) {
+	i.mutex.RLock()
+	id := i.DriveItem.ID
+	i.mutex.RUnlock()
+	path := c.contentPath(id)
+	before, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	compressed, err := c.compressFile(path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  id,
+			"err": err,
+		}).Warn("Could not compress cached content.")
+		return
+	}
+	if compressed == "" {
+		return
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	after, err := os.Stat(path)
+	if err != nil || i.content != nil || i.hydration != nil || i.DriveItem.ID != id ||
+		after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		os.Remove(compressed)
+		return
+	}
+	if err = os.Rename(compressed, path); err != nil {
+		os.Remove(compressed)
+		return
+	}
+	// it was not used just now as far as eviction is concerned
+	os.Chtimes(path, before.ModTime(), before.ModTime())
+}
+
+// compressFile writes a compressed copy of a file of content next to it, and
+// returns its path, or "" if the content is not worth compressing (or is
+// compressed already).
+func (c *Cache) compressFile(path string) (string, error) {
+	from, err := c.cipher.openFile(path, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer from.Close()
+	if _, compressed := from.compressedSize(); compressed {
+		return "", nil
+	}
+	size, err := from.Size()
+	if err != nil || size < minCompressSize {
+		return "", err
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return "", err
+	}
+	sample := make([]byte, compressSample)
+	if size < compressSample {
+		sample = sample[:size]
+	}
+	if err = from.readFull(sample, 0); err != nil {
+		return "", err
+	}
+	if len(encoder.EncodeAll(sample, nil)) > len(sample)*9/10 {
+		return "", nil
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), downloadPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return "", err
+	}
+	to, err := c.cipher.wrap(file, true)
+	if err == nil {
+		header := make([]byte, compressedHeaderSize)
+		copy(header, compressedMagic)
+		binary.BigEndian.PutUint64(header[len(compressedMagic):], size)
+		_, err = to.WriteAt(header, 0)
+	}
+	if err == nil {
+		encoder.Reset(&offsetWriter{file: to, offset: compressedHeaderSize})
+		_, err = io.Copy(encoder, io.NewSectionReader(from, 0, int64(size)))
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	var stored uint64
+	if err == nil {
+		stored, err = to.Size()
+	}
+	if err == nil {
+		err = to.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || stored > size*9/10 {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// decompressContent replaces compressed content, opened for reading and
+// writing, with the decompressed content, and returns it opened the same way.
+// file is closed.
+func (c *Cache) decompressContent(file *contentFile) (*contentFile, error) {
+	path := file.Name()
+	reader, err := newContentReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	defer reader.Close()
+	temp, err := ioutil.TempFile(filepath.Dir(path), downloadPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return nil, err
+	}
+	to, err := c.cipher.wrap(temp, true)
+	var size uint64
+	if err == nil {
+		size, err = to.readFrom(reader, false)
+	}
+	if err == nil && size != reader.size {
+		err = errors.New("compressed content is corrupt")
+	}
+	if err == nil {
+		err = to.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	return c.cipher.openFile(path, os.O_RDWR)
+}
@@ -0,0 +1,722 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/jstaf/onedriver/logger"
+	log "github.com/sirupsen/logrus"
+)
+
+// Control exposes runtime management of a mounted filesystem over RPC. It is
+// served on a unix socket in the cache directory and used by onedriver's
+// subcommands (like "onedriver queue list").
+type Control struct {
+	mountpoint string
+	root       fs.InodeEmbedder // the root of the mounted filesystem
+	caches     []*Cache
+	events     *logger.RingBuffer // may be nil
+
+	copyMutex sync.Mutex
+	copies    map[int]*copyJob // started by "onedriver cp"
+	nextCopy  int
+}
+
+// ServeControl serves a Control for the given caches on a unix socket at path.
+// mountpoint (an absolute path) and root describe the mounted filesystem, and
+// events are the recent log entries available to "onedriver events", if any.
+func ServeControl(path string, mountpoint string, root fs.InodeEmbedder,
+	events *logger.RingBuffer, caches ...*Cache) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("another instance of onedriver is already using " + path)
+	}
+	os.Remove(path) // stale socket from a previous session
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Control", &Control{
+		mountpoint: mountpoint,
+		root:       root,
+		caches:     caches,
+		events:     events,
+		copies:     make(map[int]*copyJob),
+	}); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	log.WithField("path", path).Debug("Serving control socket.")
+	go server.Accept(listener)
+	return listener, nil
+}
+
+// resolvePath finds the Inode at an absolute path inside the mountpoint.
+func (c *Control) resolvePath(path string) (*Inode, error) {
+	rel, err := filepath.Rel(c.mountpoint, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("%s is not inside the mountpoint (%s)", path, c.mountpoint)
+	}
+	if rel == "." {
+		rel = ""
+	}
+	components := strings.Split(rel, "/")
+
+	// drives mounted with --all-drives are inside DriveDirs
+	node := c.root
+	for len(components) > 0 {
+		dir, ok := node.(*DriveDir)
+		if !ok {
+			break
+		}
+		if components[0] == "" {
+			return nil, fmt.Errorf("%s is not part of a drive", path)
+		}
+		if node, ok = dir.children[components[0]]; !ok {
+			return nil, fmt.Errorf("%s does not exist", path)
+		}
+		components = components[1:]
+	}
+	root, ok := node.(*Inode)
+	if !ok {
+		return nil, fmt.Errorf("%s is not part of a drive", path)
+	}
+	cache := root.GetCache()
+	return cache.GetPath("/"+strings.Join(components, "/"), cache.GetAuth())
+}
+
+// QueueArgs selects an upload by item ID or name.
+type QueueArgs struct {
+	Target string
+}
+
+// findUpload locates the upload manager responsible for an upload and the ID
+// of its session.
+func (c *Control) findUpload(target string) (*UploadManager, string, error) {
+	var found *UploadManager
+	var id string
+	for _, cache := range c.caches {
+		for _, status := range cache.uploads.List() {
+			if status.ID != target && status.Name != target {
+				continue
+			}
+			if found != nil {
+				return nil, "", fmt.Errorf(
+					"more than one upload matches \"%s\", use its ID instead", target)
+			}
+			found, id = cache.uploads, status.ID
+		}
+	}
+	if found == nil {
+		return nil, "", fmt.Errorf("no upload matches \"%s\"", target)
+	}
+	return found, id, nil
+}
+
+// QueueList lists all pending and failed uploads.
+func (c *Control) QueueList(args *QueueArgs, reply *[]UploadStatus) error {
+	*reply = make([]UploadStatus, 0)
+	for _, cache := range c.caches {
+		*reply = append(*reply, cache.uploads.List()...)
+	}
+	return nil
+}
+
+// QueueRetry restarts a failed upload.
+func (c *Control) QueueRetry(args *QueueArgs, reply *string) error {
+	uploads, id, err := c.findUpload(args.Target)
+	if err != nil {
+		return err
+	}
+	*reply = id
+	return uploads.Retry(id)
+}
+
+// QueueCancel cancels an upload.
+func (c *Control) QueueCancel(args *QueueArgs, reply *string) error {
+	uploads, id, err := c.findUpload(args.Target)
+	if err != nil {
+		return err
+	}
+	*reply = id
+	return uploads.Cancel(id)
+}
+
+// QueuePause pauses the uploads of every drive (see UploadManager.Pause).
+func (c *Control) QueuePause(args *QueueArgs, reply *string) error {
+	for _, cache := range c.caches {
+		cache.uploads.Pause()
+	}
+	*reply = "all uploads"
+	return nil
+}
+
+// QueueResume resumes the uploads of every drive.
+func (c *Control) QueueResume(args *QueueArgs, reply *string) error {
+	for _, cache := range c.caches {
+		cache.uploads.Resume()
+	}
+	*reply = "all uploads"
+	return nil
+}
+
+// QueuePrioritize moves an upload to the front of the queue.
+func (c *Control) QueuePrioritize(args *QueueArgs, reply *string) error {
+	uploads, id, err := c.findUpload(args.Target)
+	if err != nil {
+		return err
+	}
+	*reply = id
+	return uploads.Prioritize(id)
+}
+
+// PauseSync pauses all syncing of every drive (see Cache.PauseSync).
+func (c *Control) PauseSync(args *StatusArgs, reply *string) error {
+	for _, cache := range c.caches {
+		if args.Drive == "" || cache.drive.ID == args.Drive {
+			cache.PauseSync()
+		}
+	}
+	*reply = "sync paused"
+	return nil
+}
+
+// ResumeSync resumes the syncing of every drive (see Cache.ResumeSync).
+func (c *Control) ResumeSync(args *StatusArgs, reply *string) error {
+	for _, cache := range c.caches {
+		if args.Drive == "" || cache.drive.ID == args.Drive {
+			cache.ResumeSync()
+		}
+	}
+	*reply = "sync resumed"
+	return nil
+}
+
+// EventArgs are the arguments to Control.Events.
+type EventArgs struct {
+	Limit int // only return this many of the most recent entries, 0 for all
+}
+
+// Events returns the most recent log entries recorded in memory.
+func (c *Control) Events(args *EventArgs, reply *string) error {
+	if c.events == nil {
+		return errors.New("event recording is disabled (see --event-buffer)")
+	}
+	var buf bytes.Buffer
+	err := c.events.Dump(&buf, logger.LogrusFormatter(), args.Limit)
+	*reply = buf.String()
+	return err
+}
+
+// StatusArgs are the arguments to Control.Status.
+type StatusArgs struct {
+	Drive string // only report on the drive with this ID, "" for all drives
+}
+
+// DriveStatus is a snapshot of the sync state of a mounted drive.
+type DriveStatus struct {
+	Drive      string // the API path of the drive
+	Offline    bool
+	Delta      DeltaProgress
+	Uploads    int
+	Failed     int        // uploads that gave up, see RetryPolicy
+	Paused     bool       // whether uploads are paused
+	SyncPaused bool       // whether all syncing is paused, see Cache.PauseSync
+	Recent     []Activity // most recent first
+	Downloads  []Download // files being downloaded right now
+	Conflicts  []Conflict // files waiting for a version to be picked
+}
+
+// Download is the progress of a file that is being downloaded while it is read.
+type Download struct {
+	Path   string
+	Cached uint64 // bytes of the file downloaded so far
+	Size   uint64
+}
+
+// activeDownloads returns the progress of the files that are being downloaded.
+func (c *Cache) activeDownloads() []Download {
+	downloads := make([]Download, 0)
+	for _, id := range c.downloads.active() {
+		inode := c.GetID(id)
+		if inode == nil {
+			continue
+		}
+		cached, size, partial := inode.downloadProgress()
+		if !partial {
+			continue // finished in the meantime
+		}
+		downloads = append(downloads, Download{Path: inode.Path(), Cached: cached, Size: size})
+	}
+	return downloads
+}
+
+// status returns the current DriveStatus of each selected drive.
+func (c *Control) status(drive string) []DriveStatus {
+	statuses := make([]DriveStatus, 0, len(c.caches))
+	for _, cache := range c.caches {
+		if drive != "" && cache.drive.ID != drive {
+			continue
+		}
+		uploads := cache.uploads.List()
+		failed := 0
+		for _, upload := range uploads {
+			if upload.State == uploadStateNames[uploadFailed] {
+				failed++
+			}
+		}
+		statuses = append(statuses, DriveStatus{
+			Drive:      cache.drive.Path(),
+			Offline:    cache.IsOffline(),
+			Delta:      cache.DeltaProgress(),
+			Uploads:    len(uploads),
+			Failed:     failed,
+			Paused:     cache.uploads.Paused(),
+			SyncPaused: cache.SyncPaused(),
+			Recent:     cache.RecentActivity(),
+			Downloads:  cache.activeDownloads(),
+			Conflicts:  cache.Conflicts(),
+		})
+	}
+	return statuses
+}
+
+// Status reports the sync state of each mounted drive.
+func (c *Control) Status(args *StatusArgs, reply *[]DriveStatus) error {
+	*reply = c.status(args.Drive)
+	return nil
+}
+
+// WatchArgs are the arguments to Control.WatchStatus.
+type WatchArgs struct {
+	StatusArgs
+	Last    []DriveStatus // the last status the caller knows about
+	Timeout time.Duration // give up and return the current status after this long
+}
+
+// watchInterval is how often WatchStatus checks for changes.
+const watchInterval = 500 * time.Millisecond
+
+// WatchStatus waits until the sync state of any drive differs from args.Last
+// (or until args.Timeout), then reports it like Status. Status indicators call
+// this in a loop to be told about changes without polling themselves.
+func (c *Control) WatchStatus(args *WatchArgs, reply *[]DriveStatus) error {
+	// times lose their monotonic clock reading and location when sent over RPC,
+	// so statuses are compared by their JSON representation instead
+	last, _ := json.Marshal(args.Last)
+	deadline := time.Now().Add(args.Timeout)
+	for {
+		*reply = c.status(args.Drive)
+		current, _ := json.Marshal(*reply)
+		if !bytes.Equal(current, last) || !time.Now().Before(deadline) {
+			return nil
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// PathArgs selects an item by its absolute path.
+type PathArgs struct {
+	Path string
+}
+
+// DehydrateResult reports how much space was freed by Control.Dehydrate.
+type DehydrateResult struct {
+	Files int
+	Bytes uint64
+}
+
+// Dehydrate removes the cached content of everything under a path.
+func (c *Control) Dehydrate(args *PathArgs, reply *DehydrateResult) error {
+	inode, err := c.resolvePath(args.Path)
+	if err != nil {
+		return err
+	}
+	reply.Files, reply.Bytes, err = inode.GetCache().Dehydrate(inode)
+	return err
+}
+
+// ResyncArgs are the arguments to Control.Resync.
+type ResyncArgs struct {
+	Path    string // "" for the whole of every drive
+	Content bool   // also drop the cached content of every file
+}
+
+// Resync replaces the metadata of everything under a path with the server's
+// (see Cache.Resync).
+func (c *Control) Resync(args *ResyncArgs, reply *ResyncResult) error {
+	inodes := make([]*Inode, 0, len(c.caches))
+	if args.Path == "" {
+		for _, cache := range c.caches {
+			inodes = append(inodes, cache.GetID(cache.root))
+		}
+	} else {
+		inode, err := c.resolvePath(args.Path)
+		if err != nil {
+			return err
+		}
+		inodes = append(inodes, inode)
+	}
+
+	reply.Kept = make([]string, 0)
+	for _, inode := range inodes {
+		cache := inode.GetCache()
+		if cache.IsOffline() {
+			return errors.New("cannot resync while offline")
+		}
+		result, err := cache.Resync(inode, args.Content, cache.GetAuth())
+		reply.Refreshed += result.Refreshed
+		reply.Added += result.Added
+		reply.Removed += result.Removed
+		reply.Kept = append(reply.Kept, result.Kept...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyArgs are the arguments to Control.VerifyCache.
+type VerifyArgs struct {
+	Drive string // only verify the drive with this ID, "" for all drives
+}
+
+// VerifyCache checks the content cached for every drive against the server (see
+// Cache.VerifyCache).
+func (c *Control) VerifyCache(args *VerifyArgs, reply *[]Correction) error {
+	*reply = make([]Correction, 0)
+	for _, cache := range c.caches {
+		if args.Drive != "" && cache.drive.ID != args.Drive {
+			continue
+		}
+		if cache.IsOffline() {
+			return errors.New("cannot verify cached files while offline")
+		}
+		*reply = append(*reply, cache.VerifyCache(cache.GetAuth())...)
+	}
+	return nil
+}
+
+// VerifyPath compares the local content of everything under a path against the
+// server (see Cache.VerifyPath).
+func (c *Control) VerifyPath(args *PathArgs, reply *[]Mismatch) error {
+	inode, err := c.resolvePath(args.Path)
+	if err != nil {
+		return err
+	}
+	cache := inode.GetCache()
+	if cache.IsOffline() {
+		return errors.New("cannot verify files while offline")
+	}
+	*reply, err = cache.VerifyPath(inode, cache.GetAuth())
+	return err
+}
+
+// ResolveArgs are the arguments to Control.Resolve.
+type ResolveArgs struct {
+	ID   string // the ID of a Mismatch
+	Keep string // KeepLocal or KeepRemote
+}
+
+// Resolve settles a Mismatch found by VerifyPath (see Cache.Resolve).
+func (c *Control) Resolve(args *ResolveArgs, reply *string) error {
+	for _, cache := range c.caches {
+		inode := cache.GetID(args.ID)
+		if inode == nil {
+			continue
+		}
+		if cache.IsOffline() {
+			return errors.New("cannot resolve mismatches while offline")
+		}
+		*reply = inode.Path()
+		return cache.Resolve(inode, args.Keep, cache.GetAuth())
+	}
+	return fmt.Errorf("no item with ID \"%s\"", args.ID)
+}
+
+// Conflicts lists the files of every drive waiting for the user to pick a
+// version (see ConflictPrompt).
+func (c *Control) Conflicts(args *StatusArgs, reply *[]Conflict) error {
+	*reply = make([]Conflict, 0)
+	for _, cache := range c.caches {
+		*reply = append(*reply, cache.Conflicts()...)
+	}
+	return nil
+}
+
+// ResolveConflict settles a Conflict (see Cache.ResolveConflict). Keep may also
+// be KeepBoth.
+func (c *Control) ResolveConflict(args *ResolveArgs, reply *string) error {
+	for _, cache := range c.caches {
+		inode := cache.GetID(args.ID)
+		if inode == nil {
+			continue
+		}
+		if cache.IsOffline() {
+			return errors.New("cannot resolve conflicts while offline")
+		}
+		*reply = inode.Path()
+		return cache.ResolveConflict(args.ID, args.Keep, cache.GetAuth())
+	}
+	return fmt.Errorf("no item with ID \"%s\"", args.ID)
+}
+
+// Pending reports what has not been synced yet on each drive (see
+// Cache.Pending).
+func (c *Control) Pending(args *StatusArgs, reply *[]Pending) error {
+	*reply = make([]Pending, 0, len(c.caches))
+	for _, cache := range c.caches {
+		if args.Drive != "" && cache.drive.ID != args.Drive {
+			continue
+		}
+		pending, err := cache.Pending(cache.GetAuth())
+		if err != nil {
+			return err
+		}
+		*reply = append(*reply, pending)
+	}
+	return nil
+}
+
+// PrefetchMetadata adds the whole tree of each drive to the cache so that it
+// can be browsed offline (see Cache.PrefetchMetadata), replying with how many
+// items were added.
+func (c *Control) PrefetchMetadata(args *StatusArgs, reply *int) error {
+	for _, cache := range c.caches {
+		if args.Drive != "" && cache.drive.ID != args.Drive {
+			continue
+		}
+		if cache.IsOffline() {
+			return errors.New("cannot prefetch metadata while offline")
+		}
+		added, err := cache.PrefetchMetadata(cache.GetAuth())
+		*reply += added
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrashList lists the files in the local trash of every drive (see
+// Cache.Trash).
+func (c *Control) TrashList(args *StatusArgs, reply *[]TrashedFile) error {
+	*reply = make([]TrashedFile, 0)
+	for _, cache := range c.caches {
+		if args.Drive == "" || cache.drive.ID == args.Drive {
+			*reply = append(*reply, cache.Trash()...)
+		}
+	}
+	return nil
+}
+
+// TrashArgs selects a file in the local trash by its trash ID.
+type TrashArgs struct {
+	ID string
+}
+
+// TrashRestore puts a file from the local trash back where it was (see
+// Cache.RestoreTrash), replying with where it was restored to.
+func (c *Control) TrashRestore(args *TrashArgs, reply *string) error {
+	for _, cache := range c.caches {
+		for _, trashed := range cache.Trash() {
+			if trashed.ID == args.ID {
+				var err error
+				*reply, err = cache.RestoreTrash(trashed.ID, cache.GetAuth())
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("no file with ID \"%s\" in the local trash", args.ID)
+}
+
+// TrashEmpty deletes every file in the local trash of every drive, replying
+// with how many.
+func (c *Control) TrashEmpty(args *StatusArgs, reply *int) error {
+	for _, cache := range c.caches {
+		if args.Drive == "" || cache.drive.ID == args.Drive {
+			*reply += cache.EmptyTrash()
+		}
+	}
+	return nil
+}
+
+// AnalyzeArgs are the arguments to Control.Analyze.
+type AnalyzeArgs struct {
+	Months int // files not modified in this many months are considered stale
+	Limit  int // maximum number of entries in each list
+}
+
+// Analyze reports on how the space on each drive is used (see Cache.Analyze).
+func (c *Control) Analyze(args *AnalyzeArgs, reply *[]Analysis) error {
+	staleBefore := time.Now().AddDate(0, -args.Months, 0)
+	*reply = make([]Analysis, 0, len(c.caches))
+	for _, cache := range c.caches {
+		*reply = append(*reply, cache.Analyze(staleBefore, args.Limit))
+	}
+	return nil
+}
+
+// CacheStats reports on the content cache of each drive (see Cache.Stats).
+func (c *Control) CacheStats(args *StatusArgs, reply *[]CacheStats) error {
+	*reply = make([]CacheStats, 0, len(c.caches))
+	for _, cache := range c.caches {
+		if args.Drive == "" || cache.drive.ID == args.Drive {
+			*reply = append(*reply, cache.Stats())
+		}
+	}
+	return nil
+}
+
+// CopyArgs are the arguments to Control.StartCopy.
+type CopyArgs struct {
+	Source string // absolute path of the item to copy
+	Dest   string // absolute path of the copy, or of the folder to copy into
+}
+
+// CopyJobArgs select a copy started by Control.StartCopy.
+type CopyJobArgs struct {
+	ID     int
+	Cancel bool // stop waiting for the copy
+}
+
+// CopyProgress is the progress of a copy started by Control.StartCopy.
+type CopyProgress struct {
+	Dest    string
+	Status  string // as reported by the server
+	Percent float64
+	Done    bool
+	Error   string
+}
+
+type copyJob struct {
+	mutex    sync.Mutex
+	progress CopyProgress
+	cancel   context.CancelFunc
+}
+
+// StartCopy starts copying an item on the server and replies with an ID to
+// follow its progress with Control.CopyStatus.
+func (c *Control) StartCopy(args *CopyArgs, reply *int) error {
+	src, err := c.resolvePath(args.Source)
+	if err != nil {
+		return err
+	}
+	dest := args.Dest
+	name := filepath.Base(dest)
+	parent, err := c.resolvePath(dest)
+	if err == nil && parent.IsDir() {
+		name = src.Name()
+		dest = filepath.Join(dest, name)
+	} else if err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	} else if parent, err = c.resolvePath(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	cache := src.GetCache()
+	if parent.GetCache() != cache {
+		return errors.New("items can only be copied within the same drive")
+	}
+	if exists, _ := cache.GetChild(parent.ID(), name, cache.GetAuth()); exists != nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &copyJob{
+		progress: CopyProgress{Dest: dest, Status: "notStarted"},
+		cancel:   cancel,
+	}
+	c.copyMutex.Lock()
+	c.nextCopy++
+	*reply = c.nextCopy
+	c.copies[c.nextCopy] = job
+	c.copyMutex.Unlock()
+
+	go func() {
+		_, err := cache.Copy(ctx, src, parent, name, func(status graph.CopyStatus) {
+			job.mutex.Lock()
+			job.progress.Status = status.Status
+			job.progress.Percent = status.PercentageComplete
+			job.mutex.Unlock()
+		})
+		cancel()
+		job.mutex.Lock()
+		job.progress.Done = true
+		if err != nil {
+			job.progress.Error = err.Error()
+		} else {
+			job.progress.Status = "completed"
+			job.progress.Percent = 100
+		}
+		job.mutex.Unlock()
+	}()
+	return nil
+}
+
+// CopyStatus replies with the progress of a copy. A copy is forgotten once it
+// has been reported as done.
+func (c *Control) CopyStatus(args *CopyJobArgs, reply *CopyProgress) error {
+	c.copyMutex.Lock()
+	job, exists := c.copies[args.ID]
+	c.copyMutex.Unlock()
+	if !exists {
+		return fmt.Errorf("no copy with ID %d", args.ID)
+	}
+	if args.Cancel {
+		job.cancel()
+	}
+
+	job.mutex.Lock()
+	*reply = job.progress
+	job.mutex.Unlock()
+	if reply.Done {
+		c.copyMutex.Lock()
+		delete(c.copies, args.ID)
+		c.copyMutex.Unlock()
+	}
+	return nil
+}
+
+// LimitArgs are the arguments to Control.UploadLimit and Control.DownloadLimit.
+type LimitArgs struct {
+	Rate int64 // bytes per second, 0 for no limit, or -1 to leave it unchanged
+}
+
+// UploadLimit changes the upload limit (see graph.SetUploadLimit) and replies
+// with the limit in effect.
+func (c *Control) UploadLimit(args *LimitArgs, reply *uint64) error {
+	if args.Rate >= 0 {
+		graph.SetUploadLimit(uint64(args.Rate))
+		log.WithField("rate", args.Rate).Info("Changed upload limit.")
+	}
+	*reply = graph.UploadLimit()
+	return nil
+}
+
+// DownloadLimit changes the download limit (see graph.SetDownloadLimit) and
+// replies with the limit in effect.
+func (c *Control) DownloadLimit(args *LimitArgs, reply *uint64) error {
+	if args.Rate >= 0 {
+		graph.SetDownloadLimit(uint64(args.Rate))
+		log.WithField("rate", args.Rate).Info("Changed download limit.")
+	}
+	*reply = graph.DownloadLimit()
+	return nil
+}
@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"math"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// copyTimeout is how long we wait for the server to finish a copy.
+const copyTimeout = 30 * time.Minute
+
+// remoteCopy copies an item to parentID/name on the server, without the content
+// passing through this machine. Returns the new item once the copy is done.
+func (c *Cache) remoteCopy(ctx context.Context, id string, parentID string, name string,
+	progress func(graph.CopyStatus)) (*graph.DriveItem, error) {
+	if isLocalID(id) || isLocalID(parentID) {
+		return nil, errors.New("items must be uploaded before they can be copied")
+	}
+	ctx, cancel := context.WithTimeout(ctx, copyTimeout)
+	defer cancel()
+
+	auth := c.GetAuth()
+	drive := c.Drive()
+	monitor, err := drive.Copy(id, name, parentID, auth)
+	if err != nil {
+		return nil, err
+	}
+	newID, err := graph.WaitCopy(ctx, monitor, func(status graph.CopyStatus) {
+		log.WithFields(log.Fields{
+			"id":       id,
+			"name":     name,
+			"status":   status.Status,
+			"progress": status.PercentageComplete,
+		}).Debug("Copy in progress.")
+		if progress != nil {
+			progress(status)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return drive.GetItem(newID, auth)
+}
+
+// Copy copies an item (and everything in it, if it is a folder) to a new name
+// under parent. The copy is made by the server, so nothing is downloaded or
+// uploaded. progress, if not nil, is called as the server reports progress.
+// Cancelling ctx stops waiting for the copy, but the server may still finish
+// it.
+func (c *Cache) Copy(ctx context.Context, inode *Inode, parent *Inode, name string,
+	progress func(graph.CopyStatus)) (*Inode, error) {
+	id := inode.ID()
+	item, err := c.remoteCopy(ctx, id, parent.ID(), name, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server replaced anything that was in the way
+	if existing, _ := c.GetChild(parent.ID(), name, nil); existing != nil {
+		c.uploads.CancelUpload(existing.ID())
+		c.DeleteID(existing.ID())
+		c.DeleteContent(existing.ID())
+	}
+	copied := NewInodeDriveItem(item)
+	c.setLocalAttrs(copied.ID(), c.getLocalAttrs(id))
+	c.InsertChild(parent.ID(), copied)
+	if !copied.IsDir() && c.hasContent(id) {
+		// saves downloading the copy again
+		c.copyContent(id, copied.ID())
+	}
+	c.activity.add("copied", name)
+	return copied, nil
+}
+
+// CopyFileRange copies the content of one file to another. When an entire file
+// that is already on the server is copied into a new, empty file, the copy is
+// made by the server instead of downloading and re-uploading the content. Any
+// other copy is refused, in which case the kernel or the calling program falls
+// back to reading and writing.
+func (i *Inode) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64,
+	out *fs.Inode, fhOut fs.FileHandle, offOut uint64, length uint64,
+	flags uint64) (uint32, syscall.Errno) {
+	dst, ok := out.Operations().(*Inode)
+	cache := i.GetCache()
+	if !ok || dst.GetCache() != cache || cache.IsOffline() {
+		return 0, syscall.EOPNOTSUPP
+	}
+	id := i.ID()
+	size := i.Size()
+	dstID := dst.ID()
+	if offIn != 0 || offOut != 0 || size == 0 || length < size || size > math.MaxUint32 ||
+		isLocalID(id) || i.HasChanges() || !isLocalID(dstID) || dst.Size() != 0 ||
+		dst.IsDir() {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	log.WithFields(log.Fields{
+		"id":   id,
+		"path": i.Path(),
+		"dest": dst.Path(),
+	}).Info("Copying file on the server.")
+	item, err := cache.remoteCopy(ctx, id, dst.ParentID(), dst.Name(), nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"dest": dst.Path(),
+			"err":  err,
+		}).Error("Server-side copy failed.")
+		if errors.Is(err, context.Canceled) {
+			return 0, syscall.EINTR
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			return 0, syscall.ETIMEDOUT
+		}
+		return 0, syscall.EREMOTEIO
+	}
+
+	// the destination becomes the new item, and is not uploaded by us
+	if err = cache.MoveID(dstID, item.ID); err != nil {
+		return 0, syscall.EIO
+	}
+	dst.mutex.Lock()
+	dst.DriveItem.Size = item.Size
+	dst.DriveItem.ModTime = item.ModTime
+	dst.DriveItem.ETag = item.ETag
+	dst.DriveItem.CTag = item.CTag
+	dst.DriveItem.File = item.File
+	dst.DriveItem.Parent = item.Parent
+	dst.closeContent() // read from the cache or server the next time it is used
+	dst.hasChanges = false
+	dst.mutex.Unlock()
+	cache.DeleteContent(item.ID)
+	if cache.hasContent(id) {
+		cache.copyContent(id, item.ID)
+	}
+	return uint32(size), 0
+}
+
+// Link emulates creating a hard link by copying the target on the server, if
+// enabled with Options.EmulateHardLinks. The result is an independent copy:
+// changes to one file do not show up in the other.
+func (i *Inode) Link(ctx context.Context, target fs.InodeEmbedder, name string,
+	out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	cache := i.GetCache()
+	if !cache.opts.EmulateHardLinks {
+		return nil, syscall.ENOTSUP
+	}
+	src, ok := target.(*Inode)
+	if !ok || src.GetCache() != cache {
+		return nil, syscall.EXDEV
+	}
+	if src.IsDir() || cache.isExcluded(i, name, false) {
+		return nil, syscall.EPERM
+	}
+	if cache.IsOffline() {
+		return nil, syscall.EROFS
+	}
+	if child, _ := cache.GetChild(i.ID(), name, cache.GetAuth()); child != nil {
+		return nil, syscall.EEXIST
+	}
+
+	// the server can only copy what it has
+	if src.HasChanges() {
+		if errno := src.upload(); errno != 0 {
+			return nil, errno
+		}
+	}
+	if err := cache.uploads.WaitUpload(src.ID()); err != nil || isLocalID(src.ID()) {
+		log.WithFields(log.Fields{
+			"id":   src.ID(),
+			"path": src.Path(),
+			"err":  err,
+		}).Error("Could not upload link target before copying it.")
+		return nil, syscall.EREMOTEIO
+	}
+
+	log.WithFields(log.Fields{
+		"id":   src.ID(),
+		"path": src.Path(),
+		"name": name,
+	}).Info("Emulating hard link with a copy.")
+	copied, err := cache.Copy(ctx, src, i, name, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   src.ID(),
+			"name": name,
+			"err":  err,
+		}).Error("Could not copy link target.")
+		return nil, syscall.EREMOTEIO
+	}
+	return i.NewInode(ctx, copied, fs.StableAttr{
+		Mode: fuse.S_IFREG,
+		Ino:  cache.Ino(copied.ID()),
+	}), 0
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// subtree returns an inode and all of its cached descendants. Directories whose
+// children were never fetched are not listed from the server, since nothing
+// inside them can be cached.
+func (c *Cache) subtree(inode *Inode) []*Inode {
+	inodes := []*Inode{inode}
+	inode.mutex.RLock()
+	children := append([]string{}, inode.children...)
+	inode.mutex.RUnlock()
+	for _, id := range children {
+		if child := c.GetID(id); child != nil {
+			inodes = append(inodes, c.subtree(child)...)
+		}
+	}
+	return inodes
+}
+
+// Dehydrate frees up space by removing the cached content of every file under
+// inode (or inode itself, if it is a file). Metadata is kept, so the files
+// remain visible and are downloaded again the next time they are opened.
+// Nothing is removed if any of the files have changes that have not been
+// uploaded yet. Returns how many files were dehydrated and their total size.
+func (c *Cache) Dehydrate(inode *Inode) (int, uint64, error) {
+	pending := make(map[string]bool)
+	for _, upload := range c.uploads.List() {
+		pending[upload.ID] = true
+	}
+
+	files := make([]*Inode, 0)
+	dirty := make([]string, 0)
+	for _, child := range c.subtree(inode) {
+		if child.IsDir() {
+			continue
+		}
+		id := child.ID()
+		if isLocalID(id) || child.HasChanges() || pending[id] {
+			dirty = append(dirty, child.Path())
+			continue
+		}
+		files = append(files, child)
+	}
+	if len(dirty) > 0 {
+		return 0, 0, fmt.Errorf("%d files have not been uploaded yet, not "+
+			"removing anything:\n%s", len(dirty), strings.Join(dirty, "\n"))
+	}
+
+	count := 0
+	var size uint64
+	for _, file := range files {
+		id := file.ID()
+		file.mutex.Lock()
+		if file.hasChanges { // modified since we checked
+			file.mutex.Unlock()
+			continue
+		}
+		hadContent := file.content != nil
+		file.closeContent() // reopened from the server by Read/Write if in use
+		file.mutex.Unlock()
+
+		if hadContent || c.hasContent(id) {
+			c.DeleteContent(id)
+			count++
+			size += file.Size()
+		}
+	}
+	log.WithFields(log.Fields{
+		"path":  inode.Path(),
+		"files": count,
+		"size":  size,
+	}).Info("Dehydrated files.")
+	return count, size, nil
+}
@@ -7,58 +7,110 @@ import (
 	"strings"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/jstaf/onedriver/fs/graph"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
 
+// deltaPageBuffer is how many delta pages may be fetched ahead of the ones
+// currently being applied.
+const deltaPageBuffer = 4
+
+// DeltaProgress describes the progress of the current (or last) delta fetch.
+// The server does not report how many changes are pending, so catching up
+// after a long time offline can only be measured in pages and items so far.
+type DeltaProgress struct {
+	Running  bool
+	Pages    int
+	Items    int
+	Started  time.Time
+	Finished time.Time
+}
+
+// DeltaProgress returns the progress of the current (or last) delta fetch.
+func (c *Cache) DeltaProgress() DeltaProgress {
+	c.RLock()
+	defer c.RUnlock()
+	return c.progress
+}
+
 // DeltaLoop creates a new thread to poll the server for changes and should be
 // called as a goroutine
 func (c *Cache) DeltaLoop(interval time.Duration) {
 	log.Trace("Starting delta goroutine.")
 	for { // eva
+		c.syncPause.wait(context.Background())
+
+		// changes made offline go first, so that the deltas include them
+		if c.replayJournal(c.GetAuth()) {
+			// files saved in folders that were just created can be uploaded now
+			go c.UploadDirty()
+		}
+
 		// get deltas
 		log.Debug("Fetching deltas from server.")
-		pollSuccess := false
-		deltas := make(map[string]*Inode)
-		for {
-			incoming, cont, err := c.pollDeltas(c.GetAuth())
-			if err != nil {
-				// the only thing that should be able to bring the FS out
-				// of a read-only state is a successful delta call
-				log.WithField("err", err).Error(
-					"Error during delta fetch, marking fs as offline.",
-				)
-				c.Lock()
-				c.offline = true
-				c.Unlock()
-				break
-			}
+		c.Lock()
+		c.progress = DeltaProgress{Running: true, Started: time.Now()}
+		c.Unlock()
 
-			for _, delta := range incoming {
-				// As per the API docs, the last delta received from the server
-				// for an item is the one we should use.
-				deltas[delta.ID()] = delta
-			}
-			if !cont {
-				log.Infof("Fetched %d deltas.", len(deltas))
-				pollSuccess = true
-				break
-			}
-		}
+		// Pages are fetched in the background while earlier pages are applied,
+		// so that a long catch-up makes each part of the tree visible as soon as
+		// it has been processed. Pages must still be applied in order, since
+		// the last delta received for an item is the one we should use.
+		pages := make(chan []*Inode, deltaPageBuffer)
+		result := make(chan error, 1)
+		go c.fetchDeltas(c.GetAuth(), pages, result)
 
-		// now apply deltas
-		secondPass := make([]string, 0)
-		for _, delta := range deltas {
-			err := c.applyDelta(delta)
-			// retry deletion of non-empty directories after all other deltas applied
-			if err != nil && err.Error() == "directory is non-empty" {
-				secondPass = append(secondPass, delta.ID())
+		secondPass := make(map[string]*Inode)
+		for page := range pages {
+			for _, delta := range page {
+				err := c.applyDelta(delta)
+				// retry deletion of non-empty directories after all other deltas applied
+				if err != nil && err.Error() == "directory is non-empty" {
+					secondPass[delta.ID()] = delta
+				} else {
+					delete(secondPass, delta.ID())
+				}
 			}
+			c.Lock()
+			c.progress.Pages++
+			c.progress.Items += len(page)
+			c.Unlock()
 		}
-		for _, id := range secondPass {
+		for _, delta := range secondPass {
 			// failures should explicitly be ignored the second time around as per docs
-			c.applyDelta(deltas[id])
+			c.applyDelta(delta)
+		}
+
+		pollSuccess := true
+		if err := <-result; errors.Is(err, graph.ErrDeltaExpired) {
+			// too long since the last session, whatever changed since then
+			// is fetched from the server again as it is used
+			log.WithField("err", err).Warn("The server no longer has the changes " +
+				"since the last sync, only tracking changes from now on.")
+			c.deltaLink = c.deltaStart
+			time.Sleep(2 * time.Second)
+			continue
+		} else if err != nil {
+			// the only thing that should be able to bring the FS out
+			// of a read-only state is a successful delta call
+			log.WithField("err", err).Error(
+				"Error during delta fetch, marking fs as offline.",
+			)
+			c.Lock()
+			c.offline = true
+			c.Unlock()
+			pollSuccess = false
+		}
+
+		c.Lock()
+		c.progress.Running = false
+		c.progress.Finished = time.Now()
+		progress := c.progress
+		c.Unlock()
+		if pollSuccess {
+			log.Infof("Fetched %d deltas.", progress.Items)
 		}
 
 		if !c.IsOffline() {
@@ -67,18 +119,31 @@ func (c *Cache) DeltaLoop(interval time.Duration) {
 
 		if pollSuccess {
 			c.Lock()
+			wasOffline := c.offline
 			if c.offline {
 				log.Info("Delta fetch success, marking fs as online.")
 			}
 			c.offline = false
 			c.Unlock()
+			if wasOffline {
+				// files saved while offline
+				go c.UploadDirty()
+			}
 
 			c.db.Update(func(tx *bolt.Tx) error {
-				return tx.Bucket(bucketDelta).Put([]byte("deltaLink"), []byte(c.deltaLink))
+				b := tx.Bucket(bucketDelta)
+				if err := b.Put([]byte("deltaStart"), []byte(c.deltaStart)); err != nil {
+					return err
+				}
+				return b.Put([]byte("deltaLink"), []byte(c.deltaLink))
 			})
 
-			// wait until next interval
-			time.Sleep(interval)
+			// wait until next interval, or until the server says something changed
+			select {
+			case <-time.After(interval):
+			case <-c.changed:
+				log.Debug("Server reported changes, fetching deltas early.")
+			}
 		} else {
 			// shortened duration while offline
 			time.Sleep(2 * time.Second)
@@ -86,6 +151,44 @@ func (c *Cache) DeltaLoop(interval time.Duration) {
 	}
 }
 
+// resumeDelta returns the delta link saved by the last session, so that what
+// changed on the server while onedriver was not running is applied instead of
+// left stale, or deltaStart (which only tracks changes from now on) if there is
+// none, or it covers another part of the drive.
+func (c *Cache) resumeDelta() string {
+	link := c.deltaStart
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDelta)
+		if saved := b.Get([]byte("deltaLink")); saved != nil &&
+			string(b.Get([]byte("deltaStart"))) == c.deltaStart {
+			link = string(saved)
+		}
+		return nil
+	})
+	if link != c.deltaStart {
+		log.Info("Resuming sync from where the last session left off.")
+	}
+	return link
+}
+
+// fetchDeltas sends each page of deltas to pages until there are no more, then
+// closes pages and reports whether fetching succeeded on result.
+func (c *Cache) fetchDeltas(auth *graph.Auth, pages chan<- []*Inode, result chan<- error) {
+	defer close(pages)
+	for {
+		incoming, cont, err := c.pollDeltas(auth)
+		if err != nil {
+			result <- err
+			return
+		}
+		pages <- incoming
+		if !cont {
+			result <- nil
+			return
+		}
+	}
+}
+
 type deltaResponse struct {
 	NextLink  string   `json:"@odata.nextLink,omitempty"`
 	DeltaLink string   `json:"@odata.deltaLink,omitempty"`
@@ -132,9 +235,34 @@ func (c *Cache) applyDelta(delta *Inode) error {
 
 	// diagnose and act on what type of delta we're dealing with
 
+	local := c.GetID(id)
+
+	// was it deleted? checked first, since deletions do not always say where
+	// the item was
+	if delta.Deleted != nil {
+		return c.applyDeletion(id, local)
+	}
+
 	// do we have it at all?
 	parentID := delta.ParentID()
-	if parent := c.GetID(parentID); parent == nil {
+	parent := c.GetID(parentID)
+	if parent == nil && local != nil && local.ParentID() != parentID &&
+		!c.changedLocally(local) {
+		// moved to a folder that was never listed, where it turns up (with
+		// its cached content, which is kept by ID) once the folder is listed
+		log.WithFields(log.Fields{
+			"id":       id,
+			"parentID": parentID,
+			"name":     name,
+			"delta":    "rename",
+		}).Info("Item was moved to a folder that is not in the cache, removing it from its old one.")
+		notifyRemoved(local)
+		c.DeleteID(id)
+		c.forgetMetadata(id)
+		c.activity.add("renamed", name)
+		return nil
+	}
+	if parent == nil {
 		// Nothing needs to be applied, item not in cache, so latest copy will
 		// be pulled down next time it's accessed.
 		log.WithFields(log.Fields{
@@ -146,32 +274,30 @@ func (c *Cache) applyDelta(delta *Inode) error {
 		return nil
 	}
 
-	local := c.GetID(id)
+	excluded := c.isExcluded(parent, name, delta.IsDir())
 
-	// was it deleted?
-	if delta.Deleted != nil {
-		if delta.IsDir() && local != nil && local.HasChildren() {
-			// from docs: you should only delete a folder locally if it is empty
-			// after syncing all the changes.
+	// does the item exist locally? if not, add the delta to the cache under the
+	// appropriate parent
+	if local == nil {
+		if excluded {
 			log.WithFields(log.Fields{
 				"id":    id,
 				"name":  name,
-				"delta": "delete",
-			}).Warn("Refusing delta deletion of non-empty folder as per API docs.")
-			return errors.New("directory is non-empty")
+				"delta": "skip",
+			}).Trace("Skipping delta, item is excluded.")
+			return nil
+		}
+		if sibling, _ := c.GetChild(parentID, name, nil); sibling != nil && isLocalID(sibling.ID()) {
+			// most likely a new file we just uploaded, which takes on this ID
+			// once the upload loop notices
+			log.WithFields(log.Fields{
+				"id":      id,
+				"localID": sibling.ID(),
+				"name":    name,
+				"delta":   "skip",
+			}).Debug("Skipping delta, a new local file with the same name is being uploaded.")
+			return nil
 		}
-		log.WithFields(log.Fields{
-			"id":    id,
-			"name":  name,
-			"delta": "delete",
-		}).Info("Applying server-side deletion of item.")
-		c.DeleteID(id)
-		return nil
-	}
-
-	// does the item exist locally? if not, add the delta to the cache under the
-	// appropriate parent
-	if local == nil {
 		log.WithFields(log.Fields{
 			"id":       id,
 			"parentID": parentID,
@@ -179,11 +305,25 @@ func (c *Cache) applyDelta(delta *Inode) error {
 			"delta":    "create",
 		}).Info("Creating inode from delta.")
 		c.InsertChild(parentID, delta)
+		c.activity.add("created", name)
+		c.notifyAdded(parentID, name)
 		return nil
 	}
 
 	// was the item moved?
-	if local.ParentID() != parentID || local.Name() != name {
+	moved := local.ParentID() != parentID || local.Name() != name
+	if moved && excluded && !c.changedLocally(local) {
+		// local changes are kept (and uploaded) where they are instead
+		log.WithFields(log.Fields{
+			"id":      id,
+			"name":    local.Name(),
+			"newName": name,
+			"delta":   "delete",
+		}).Info("Item was moved somewhere excluded, removing it from the cache.")
+		c.deleteLocal(local)
+		return nil
+	}
+	if moved {
 		log.WithFields(log.Fields{
 			"parent":    local.ParentID(),
 			"name":      local.Name(),
@@ -192,23 +332,17 @@ func (c *Cache) applyDelta(delta *Inode) error {
 			"id":        id,
 			"delta":     "rename",
 		}).Info("Applying server-side rename")
-		parent := c.GetID(local.ParentID())
-		newParent := c.GetID(parentID)
-		if parent == nil || newParent == nil {
-			log.WithFields(log.Fields{
-				"parent":    local.ParentID(),
-				"name":      local.Name(),
-				"newParent": parentID,
-				"newName":   name,
-				"id":        id,
-				"delta":     "rename",
-			}).Error("Either original parent or new parent not found in cache!")
-			return errors.New("parent not in cache")
-		}
-		parent.Rename(context.Background(), local.Name(), newParent, name, 0)
+		c.moveLocal(local, parentID, name)
+		c.activity.add("renamed", name)
 		// do not return, there may be additional changes
 	}
 
+	// descriptions are only ever edited through the web UI or by setting an
+	// xattr (which updates the server first), so the remote copy always wins
+	local.mutex.Lock()
+	local.DriveItem.Description = delta.DriveItem.Description
+	local.mutex.Unlock()
+
 	// Finally, check if the content/metadata of the remote has changed.
 	// "Interesting" changes must be synced back to our local state without
 	// data loss or corruption. Currently the only thing the local filesystem
@@ -222,31 +356,38 @@ func (c *Cache) applyDelta(delta *Inode) error {
 		sameContent := false
 		if !delta.IsDir() && delta.File != nil {
 			local.mutex.RLock()
-			if delta.DriveItem.Parent.DriveType == graph.DriveTypePersonal {
-				sameContent = local.VerifyChecksum(delta.File.Hashes.SHA1Hash)
-			} else {
-				sameContent = local.VerifyChecksum(delta.File.Hashes.QuickXorHash)
-			}
+			sameContent = local.VerifyChecksum(c.Capabilities().Checksum(delta.File.Hashes))
 			local.mutex.RUnlock()
 		}
+		if sameContent {
+			// the content has not changed since it was last synced after all
+			local.mutex.Lock()
+			local.DriveItem.CTag = delta.DriveItem.CTag
+			local.mutex.Unlock()
+		}
 
-		if !sameContent {
-			//TODO check if local has changes and rename the server copy if so
+		if !sameContent && !delta.IsDir() && local.holdRemoteChange(&delta.DriveItem) {
+			// whoever has it open keeps reading the version they opened
 			log.WithFields(log.Fields{
 				"id":    id,
 				"name":  name,
-				"delta": "overwrite",
-			}).Info("Overwriting local item, no local changes to preserve.")
-			// update modtime, hashes, purge any local content in memory
-			local.mutex.Lock()
-			defer local.mutex.Unlock()
-			local.DriveItem.ModTime = delta.DriveItem.ModTime
-			local.DriveItem.Size = delta.DriveItem.Size
-			// the rest of these are harmless when this is a directory
-			// as they will be null anyways
-			local.DriveItem.File = delta.DriveItem.File
-			local.hasChanges = false
-			local.data = nil
+				"delta": "hold",
+			}).Info("File changed on the server while open, applying the change once it is closed.")
+			return nil
+		}
+		if !sameContent && !delta.IsDir() && c.hasLocalChanges(local) &&
+			c.opts.ConflictStrategy != ConflictRemoteWins {
+			// local still has the old cTag, so the upload of its changes is
+			// refused and the conflict is settled then (see uploadConflict)
+			log.WithFields(log.Fields{
+				"id":    id,
+				"name":  name,
+				"delta": "skip",
+			}).Info("Not overwriting local item, its local changes have not been uploaded yet.")
+			return nil
+		}
+		if !sameContent {
+			c.overwriteLocal(local, &delta.DriveItem)
 			return nil
 		}
 	}
@@ -258,3 +399,244 @@ func (c *Cache) applyDelta(delta *Inode) error {
 	}).Trace("Skipping, no changes relative to local state.")
 	return nil
 }
+
+// moveLocal moves an item that was moved (or renamed) on the server to where it
+// is now in the cache, without touching the server. It keeps its ID, and with
+// it its cached content and everything in it, however much of it there is.
+func (c *Cache) moveLocal(local *Inode, newParentID string, newName string) {
+	id := local.ID()
+	notifyRemoved(local)
+	c.DeleteID(id)
+	local.SetName(newName)
+	c.InsertChild(newParentID, local)
+	// the upload of the item (if any) carries on where the item is now
+	c.uploads.MoveUpload(id, newName, newParentID)
+	c.notifyAdded(newParentID, newName)
+}
+
+// overwriteLocal replaces the metadata of a local item with the server's, and
+// drops its cached content (which is downloaded again the next time the file is
+// opened). Local changes that were not uploaded are thrown away.
+func (c *Cache) overwriteLocal(local *Inode, remote *graph.DriveItem) {
+	id := local.ID()
+	name := local.Name()
+	if !local.IsDir() && c.hasLocalChanges(local) {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"name":  name,
+			"delta": "overwrite",
+		}).Warn("File was changed both locally and on the server, " +
+			"discarding local changes (see --conflict-strategy).")
+		c.uploads.CancelUpload(id)
+		c.clearDirty(id)
+		c.removeConflict(id)
+	} else {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"name":  name,
+			"delta": "overwrite",
+		}).Info("Overwriting local item, no local changes to preserve.")
+	}
+	c.activity.add("modified", name)
+	// update modtime, hashes, purge any local content in memory
+	local.mutex.Lock()
+	local.DriveItem.ModTime = remote.ModTime
+	local.DriveItem.Size = remote.Size
+	// the rest of these are harmless when this is a directory
+	// as they will be null anyways
+	local.DriveItem.File = remote.File
+	local.DriveItem.CTag = remote.CTag
+	local.hasChanges = false
+	local.closeContent()
+	local.mutex.Unlock()
+	notifyModified(local)
+}
+
+// Files that are open keep the content they were opened with until they are
+// closed everywhere, instead of it changing under whoever is reading it when it
+// changes on the server. Parts of a partly downloaded file that were not
+// downloaded yet are no longer available then, reading them fails with ESTALE.
+// If the file is written to while it is open, the upload of those changes is
+// refused by the server, and the conflict is settled like any other (see
+// Options.ConflictStrategy).
+
+// errStaleContent is returned when reading part of a file that was not
+// downloaded before the file changed on the server.
+var errStaleContent = errors.New("the file changed on the server since it was opened")
+
+// holdRemoteChange keeps a change to the content of a file from the server to
+// apply once the file is closed, if it is open. Returns false if it is not.
+func (i *Inode) holdRemoteChange(remote *graph.DriveItem) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.opens == 0 {
+		return false
+	}
+	held := *remote
+	i.remoteChange = &held
+	return true
+}
+
+// applyHeldChange applies a change to the content of a file from the server
+// that was held back while the file was open.
+func (c *Cache) applyHeldChange(inode *Inode, remote *graph.DriveItem) {
+	if c.hasLocalChanges(inode) && c.opts.ConflictStrategy != ConflictRemoteWins {
+		log.WithFields(log.Fields{
+			"id":   inode.ID(),
+			"name": inode.Name(),
+		}).Info("File changed on the server was written to while open, " +
+			"its changes conflict with the server's.")
+		return
+	}
+	c.overwriteLocal(inode, remote)
+}
+
+// applyDeletion removes an item deleted on the server from the cache right away,
+// along with everything in it: its metadata (also on disk), cached content, and
+// whatever the kernel knows of it. Deletions are applied wherever the item is,
+// even if its parent was never listed or the deletion does not say where it
+// was. Local changes that have not been uploaded are not thrown away, unless
+// the server's version should win (see ConflictRemoteWins).
+func (c *Cache) applyDeletion(id string, local *Inode) error {
+	if local == nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"delta": "skip",
+		}).Trace("Skipping deletion, item not in cache.")
+		return nil
+	}
+	name := local.Name()
+	remoteWins := c.opts.ConflictStrategy == ConflictRemoteWins
+	if local.IsDir() && !remoteWins {
+		if changed := c.changedDescendant(local); changed != nil {
+			// from docs: you should only delete a folder locally if it is
+			// empty after syncing all the changes.
+			log.WithFields(log.Fields{
+				"id":      id,
+				"name":    name,
+				"changed": changed.Name(),
+				"delta":   "delete",
+			}).Warn("Refusing delta deletion of folder with local changes in it.")
+			return errors.New("directory has local changes")
+		}
+	} else if !local.IsDir() && (c.isDirty(id) || c.hasConflict(id)) && !remoteWins {
+		c.removeConflict(id)
+		c.keepDeleted(local)
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"id":    id,
+		"name":  name,
+		"delta": "delete",
+	}).Info("Applying server-side deletion of item.")
+	c.trashLocal(local)
+	c.deleteLocal(local)
+	c.activity.add("deleted", name)
+	return nil
+}
+
+// changedLocally returns whether an item (or anything in it) has local changes
+// that were not uploaded.
+func (c *Cache) changedLocally(inode *Inode) bool {
+	if inode.IsDir() {
+		return c.changedDescendant(inode) != nil
+	}
+	return isLocalID(inode.ID()) || c.hasLocalChanges(inode)
+}
+
+// changedDescendant returns an item inside a folder (at any depth) that has
+// local changes that were not uploaded, or nil if there are none.
+func (c *Cache) changedDescendant(dir *Inode) *Inode {
+	dir.mutex.RLock()
+	children := append([]string{}, dir.children...)
+	dir.mutex.RUnlock()
+	for _, childID := range children {
+		child := c.GetID(childID)
+		if child == nil {
+			continue
+		}
+		if isLocalID(childID) {
+			return child
+		}
+		if child.IsDir() {
+			if changed := c.changedDescendant(child); changed != nil {
+				return changed
+			}
+		} else if c.hasLocalChanges(child) {
+			return child
+		}
+	}
+	return nil
+}
+
+// deleteLocal removes an item and everything in it from the cache, without
+// touching the server.
+func (c *Cache) deleteLocal(inode *Inode) {
+	id := inode.ID()
+	inode.mutex.RLock()
+	children := append([]string{}, inode.children...)
+	inode.mutex.RUnlock()
+	for _, childID := range children {
+		if child := c.GetID(childID); child != nil {
+			c.deleteLocal(child)
+		}
+	}
+	notifyRemoved(inode)
+	c.uploads.CancelUpload(id)
+	c.clearDirty(id)
+	c.removeConflict(id)
+	c.DeleteID(id)
+	// or the item is found on disk the next time it is looked up
+	c.forgetMetadata(id)
+	c.setLocalAttrs(id, localAttrs{})
+	c.DeleteContent(id)
+}
+
+// The kernel keeps what it looked up on the mount (and the content it read)
+// until it times out or is invalidated, so changes from the server are pushed to
+// it. Otherwise programs watching files on the mount would not notice them.
+
+// kernelInode returns the node the kernel knows an item by, or nil if the kernel
+// never looked it up, in which case it has nothing to invalidate.
+func (i *Inode) kernelInode() *fs.Inode {
+	node := i.EmbeddedInode()
+	if node.StableAttr().Ino == 0 {
+		return nil
+	}
+	return node
+}
+
+// notifyRemoved tells the kernel that an item is no longer where it looked it
+// up, because it was deleted or moved.
+func notifyRemoved(inode *Inode) {
+	node := inode.kernelInode()
+	if node == nil {
+		return
+	}
+	name, parent := node.Parent()
+	if parent == nil {
+		return
+	}
+	// so that paths are not worked out from the old name
+	parent.RmChild(name)
+	// unlike NotifyEntry, this wakes up inotify watchers
+	parent.NotifyDelete(name, node)
+}
+
+// notifyAdded tells the kernel that an item appeared in a folder, in case it
+// remembers that nothing was there.
+func (c *Cache) notifyAdded(parentID string, name string) {
+	if parent := c.GetID(parentID); parent != nil {
+		if node := parent.kernelInode(); node != nil {
+			node.NotifyEntry(name)
+		}
+	}
+}
+
+// notifyModified tells the kernel that the content and attributes of an item
+// changed.
+func notifyModified(inode *Inode) {
+	if node := inode.kernelInode(); node != nil {
+		node.NotifyContent(0, 0)
+	}
+}
@@ -3,20 +3,26 @@ package fs
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/jstaf/onedriver/fs/graph"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
 )
 
-// a helper function for use with tests
+// a helper function for use with tests, the Inode must already have a cache
 func (i *Inode) setContent(newContent []byte) {
 	i.DriveItem.Size = uint64(len(newContent))
-	i.data = &newContent
+	i.cache.InsertContent(i.DriveItem.ID, newContent)
 	if i.DriveItem.Parent.DriveType == graph.DriveTypePersonal {
 		i.DriveItem.File.Hashes.SHA1Hash = graph.SHA1Hash(&newContent)
 	} else {
@@ -148,10 +154,12 @@ func TestDeltaContentChangeRemote(t *testing.T) {
 	item, err := graph.GetItemPath("/onedriver_tests/delta/remote_content", auth)
 	inode := NewInodeDriveItem(item)
 	failOnErr(t, err)
+	inode.cache = fsCache
 	newContent := []byte("because it has been changed remotely!")
 	inode.setContent(newContent)
 	session, err := NewUploadSession(inode, auth)
 	failOnErr(t, err)
+	defer session.removeSnapshot()
 	failOnErr(t, session.Upload(auth))
 
 	time.Sleep(time.Second * 10)
@@ -176,6 +184,49 @@ func TestDeltaContentChangeRemote(t *testing.T) {
 		string(content), string(body))
 }
 
+// A file changed on the server while it is open should keep the content it was
+// opened with until it is closed.
+func TestDeltaContentChangeWhileOpen(t *testing.T) {
+	t.Parallel()
+	fpath := filepath.Join(DeltaDir, "remote_content_open")
+	original := []byte("opened before it changed")
+	failOnErr(t, ioutil.WriteFile(fpath, original, 0644))
+	time.Sleep(time.Second * 10)
+
+	file, err := os.Open(fpath)
+	failOnErr(t, err)
+	defer file.Close()
+
+	item, err := graph.GetItemPath("/onedriver_tests/delta/remote_content_open", auth)
+	failOnErr(t, err)
+	inode := NewInodeDriveItem(item)
+	inode.cache = fsCache
+	newContent := []byte("changed while it was open")
+	inode.setContent(newContent)
+	session, err := NewUploadSession(inode, auth)
+	failOnErr(t, err)
+	defer session.removeSnapshot()
+	failOnErr(t, session.Upload(auth))
+	time.Sleep(time.Second * 15)
+
+	content, err := ioutil.ReadAll(file)
+	failOnErr(t, err)
+	if !bytes.Equal(content, original) {
+		t.Fatalf("Content of open file changed under it to \"%s\".\n", content)
+	}
+	file.Close()
+
+	for i := 0; i < retrySeconds; i++ {
+		content, err = ioutil.ReadFile(fpath)
+		failOnErr(t, err)
+		if bytes.Equal(content, newContent) {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	t.Fatalf("Change was not applied once the file was closed, got \"%s\".\n", content)
+}
+
 // Change the content both on the server and the client and verify that the
 // client data is preserved.
 func TestDeltaContentChangeBoth(t *testing.T) {
@@ -187,10 +238,12 @@ func TestDeltaContentChangeBoth(t *testing.T) {
 	item, err := graph.GetItemPath("/onedriver_tests/delta/both_content_changed", auth)
 	inode := NewInodeDriveItem(item)
 	failOnErr(t, err)
+	inode.cache = fsCache
 	newContent := []byte("remote")
 	inode.setContent(newContent)
 	session, err := NewUploadSession(inode, auth)
 	failOnErr(t, err)
+	defer session.removeSnapshot()
 	failOnErr(t, session.Upload(auth))
 
 	// now change it locally
@@ -275,7 +328,7 @@ func TestDeltaFolderDeletion(t *testing.T) {
 // We should only perform a delta deletion of a folder if it was nonempty
 func TestDeltaFolderDeletionNonEmpty(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_delta_folder_deletion_nonempty.db")
+	cache := NewCache(auth, "test_delta_folder_deletion_nonempty.db", nil)
 	dir := NewInode("folder", 0755|fuse.S_IFDIR, nil)
 	file := NewInode("file", 0644|fuse.S_IFREG, nil)
 	cache.InsertPath("/folder", nil, dir)
@@ -304,6 +357,178 @@ func TestDeltaFolderDeletionNonEmpty(t *testing.T) {
 	}
 }
 
+// Deletions should be applied right away, even when they do not say where the
+// item was, and leave nothing of it (or what was in it) behind.
+func TestDeltaDeletionWithoutParent(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_delta_deletion_without_parent.db", nil)
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	_, err = cache.GetChildrenID(root.ID(), auth)
+	failOnErr(t, err)
+	dir := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "deletion-without-parent-dir",
+		Name:   "folder",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		Folder: &graph.Folder{},
+	})
+	file := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "deletion-without-parent-file",
+		Name:   "file",
+		Parent: &graph.DriveItemParent{ID: dir.ID()},
+		File:   &graph.File{},
+	})
+	cache.InsertChild(root.ID(), dir)
+	cache.InsertChild(dir.ID(), file)
+	failOnErr(t, cache.InsertContent(file.ID(), []byte("deleted on the server")))
+	cache.SerializeAll()
+
+	delta := &Inode{
+		DriveItem: graph.DriveItem{
+			ID:      dir.ID(),
+			Folder:  &graph.Folder{},
+			Deleted: &graph.Deleted{State: "deleted"},
+		},
+		mode: 0755 | fuse.S_IFDIR,
+	}
+	failOnErr(t, cache.applyDelta(delta))
+	for _, id := range []string{dir.ID(), file.ID()} {
+		if cache.GetID(id) != nil {
+			t.Fatalf("Item %s was still found after being deleted on the server.\n", id)
+		}
+	}
+	if cache.hasContent(file.ID()) {
+		t.Fatal("Content of a file deleted on the server was still cached.")
+	}
+	root.mutex.RLock()
+	defer root.mutex.RUnlock()
+	for _, childID := range root.children {
+		if childID == dir.ID() {
+			t.Fatal("Deleted folder is still listed in its parent.")
+		}
+	}
+}
+
+// Folders renamed on the server should be moved in the cache, keeping the
+// content of everything in them, without touching the server.
+func TestDeltaRenameKeepsContent(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_delta_rename_keeps_content.db", nil)
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	_, err = cache.GetChildrenID(root.ID(), auth)
+	failOnErr(t, err)
+	dir := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "rename-keeps-content-dir",
+		Name:   "rename_keeps_content",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		Folder: &graph.Folder{},
+	})
+	file := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "rename-keeps-content-file",
+		Name:   "file",
+		Parent: &graph.DriveItemParent{ID: dir.ID()},
+		File:   &graph.File{},
+	})
+	cache.InsertChild(root.ID(), dir)
+	cache.InsertChild(dir.ID(), file)
+	failOnErr(t, cache.InsertContent(file.ID(), []byte("hydrated")))
+
+	delta := NewInodeDriveItem(&graph.DriveItem{
+		ID:     dir.ID(),
+		Name:   "rename_keeps_content_renamed",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		Folder: &graph.Folder{},
+	})
+	failOnErr(t, cache.applyDelta(delta))
+	moved, err := cache.GetPath("/rename_keeps_content_renamed/file", auth)
+	failOnErr(t, err)
+	if moved.ID() != file.ID() || !cache.hasContent(file.ID()) {
+		t.Fatal("Content of a file in a renamed folder was not kept.")
+	}
+	if _, err = cache.GetPath("/rename_keeps_content", auth); err == nil {
+		t.Fatal("Renamed folder was still found under its old name.")
+	}
+}
+
+// Files deleted on the server should have their content moved to the local
+// trash instead of being removed.
+func TestDeltaDeletionTrash(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_delta_deletion_trash.db", &Options{TrashRetention: time.Hour})
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	file := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "deletion-trash",
+		Name:   "deletion_trash.txt",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		File:   &graph.File{},
+		Size:   7,
+	})
+	cache.InsertChild(root.ID(), file)
+	failOnErr(t, cache.InsertContent(file.ID(), []byte("trashed")))
+
+	failOnErr(t, cache.applyDeletion(file.ID(), file))
+	trash := cache.Trash()
+	if len(trash) != 1 || trash[0].Path != "/deletion_trash.txt" {
+		t.Fatalf("Deleted file was not moved to the local trash: %+v\n", trash)
+	}
+	if cache.hasContent(file.ID()) {
+		t.Fatal("Content of the deleted file was left in the content cache.")
+	}
+	if removed := cache.EmptyTrash(); removed != 1 || len(cache.Trash()) != 0 {
+		t.Fatal("Local trash was not emptied.")
+	}
+}
+
+// Files restored next to one with the same name should get a name of their own.
+func TestRestoredName(t *testing.T) {
+	t.Parallel()
+	if name := restoredName("notes.txt", 1); name != "notes (restored).txt" {
+		t.Fatalf("Unexpected restored name \"%s\".\n", name)
+	}
+	if name := restoredName("Makefile", 2); name != "Makefile (restored 2)" {
+		t.Fatalf("Unexpected restored name \"%s\".\n", name)
+	}
+}
+
+// Pending changes from the server should be described without being applied.
+func TestPendingDelta(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_pending_delta.db", nil)
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	file := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "pending-delta-file",
+		Name:   "pending_delta",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		File:   &graph.File{},
+		CTag:   "old",
+	})
+	cache.InsertChild(root.ID(), file)
+
+	deltas := map[string]*graph.DriveItem{
+		"": {ID: file.ID(), Name: file.Name(), CTag: "old",
+			Parent: &graph.DriveItemParent{ID: root.ID()}, File: &graph.File{}},
+		"modified": {ID: file.ID(), Name: file.Name(), CTag: "new",
+			Parent: &graph.DriveItemParent{ID: root.ID()}, File: &graph.File{}},
+		"moved to /pending_delta_renamed": {ID: file.ID(), Name: "pending_delta_renamed",
+			CTag: "old", Parent: &graph.DriveItemParent{ID: root.ID()}, File: &graph.File{}},
+		"deleted": {ID: file.ID(), Deleted: &graph.Deleted{}},
+		"created": {ID: "pending-delta-new", Name: "pending_delta_new",
+			Parent: &graph.DriveItemParent{ID: root.ID()}, File: &graph.File{}},
+	}
+	for expected, delta := range deltas {
+		change, ok := cache.pendingDelta(NewInodeDriveItem(delta))
+		if ok != (expected != "") || change.Change != expected {
+			t.Errorf("Expected \"%s\", got \"%s\"\n", expected, change.Change)
+		}
+	}
+	if cache.GetID(file.ID()).CTag != "old" || cache.GetID("pending-delta-new") != nil {
+		t.Fatal("Pending changes were applied.")
+	}
+}
+
 // Some programs like LibreOffice and WPS Office will have a fit if the
 // modification times on their lockfiles is updated after they are written. This
 // test verifies that the delta thread does not modify modification times if the
@@ -332,7 +557,7 @@ func TestDeltaNoModTimeUpdate(t *testing.T) {
 // https://github.com/jstaf/onedriver/issues/111
 func TestDeltaMissingHash(t *testing.T) {
 	t.Parallel()
-	cache := NewCache(auth, "test_delta_missing_hash.db")
+	cache := NewCache(auth, "test_delta_missing_hash.db", nil)
 	file := NewInode("file", 0644|fuse.S_IFREG, nil)
 	cache.InsertPath("/folder", nil, file)
 
@@ -350,3 +575,92 @@ func TestDeltaMissingHash(t *testing.T) {
 	cache.applyDelta(delta)
 	// if we survive to here without a segfault, test passed
 }
+
+// A restart should resume syncing from the last session's delta link, as long
+// as it covers the same part of the drive.
+func TestResumeDelta(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_resume_delta.db", nil)
+	cache.deltaStart = "/me/drive/root/delta?token=latest"
+	cache.deltaLink = "/me/drive/root/delta?token=saved"
+	failOnErr(t, cache.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDelta)
+		b.Put([]byte("deltaStart"), []byte(cache.deltaStart))
+		return b.Put([]byte("deltaLink"), []byte(cache.deltaLink))
+	}))
+	if link := cache.resumeDelta(); link != cache.deltaLink {
+		t.Fatalf("Did not resume from the saved delta link, got %s.\n", link)
+	}
+
+	cache.deltaStart = "/me/drive/items/other/delta?token=latest"
+	if link := cache.resumeDelta(); link != cache.deltaStart {
+		t.Fatalf("Resumed from the delta link of another folder, got %s.\n", link)
+	}
+}
+
+// Notifications sent to a WebhookNotifier should wake up the cache they are
+// for, but only if they come from the server.
+func TestWebhookNotifier(t *testing.T) {
+	t.Parallel()
+	cache := &Cache{changed: make(chan struct{}, 1)}
+	notifier := NewWebhookNotifier("https://example.com/notify")
+	notifier.caches["subscription"] = cache
+
+	// validation requests are echoed back
+	request := httptest.NewRequest("POST", "/notify?validationToken=token%20123", nil)
+	response := httptest.NewRecorder()
+	notifier.ServeHTTP(response, request)
+	if body := response.Body.String(); response.Code != 200 || body != "token 123" {
+		t.Fatalf("Validation token was not echoed back, got %d: %s\n", response.Code, body)
+	}
+
+	notify := func(state string) {
+		body := fmt.Sprintf(`{"value":[{"subscriptionId":"subscription","clientState":"%s"}]}`, state)
+		response := httptest.NewRecorder()
+		notifier.ServeHTTP(response, httptest.NewRequest("POST", "/notify", strings.NewReader(body)))
+		if response.Code != http.StatusAccepted {
+			t.Fatalf("Notification was not accepted, got %d.\n", response.Code)
+		}
+	}
+	notify("forged")
+	select {
+	case <-cache.changed:
+		t.Fatal("Notification with the wrong client state woke up the cache.")
+	default:
+	}
+	notify(notifier.clientState)
+	select {
+	case <-cache.changed:
+	default:
+		t.Fatal("Notification did not wake up the cache.")
+	}
+}
+
+// Programs watching the mount with inotify should be woken up when a file is
+// deleted on the server.
+func TestDeltaInotify(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(DeltaDir, "delta_inotify")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("watched"), 0644))
+	time.Sleep(time.Second)
+
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK)
+	failOnErr(t, err)
+	defer unix.Close(fd)
+	_, err = unix.InotifyAddWatch(fd, DeltaDir, unix.IN_DELETE)
+	failOnErr(t, err)
+
+	item, err := graph.GetItemPath("/onedriver_tests/delta/delta_inotify", auth)
+	failOnErr(t, err)
+	failOnErr(t, graph.Remove(item.ID, auth))
+
+	buf := make([]byte, 4096)
+	for i := 0; i < retrySeconds; i++ {
+		time.Sleep(time.Second)
+		if n, _ := unix.Read(fd, buf); n > unix.SizeofInotifyEvent &&
+			bytes.Contains(buf[unix.SizeofInotifyEvent:n], []byte("delta_inotify")) {
+			return
+		}
+	}
+	t.Fatal("Watcher was not notified of the deletion.")
+}
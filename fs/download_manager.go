@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// DefaultMaxDownloads is how many parts of files are downloaded at once by
+// default.
+const DefaultMaxDownloads = 4
+
+// blockKey identifies a hydrationBlock of the content of an item.
+type blockKey struct {
+	id    string
+	block uint64
+}
+
+// downloadManager keeps track of the parts of files being hydrated, so that
+// when several programs read the same part of a file at once (or a read
+// catches up with a readahead) it is downloaded once and the others wait for
+// it. It also limits how many parts are downloaded at once.
+type downloadManager struct {
+	mutex   sync.Mutex
+	pending map[blockKey]chan struct{} // closed when the block's download ends
+	slots   chan struct{}
+}
+
+func newDownloadManager(maxDownloads int) *downloadManager {
+	if maxDownloads <= 0 {
+		maxDownloads = DefaultMaxDownloads
+	}
+	return &downloadManager{
+		pending: make(map[blockKey]chan struct{}),
+		slots:   make(chan struct{}, maxDownloads),
+	}
+}
+
+// claim splits a range of an item's content, which starts on a block boundary,
+// into the runs of blocks nobody is downloading yet, which the caller must now
+// download and release, and the downloads of everything else in it, which end
+// when their channels are closed. Runs are at most maxHydrationRequest long.
+func (d *downloadManager) claim(id string, start uint64, end uint64) ([]extent, []chan struct{}) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	runs := make([]extent, 0)
+	waits := make([]chan struct{}, 0)
+	var done chan struct{} // of the run being claimed, nil between runs
+	for offset := start; offset < end; offset += hydrationBlock {
+		blockEnd := offset + hydrationBlock
+		if blockEnd > end {
+			blockEnd = end
+		}
+		key := blockKey{id: id, block: offset / hydrationBlock}
+		if other, exists := d.pending[key]; exists {
+			if len(waits) == 0 || waits[len(waits)-1] != other {
+				waits = append(waits, other)
+			}
+			done = nil
+			continue
+		}
+		if done == nil || runs[len(runs)-1].End-runs[len(runs)-1].Start >= maxHydrationRequest {
+			done = make(chan struct{})
+			runs = append(runs, extent{Start: offset, End: blockEnd})
+		} else {
+			runs[len(runs)-1].End = blockEnd
+		}
+		d.pending[key] = done
+	}
+	return runs, waits
+}
+
+// release ends the downloads of runs returned by claim, whether they succeeded
+// or not, so that whoever is waiting for them checks what is missing again.
+func (d *downloadManager) release(id string, runs ...extent) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, run := range runs {
+		var done chan struct{}
+		for offset := run.Start; offset < run.End; offset += hydrationBlock {
+			key := blockKey{id: id, block: offset / hydrationBlock}
+			done = d.pending[key]
+			delete(d.pending, key)
+		}
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+// active returns the IDs of the items with parts being downloaded.
+func (d *downloadManager) active() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	for key := range d.pending {
+		if !seen[key.id] {
+			seen[key.id] = true
+			ids = append(ids, key.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// acquire waits for a free download slot, which must be given back with
+// giveBack.
+func (d *downloadManager) acquire(ctx context.Context) error {
+	select {
+	case d.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *downloadManager) giveBack() {
+	<-d.slots
+}
+
+// wait waits for the downloads of others returned by claim to end.
+func (d *downloadManager) wait(ctx context.Context, waits []chan struct{}) error {
+	for _, done := range waits {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
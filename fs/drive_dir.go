@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// DriveDir is a read-only virtual directory used to expose several drives under
+// a single mountpoint. Its children are the root Inodes of other Caches (one per
+// drive) or other DriveDirs. Children must all be added before the DriveDir is
+// mounted or added to the filesystem tree.
+type DriveDir struct {
+	fs.Inode
+
+	children map[string]fs.InodeEmbedder
+	statfs   *Cache // used to answer statfs() calls, may be nil
+}
+
+// NewDriveDir creates a new, empty DriveDir.
+func NewDriveDir() *DriveDir {
+	return &DriveDir{children: make(map[string]fs.InodeEmbedder)}
+}
+
+// AddDrive adds a child directory to the DriveDir. If a child already has that
+// name, a numeric suffix is appended. Returns the name actually used.
+func (d *DriveDir) AddDrive(name string, child fs.InodeEmbedder) string {
+	unique := name
+	for n := 2; ; n++ {
+		if _, exists := d.children[unique]; !exists {
+			break
+		}
+		unique = fmt.Sprintf("%s (%d)", name, n)
+	}
+	d.children[unique] = child
+	if inode, ok := child.(*Inode); ok && d.statfs == nil {
+		d.statfs = inode.GetCache()
+	}
+	return unique
+}
+
+// OnAdd populates the filesystem tree with the DriveDir's children.
+func (d *DriveDir) OnAdd(ctx context.Context) {
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.WithField("name", name).Debug("Adding drive to filesystem.")
+		child := d.NewPersistentInode(ctx, d.children[name], fs.StableAttr{Mode: fuse.S_IFDIR})
+		d.AddChild(name, child, true)
+	}
+}
+
+// Getattr reports the DriveDir as an ordinary directory owned by the user.
+func (d *DriveDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = fuse.Attr{
+		Size:  4096,
+		Nlink: 2 + uint32(len(d.children)),
+		Mode:  fuse.S_IFDIR | 0755,
+		Owner: fuse.Owner{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		},
+	}
+	return 0
+}
+
+// Statfs reports the quota of the first drive added to the DriveDir.
+func (d *DriveDir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	if d.statfs == nil {
+		return 0
+	}
+	root, _ := d.statfs.GetPath("/", nil)
+	return root.Statfs(ctx, out)
+}
@@ -0,0 +1,15 @@
+package fs
+
+import "testing"
+
+// Drives with the same name should not clobber one another.
+func TestDriveDirDuplicateNames(t *testing.T) {
+	t.Parallel()
+	dir := NewDriveDir()
+	if name := dir.AddDrive("Documents", NewDriveDir()); name != "Documents" {
+		t.Fatalf("First drive was renamed to \"%s\"", name)
+	}
+	if name := dir.AddDrive("Documents", NewDriveDir()); name != "Documents (2)" {
+		t.Fatalf("Duplicate drive name was not deduplicated, got \"%s\"", name)
+	}
+}
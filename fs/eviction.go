@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucketUses counts how many times the content of each file was opened, keyed
+// by item ID, for EvictLFU. Only kept while the content is cached.
+var bucketUses = []byte("uses")
+
+// cachedContent is the content of an item in the content directory.
+type cachedContent struct {
+	id      string
+	size    uint64    // space used on disk, which is less than the file's for sparse content
+	lastUse time.Time // the modification time of the content, see touchContent
+	uses    uint64    // how many times it was opened, see touchContent
+}
+
+// evictionPolicy orders content for eviction, see EvictionPolicy.
+type evictionPolicy interface {
+	// first returns whether a should be evicted before b.
+	first(a cachedContent, b cachedContent, now time.Time) bool
+}
+
+type lruPolicy struct{}
+
+func (lruPolicy) first(a cachedContent, b cachedContent, now time.Time) bool {
+	return a.lastUse.Before(b.lastUse)
+}
+
+type lfuPolicy struct{}
+
+func (lfuPolicy) first(a cachedContent, b cachedContent, now time.Time) bool {
+	if a.uses != b.uses {
+		return a.uses < b.uses
+	}
+	return a.lastUse.Before(b.lastUse)
+}
+
+type sizePolicy struct{}
+
+func (sizePolicy) first(a cachedContent, b cachedContent, now time.Time) bool {
+	weight := func(content cachedContent) float64 {
+		return float64(content.size) * now.Sub(content.lastUse).Seconds()
+	}
+	return weight(a) > weight(b)
+}
+
+// evictionPolicies implement each EvictionPolicy.
+var evictionPolicies = map[EvictionPolicy]evictionPolicy{
+	EvictLRU:  lruPolicy{},
+	EvictLFU:  lfuPolicy{},
+	EvictSize: sizePolicy{},
+}
+
+// evictionPolicy returns the implementation of Options.EvictionPolicy.
+func (c *Cache) evictionPolicy() evictionPolicy {
+	if policy, exists := evictionPolicies[c.opts.EvictionPolicy]; exists {
+		return policy
+	}
+	return lruPolicy{}
+}
+
+// touchContent marks the content of an item as just used, so that it is the last
+// to be evicted.
+func (c *Cache) touchContent(id string) {
+	now := time.Now()
+	os.Chtimes(c.contentPath(id), now, now)
+	if c.opts.MaxCacheSize == 0 || isLocalID(id) {
+		return
+	}
+	// batched like recordAccess, since this is called for every open
+	go c.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUses)
+		var uses uint64
+		if v := b.Get([]byte(id)); len(v) == 8 {
+			uses = binary.BigEndian.Uint64(v)
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uses+1)
+		return b.Put([]byte(id), value)
+	})
+}
+
+// decayUses halves how many times the content of each file was opened, and
+// forgets files whose content is no longer cached.
+func (c *Cache) decayUses() {
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUses)
+		uses := make(map[string]uint64)
+		b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				uses[string(k)] = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+		for id, count := range uses {
+			if count <= 1 || !c.hasContent(id) {
+				b.Delete([]byte(id))
+				continue
+			}
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, count/2)
+			b.Put([]byte(id), value)
+		}
+		return nil
+	})
+}
+
+// contentUsage returns all content in the content directory, including downloads
+// in progress, along with how much space it takes up in total.
+func (c *Cache) contentUsage() ([]cachedContent, uint64) {
+	entries, _ := ioutil.ReadDir(contentDir(c.db))
+	contents := make([]cachedContent, 0, len(entries))
+	var total uint64
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUses)
+		for _, entry := range entries {
+			size := uint64(entry.Size())
+			if stat, ok := entry.Sys().(*syscall.Stat_t); ok {
+				size = uint64(stat.Blocks) * 512
+			}
+			total += size
+			var uses uint64
+			if v := b.Get([]byte(entry.Name())); len(v) == 8 {
+				uses = binary.BigEndian.Uint64(v)
+			}
+			contents = append(contents, cachedContent{
+				id:      entry.Name(),
+				size:    size,
+				lastUse: entry.ModTime(),
+				uses:    uses,
+			})
+		}
+		return nil
+	})
+	return contents, total
+}
+
+// requestEviction evicts content in the background if the content cache has
+// grown past Options.MaxCacheSize. Does nothing while an eviction is running.
+func (c *Cache) requestEviction() {
+	if c.opts.MaxCacheSize == 0 || !atomic.CompareAndSwapInt32(&c.evicting, 0, 1) {
+		return
+	}
+	go func() {
+		c.evictContent()
+		atomic.StoreInt32(&c.evicting, 0)
+	}()
+}
+
+// evictContent removes content in the order of Options.EvictionPolicy until the
+// content cache fits in Options.MaxCacheSize. Content is only evicted if it can
+// be downloaded again: files that are open or have changes that were not
+// uploaded yet are kept, however long ago they were used. Metadata is never
+// evicted. Returns how many files were evicted and how much space that freed.
+func (c *Cache) evictContent() (int, uint64) {
+	max := c.opts.MaxCacheSize
+	contents, total := c.contentUsage()
+	if max == 0 || total <= max {
+		return 0, 0
+	}
+	policy := c.evictionPolicy()
+	now := time.Now()
+	sort.Slice(contents, func(i, j int) bool {
+		return policy.first(contents[i], contents[j], now)
+	})
+
+	keep := make(map[string]bool)
+	for _, upload := range c.uploads.List() {
+		keep[upload.ID] = true
+	}
+	for _, id := range c.dirtyIDs() {
+		keep[id] = true
+	}
+
+	count := 0
+	var freed uint64
+	for _, content := range contents {
+		if total <= max {
+			break
+		}
+		id := content.id
+		if strings.HasPrefix(id, downloadPrefix) || isLocalID(id) || keep[id] {
+			continue
+		}
+		if c.evict(id) {
+			total -= content.size
+			freed += content.size
+			count++
+		}
+	}
+	if count > 0 {
+		c.pruneShared()
+		c.counters.evict(count, freed)
+		log.WithFields(log.Fields{
+			"files": count,
+			"freed": freed,
+			"size":  total,
+		}).Info("Evicted content from the cache.")
+	}
+	if total > max {
+		log.WithFields(log.Fields{
+			"size": total,
+			"max":  max,
+		}).Warn("Content cache is over its maximum size, but everything left " +
+			"in it is open or has not been uploaded yet.")
+	}
+	return count, freed
+}
+
+// evict removes the content of an item, unless it is open or has changes.
+// Returns whether the content was removed.
+func (c *Cache) evict(id string) bool {
+	inode := c.GetID(id)
+	if inode == nil {
+		// nothing refers to the content anymore
+		return c.DeleteContent(id) == nil
+	}
+	// locked for the whole time, so that the file cannot be opened with the
+	// content halfway gone
+	inode.mutex.Lock()
+	defer inode.mutex.Unlock()
+	if inode.content != nil || inode.hasChanges {
+		return false
+	}
+	return c.DeleteContent(id) == nil
+}
@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"path"
+	"strings"
+)
+
+// Items matching Options.Exclude are left out of the filesystem entirely: they
+// are never added to the cache when listing a folder or applying changes from
+// the server, so they are not listed, downloaded, or kept up to date, and
+// neither is anything inside excluded folders.
+
+// ValidExcludePattern returns whether a pattern can be used in Options.Exclude.
+func ValidExcludePattern(pattern string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return false
+	}
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// excluded returns whether an item at relPath (relative to the filesystem root,
+// with no leading slash) matches any of patterns (see Options.Exclude).
+func excluded(relPath string, isDir bool, patterns []string) bool {
+	relPath = strings.ToLower(relPath)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		target := relPath
+		if strings.Contains(pattern, "/") {
+			// anchored to the filesystem root
+			pattern = strings.TrimPrefix(pattern, "/")
+		} else {
+			// matches a name anywhere
+			target = path.Base(relPath)
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcluded returns whether an item named name in the folder parent is left out
+// of the filesystem (see Options.Exclude).
+func (c *Cache) isExcluded(parent *Inode, name string, isDir bool) bool {
+	if len(c.opts.Exclude) == 0 {
+		return false
+	}
+	parentPath, ok := c.relativePath(parent)
+	if !ok {
+		return false
+	}
+	return excluded(path.Join(parentPath, name), isDir, c.opts.Exclude)
+}
@@ -0,0 +1,192 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The Graph API does not offer a way to mark items as favorites, so favorites
+// are tracked locally in their own bucket (keyed by item ID).
+var bucketFavorites = []byte("favorites")
+
+// favoritesDirName is the name of the virtual folder at the root of the
+// filesystem that lists all favorites.
+const favoritesDirName = ".favorites"
+
+// IsFavorite returns whether or not an item has been marked as a favorite.
+func (c *Cache) IsFavorite(id string) bool {
+	favorite := false
+	c.db.View(func(tx *bolt.Tx) error {
+		favorite = tx.Bucket(bucketFavorites).Get([]byte(id)) != nil
+		return nil
+	})
+	return favorite
+}
+
+// SetFavorite marks or unmarks an item as a favorite.
+func (c *Cache) SetFavorite(id string, favorite bool) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketFavorites)
+		if favorite {
+			return b.Put([]byte(id), []byte{})
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// GetFavorites returns the IDs of all items marked as favorites.
+func (c *Cache) GetFavorites() []string {
+	ids := make([]string, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFavorites).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids
+}
+
+// moveFavorite carries over an item's favorite status when its ID changes.
+func (c *Cache) moveFavorite(oldID string, newID string) {
+	if c.IsFavorite(oldID) {
+		c.SetFavorite(oldID, false)
+		c.SetFavorite(newID, true)
+	}
+}
+
+// relativePath returns the path of an item relative to the root of the
+// filesystem (with no leading slash), walking up the tree of cached items.
+// Returns false if the item is not (or no longer) inside the filesystem.
+func (c *Cache) relativePath(inode *Inode) (string, bool) {
+	names := make([]string, 0)
+	for inode.ID() != c.root {
+		names = append([]string{inode.Name()}, names...)
+		if inode = c.GetID(inode.ParentID()); inode == nil {
+			return "", false
+		}
+	}
+	return strings.Join(names, "/"), true
+}
+
+// FavoritesDir is a read-only virtual directory containing a symlink to every
+// item in a Cache that has been marked as a favorite.
+type FavoritesDir struct {
+	fs.Inode
+
+	cache *Cache
+}
+
+// links maps the name of each symlink in the FavoritesDir to its target.
+func (f *FavoritesDir) links() map[string]string {
+	links := make(map[string]string)
+	ids := f.cache.GetFavorites()
+	sort.Strings(ids) // keeps names stable if there are duplicates
+	for _, id := range ids {
+		inode := f.cache.GetID(id)
+		if inode == nil {
+			continue
+		}
+		path, ok := f.cache.relativePath(inode)
+		if !ok {
+			log.WithField("id", id).Debug("Favorite is no longer in the filesystem.")
+			continue
+		}
+		name := inode.Name()
+		unique := name
+		for n := 2; ; n++ {
+			if _, exists := links[unique]; !exists {
+				break
+			}
+			unique = fmt.Sprintf("%s (%d)", name, n)
+		}
+		links[unique] = "../" + path
+	}
+	return links
+}
+
+// Readdir lists the symlinks in the FavoritesDir.
+func (f *FavoritesDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return readdirLinks(f.links()), 0
+}
+
+// Lookup fetches a single symlink from the FavoritesDir.
+func (f *FavoritesDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return lookupLink(ctx, &f.Inode, f.links(), name, out)
+}
+
+// readdirLinks lists the symlinks in a virtual directory of symlinks.
+func readdirLinks(links map[string]string) fs.DirStream {
+	entries := make([]fuse.DirEntry, 0)
+	for name := range links {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFLNK})
+	}
+	return fs.NewListDirStream(entries)
+}
+
+// lookupLink fetches a single symlink from a virtual directory of symlinks.
+func lookupLink(ctx context.Context, dir *fs.Inode, links map[string]string, name string,
+	out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	target, exists := links[name]
+	if !exists {
+		return nil, syscall.ENOENT
+	}
+	link := &fs.MemSymlink{Data: []byte(target)}
+	link.Attr.Owner = fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	out.Attr = link.Attr
+	out.Attr.Mode = fuse.S_IFLNK | 0777
+	out.Attr.Size = uint64(len(target))
+	return dir.NewInode(ctx, link, fs.StableAttr{Mode: fuse.S_IFLNK}), 0
+}
+
+// Getattr reports the FavoritesDir as a read-only directory.
+func (f *FavoritesDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = virtualDirAttr()
+	return 0
+}
+
+// virtualDirAttr are the attributes of the read-only virtual directories at the
+// root of the filesystem.
+func virtualDirAttr() fuse.Attr {
+	return fuse.Attr{
+		Size:  4096,
+		Nlink: 2,
+		Mode:  fuse.S_IFDIR | 0555,
+		Owner: fuse.Owner{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		},
+	}
+}
+
+// favoritesDir returns the FavoritesDir for an Inode's filesystem, creating it
+// on first use. Must only be called on the root Inode. Any real item at the root
+// named ".favorites" is hidden by the FavoritesDir.
+func (i *Inode) favoritesDir(ctx context.Context) *fs.Inode {
+	if child := i.EmbeddedInode().GetChild(favoritesDirName); child != nil {
+		return child
+	}
+	dir := &FavoritesDir{cache: i.GetCache()}
+	return i.NewPersistentInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR})
+}
+
+// setFavorite marks or unmarks an Inode as a favorite.
+func (i *Inode) setFavorite(favorite bool) syscall.Errno {
+	if err := i.GetCache().SetFavorite(i.ID(), favorite); err != nil {
+		log.WithFields(log.Fields{
+			"id":   i.ID(),
+			"path": i.Path(),
+			"err":  err,
+		}).Error("Could not update favorite status.")
+		return syscall.EIO
+	}
+	return 0
+}
@@ -51,6 +51,24 @@ func TestTouchCreate(t *testing.T) {
 	}
 }
 
+// Empty files should be created on the server without uploading any content.
+func TestTouchCreateUploadsEmptyFile(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "empty_uploaded")
+	failOnErr(t, exec.Command("touch", fname).Run())
+	for i := 0; i < retrySeconds; i++ {
+		item, err := graph.GetItemPath("/onedriver_tests/empty_uploaded", auth)
+		if err == nil {
+			if item.Size != 0 || item.File == nil {
+				t.Fatalf("Created item was not an empty file: %+v\n", item)
+			}
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	t.Fatal("Empty file was never created on the server.")
+}
+
 // does the touch command update modification time properly?
 func TestTouchUpdateTime(t *testing.T) {
 	t.Parallel()
@@ -499,3 +517,297 @@ func TestLibreOfficeSavePattern(t *testing.T) {
 		t.Fatal("Item size was 0!")
 	}
 }
+
+// Item descriptions should be readable and writable via xattrs, and should
+// actually make it to the server.
+func TestXattrDescription(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "xattr_description.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("description test"), 0644))
+
+	description := "a file with a description"
+	failOnErr(t, syscall.Setxattr(fname, xattrDescription, []byte(description), 0))
+
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(fname, xattrDescription, buf)
+	failOnErr(t, err)
+	if string(buf[:n]) != description {
+		t.Fatalf("Description was \"%s\", wanted \"%s\".\n", buf[:n], description)
+	}
+
+	item, err := graph.GetItemPath("/onedriver_tests/xattr_description.txt", auth)
+	failOnErr(t, err)
+	if item.Description != description {
+		t.Fatalf("Description on server was \"%s\", wanted \"%s\".\n",
+			item.Description, description)
+	}
+
+	failOnErr(t, syscall.Removexattr(fname, xattrDescription))
+	if _, err = syscall.Getxattr(fname, xattrDescription, buf); err != syscall.ENODATA {
+		t.Fatalf("Expected ENODATA after removing description, got %v.\n", err)
+	}
+}
+
+// Favorites are set via xattr and should show up as symlinks in .favorites.
+func TestFavorites(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "favorite.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("a favorite file"), 0644))
+	failOnErr(t, syscall.Setxattr(fname, xattrFavorite, []byte("1"), 0))
+
+	link := filepath.Join(mountLoc, favoritesDirName, "favorite.txt")
+	content, err := ioutil.ReadFile(link)
+	failOnErr(t, err)
+	if string(content) != "a favorite file" {
+		t.Fatalf("Read \"%s\" through favorites symlink.\n", content)
+	}
+
+	failOnErr(t, syscall.Removexattr(fname, xattrFavorite))
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Fatal("Favorite symlink still existed after unmarking the file.")
+	}
+}
+
+// Changing only the modification time of a file should update it on the server
+// without reuploading the file's content.
+func TestTouchUpdatesModTime(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "touch_mtime.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("touch me"), 0644))
+
+	var before *graph.DriveItem
+	for i := 0; i < retrySeconds; i++ {
+		time.Sleep(time.Second)
+		item, err := graph.GetItemPath("/onedriver_tests/touch_mtime.txt", auth)
+		if err == nil && item.Size > 0 {
+			before = item
+			break
+		}
+	}
+	if before == nil {
+		t.Fatal("File was never uploaded.")
+	}
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	failOnErr(t, os.Chtimes(fname, mtime, mtime))
+	after, err := graph.GetItemPath("/onedriver_tests/touch_mtime.txt", auth)
+	failOnErr(t, err)
+	if after.ModTime == nil || !after.ModTime.Equal(mtime) {
+		t.Fatalf("Modification time on server was %v, wanted %v.\n", after.ModTime, mtime)
+	}
+	if after.File.Hashes.SHA1Hash != before.File.Hashes.SHA1Hash ||
+		after.File.Hashes.QuickXorHash != before.File.Hashes.QuickXorHash {
+		t.Fatal("File content changed after only touching it.")
+	}
+}
+
+// Saving a file without changing its content should not upload it again.
+func TestUnchangedContentNotUploaded(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "unchanged.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("same as before"), 0644))
+
+	var before *graph.DriveItem
+	for i := 0; i < retrySeconds; i++ {
+		time.Sleep(time.Second)
+		item, err := graph.GetItemPath("/onedriver_tests/unchanged.txt", auth)
+		if err == nil && item.Size > 0 {
+			before = item
+			break
+		}
+	}
+	if before == nil {
+		t.Fatal("File was never uploaded.")
+	}
+
+	failOnErr(t, ioutil.WriteFile(fname, []byte("same as before"), 0644))
+	time.Sleep(10 * time.Second)
+	after, err := graph.GetItemPath("/onedriver_tests/unchanged.txt", auth)
+	failOnErr(t, err)
+	if after.CTag != before.CTag {
+		t.Fatalf("File was uploaded again without changes (cTag %s, was %s).\n",
+			after.CTag, before.CTag)
+	}
+}
+
+// Writes to a shared mapping of a file should reach the file, and be uploaded,
+// even after the file was closed.
+func TestMmapWrite(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "mmap.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("mapped into memory"), 0644))
+	file, err := os.OpenFile(fname, os.O_RDWR, 0644)
+	failOnErr(t, err)
+	data, err := syscall.Mmap(int(file.Fd()), 0, 18, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED)
+	failOnErr(t, err)
+	file.Close()
+	copy(data, "MAPPED")
+	failOnErr(t, syscall.Munmap(data))
+
+	content, err := ioutil.ReadFile(fname)
+	failOnErr(t, err)
+	if string(content) != "MAPPED into memory" {
+		t.Fatalf("Writes to the mapping did not reach the file, got \"%s\".\n", content)
+	}
+	for i := 0; i < retrySeconds; i++ {
+		time.Sleep(time.Second)
+		item, err := graph.GetItemPath("/onedriver_tests/mmap.txt", auth)
+		if err == nil && item.File != nil &&
+			strings.EqualFold(item.File.Hashes.QuickXorHash, graph.QuickXORHash(&content)) {
+			return
+		}
+	}
+	t.Fatal("Writes to the mapping were never uploaded.")
+}
+
+// Dehydrated files keep their metadata, and their content is downloaded again
+// the next time they are read.
+func TestDehydrate(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "dehydrate.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("dehydrate me"), 0644))
+
+	inode, err := fsCache.GetPath("/onedriver_tests/dehydrate.txt", auth)
+	failOnErr(t, err)
+	for i := 0; i < 60 && isLocalID(inode.ID()); i++ {
+		time.Sleep(time.Second) // wait for the upload to finish
+	}
+	failOnErr(t, fsCache.uploads.WaitUpload(inode.ID()))
+
+	files, _, err := fsCache.Dehydrate(inode)
+	failOnErr(t, err)
+	if files != 1 || inode.HasContent() || fsCache.hasContent(inode.ID()) {
+		t.Fatalf("File was not dehydrated (%d files).\n", files)
+	}
+
+	content, err := ioutil.ReadFile(fname)
+	failOnErr(t, err)
+	if string(content) != "dehydrate me" {
+		t.Fatalf("Read \"%s\" after dehydrating.\n", content)
+	}
+}
+
+// Files should keep their inode number, even once they are uploaded and get a
+// new ID.
+func TestStableInodeNumbers(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "stable_ino.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("my inode number never changes"), 0644))
+	st, err := os.Stat(fname)
+	failOnErr(t, err)
+	ino := st.Sys().(*syscall.Stat_t).Ino
+
+	inode, err := fsCache.GetPath("/onedriver_tests/stable_ino.txt", auth)
+	failOnErr(t, err)
+	for i := 0; i < 60 && isLocalID(inode.ID()); i++ {
+		time.Sleep(time.Second) // wait for the upload to assign a new ID
+	}
+	if isLocalID(inode.ID()) {
+		t.Fatal("File was never uploaded.")
+	}
+
+	st, err = os.Stat(fname)
+	failOnErr(t, err)
+	if newIno := st.Sys().(*syscall.Stat_t).Ino; newIno != ino {
+		t.Fatalf("Inode number changed from %d to %d.\n", ino, newIno)
+	}
+	if fsCache.Ino(inode.ID()) != ino {
+		t.Fatal("Cache reported a different inode number than stat().")
+	}
+}
+
+// Hard links should fail unless emulated, in which case they are copies.
+func TestHardLinkEmulation(t *testing.T) {
+	// not parallel, since this changes the options of the shared cache
+	fname := filepath.Join(TestDir, "link_target.txt")
+	lname := filepath.Join(TestDir, "link.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("linked content\n"), 0644))
+	if err := os.Link(fname, lname); err == nil {
+		t.Fatal("Hard link was created without emulation.")
+	}
+
+	fsCache.opts.EmulateHardLinks = true
+	defer func() { fsCache.opts.EmulateHardLinks = false }()
+	failOnErr(t, os.Link(fname, lname))
+	content, err := ioutil.ReadFile(lname)
+	failOnErr(t, err)
+	if string(content) != "linked content\n" {
+		t.Fatalf("Link had the wrong content: \"%s\"\n", content)
+	}
+}
+
+// Extended attributes OneDrive cannot store should be kept locally, and follow
+// the file when it is renamed.
+func TestLocalXattrs(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "local_xattrs.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("xattrs"), 0644))
+	failOnErr(t, syscall.Setxattr(fname, "user.test", []byte("value"), 0))
+	if err := syscall.Setxattr(fname, "user.test", []byte("value"), 1); err != syscall.EEXIST {
+		t.Fatal("XATTR_CREATE did not fail for an existing attribute:", err)
+	}
+
+	renamed := filepath.Join(TestDir, "local_xattrs_renamed.txt")
+	failOnErr(t, os.Rename(fname, renamed))
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(renamed, "user.test", buf)
+	failOnErr(t, err)
+	if string(buf[:n]) != "value" {
+		t.Fatalf("Got \"%s\", wanted \"value\".\n", buf[:n])
+	}
+
+	failOnErr(t, syscall.Removexattr(renamed, "user.test"))
+	if _, err = syscall.Getxattr(renamed, "user.test", buf); err != syscall.ENODATA {
+		t.Fatal("Attribute still present after removal:", err)
+	}
+}
+
+// The sync state of a file should follow it from being written to being
+// evicted.
+func TestXattrState(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "xattr_state.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("state"), 0644))
+
+	buf := make([]byte, 64)
+	state := ""
+	for i := 0; i < retrySeconds && state != stateHydrated; i++ {
+		n, err := syscall.Getxattr(fname, xattrState, buf)
+		failOnErr(t, err)
+		state = string(buf[:n])
+		if state != stateUploading && state != stateDirty && state != stateHydrated {
+			t.Fatalf("Unexpected state \"%s\" of a new file.\n", state)
+		}
+		time.Sleep(time.Second)
+	}
+	if state != stateHydrated {
+		t.Fatalf("File was still \"%s\" after being uploaded.\n", state)
+	}
+
+	failOnErr(t, syscall.Setxattr(fname, xattrEvict, []byte("1"), 0))
+	n, err := syscall.Getxattr(fname, xattrState, buf)
+	failOnErr(t, err)
+	if string(buf[:n]) != stateCloudOnly {
+		t.Fatalf("Evicted file was \"%s\", not cloud-only.\n", buf[:n])
+	}
+}
+
+// Thumbnails take a request to the server to get, so they should not be listed,
+// and cannot be written.
+func TestXattrThumbnail(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "xattr_thumbnail.txt")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("no picture here"), 0644))
+
+	buf := make([]byte, 4096)
+	n, err := syscall.Listxattr(fname, buf)
+	failOnErr(t, err)
+	if strings.Contains(string(buf[:n]), xattrThumbnail) {
+		t.Fatalf("Thumbnails were listed: \"%s\"\n", buf[:n])
+	}
+	attr := xattrThumbnail + graph.ThumbnailSmall
+	if err = syscall.Setxattr(fname, attr, []byte("x"), 0); err != syscall.ENOTSUP {
+		t.Fatal("Setting a thumbnail did not fail with ENOTSUP:", err)
+	}
+}
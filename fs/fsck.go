@@ -0,0 +1,167 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Items that were created locally but never made it to the server keep their
+// local IDs across restarts. The ones that cannot simply be uploaded again are
+// tracked here until the user decides what to do with them.
+var bucketUnsynced = []byte("unsynced")
+
+// UnsyncedItem describes a local item that could not be uploaded.
+type UnsyncedItem struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// localItems returns all file metadata on disk that still has a local ID.
+func (c *Cache) localItems() []*Inode {
+	ids := make([]string, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).ForEach(func(k, v []byte) error {
+			if strings.HasPrefix(string(k), "local-") {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+
+	items := make([]*Inode, 0)
+	for _, id := range ids {
+		if inode := c.GetID(id); inode != nil && !inode.IsDir() {
+			items = append(items, inode)
+		}
+	}
+	return items
+}
+
+// uploadLocalItem attempts to upload an item that was never uploaded, returning
+// an error explaining why if this is not possible.
+func (c *Cache) uploadLocalItem(inode *Inode, auth *graph.Auth) error {
+	parent := c.GetID(inode.ParentID())
+	if parent == nil || isLocalID(parent.ID()) {
+		return errors.New("parent folder no longer exists")
+	}
+	// don't clobber something that was created remotely in the meantime
+	remote, err := c.drive.GetItemChild(parent.ID(), inode.Name(), auth)
+	if err == nil && remote.ID != inode.ID() {
+		return errors.New("an item with the same name exists on the server")
+	}
+
+	id := inode.ID()
+	if !c.hasContent(id) {
+		if inode.Size() > 0 {
+			return errors.New("local content was lost")
+		}
+		if err := c.InsertContent(id, make([]byte, 0)); err != nil {
+			return err
+		}
+	}
+
+	session, err := NewUploadSession(inode, auth)
+	if err == nil {
+		if err = session.Upload(auth); err == nil {
+			// the item gets its ID from the upload
+			c.uploadComplete(id, session.getUploaded())
+		}
+		session.removeSnapshot()
+	}
+	return err
+}
+
+// ReconcileLocalItems retries the upload of every file left over from a
+// previous session that was never uploaded. Items that still cannot be uploaded
+// are recorded as unsynced and returned. Should be called before the filesystem
+// is mounted, as new files legitimately have local IDs until they are uploaded.
+func (c *Cache) ReconcileLocalItems(auth *graph.Auth) []UnsyncedItem {
+	if c.IsOffline() {
+		return c.GetUnsynced()
+	}
+	for _, inode := range c.localItems() {
+		id := inode.ID()
+		path := inode.Path()
+		if err := c.uploadLocalItem(inode, auth); err != nil {
+			log.WithFields(log.Fields{
+				"id":   id,
+				"path": path,
+				"err":  err,
+			}).Warn("Could not upload item left over from a previous session.")
+			c.setUnsynced(UnsyncedItem{ID: id, Path: path, Reason: err.Error()})
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":    id,
+			"newID": inode.ID(),
+			"path":  path,
+		}).Info("Uploaded item left over from a previous session.")
+		c.removeLocalItem(id)
+	}
+	return c.GetUnsynced()
+}
+
+// GetUnsynced returns all items that could not be uploaded.
+func (c *Cache) GetUnsynced() []UnsyncedItem {
+	items := make([]UnsyncedItem, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUnsynced).ForEach(func(k, v []byte) error {
+			var item UnsyncedItem
+			if v, err := c.sealer.open(v); err == nil && json.Unmarshal(v, &item) == nil {
+				items = append(items, item)
+			}
+			return nil
+		})
+	})
+	return items
+}
+
+func (c *Cache) setUnsynced(item UnsyncedItem) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		contents, _ := json.Marshal(item)
+		return tx.Bucket(bucketUnsynced).Put([]byte(item.ID), c.sealer.seal(contents))
+	})
+}
+
+// removeLocalItem deletes all traces of a local ID from disk.
+func (c *Cache) removeLocalItem(id string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket(bucketMetadata).Delete([]byte(id))
+		return tx.Bucket(bucketUnsynced).Delete([]byte(id))
+	})
+	c.DeleteContent(id)
+}
+
+// DiscardUnsynced permanently deletes all unsynced items and their content from
+// the cache. Returns the items that were discarded.
+func (c *Cache) DiscardUnsynced() []UnsyncedItem {
+	items := c.GetUnsynced()
+	for _, item := range items {
+		if inode := c.GetID(item.ID); inode != nil {
+			if parent := c.GetID(inode.ParentID()); parent != nil {
+				parent.mutex.Lock()
+				for i, childID := range parent.children {
+					if childID == item.ID {
+						parent.children = append(parent.children[:i], parent.children[i+1:]...)
+						break
+					}
+				}
+				parent.mutex.Unlock()
+			}
+			c.metadata.Delete(item.ID)
+		}
+		c.removeLocalItem(item.ID)
+		log.WithFields(log.Fields{
+			"id":   item.ID,
+			"path": item.Path,
+		}).Info("Discarded unsynced item.")
+	}
+	c.SerializeAll() // parents no longer reference the discarded items
+	return items
+}
@@ -0,0 +1,139 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Capabilities are the behaviors that differ between types of drives. Check
+// these instead of comparing drive types, so that all of the differences
+// between personal and business drives are listed in one place.
+type Capabilities struct {
+	DriveType string
+
+	// SHA1 is whether files are hashed with SHA1 (QuickXorHash otherwise).
+	SHA1 bool
+
+	// ScopedDelta is whether changes can be fetched for a single folder
+	// instead of only for the entire drive.
+	ScopedDelta bool
+
+	// FileCount is whether the drive's quota includes the number of files.
+	FileCount bool
+
+	// SpecialFolders are the special folders that can be looked up by name.
+	// https://docs.microsoft.com/en-us/graph/api/drive-get-specialfolder
+	SpecialFolders []string
+}
+
+var capabilities = map[string]Capabilities{
+	DriveTypePersonal: {
+		DriveType:      DriveTypePersonal,
+		SHA1:           true,
+		ScopedDelta:    true,
+		SpecialFolders: []string{"documents", "photos", "cameraroll", "approot", "music"},
+	},
+	DriveTypeBusiness: {
+		DriveType:      DriveTypeBusiness,
+		FileCount:      true,
+		SpecialFolders: []string{"approot"},
+	},
+	DriveTypeSharepoint: {
+		DriveType: DriveTypeSharepoint,
+		FileCount: true,
+	},
+}
+
+// CapabilitiesOf returns the capabilities of a type of drive. Unknown types
+// get the capabilities of a business drive (along with an error), since new
+// types of drives are far more likely to be business offerings.
+func CapabilitiesOf(driveType string) (Capabilities, error) {
+	if caps, exists := capabilities[driveType]; exists {
+		return caps, nil
+	}
+	caps := capabilities[DriveTypeBusiness]
+	caps.DriveType = driveType
+	return caps, fmt.Errorf("unknown drive type \"%s\"", driveType)
+}
+
+// SpecialFolderNames are the display names of special folders, by the name the
+// API uses for them.
+var SpecialFolderNames = map[string]string{
+	"documents":  "Documents",
+	"photos":     "Photos",
+	"cameraroll": "Camera Roll",
+	"music":      "Music",
+	"approot":    "Apps",
+}
+
+// NormalizeSpecialFolder turns a special folder name like "Camera Roll" into
+// the name the API uses for it ("cameraroll").
+func NormalizeSpecialFolder(name string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(name))
+}
+
+// UnsupportedError is returned when a feature is not available on a type of
+// drive.
+type UnsupportedError struct {
+	Feature   string
+	DriveType string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s is not available on %s drives", e.Feature, e.DriveType)
+}
+
+// Unsupported returns an UnsupportedError for a feature.
+func (c Capabilities) Unsupported(feature string) error {
+	return &UnsupportedError{Feature: feature, DriveType: c.DriveType}
+}
+
+// HasSpecialFolder returns whether a special folder exists on this type of
+// drive.
+func (c Capabilities) HasSpecialFolder(name string) bool {
+	for _, folder := range c.SpecialFolders {
+		if strings.EqualFold(folder, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash hashes content with the hash this type of drive uses.
+func (c Capabilities) Hash(content *[]byte) string {
+	if c.SHA1 {
+		return SHA1Hash(content)
+	}
+	return QuickXORHash(content)
+}
+
+// HashStream is like Hash, but for content read from reader.
+func (c Capabilities) HashStream(reader io.Reader) (string, error) {
+	if c.SHA1 {
+		return SHA1HashStream(reader)
+	}
+	return QuickXORHashStream(reader)
+}
+
+// Hashes returns the hashes of content as the server would report them.
+func (c Capabilities) Hashes(content *[]byte) Hashes {
+	return c.HashesOf(c.Hash(content))
+}
+
+// HashesOf returns a hash made with Hash or HashStream as the server would
+// report it.
+func (c Capabilities) HashesOf(hash string) Hashes {
+	if c.SHA1 {
+		return Hashes{SHA1Hash: hash}
+	}
+	return Hashes{QuickXorHash: hash}
+}
+
+// Checksum returns the hash this type of drive uses from a set of hashes.
+func (c Capabilities) Checksum(hashes Hashes) string {
+	if c.SHA1 {
+		return hashes.SHA1Hash
+	}
+	return hashes.QuickXorHash
+}
@@ -0,0 +1,73 @@
+package graph
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The Date header only has a resolution of one second, so smaller differences
+// between the local and server clocks cannot be measured and are ignored.
+const minClockSkew = 2 * time.Second
+
+// warnClockSkew is how far the local clock can drift from the server's before
+// the user is told to fix it.
+const warnClockSkew = time.Minute
+
+var clock struct {
+	sync.RWMutex
+	skew     time.Duration // server time minus local time
+	measured bool
+	warned   bool
+}
+
+// recordClockSkew updates the estimated difference between the local and server
+// clocks from the Date header of a response to a request sent at sent.
+func recordClockSkew(response *http.Response, sent time.Time) {
+	date, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	received := time.Now()
+	// the server's clock was read somewhere between sending and receiving, and
+	// on average half a second before what the Date header says (it is rounded
+	// down to the second)
+	sample := date.Add(500 * time.Millisecond).Sub(sent.Add(received.Sub(sent) / 2))
+
+	clock.Lock()
+	defer clock.Unlock()
+	if !clock.measured {
+		clock.skew = sample
+		clock.measured = true
+	} else {
+		// smooth out network latency and the Date header's rounding
+		clock.skew += (sample - clock.skew) / 4
+	}
+	if !clock.warned && (clock.skew > warnClockSkew || clock.skew < -warnClockSkew) {
+		clock.warned = true
+		log.WithField("skew", clock.skew.Round(time.Second)).Warn(
+			"The local clock differs from the OneDrive server's clock. " +
+				"Timestamps will be corrected, but you should fix your system clock.")
+	}
+}
+
+// ClockSkew returns how far ahead the server's clock is relative to the local
+// clock (negative if it is behind). Returns 0 if the clocks are too close
+// together to tell apart.
+func ClockSkew() time.Duration {
+	clock.RLock()
+	defer clock.RUnlock()
+	if clock.skew < minClockSkew && clock.skew > -minClockSkew {
+		return 0
+	}
+	return clock.skew
+}
+
+// ServerNow returns the current time according to the server's clock. Local
+// timestamps should use this so they can be compared with timestamps set by the
+// server.
+func ServerNow() time.Time {
+	return time.Now().Add(ClockSkew())
+}
@@ -0,0 +1,130 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Copies are performed by the server in the background. Their progress is
+// polled from a monitor URL, more slowly the longer they take.
+const (
+	copyPollMin       = 500 * time.Millisecond
+	copyPollMax       = 5 * time.Second
+	copyPollMaxErrors = 3
+)
+
+// monitorClient fetches monitor URLs. These do not require authentication, and
+// redirect to the new item once a copy is complete (which does).
+var monitorClient = &http.Client{
+	Timeout: 15 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// CopyStatus is the progress of a copy as reported by its monitor URL.
+// https://docs.microsoft.com/en-us/graph/long-running-actions-overview
+type CopyStatus struct {
+	Status             string  `json:"status"` // notStarted | inProgress | completed | failed
+	PercentageComplete float64 `json:"percentageComplete"`
+	ResourceID         string  `json:"resourceId,omitempty"` // ID of the new item
+	Error              *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// Copy starts copying an item (and its children, if it is a folder) to a new
+// parent on this drive. Anything already at the destination is replaced. The
+// copy happens asynchronously on the server, use WaitCopy with the returned
+// monitor URL to find out when it is done.
+func (d Drive) Copy(id string, name string, parentID string, auth *Auth) (string, error) {
+	payload, _ := json.Marshal(DriveItem{
+		Name:   name,
+		Parent: &DriveItemParent{ID: parentID, DriveID: d.ID},
+	})
+	_, header, err := request(d.IDPath(id)+"/copy?@microsoft.graph.conflictBehavior=replace",
+		auth, "POST", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	monitor := header.Get("Location")
+	if monitor == "" {
+		return "", errors.New("server did not return a monitor URL for the copy")
+	}
+	return monitor, nil
+}
+
+// PollCopy fetches the progress of a copy from its monitor URL.
+func PollCopy(monitor string) (*CopyStatus, error) {
+	response, err := monitorClient.Get(monitor)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusSeeOther {
+		// the location is the new item
+		return &CopyStatus{
+			Status:             "completed",
+			PercentageComplete: 100,
+			ResourceID:         path.Base(response.Header.Get("Location")),
+		}, nil
+	}
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("HTTP %d while checking the progress of a copy",
+			response.StatusCode)
+	}
+	status := &CopyStatus{}
+	return status, json.NewDecoder(response.Body).Decode(status)
+}
+
+// WaitCopy polls the monitor URL of a copy until it finishes and returns the ID
+// of the new item. progress, if not nil, is called with every status received.
+// Stops waiting (but cannot stop the copy itself) when ctx is done.
+func WaitCopy(ctx context.Context, monitor string, progress func(CopyStatus)) (string, error) {
+	interval := copyPollMin
+	errs := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > copyPollMax {
+			interval = copyPollMax
+		}
+
+		status, err := PollCopy(monitor)
+		if err != nil {
+			if errs++; errs >= copyPollMaxErrors {
+				return "", err
+			}
+			continue
+		}
+		errs = 0
+		if progress != nil {
+			progress(*status)
+		}
+
+		switch status.Status {
+		case "completed":
+			if status.ResourceID == "" {
+				return "", errors.New("copy completed, but the server did not say where")
+			}
+			return status.ResourceID, nil
+		case "failed":
+			if status.Error != nil {
+				return "", fmt.Errorf("copy failed - %s: %s",
+					status.Error.Code, status.Error.Message)
+			}
+			return "", errors.New("copy failed")
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// downloadChunkSize is how much content is requested at once when streaming a
+// download. A connection that drops only loses what was left of its chunk.
+const downloadChunkSize = 10 * 1024 * 1024
+
+// downloadResumeAttempts is how many times in a row a download continues from
+// where it stopped after failing, before giving up.
+const downloadResumeAttempts = 5
+
+// downloadClient gives up on servers that stop responding, but not on bodies
+// that take a long time to arrive (large chunks, or a bandwidth limit).
+var downloadClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = 30 * time.Second
+		return transport
+	}(),
+}
+
+// DefaultDownloadSegments is how many parts of a large file are downloaded at
+// the same time by default.
+const DefaultDownloadSegments = 4
+
+// downloadSegments is how many parts of a large file are downloaded at the same
+// time, see SetDownloadSegments.
+var downloadSegments int32 = DefaultDownloadSegments
+
+// SetDownloadSegments changes how many parts of a large file are downloaded at
+// the same time by GetItemContentStream (1 downloads files from start to end
+// over a single connection). Can be changed at any time.
+func SetDownloadSegments(segments int) {
+	if segments < 1 {
+		segments = 1
+	}
+	atomic.StoreInt32(&downloadSegments, int32(segments))
+}
+
+// DownloadSegments returns how many parts of a large file are downloaded at the
+// same time.
+func DownloadSegments() int {
+	return int(atomic.LoadInt32(&downloadSegments))
+}
+
+// offsetWriter writes sequentially to an io.WriterAt, starting at an offset.
+type offsetWriter struct {
+	writer io.WriterAt
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// contentURL returns the URL to download the content of an item on this drive
+// from.
+func (d Drive) contentURL(id string) string {
+	return GraphURL + d.IDPath(id) + "/content"
+}
+
+// GetItemContentRange downloads up to length bytes of the content of an item on
+// this drive, starting at offset, and writes them to output as they arrive.
+// Returns how many bytes were written and the size of the entire content.
+// Nothing is written if offset is at or past the end of the content.
+func (d Drive) GetItemContentRange(ctx context.Context, id string, offset uint64,
+	length uint64, output io.Writer, priority Priority, auth *Auth) (uint64, uint64, error) {
+	download := &transferReader{
+		key:      transferKey{direction: Download, id: id},
+		priority: priority,
+	}
+	return getRange(ctx, d.contentURL(id), offset, length, output, download, auth)
+}
+
+// GetItemContentStream downloads the content of an item on this drive into
+// output, a chunk at a time, and returns its size. Large files are downloaded in
+// several parts at once (see SetDownloadSegments). A chunk that fails or is cut
+// off continues from where it stopped instead of starting over, so that large
+// files never have to be held in memory or downloaded twice.
+func (d Drive) GetItemContentStream(ctx context.Context, id string, output io.WriterAt,
+	priority Priority, auth *Auth) (uint64, error) {
+	download := &transferReader{
+		key:      transferKey{direction: Download, id: id},
+		priority: priority,
+	}
+	return streamContent(ctx, d.contentURL(id), output, DownloadSegments(), download, auth)
+}
+
+// getRange is GetItemContentRange for the content at url.
+func getRange(ctx context.Context, url string, offset uint64, length uint64,
+	output io.Writer, download *transferReader, auth *Auth) (uint64, uint64, error) {
+	if auth == nil || auth.AccessToken == "" {
+		return 0, 0, errors.New("cannot make a request with empty auth")
+	}
+	auth.Refresh()
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Add("Authorization", "bearer "+auth.AccessToken)
+	request.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	sent := time.Now()
+	response, err := downloadClient.Do(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer response.Body.Close()
+	recordClockSkew(response, sent)
+
+	body := download.wrap(response.Body)
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		total, err := contentRangeTotal(response.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, 0, err
+		}
+		written, err := io.Copy(output, body)
+		return uint64(written), total, err
+
+	case http.StatusOK:
+		// the range was ignored and the entire content is on its way, which
+		// is kept as a whole so that the caller does not ask for the rest
+		if _, err := io.CopyN(ioutil.Discard, body, int64(offset)); err != nil {
+			if err == io.EOF {
+				return 0, offset, nil
+			}
+			return 0, 0, err
+		}
+		written, err := io.Copy(output, body)
+		return uint64(written), offset + uint64(written), err
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// nothing left to download
+		total, err := contentRangeTotal(response.Header.Get("Content-Range"))
+		if err != nil {
+			total = offset
+		}
+		return 0, total, nil
+	}
+	errBody, _ := ioutil.ReadAll(response.Body)
+	return 0, 0, responseError(response, errBody)
+}
+
+// contentRangeTotal returns the size of the entire content from a
+// Content-Range header, like "bytes 0-99/1234".
+func contentRangeTotal(header string) (uint64, error) {
+	slash := strings.LastIndex(header, "/")
+	if slash < 0 {
+		return 0, fmt.Errorf("invalid Content-Range \"%s\"", header)
+	}
+	total, err := strconv.ParseUint(header[slash+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range \"%s\"", header)
+	}
+	return total, nil
+}
+
+// resumable returns whether a download that failed with err may succeed if it
+// continues where it stopped.
+func resumable(err error) bool {
+	if _, throttled := IsThrottled(err); throttled {
+		return true
+	}
+	if IsOffline(err) {
+		return false
+	}
+	msg := err.Error()
+	return !strings.HasPrefix(msg, "HTTP ") || strings.HasPrefix(msg, "HTTP 5")
+}
+
+// streamContent is GetItemContentStream for the content at url. After the first
+// chunk, which tells how large the content is, the rest is split into up to
+// segments parts that are downloaded at the same time, since a single
+// connection is often much slower than the line it runs over.
+func streamContent(ctx context.Context, url string, output io.WriterAt, segments int,
+	download *transferReader, auth *Auth) (uint64, error) {
+	if segments <= 1 {
+		return streamRange(ctx, url, output, 0, ^uint64(0), download, auth)
+	}
+	size, err := streamRange(ctx, url, output, 0, downloadChunkSize, download, auth)
+	if err != nil || size <= downloadChunkSize {
+		return size, err
+	}
+
+	// every segment is at least a chunk long
+	remaining := size - downloadChunkSize
+	if chunks := (remaining + downloadChunkSize - 1) / downloadChunkSize; chunks < uint64(segments) {
+		segments = int(chunks)
+	}
+	length := (remaining + uint64(segments) - 1) / uint64(segments)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, segments)
+	for offset := uint64(downloadChunkSize); offset < size; offset += length {
+		end := offset + length
+		if end > size {
+			end = size
+		}
+		go func(offset uint64, end uint64) {
+			_, err := streamRange(ctx, url, output, offset, end, download, auth)
+			if err != nil {
+				cancel() // the others are of no use without this one
+			}
+			errs <- err
+		}(offset, end)
+	}
+	for n := 0; n < segments; n++ {
+		if segmentErr := <-errs; segmentErr != nil && err == nil {
+			err = segmentErr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// streamRange downloads the content at url from offset up to end (or the end of
+// the content, if that comes first) into output, a chunk at a time, continuing
+// from where it stopped when a chunk fails. Returns the size of the entire
+// content.
+func streamRange(ctx context.Context, url string, output io.WriterAt, offset uint64,
+	end uint64, download *transferReader, auth *Auth) (uint64, error) {
+	size := ^uint64(0) // unknown until the first response
+	attempts := 0
+	for offset < end {
+		length := end - offset
+		if length > downloadChunkSize {
+			length = downloadChunkSize
+		}
+		written, total, err := getRange(ctx, url, offset, length,
+			&offsetWriter{writer: output, offset: int64(offset)}, download, auth)
+		offset += written
+		if err == nil {
+			size = total
+			if end > size {
+				end = size
+			}
+			if written == 0 && offset < end {
+				return 0, fmt.Errorf("download stopped at %d of %d bytes", offset, size)
+			}
+			attempts = 0
+			continue
+		}
+
+		attempts++
+		if ctx.Err() != nil || !resumable(err) || attempts > downloadResumeAttempts {
+			return 0, err
+		}
+		wait, throttled := IsThrottled(err)
+		if !throttled {
+			wait = time.Duration(attempts*attempts) * time.Second
+		}
+		log.WithFields(log.Fields{
+			"url":    url,
+			"offset": offset,
+			"wait":   wait,
+			"err":    err,
+		}).Warn("Download was interrupted, resuming where it stopped.")
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return size, nil
+}
@@ -3,6 +3,7 @@ package graph
 import (
 	"bytes"
 	"encoding/json"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -56,44 +57,52 @@ type DriveItem struct {
 	ID               string           `json:"id,omitempty"`
 	Name             string           `json:"name,omitempty"`
 	Size             uint64           `json:"size,omitempty"`
+	Description      string           `json:"description,omitempty"`
+	ETag             string           `json:"eTag,omitempty"`
+	CTag             string           `json:"cTag,omitempty"` // changes only with the content
 	ModTime          *time.Time       `json:"lastModifiedDatetime,omitempty"`
 	Parent           *DriveItemParent `json:"parentReference,omitempty"`
 	Folder           *Folder          `json:"folder,omitempty"`
 	File             *File            `json:"file,omitempty"`
 	Deleted          *Deleted         `json:"deleted,omitempty"`
+	RemoteItem       *DriveItem       `json:"remoteItem,omitempty"` // set on items shared from another drive
 	ConflictBehavior string           `json:"@microsoft.graph.conflictBehavior,omitempty"`
 }
 
 // GetItem fetches a DriveItem by ID. ID can also be "root" for the root item.
 func GetItem(id string, auth *Auth) (*DriveItem, error) {
-	path := "/me/drive/items/" + id
-	if id == "root" {
-		path = "/me/drive/root"
-	}
+	return Drive{}.GetItem(id, auth)
+}
 
-	body, err := Get(path, auth)
+// GetItem fetches a DriveItem on this drive by ID. ID can also be "root" for the
+// root item.
+func (d Drive) GetItem(id string, auth *Auth) (*DriveItem, error) {
+	body, err := Get(d.IDPath(id), auth)
 	if err != nil {
 		return nil, err
 	}
-	item := &DriveItem{}
-	err = json.Unmarshal(body, item)
-	if err != nil && bytes.Contains(body, []byte("\"size\":-")) {
-		// onedrive for business directories can sometimes have negative sizes,
-		// ignore this error
-		err = nil
-	}
-	return item, err
+	return unmarshalItem(body)
 }
 
 // GetItemPath fetches a DriveItem by path. Only used in special cases, like for the
 // root item.
 func GetItemPath(path string, auth *Auth) (*DriveItem, error) {
-	body, err := Get(ResourcePath(path), auth)
-	item := &DriveItem{}
+	return Drive{}.GetItemPath(path, auth)
+}
+
+// GetItemPath fetches a DriveItem on this drive by path.
+func (d Drive) GetItemPath(path string, auth *Auth) (*DriveItem, error) {
+	body, err := Get(d.ResourcePath(path), auth)
 	if err != nil {
-		return item, err
+		return &DriveItem{}, err
 	}
-	err = json.Unmarshal(body, item)
+	return unmarshalItem(body)
+}
+
+// unmarshalItem parses a DriveItem from an API response
+func unmarshalItem(body []byte) (*DriveItem, error) {
+	item := &DriveItem{}
+	err := json.Unmarshal(body, item)
 	if err != nil && bytes.Contains(body, []byte("\"size\":-")) {
 		// onedrive for business directories can sometimes have negative sizes,
 		// ignore this error
@@ -102,25 +111,78 @@ func GetItemPath(path string, auth *Auth) (*DriveItem, error) {
 	return item, err
 }
 
+// GetSpecialFolder fetches one of the special folders of this drive (like
+// "photos") by the name the API uses for it. Note that fetching "approot"
+// creates the app's folder if it does not exist yet.
+// https://docs.microsoft.com/en-us/graph/api/drive-get-specialfolder
+func (d Drive) GetSpecialFolder(name string, auth *Auth) (*DriveItem, error) {
+	body, err := Get(d.Path()+"/special/"+url.PathEscape(name), auth)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalItem(body)
+}
+
+// GetItemChild fetches the named child of an item.
+func GetItemChild(id string, name string, auth *Auth) (*DriveItem, error) {
+	return Drive{}.GetItemChild(id, name, auth)
+}
+
+// GetItemChild fetches the named child of an item on this drive.
+func (d Drive) GetItemChild(id string, name string, auth *Auth) (*DriveItem, error) {
+	body, err := Get(d.IDPath(id)+":/"+url.PathEscape(name), auth)
+	if err != nil {
+		return &DriveItem{}, err
+	}
+	return unmarshalItem(body)
+}
+
 // GetItemContent retrieves an item's content from the Graph endpoint.
 func GetItemContent(id string, auth *Auth) ([]byte, error) {
-	return Get("/me/drive/items/"+id+"/content", auth)
+	return Drive{}.GetItemContent(id, auth)
+}
+
+// GetItemContent retrieves the content of an item on this drive for a program
+// that is waiting for it.
+func (d Drive) GetItemContent(id string, auth *Auth) ([]byte, error) {
+	return d.GetItemContentPriority(id, PriorityInteractive, auth)
+}
+
+// GetItemContentPriority retrieves the content of an item on this drive, with a
+// priority for sharing the bandwidth limit with other transfers.
+func (d Drive) GetItemContentPriority(id string, priority Priority, auth *Auth) ([]byte, error) {
+	download := &transferReader{
+		key:      transferKey{direction: Download, id: id},
+		priority: priority,
+	}
+	body, _, err := scheduledRequest(d.IDPath(id)+"/content", auth, "GET", nil, download, "")
+	return body, err
 }
 
 // Remove removes a directory or file by ID
 func Remove(id string, auth *Auth) error {
-	return Delete("/me/drive/items/"+id, auth)
+	return Drive{}.Remove(id, auth)
+}
+
+// Remove removes a directory or file on this drive by ID
+func (d Drive) Remove(id string, auth *Auth) error {
+	return Delete(d.IDPath(id), auth)
 }
 
 // Mkdir creates a directory on the server at the specified parent ID.
 func Mkdir(name string, parentID string, auth *Auth) (*DriveItem, error) {
+	return Drive{}.Mkdir(name, parentID, auth)
+}
+
+// Mkdir creates a directory on this drive at the specified parent ID.
+func (d Drive) Mkdir(name string, parentID string, auth *Auth) (*DriveItem, error) {
 	// create a new folder on the server
 	newFolderPost := DriveItem{
 		Name:   name,
 		Folder: &Folder{},
 	}
 	bytePayload, _ := json.Marshal(newFolderPost)
-	resp, err := Post(childrenPathID(parentID), auth, bytes.NewReader(bytePayload))
+	resp, err := Post(d.IDPath(parentID)+"/children", auth, bytes.NewReader(bytePayload))
 	if err != nil {
 		return nil, err
 	}
@@ -128,9 +190,45 @@ func Mkdir(name string, parentID string, auth *Auth) (*DriveItem, error) {
 	return &newFolderPost, err
 }
 
+// CreateEmptyFile creates an empty file on this drive at the specified parent
+// ID, without uploading any content. conflictBehavior may be empty, in which
+// case creating a file with the name of an existing item fails.
+func (d Drive) CreateEmptyFile(name string, parentID string, conflictBehavior string,
+	auth *Auth) (*DriveItem, error) {
+	post := map[string]interface{}{
+		"name": name,
+		"file": map[string]interface{}{},
+	}
+	if conflictBehavior != "" {
+		post["@microsoft.graph.conflictBehavior"] = conflictBehavior
+	}
+	payload, _ := json.Marshal(post)
+	resp, err := Post(d.IDPath(parentID)+"/children", auth, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalItem(resp)
+}
+
+// UpdateItem patches the metadata of an item on this drive. Only the fields
+// present in patch are modified.
+func (d Drive) UpdateItem(id string, patch map[string]interface{}, auth *Auth) (*DriveItem, error) {
+	payload, _ := json.Marshal(patch)
+	resp, err := Patch(d.IDPath(id), auth, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalItem(resp)
+}
+
 // Rename moves and/or renames an item on the server. The itemName and parentID
 // arguments correspond to the *new* basename or id of the parent.
 func Rename(itemID string, itemName string, parentID string, auth *Auth) error {
+	return Drive{}.Rename(itemID, itemName, parentID, auth)
+}
+
+// Rename moves and/or renames an item on this drive.
+func (d Drive) Rename(itemID string, itemName string, parentID string, auth *Auth) error {
 	// start creating patch content for server
 	// mutex does not need to be initialized since it is never used locally
 	patchContent := DriveItem{
@@ -144,13 +242,13 @@ func Rename(itemID string, itemName string, parentID string, auth *Auth) error {
 	// apply patch to server copy - note that we don't actually care about the
 	// response content, only if it returns an error
 	jsonPatch, _ := json.Marshal(patchContent)
-	_, err := Patch("/me/drive/items/"+itemID, auth, bytes.NewReader(jsonPatch))
+	_, err := Patch(d.IDPath(itemID), auth, bytes.NewReader(jsonPatch))
 	if err != nil && strings.Contains(err.Error(), "resourceModified") {
 		// Wait a second, then retry the request. The Onedrive servers sometimes
 		// aren't quick enough here if the object has been recently created
 		// (<1 second ago).
 		time.Sleep(time.Second)
-		_, err = Patch("/me/drive/items/"+itemID, auth, bytes.NewReader(jsonPatch))
+		_, err = Patch(d.IDPath(itemID), auth, bytes.NewReader(jsonPatch))
 	}
 	return err
 }
@@ -182,7 +280,18 @@ func getItemChildren(pollURL string, auth *Auth) ([]*DriveItem, error) {
 
 // GetItemChildren fetches all children of an item denoted by ID.
 func GetItemChildren(id string, auth *Auth) ([]*DriveItem, error) {
-	return getItemChildren(childrenPathID(id), auth)
+	return Drive{}.GetItemChildren(id, auth)
+}
+
+// GetItemChildren fetches all children of an item on this drive denoted by ID.
+func (d Drive) GetItemChildren(id string, auth *Auth) ([]*DriveItem, error) {
+	return getItemChildren(d.IDPath(id)+"/children", auth)
+}
+
+// GetSharedWithMe lists the items that other users have shared with the user.
+// The RemoteItem field of each result references the actual shared item.
+func GetSharedWithMe(auth *Auth) ([]*DriveItem, error) {
+	return getItemChildren("/me/drive/sharedWithMe", auth)
 }
 
 // GetItemChildrenPath fetches all children of an item denoted by path.
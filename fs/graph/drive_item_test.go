@@ -16,3 +16,63 @@ func TestGetItem(t *testing.T) {
 		t.Fatal("We didn't return an error for a non-existent item!")
 	}
 }
+
+// Upload responses sometimes omit the hashes facet entirely, which should not
+// be mistaken for an item with hashes.
+func TestHasHashes(t *testing.T) {
+	t.Parallel()
+	item := DriveItem{}
+	if item.HasHashes() {
+		t.Fatal("Item without a file facet should not have hashes.")
+	}
+	item.File = &File{}
+	if item.HasHashes() {
+		t.Fatal("Item with an empty hashes facet should not have hashes.")
+	}
+	item.File.Hashes.QuickXorHash = "AAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	if !item.HasHashes() {
+		t.Fatal("Item with a QuickXorHash should have hashes.")
+	}
+}
+
+// Each drive type should hash content the way the server does, and unknown
+// types should be reported.
+func TestCapabilitiesOf(t *testing.T) {
+	t.Parallel()
+	content := []byte("capabilities")
+	personal, err := CapabilitiesOf(DriveTypePersonal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if personal.Hash(&content) != SHA1Hash(&content) {
+		t.Fatal("Personal drives should use SHA1 hashes.")
+	}
+	business, err := CapabilitiesOf(DriveTypeBusiness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if business.Checksum(business.Hashes(&content)) != QuickXORHash(&content) {
+		t.Fatal("Business drives should use QuickXorHash.")
+	}
+	if business.HasSpecialFolder("photos") || !personal.HasSpecialFolder("Photos") {
+		t.Fatal("Wrong special folders.")
+	}
+	if _, err = CapabilitiesOf("spaceship"); err == nil {
+		t.Fatal("Unknown drive type was not reported.")
+	}
+}
+
+// Special folders should be found by their display names too.
+func TestNormalizeSpecialFolder(t *testing.T) {
+	t.Parallel()
+	for display, name := range map[string]string{
+		"Camera Roll": "cameraroll",
+		"camera-roll": "cameraroll",
+		"Photos":      "photos",
+		"approot":     "approot",
+	} {
+		if NormalizeSpecialFolder(display) != name {
+			t.Fatalf("\"%s\" should be the \"%s\" special folder.", display, name)
+		}
+	}
+}
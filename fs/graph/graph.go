@@ -30,19 +30,55 @@ type graphError struct {
 
 // Request performs an authenticated request to Microsoft Graph
 func Request(resource string, auth *Auth, method string, content io.Reader) ([]byte, error) {
+	body, _, err := request(resource, auth, method, content)
+	return body, err
+}
+
+// request is like Request, but also returns the headers of the response.
+func request(resource string, auth *Auth, method string, content io.Reader) ([]byte, http.Header, error) {
+	return scheduledRequest(resource, auth, method, content, nil, "")
+}
+
+// ErrPreconditionFailed is wrapped by the error of a conditional request (see
+// PutIfMatch) when the item's tag no longer matches.
+var ErrPreconditionFailed = errors.New("item changed on the server")
+
+// ErrDeltaExpired is wrapped by the error of a delta request whose token the
+// server no longer accepts (HTTP 410), after which changes can only be tracked
+// from a new token.
+var ErrDeltaExpired = errors.New("delta token expired")
+
+// scheduledRequest is like request, but the response body is downloaded
+// through the transfer scheduler if download is not nil. If ifMatch is set, the
+// request only goes through if the item still has that eTag or cTag.
+func scheduledRequest(resource string, auth *Auth, method string, content io.Reader,
+	download *transferReader, ifMatch string) ([]byte, http.Header, error) {
 	if auth == nil || auth.AccessToken == "" {
 		// a catch all condition to avoid wiping our auth by accident
 		log.WithFields(log.Fields{
 			"caller":   logger.Caller(3),
 			"calledBy": logger.Caller(4),
 		}).Error("Auth was empty and we attempted to make a request with it!")
-		return nil, errors.New("cannot make a request with empty auth")
+		return nil, nil, errors.New("cannot make a request with empty auth")
 	}
 
 	auth.Refresh()
 
 	client := &http.Client{Timeout: 15 * time.Second}
 	request, _ := http.NewRequest(method, GraphURL+resource, content)
+	upload, isUpload := content.(*transferReader)
+	if isUpload {
+		// http.NewRequest can only tell the length of a few types of readers
+		if size := upload.size(); size > 0 {
+			request.ContentLength = size
+		} else if size == 0 {
+			request.Body = http.NoBody
+		}
+	}
+	if (isUpload && limited(Upload)) || (download != nil && limited(Download)) {
+		// a slow transfer is not a stuck one
+		client.Timeout = 0
+	}
 	request.Header.Add("Authorization", "bearer "+auth.AccessToken)
 	switch method { // request type-specific code here
 	case "PATCH":
@@ -53,13 +89,23 @@ func Request(resource string, auth *Auth, method string, content io.Reader) ([]b
 	case "PUT":
 		request.Header.Add("Content-Type", "text/plain")
 	}
+	if ifMatch != "" {
+		request.Header.Set("If-Match", ifMatch)
+	}
 
+	// uploads and downloads are paced by the transfer scheduler instead
+	paced := !isUpload && download == nil
+	if paced {
+		apiRequests.wait()
+	}
+	sent := time.Now()
 	response, err := client.Do(request)
 	if err != nil {
 		// the actual request failed
-		return nil, err
+		return nil, nil, err
 	}
-	body, _ := ioutil.ReadAll(response.Body)
+	recordClockSkew(response, sent)
+	body, _ := ioutil.ReadAll(download.wrap(response.Body))
 	response.Body.Close()
 
 	if response.StatusCode == 401 {
@@ -71,31 +117,103 @@ func Request(resource string, auth *Auth, method string, content io.Reader) ([]b
 		}).Warn("Authentication token invalid or new app permissions required, " +
 			"forcing reauth before retrying.")
 
-		reauth := newAuth(auth.path)
+		reauth := newAuth(auth.path, auth.Scopes)
 		auth.AccessToken = reauth.AccessToken
 		auth.RefreshToken = reauth.RefreshToken
 		auth.ExpiresAt = reauth.ExpiresAt
 		auth.Account = reauth.Account
+		auth.Scope = reauth.Scope
 		request.Header.Set("Authorization", "bearer "+auth.AccessToken)
 	}
 	if response.StatusCode >= 500 || response.StatusCode == 401 {
 		// the onedrive API is having issues, retry once
 		response, err = client.Do(request)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		body, _ = ioutil.ReadAll(download.wrap(response.Body))
+		response.Body.Close()
+	}
+
+	// back off as long as the server asks when throttled, as long as the
+	// request can be sent again (uploads are retried by their caller instead)
+	for attempt := 0; attempt < throttleRetries &&
+		Throttled(response.StatusCode, response.Header) && rewind(request); attempt++ {
+		wait := RetryAfter(response.Header)
+		log.WithFields(log.Fields{
+			"resource": resource,
+			"method":   method,
+			"status":   response.StatusCode,
+			"wait":     wait,
+		}).Warn("Throttled by the server, waiting before retrying.")
+		apiRequests.throttled(wait)
+		apiRequests.wait()
+		if response, err = client.Do(request); err != nil {
+			return nil, nil, err
 		}
-		body, _ = ioutil.ReadAll(response.Body)
+		body, _ = ioutil.ReadAll(download.wrap(response.Body))
 		response.Body.Close()
 	}
 
+	if Throttled(response.StatusCode, response.Header) {
+		// whatever is sent next waits too
+		apiRequests.throttled(RetryAfter(response.Header))
+	} else if paced {
+		apiRequests.succeeded()
+	}
+
 	if response.StatusCode >= 400 {
 		// something was wrong with the request
-		var err graphError
-		json.Unmarshal(body, &err)
-		return nil, fmt.Errorf("HTTP %d - %s: %s",
+		return nil, nil, responseError(response, body)
+	}
+	return body, response.Header, nil
+}
+
+// responseError returns the error for an unsuccessful response, from the error
+// message in its body.
+func responseError(response *http.Response, body []byte) error {
+	var err graphError
+	json.Unmarshal(body, &err)
+	if Throttled(response.StatusCode, response.Header) {
+		return &ThrottledError{
+			StatusCode: response.StatusCode,
+			Code:       err.Error.Code,
+			Message:    err.Error.Message,
+			RetryAfter: RetryAfter(response.Header),
+		}
+	}
+	if response.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("HTTP %d - %s: %s: %w",
+			response.StatusCode, err.Error.Code, err.Error.Message, ErrPreconditionFailed)
+	}
+	if response.StatusCode == http.StatusGone {
+		return fmt.Errorf("HTTP %d - %s: %s: %w",
+			response.StatusCode, err.Error.Code, err.Error.Message, ErrDeltaExpired)
+	}
+	if response.StatusCode == 403 && err.Error.Code == "accessDenied" {
+		return fmt.Errorf("HTTP %d - %s: %s (this may require additional "+
+			"permissions, see \"scopes\" in the onedriver config file)",
 			response.StatusCode, err.Error.Code, err.Error.Message)
 	}
-	return body, nil
+	return fmt.Errorf("HTTP %d - %s: %s",
+		response.StatusCode, err.Error.Code, err.Error.Message)
+}
+
+// rewind prepares a request to be sent again, returning false if its body has
+// already been read and cannot be recreated.
+func rewind(request *http.Request) bool {
+	if request.Body == nil || request.Body == http.NoBody {
+		return true
+	}
+	if request.GetBody == nil {
+		return false
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return false
+	}
+	request.Body = body
+	return true
 }
 
 // Get is a convenience wrapper around Request
@@ -118,6 +236,21 @@ func Put(resource string, auth *Auth, content io.Reader) ([]byte, error) {
 	return Request(resource, auth, "PUT", content)
 }
 
+// PutIfMatch is like Put, but fails with ErrPreconditionFailed unless the item
+// still has tag as its eTag or cTag, so that changes someone else made since
+// are not overwritten. An empty tag always matches.
+func PutIfMatch(resource string, auth *Auth, content io.Reader, tag string) ([]byte, error) {
+	body, _, err := scheduledRequest(resource, auth, "PUT", content, nil, tag)
+	return body, err
+}
+
+// PostIfMatch is like Post, but fails with ErrPreconditionFailed unless the
+// item still has tag as its eTag or cTag. An empty tag always matches.
+func PostIfMatch(resource string, auth *Auth, content io.Reader, tag string) ([]byte, error) {
+	body, _, err := scheduledRequest(resource, auth, "POST", content, nil, tag)
+	return body, err
+}
+
 // Delete performs an HTTP delete
 func Delete(resource string, auth *Auth) error {
 	_, err := Request(resource, auth, "DELETE", nil)
@@ -126,10 +259,24 @@ func Delete(resource string, auth *Auth) error {
 
 // ResourcePath translates an item's path to the proper path used by Graph
 func ResourcePath(path string) string {
+	return Drive{}.ResourcePath(path)
+}
+
+// ResourcePath translates the path of an item on this drive to the proper path
+// used by Graph
+func (d Drive) ResourcePath(path string) string {
 	if path == "/" {
-		return "/me/drive/root"
+		return d.Path() + "/root"
 	}
-	return "/me/drive/root:" + path
+	return d.Path() + "/root:" + path
+}
+
+// IDPath returns the API resource path of an item on this drive by ID
+func (d Drive) IDPath(id string) string {
+	if id == "root" {
+		return d.Path() + "/root"
+	}
+	return d.Path() + "/items/" + id
 }
 
 // ChildrenPath returns the path to an item's children
@@ -140,11 +287,6 @@ func childrenPath(path string) string {
 	return ResourcePath(path) + ":/children"
 }
 
-// ChildrenPathID returns the API resource path of an item's children
-func childrenPathID(id string) string {
-	return "/me/drive/items/" + id + "/children"
-}
-
 // User represents the user. Currently only used to fetch the account email so
 // we can display it in file managers with .xdg-volume-info
 // https://docs.microsoft.com/en-ca/graph/api/user-get
@@ -173,17 +315,34 @@ type DriveQuota struct {
 	Used      uint64 `json:"used"`
 }
 
-// Drive has some general information about the user's OneDrive
+// Drive has some general information about the user's OneDrive. Item operations
+// can be performed against a specific drive using its methods. The zero value
+// refers to the signed-in user's own drive.
 // https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/drive
 type Drive struct {
 	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
 	DriveType string     `json:"driveType"` // personal | business | documentLibrary
 	Quota     DriveQuota `json:"quota,omitempty"`
 }
 
+// Path returns the API resource path of the drive
+func (d Drive) Path() string {
+	if d.ID == "" {
+		return "/me/drive"
+	}
+	return "/drives/" + d.ID
+}
+
 // GetDrive is used to fetch the details of the user's OneDrive.
 func GetDrive(auth *Auth) (Drive, error) {
-	resp, err := Get("/me/drive", auth)
+	return GetDriveID("", auth)
+}
+
+// GetDriveID fetches the details of a drive by ID. An empty ID fetches the
+// user's own drive.
+func GetDriveID(id string, auth *Auth) (Drive, error) {
+	resp, err := Get(Drive{ID: id}.Path(), auth)
 	drive := Drive{}
 	if err != nil {
 		return drive, err
@@ -191,6 +350,53 @@ func GetDrive(auth *Auth) (Drive, error) {
 	return drive, json.Unmarshal(resp, &drive)
 }
 
+// GetDrives lists all of the drives available to the user.
+func GetDrives(auth *Auth) ([]Drive, error) {
+	resp, err := Get("/me/drives", auth)
+	if err != nil {
+		return nil, err
+	}
+	var drives struct {
+		Value []Drive `json:"value"`
+	}
+	return drives.Value, json.Unmarshal(resp, &drives)
+}
+
+// Site is a SharePoint site.
+type Site struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// GetFollowedSites lists the SharePoint sites the user follows. Requires the
+// Sites.Read.All scope.
+func GetFollowedSites(auth *Auth) ([]Site, error) {
+	if err := RequireScope(auth, "Sites.Read.All", "Listing SharePoint sites"); err != nil {
+		return nil, err
+	}
+	resp, err := Get("/me/followedSites", auth)
+	if err != nil {
+		return nil, err
+	}
+	var sites struct {
+		Value []Site `json:"value"`
+	}
+	return sites.Value, json.Unmarshal(resp, &sites)
+}
+
+// GetSiteDrives lists the document libraries of a SharePoint site.
+func GetSiteDrives(siteID string, auth *Auth) ([]Drive, error) {
+	resp, err := Get("/sites/"+siteID+"/drives", auth)
+	if err != nil {
+		return nil, err
+	}
+	var drives struct {
+		Value []Drive `json:"value"`
+	}
+	return drives.Value, json.Unmarshal(resp, &drives)
+}
+
 // IsOffline checks if an error is indicative of being offline.
 func IsOffline(err error) bool {
 	if err == nil {
@@ -200,3 +406,26 @@ func IsOffline(err error) bool {
 		strings.Contains(err.Error(), "connection refused") ||
 		strings.Contains(err.Error(), "failure in name resolution")
 }
+
+// blockedCodes are the error codes the API uses when it refuses to serve the
+// content of an item we can otherwise see.
+var blockedCodes = []string{"accessRestricted", "notAllowed", "malwareDetected"}
+
+// IsBlocked returns whether an error means that downloading an item is not
+// allowed, like when it is protected by Information Rights Management or a data
+// loss prevention policy. Retrying these requests is pointless.
+func IsBlocked(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "HTTP 403 -") || strings.HasPrefix(msg, "HTTP 451 -") {
+		return true
+	}
+	for _, code := range blockedCodes {
+		if strings.Contains(msg, " - "+code+":") {
+			return true
+		}
+	}
+	return false
+}
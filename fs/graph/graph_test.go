@@ -1,6 +1,18 @@
 package graph
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -17,3 +29,305 @@ func TestRequestUnauthenticated(t *testing.T) {
 		t.Fatal("An unauthenticated request was not handled as an error")
 	}
 }
+
+func TestDrivePaths(t *testing.T) {
+	t.Parallel()
+	if path := (Drive{}).IDPath("root"); path != "/me/drive/root" {
+		t.Fatalf("Default drive root path was wrong, got %s", path)
+	}
+	drive := Drive{ID: "b!abc"}
+	if path := drive.IDPath("123"); path != "/drives/b!abc/items/123" {
+		t.Fatalf("Item path on another drive was wrong, got %s", path)
+	}
+	if path := drive.ResourcePath("/Documents"); path != "/drives/b!abc/root:/Documents" {
+		t.Fatalf("Resource path on another drive was wrong, got %s", path)
+	}
+}
+
+// The skew between the local and server clocks is measured from the Date header
+// of responses. Not run in parallel, since this changes the skew used by other
+// tests.
+func TestClockSkew(t *testing.T) {
+	clock.Lock()
+	saved := clock.skew
+	clock.measured = false
+	clock.Unlock()
+	defer func() {
+		clock.Lock()
+		clock.skew = saved
+		clock.Unlock()
+	}()
+
+	response := &http.Response{Header: http.Header{}}
+	response.Header.Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	recordClockSkew(response, time.Now())
+	if skew := ClockSkew(); skew < time.Hour-2*time.Second || skew > time.Hour+2*time.Second {
+		t.Fatalf("Expected a clock skew of 1h, got %s.\n", skew)
+	}
+	if now := ServerNow(); now.Before(time.Now().Add(59 * time.Minute)) {
+		t.Fatalf("Server time was not corrected for skew: %s\n", now)
+	}
+}
+
+func TestIsBlocked(t *testing.T) {
+	t.Parallel()
+	blocked := []string{
+		"HTTP 403 - accessDenied: Access denied",
+		"HTTP 451 - unavailableForLegalReasons: Blocked",
+		"HTTP 400 - malwareDetected: Malicious software was detected",
+	}
+	for _, msg := range blocked {
+		if !IsBlocked(errors.New(msg)) {
+			t.Errorf("\"%s\" was not recognized as a blocked download.\n", msg)
+		}
+	}
+	if IsBlocked(errors.New("HTTP 404 - itemNotFound: Item not found")) {
+		t.Error("A missing item should not be treated as blocked.")
+	}
+}
+
+// Bandwidth should be granted round-robin between files and directions, with
+// most of it going to interactive downloads while they wait.
+func TestSchedulerFairness(t *testing.T) {
+	t.Parallel()
+	s := newScheduler()
+	s.prioritize = true
+	big := transferKey{direction: Upload, id: "big"}
+	small := transferKey{direction: Upload, id: "small"}
+	prefetch := transferKey{direction: Download, id: "prefetch"}
+	for i := 0; i < 10; i++ {
+		s.enqueue(big, PriorityBackground, 1)
+	}
+	s.enqueue(small, PriorityBackground, 1)
+	s.enqueue(prefetch, PriorityBackground, 1)
+
+	order := make(map[*ticket]string)
+	served := func(n int) []string {
+		ids := []string{}
+		for i := 0; i < n; i++ {
+			grant := s.grant()
+			if grant == nil {
+				break
+			}
+			ids = append(ids, order[grant])
+		}
+		return ids
+	}
+	for _, f := range s.waiting {
+		for _, ticket := range f.tickets {
+			order[ticket] = f.key.id
+		}
+	}
+	// uploads and downloads alternate, and so do the files in each direction
+	if got := fmt.Sprint(served(4)); got != "[big prefetch small big]" {
+		t.Fatalf("Background transfers were not interleaved: %s\n", got)
+	}
+
+	open := transferKey{direction: Download, id: "open"}
+	for i := 0; i < 10; i++ {
+		order[s.enqueue(open, PriorityInteractive, 1)] = open.id
+	}
+	got := fmt.Sprint(served(5))
+	if got != "[open open open open big]" {
+		t.Fatalf("Interactive download did not get most of the bandwidth: %s\n", got)
+	}
+}
+
+// Once the initial burst is used up, uploads should be paced at the limit.
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+	b := &tokenBucket{}
+	b.setRate(1024 * 1024)
+	b.tokens = transferQuantum
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		b.wait(transferQuantum)
+	}
+	// 4 quanta past the burst take 250ms at 1MB/s
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected uploads to take about 250ms, took %s\n", elapsed)
+	}
+}
+
+// Requests should be spaced out, held back entirely while throttled, and spaced
+// out further afterwards until enough requests succeed.
+func TestRequestPacer(t *testing.T) {
+	t.Parallel()
+	p := &requestPacer{min: 50 * time.Millisecond, interval: 50 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		p.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected requests to take about 200ms, took %s\n", elapsed)
+	}
+
+	p.throttled(300 * time.Millisecond)
+	start = time.Now()
+	p.wait()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("Request was not held back while throttled, took %s\n", elapsed)
+	}
+	if p.interval != throttledRequestInterval {
+		t.Fatalf("Expected requests to be spaced out further, got %s\n", p.interval)
+	}
+	for i := 0; i < 100; i++ {
+		p.succeeded()
+	}
+	if p.interval != p.min {
+		t.Fatalf("Expected spacing to recover to %s, got %s\n", p.min, p.interval)
+	}
+}
+
+// Downloads should be paced at the download limit without any other limit set.
+// Not parallel, since the limit applies to every download.
+func TestDownloadLimit(t *testing.T) {
+	SetDownloadLimit(1024 * 1024)
+	defer SetDownloadLimit(0)
+	if !limited(Download) || limited(Upload) {
+		t.Fatal("Download limit should only limit downloads.")
+	}
+	reader := TransferReader(bytes.NewReader(make([]byte, 5*transferQuantum)),
+		Download, "download_limit", PriorityBackground)
+	start := time.Now()
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	// every quantum after the first takes 62.5ms at 1MB/s
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected download to take about 250ms, took %s\n", elapsed)
+	}
+}
+
+// Retry-After can be a number of seconds or a date, and throttling errors
+// should carry it.
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+	header := http.Header{}
+	header.Set("Retry-After", "120")
+	if wait := RetryAfter(header); wait != 2*time.Minute {
+		t.Fatalf("Expected to wait 2m, got %s\n", wait)
+	}
+	header.Set("Retry-After", ServerNow().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if wait := RetryAfter(header); wait < 58*time.Second || wait > time.Minute {
+		t.Fatalf("Expected to wait about 1m, got %s\n", wait)
+	}
+	header.Set("Retry-After", "not a number")
+	if wait := RetryAfter(header); wait != defaultRetryAfter {
+		t.Fatalf("Expected the default wait for a bad header, got %s\n", wait)
+	}
+	if !Throttled(http.StatusServiceUnavailable, header) || Throttled(http.StatusServiceUnavailable, http.Header{}) {
+		t.Fatal("503 should only mean throttling with a Retry-After header.")
+	}
+
+	err := fmt.Errorf("wrapped: %w", &ThrottledError{StatusCode: 429, RetryAfter: time.Second})
+	if wait, throttled := IsThrottled(err); !throttled || wait != time.Second {
+		t.Fatal("Wrapped ThrottledError was not recognized.")
+	}
+}
+
+// Downloads are requested in ranges, and continue where they stopped when the
+// connection drops partway through a chunk.
+func TestStreamContent(t *testing.T) {
+	t.Parallel()
+	content := make([]byte, 2*downloadChunkSize+1000)
+	rand.Read(content)
+	var requests, aborted int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Range") == fmt.Sprintf("bytes=%d-%d", downloadChunkSize, 2*downloadChunkSize-1) &&
+			atomic.CompareAndSwapInt32(&aborted, 0, 1) {
+			// send part of the chunk, then drop the connection
+			w.Header().Set("Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", downloadChunkSize, 2*downloadChunkSize-1, len(content)))
+			w.Header().Set("Content-Length", fmt.Sprint(downloadChunkSize))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[downloadChunkSize : downloadChunkSize+1000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	output, err := ioutil.TempFile("", "onedriver-download-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	size, err := streamContent(context.Background(), server.URL, output, 1, nil, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != uint64(len(content)) {
+		t.Fatalf("Expected a size of %d, got %d\n", len(content), size)
+	}
+	downloaded, _ := ioutil.ReadFile(output.Name())
+	if !bytes.Equal(downloaded, content) {
+		t.Fatal("Downloaded content did not match.")
+	}
+	// the resumed chunk picks up the last 1000 bytes as well
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("Expected 2 chunks and 1 resumed chunk, got %d requests\n", n)
+	}
+}
+
+// Large files should be downloaded in several parts at once, and put together
+// in the right places.
+func TestStreamContentSegments(t *testing.T) {
+	t.Parallel()
+	content := make([]byte, 4*downloadChunkSize+1000)
+	rand.Read(content)
+	var requests, started int32
+	var segments sync.WaitGroup
+	segments.Add(3)
+	var concurrent int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Range") != fmt.Sprintf("bytes=0-%d", downloadChunkSize-1) &&
+			atomic.AddInt32(&started, 1) <= 3 {
+			// the first request of each segment waits for the others
+			segments.Done()
+			done := make(chan struct{})
+			go func() {
+				segments.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				atomic.StoreInt32(&concurrent, 0)
+			}
+		}
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	output, err := ioutil.TempFile("", "onedriver-download-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	size, err := streamContent(context.Background(), server.URL, output, 3, nil, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != uint64(len(content)) {
+		t.Fatalf("Expected a size of %d, got %d\n", len(content), size)
+	}
+	downloaded, _ := ioutil.ReadFile(output.Name())
+	if !bytes.Equal(downloaded, content) {
+		t.Fatal("Downloaded content did not match.")
+	}
+	if atomic.LoadInt32(&concurrent) == 0 {
+		t.Fatal("Segments were not downloaded at the same time.")
+	}
+	// the first chunk, then 3 segments of just over a chunk each
+	if n := atomic.LoadInt32(&requests); n != 7 {
+		t.Fatalf("Expected 7 requests, got %d\n", n)
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"strings"
 
-	"github.com/rclone/rclone/backend/onedrive/quickxorhash"
+	"github.com/jstaf/onedriver/fs/graph/quickxorhash"
 )
 
 // SHA1Hash returns the SHA1 hash of some data as a string
@@ -15,14 +16,32 @@ func SHA1Hash(data *[]byte) string {
 	return strings.ToUpper(fmt.Sprintf("%x", sha1.Sum(*data)))
 }
 
-// QuickXORHash computes the Microsoft-specific QuickXORHash. Reusing rclone's
-// implementation until I get the chance to rewrite/add test cases to remove the
-// dependency.
+// QuickXORHash computes the Microsoft-specific QuickXORHash.
 func QuickXORHash(data *[]byte) string {
 	hash := quickxorhash.Sum(*data)
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
 
+// SHA1HashStream is like SHA1Hash, but hashes everything read from reader
+// instead of content in memory.
+func SHA1HashStream(reader io.Reader) (string, error) {
+	hash := sha1.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(fmt.Sprintf("%x", hash.Sum(nil))), nil
+}
+
+// QuickXORHashStream is like QuickXORHash, but hashes everything read from
+// reader instead of content in memory.
+func QuickXORHashStream(reader io.Reader) (string, error) {
+	hash := quickxorhash.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
 // VerifyChecksum checks to see if a DriveItem's checksum matches what it's
 // supposed to be. This is less of a cryptographic check and more of a file
 // integrity check.
@@ -36,3 +55,25 @@ func (d *DriveItem) VerifyChecksum(checksum string) bool {
 	return strings.ToUpper(d.File.Hashes.SHA1Hash) == checksum ||
 		strings.ToUpper(d.File.Hashes.QuickXorHash) == checksum
 }
+
+// HasHashes returns whether the server included any hashes for this item. The
+// hashes facet is occasionally missing from responses for freshly uploaded
+// files and only shows up a little later.
+func (d *DriveItem) HasHashes() bool {
+	return d.File != nil &&
+		(d.File.Hashes.SHA1Hash != "" || d.File.Hashes.QuickXorHash != "")
+}
+
+// VerifyContent checks content against the DriveItem's hashes, using whichever
+// hash its type of drive provides. Returns true if the drive type is unknown,
+// since there is nothing to check the content against.
+func (d *DriveItem) VerifyContent(content *[]byte) bool {
+	if d.Parent == nil {
+		return true
+	}
+	caps, err := CapabilitiesOf(d.Parent.DriveType)
+	if err != nil {
+		return true
+	}
+	return d.VerifyChecksum(caps.Hash(content))
+}
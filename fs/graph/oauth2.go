@@ -3,6 +3,7 @@ package graph
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -22,14 +23,55 @@ const (
 	authFile        = "auth_tokens.json"
 )
 
+// DefaultScopes are the OAuth2 scopes that onedriver always requests.
+var DefaultScopes = []string{"user.read", "files.readwrite.all", "offline_access"}
+
 // Auth represents a set of oauth2 authentication tokens
 type Auth struct {
-	Account      string `json:"account"`
-	ExpiresIn    int64  `json:"expires_in"` // only used for parsing
-	ExpiresAt    int64  `json:"expires_at"`
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	path         string // auth tokens remember their path for use by Refresh()
+	Account      string   `json:"account"`
+	ExpiresIn    int64    `json:"expires_in"` // only used for parsing
+	ExpiresAt    int64    `json:"expires_at"`
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token"`
+	Scope        string   `json:"scope,omitempty"`  // scopes granted by the server
+	Scopes       []string `json:"scopes,omitempty"` // extra scopes we requested
+	path         string   // auth tokens remember their path for use by Refresh()
+}
+
+// HasScope returns whether the user granted a scope to onedriver.
+func (a *Auth) HasScope(scope string) bool {
+	for _, s := range DefaultScopes {
+		if strings.EqualFold(s, scope) {
+			return true
+		}
+	}
+	for _, granted := range strings.Fields(a.Scope) {
+		if strings.EqualFold(granted, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeError is returned when a feature is used without the scope it needs.
+type ScopeError struct {
+	Scope   string
+	Feature string
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("%s requires the \"%s\" permission. Add it to \"scopes\" "+
+		"in your config file and run onedriver again to reauthenticate.",
+		e.Feature, e.Scope)
+}
+
+// RequireScope returns a ScopeError if the user has not granted a scope needed
+// by a feature.
+func RequireScope(auth *Auth, scope string, feature string) error {
+	if auth.HasScope(scope) {
+		return nil
+	}
+	return &ScopeError{Scope: scope, Feature: feature}
 }
 
 // AuthError is an authentication error from the Microsoft API. Generally we don't see
@@ -101,7 +143,7 @@ func (a *Auth) Refresh() {
 				"response":  string(body),
 				"http_code": resp.StatusCode,
 			}).Error("Failed to renew access tokens. Attempting to reauthenticate.")
-			a = newAuth(a.path)
+			a = newAuth(a.path, a.Scopes)
 		} else {
 			a.ToFile(a.path)
 		}
@@ -109,10 +151,11 @@ func (a *Auth) Refresh() {
 }
 
 // Get the appropriate authentication URL for the Graph OAuth2 challenge.
-func getAuthURL() string {
+// scopes are requested in addition to DefaultScopes.
+func getAuthURL(scopes []string) string {
 	return authCodeURL +
 		"?client_id=" + authClientID +
-		"&scope=" + url.PathEscape("user.read files.readwrite.all offline_access") +
+		"&scope=" + url.PathEscape(strings.Join(append(DefaultScopes, scopes...), " ")) +
 		"&response_type=code" +
 		"&redirect_uri=" + authRedirectURL
 }
@@ -173,11 +216,16 @@ func getAuthTokens(authCode string) *Auth {
 	return &auth
 }
 
-// newAuth performs initial authentication flow and saves tokens to disk
-func newAuth(path string) *Auth {
+// newAuth performs initial authentication flow and saves tokens to disk. The
+// extra scopes requested last time are requested again if scopes is nil.
+func newAuth(path string, scopes []string) *Auth {
 	old := Auth{}
 	old.FromFile(path)
-	auth := getAuthTokens(getAuthCode(old.Account))
+	if scopes == nil {
+		scopes = old.Scopes
+	}
+	auth := getAuthTokens(getAuthCode(old.Account, scopes))
+	auth.Scopes = scopes
 
 	if user, err := GetUser(auth); err == nil {
 		auth.Account = user.UserPrincipalName
@@ -186,17 +234,26 @@ func newAuth(path string) *Auth {
 	return auth
 }
 
-// Authenticate performs first-time authentication to Graph
-func Authenticate(path string) *Auth {
+// Authenticate performs first-time authentication to Graph. scopes are any
+// OAuth2 scopes needed in addition to DefaultScopes.
+func Authenticate(path string, scopes ...string) *Auth {
 	auth := &Auth{}
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		// no tokens found, gotta start oauth flow from beginning
-		auth = newAuth(path)
-	} else {
-		// we already have tokens, no need to force a new auth flow
-		auth.FromFile(path)
-		auth.Refresh()
+		return newAuth(path, scopes)
+	}
+
+	// we already have tokens, no need to force a new auth flow unless we need
+	// scopes that weren't requested last time
+	auth.FromFile(path)
+	for _, scope := range scopes {
+		if !auth.HasScope(scope) {
+			log.WithField("scope", scope).Info(
+				"Additional permissions requested, reauthenticating.")
+			return newAuth(path, scopes)
+		}
 	}
+	auth.Refresh()
 	return auth
 }
@@ -17,8 +17,8 @@ import (
 
 // Fetch the auth code required as the first part of oauth2 authentication. Uses
 // webkit2gtk to create a popup browser.
-func getAuthCode(accountName string) string {
-	cAuthURL := C.CString(getAuthURL())
+func getAuthCode(accountName string, scopes []string) string {
+	cAuthURL := C.CString(getAuthURL(scopes))
 	cAccountName := C.CString(accountName)
 	cResponse := C.webkit_auth_window(cAuthURL, cAccountName)
 	response := C.GoString(cResponse)
@@ -9,8 +9,8 @@ import (
 )
 
 // accountName arg is only present for compatibility with the non-headless C version.
-func getAuthCode(accountName string) string {
-	fmt.Printf("Please visit the following URL:\n%s\n\n", getAuthURL())
+func getAuthCode(accountName string, scopes []string) string {
+	fmt.Printf("Please visit the following URL:\n%s\n\n", getAuthURL(scopes))
 	fmt.Println("Please enter the redirect URL once you are redirected to a " +
 		"blank page (after \"Let this app access your info?\"):")
 	var response string
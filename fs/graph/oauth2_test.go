@@ -45,3 +45,20 @@ func TestAuthRefresh(t *testing.T) {
 		t.Fatal("Auth could not be refreshed successfully!")
 	}
 }
+
+// Scopes are compared case-insensitively and the default scopes are always
+// assumed to be granted.
+func TestHasScope(t *testing.T) {
+	t.Parallel()
+	auth := &Auth{Scope: "User.Read Files.ReadWrite.All Sites.Read.All"}
+	if !auth.HasScope("sites.read.all") {
+		t.Fatal("Granted scope was not found.")
+	}
+	if !(&Auth{}).HasScope("Files.ReadWrite.All") {
+		t.Fatal("Default scope was not treated as granted.")
+	}
+	err := RequireScope(auth, "Sites.ReadWrite.All", "Testing")
+	if _, ok := err.(*ScopeError); !ok {
+		t.Fatalf("Expected a ScopeError for a missing scope, got %v\n", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Package quickxorhash implements QuickXorHash, the hash OneDrive for Business
+// and SharePoint use for file content.
+// https://docs.microsoft.com/en-us/onedrive/developer/code-snippets/quickxorhash
+//
+// The reference implementation shifts every byte into a 160-bit state one at a
+// time. Since the shift (11 bits) and the width of the state (160 bits) are
+// coprime, byte i always lands at bit (11*i) mod 160, and bytes 160 apart land
+// in the same place. So instead, the input is XORed together 160 bytes at a time
+// (which is all the hot loop does, using SIMD instructions where available), and
+// the 160 resulting bytes are only shifted into place once, when the sum is
+// computed.
+package quickxorhash
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+const (
+	// Size is the size of a QuickXorHash in bytes.
+	Size = 20
+
+	// BlockSize is the hash's block size in bytes. Writes of multiples of this
+	// size are the fastest.
+	BlockSize = 8 * Size
+
+	shift = 11
+)
+
+type digest struct {
+	acc    [BlockSize]byte // XOR of every byte written, by position mod BlockSize
+	length uint64
+}
+
+// New returns a new hash.Hash computing QuickXorHash.
+func New() hash.Hash {
+	return &digest{}
+}
+
+// Sum returns the QuickXorHash of data.
+func Sum(data []byte) [Size]byte {
+	var d digest
+	d.Write(data)
+	return d.checksum()
+}
+
+// Write adds more data to the running hash. It never returns an error.
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	// finish the block started by the last write
+	if start := int(d.length % BlockSize); start > 0 {
+		p = p[xorBytes(d.acc[start:], p):]
+	}
+	d.length += uint64(n)
+	if full := len(p) - len(p)%BlockSize; full > 0 {
+		xorBlocks(&d.acc, p[:full])
+		p = p[full:]
+	}
+	xorBytes(d.acc[:], p)
+	return n, nil
+}
+
+// xorBytes XORs as much of src as fits into dst, returning how many bytes it
+// XORed.
+func xorBytes(dst []byte, src []byte) int {
+	if len(src) > len(dst) {
+		src = src[:len(dst)]
+	}
+	for i, b := range src {
+		dst[i] ^= b
+	}
+	return len(src)
+}
+
+// xorBlocksGeneric XORs each BlockSize-byte block of blocks into acc, a word at
+// a time. len(blocks) must be a multiple of BlockSize.
+func xorBlocksGeneric(acc *[BlockSize]byte, blocks []byte) {
+	var words [BlockSize / 8]uint64
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(acc[8*i:])
+	}
+	for ; len(blocks) >= BlockSize; blocks = blocks[BlockSize:] {
+		block := blocks[:BlockSize]
+		for i := range words {
+			words[i] ^= binary.LittleEndian.Uint64(block[8*i:])
+		}
+	}
+	for i, word := range words {
+		binary.LittleEndian.PutUint64(acc[8*i:], word)
+	}
+}
+
+// checksum shifts the accumulated bytes into place and mixes in the length.
+func (d *digest) checksum() [Size]byte {
+	var sum [Size]byte
+	for i, b := range d.acc {
+		// the state is a little-endian, circular 160-bit number
+		bit := (shift * i) % BlockSize
+		sum[bit/8] ^= b << uint(bit%8)
+		if bit%8 != 0 {
+			sum[(bit/8+1)%Size] ^= b >> uint(8-bit%8)
+		}
+	}
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], d.length)
+	xorBytes(sum[Size-8:], length[:])
+	return sum
+}
+
+// Sum appends the current hash to b without changing the state of the hash.
+func (d *digest) Sum(b []byte) []byte {
+	sum := d.checksum()
+	return append(b, sum[:]...)
+}
+
+// Reset resets the hash to its initial state.
+func (d *digest) Reset() {
+	*d = digest{}
+}
+
+// Size returns the number of bytes Sum will return.
+func (d *digest) Size() int {
+	return Size
+}
+
+// BlockSize returns the hash's block size.
+func (d *digest) BlockSize() int {
+	return BlockSize
+}
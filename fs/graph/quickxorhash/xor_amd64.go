@@ -0,0 +1,19 @@
+package quickxorhash
+
+import "golang.org/x/sys/cpu"
+
+var useAVX2 = cpu.X86.HasAVX2
+
+func xorBlocks(acc *[BlockSize]byte, blocks []byte) {
+	if useAVX2 {
+		xorBlocksAVX2(acc, blocks)
+	} else {
+		xorBlocksGeneric(acc, blocks)
+	}
+}
+
+// xorBlocksAVX2 is xorBlocksGeneric, with the accumulator kept in five 256-bit
+// registers.
+//
+//go:noescape
+func xorBlocksAVX2(acc *[BlockSize]byte, blocks []byte)
@@ -0,0 +1,34 @@
+#include "textflag.h"
+
+// func xorBlocksAVX2(acc *[BlockSize]byte, blocks []byte)
+TEXT ·xorBlocksAVX2(SB), NOSPLIT, $0-32
+	MOVQ acc+0(FP), AX
+	MOVQ blocks_base+8(FP), SI
+	MOVQ blocks_len+16(FP), CX
+
+	VMOVDQU 0(AX), Y0
+	VMOVDQU 32(AX), Y1
+	VMOVDQU 64(AX), Y2
+	VMOVDQU 96(AX), Y3
+	VMOVDQU 128(AX), Y4
+
+loop:
+	CMPQ CX, $160
+	JB   done
+	VPXOR 0(SI), Y0, Y0
+	VPXOR 32(SI), Y1, Y1
+	VPXOR 64(SI), Y2, Y2
+	VPXOR 96(SI), Y3, Y3
+	VPXOR 128(SI), Y4, Y4
+	ADDQ $160, SI
+	SUBQ $160, CX
+	JMP  loop
+
+done:
+	VMOVDQU Y0, 0(AX)
+	VMOVDQU Y1, 32(AX)
+	VMOVDQU Y2, 64(AX)
+	VMOVDQU Y3, 96(AX)
+	VMOVDQU Y4, 128(AX)
+	VZEROUPPER
+	RET
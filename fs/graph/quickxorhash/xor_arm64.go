@@ -0,0 +1,19 @@
+package quickxorhash
+
+import "golang.org/x/sys/cpu"
+
+var useNEON = cpu.ARM64.HasASIMD
+
+func xorBlocks(acc *[BlockSize]byte, blocks []byte) {
+	if useNEON {
+		xorBlocksNEON(acc, blocks)
+	} else {
+		xorBlocksGeneric(acc, blocks)
+	}
+}
+
+// xorBlocksNEON is xorBlocksGeneric, with the accumulator kept in ten 128-bit
+// registers.
+//
+//go:noescape
+func xorBlocksNEON(acc *[BlockSize]byte, blocks []byte)
@@ -0,0 +1,38 @@
+#include "textflag.h"
+
+// func xorBlocksNEON(acc *[BlockSize]byte, blocks []byte)
+TEXT ·xorBlocksNEON(SB), NOSPLIT, $0-32
+	MOVD acc+0(FP), R0
+	MOVD blocks_base+8(FP), R1
+	MOVD blocks_len+16(FP), R2
+
+	MOVD R0, R3
+	VLD1.P 64(R3), [V0.B16, V1.B16, V2.B16, V3.B16]
+	VLD1.P 64(R3), [V4.B16, V5.B16, V6.B16, V7.B16]
+	VLD1   (R3), [V8.B16, V9.B16]
+
+loop:
+	CMP  $160, R2
+	BLT  done
+	VLD1.P 64(R1), [V10.B16, V11.B16, V12.B16, V13.B16]
+	VEOR V10.B16, V0.B16, V0.B16
+	VEOR V11.B16, V1.B16, V1.B16
+	VEOR V12.B16, V2.B16, V2.B16
+	VEOR V13.B16, V3.B16, V3.B16
+	VLD1.P 64(R1), [V14.B16, V15.B16, V16.B16, V17.B16]
+	VEOR V14.B16, V4.B16, V4.B16
+	VEOR V15.B16, V5.B16, V5.B16
+	VEOR V16.B16, V6.B16, V6.B16
+	VEOR V17.B16, V7.B16, V7.B16
+	VLD1.P 32(R1), [V18.B16, V19.B16]
+	VEOR V18.B16, V8.B16, V8.B16
+	VEOR V19.B16, V9.B16, V9.B16
+	SUB  $160, R2
+	B    loop
+
+done:
+	MOVD R0, R3
+	VST1.P [V0.B16, V1.B16, V2.B16, V3.B16], 64(R3)
+	VST1.P [V4.B16, V5.B16, V6.B16, V7.B16], 64(R3)
+	VST1   [V8.B16, V9.B16], (R3)
+	RET
@@ -0,0 +1,8 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package quickxorhash
+
+func xorBlocks(acc *[BlockSize]byte, blocks []byte) {
+	xorBlocksGeneric(acc, blocks)
+}
@@ -0,0 +1,78 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// SubscriptionMaxLifetime is the longest a subscription to changes on a drive
+// lasts before it has to be renewed.
+// https://docs.microsoft.com/en-us/graph/api/resources/subscription#maximum-length-of-subscription-per-resource-type
+const SubscriptionMaxLifetime = 42300 * time.Minute
+
+// Subscription is a request for the server to notify a URL whenever something
+// changes on a drive, so that changes do not have to be polled for.
+// https://docs.microsoft.com/en-us/graph/api/resources/subscription
+type Subscription struct {
+	ID                 string    `json:"id,omitempty"`
+	ChangeType         string    `json:"changeType,omitempty"`
+	NotificationURL    string    `json:"notificationUrl,omitempty"`
+	Resource           string    `json:"resource,omitempty"`
+	ExpirationDateTime time.Time `json:"expirationDateTime"`
+	ClientState        string    `json:"clientState,omitempty"`
+}
+
+// Notification is one of the notifications the server sends to the
+// notification URL of a subscription. Notifications for drives only say that
+// something changed, what changed has to be fetched with a delta request.
+type Notification struct {
+	SubscriptionID string `json:"subscriptionId"`
+	ClientState    string `json:"clientState,omitempty"`
+	Resource       string `json:"resource"`
+}
+
+// Notifications is the body of the requests the server sends to the
+// notification URL of a subscription.
+type Notifications struct {
+	Value []Notification `json:"value"`
+}
+
+// Subscribe subscribes to changes anywhere on the drive, which are sent to
+// notificationURL until expires. The server checks that notificationURL
+// answers validation requests before it creates the subscription.
+// clientState is sent along with every notification, so that they can be told
+// apart from requests by anyone else.
+func (d Drive) Subscribe(notificationURL string, clientState string, expires time.Time,
+	auth *Auth) (*Subscription, error) {
+	payload, _ := json.Marshal(Subscription{
+		ChangeType:         "updated",
+		NotificationURL:    notificationURL,
+		Resource:           d.Path()[1:] + "/root",
+		ExpirationDateTime: expires.UTC(),
+		ClientState:        clientState,
+	})
+	resp, err := Post("/subscriptions", auth, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	subscription := &Subscription{}
+	return subscription, json.Unmarshal(resp, subscription)
+}
+
+// RenewSubscription makes a subscription last until expires.
+func RenewSubscription(id string, expires time.Time, auth *Auth) (*Subscription, error) {
+	payload, _ := json.Marshal(Subscription{ExpirationDateTime: expires.UTC()})
+	resp, err := Patch("/subscriptions/"+id, auth, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	subscription := &Subscription{}
+	return subscription, json.Unmarshal(resp, subscription)
+}
+
+// Unsubscribe deletes a subscription, so that no more notifications are sent
+// for it.
+func Unsubscribe(id string, auth *Auth) error {
+	return Delete("/subscriptions/"+id, auth)
+}
@@ -0,0 +1,183 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is how long to wait after being throttled when the server
+// does not say how long.
+const defaultRetryAfter = 30 * time.Second
+
+// maxRetryAfter caps how long a throttled request waits before retrying, in
+// case the server asks for something unreasonable.
+const maxRetryAfter = 10 * time.Minute
+
+// throttleRetries is how many times a throttled request is retried before the
+// ThrottledError is returned to the caller.
+const throttleRetries = 3
+
+// ThrottledError is returned when the server refuses a request because too many
+// were made (HTTP 429, or 503 with a Retry-After header).
+// https://docs.microsoft.com/en-us/graph/throttling
+type ThrottledError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RetryAfter time.Duration // how long the server asked us to wait
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("HTTP %d - %s: %s (retry after %s)",
+		e.StatusCode, e.Code, e.Message, e.RetryAfter)
+}
+
+// IsThrottled returns whether an error means that the server throttled a
+// request, and if so, how long to wait before trying again.
+func IsThrottled(err error) (time.Duration, bool) {
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		return throttled.RetryAfter, true
+	}
+	return 0, false
+}
+
+// Throttled returns whether a response status and headers mean that the server
+// is throttling requests.
+func Throttled(status int, header http.Header) bool {
+	return status == http.StatusTooManyRequests ||
+		(status == http.StatusServiceUnavailable && header.Get("Retry-After") != "")
+}
+
+// RetryAfter returns how long the Retry-After header of a response says to wait,
+// which may be a number of seconds or a date.
+func RetryAfter(header http.Header) time.Duration {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		// the date is by the server's clock
+		wait = date.Sub(ServerNow())
+	} else {
+		return defaultRetryAfter
+	}
+	if wait < 0 {
+		return 0
+	} else if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+// Requests to the API (everything but the content of files) are paced, so that
+// listing many folders at once does not get onedriver throttled. Requests are
+// spaced out by an interval that grows every time the server throttles a
+// request and shrinks back as requests succeed, and once the server asks to
+// wait with Retry-After, nothing is sent until then, whichever drive or
+// goroutine the request is from.
+
+// maxRequestInterval caps how far apart requests are spaced after throttling.
+const maxRequestInterval = 5 * time.Second
+
+// throttledRequestInterval is how far apart requests are spaced at least after
+// the server throttled one.
+const throttledRequestInterval = 100 * time.Millisecond
+
+// requestPacer spaces out requests to the API.
+type requestPacer struct {
+	mutex       sync.Mutex
+	min         time.Duration // spacing while nothing is throttled, 0 for none
+	interval    time.Duration // current spacing
+	next        time.Time     // when the next request may be sent
+	pausedUntil time.Time     // when the server said to try again
+}
+
+// apiRequests paces the requests of every drive, since the server throttles
+// onedriver as a whole.
+var apiRequests = &requestPacer{}
+
+// SetRequestRate limits how many requests are sent to the API per second while
+// the server is not throttling them (0 for no limit). Requests are spaced out
+// further after being throttled either way. Can be changed at any time.
+func SetRequestRate(perSecond int) {
+	var interval time.Duration
+	if perSecond > 0 {
+		interval = time.Second / time.Duration(perSecond)
+	}
+	apiRequests.mutex.Lock()
+	defer apiRequests.mutex.Unlock()
+	apiRequests.min = interval
+	if apiRequests.interval < interval {
+		apiRequests.interval = interval
+	}
+}
+
+// wait blocks until a request may be sent. Callers reserve their turn in the
+// order they arrive.
+func (p *requestPacer) wait() {
+	for {
+		p.mutex.Lock()
+		now := time.Now()
+		if now.Before(p.pausedUntil) {
+			pause := p.pausedUntil.Sub(now)
+			p.mutex.Unlock()
+			time.Sleep(pause)
+			continue
+		}
+		start := p.next
+		if start.Before(now) {
+			start = now
+		}
+		p.next = start.Add(p.interval)
+		p.mutex.Unlock()
+		if !start.After(now) {
+			return
+		}
+		time.Sleep(start.Sub(now))
+
+		// the server may have throttled a request in the meantime
+		p.mutex.Lock()
+		paused := time.Now().Before(p.pausedUntil)
+		p.mutex.Unlock()
+		if !paused {
+			return
+		}
+	}
+}
+
+// throttled holds back every request for retryAfter, and spaces them out
+// further afterwards.
+func (p *requestPacer) throttled(retryAfter time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if until := time.Now().Add(retryAfter); until.After(p.pausedUntil) {
+		p.pausedUntil = until
+	}
+	p.interval *= 2
+	if p.interval < throttledRequestInterval {
+		p.interval = throttledRequestInterval
+	}
+	if p.interval > maxRequestInterval {
+		p.interval = maxRequestInterval
+	}
+}
+
+// succeeded brings the spacing of requests back down a little, after it was
+// raised by throttling.
+func (p *requestPacer) succeeded() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.interval <= p.min {
+		return
+	}
+	p.interval -= p.interval / 16
+	if p.interval < p.min || p.interval < time.Millisecond {
+		p.interval = p.min
+	}
+}
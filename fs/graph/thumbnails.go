@@ -0,0 +1,20 @@
+package graph
+
+// ThumbnailSmall and friends are the sizes of thumbnail the server renders,
+// which fit in 96, 176 and 800 pixels along their longest side respectively.
+const (
+	ThumbnailSmall  = "small"
+	ThumbnailMedium = "medium"
+	ThumbnailLarge  = "large"
+)
+
+// GetThumbnail fetches a thumbnail of an item on this drive as an image (usually
+// a JPEG), without downloading the item itself. Fails with a 404 for items the
+// server cannot render a thumbnail of, which is most things besides images,
+// videos and documents.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/api/driveitem-list-thumbnails
+func (d Drive) GetThumbnail(id string, size string, auth *Auth) ([]byte, error) {
+	// the server redirects to where the image is hosted, which the http client
+	// follows without our auth header
+	return Get(d.IDPath(id)+"/thumbnails/0/"+size+"/content", auth)
+}
@@ -0,0 +1,355 @@
+package graph
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction is which way the content of a transfer flows.
+type Direction int
+
+// transfer directions
+const (
+	Download Direction = iota
+	Upload
+)
+
+// Priority decides which transfers go first when bandwidth is limited.
+type Priority int
+
+// transfer priorities
+const (
+	PriorityBackground  Priority = iota // prefetching and uploads
+	PriorityInteractive                 // a program is waiting for the content
+)
+
+// transferQuantum is the most bandwidth granted to a transfer at once. Smaller
+// quanta interleave transfers more finely at the cost of more scheduling.
+const transferQuantum = 64 * 1024
+
+// interactiveShare is how many quanta interactive transfers get for every
+// quantum of background transfers, so that background transfers slow down
+// while something is being opened but never stop completely.
+const interactiveShare = 4
+
+// transferKey identifies a flow: all transfers of one item in one direction
+// share the same slice of bandwidth.
+type transferKey struct {
+	direction Direction
+	id        string
+}
+
+// ticket is a request for n bytes of bandwidth, granted by closing ready.
+type ticket struct {
+	n     int
+	ready chan struct{}
+}
+
+// flow is a transfer waiting for bandwidth.
+type flow struct {
+	key      transferKey
+	priority Priority
+	tickets  []*ticket
+}
+
+// scheduler shares a bandwidth limit between transfers. Quanta are granted
+// round-robin between flows, alternating between uploads and downloads, and
+// with a larger share for interactive flows if prioritize is set. Nothing is
+// scheduled without a limit.
+type scheduler struct {
+	mutex       sync.Mutex
+	limit       uint64 // bytes per second, 0 for unlimited
+	prioritize  bool
+	waiting     []*flow // in round-robin order
+	flows       map[transferKey]*flow
+	last        Direction // direction of the last grant
+	interactive int       // interactive grants in a row
+	next        time.Time // when the next grant may be made
+	running     bool      // whether dispatch is running
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{flows: make(map[transferKey]*flow)}
+}
+
+// transfers schedules the content transfers of every drive, so that the limit
+// applies to onedriver as a whole.
+var transfers = newScheduler()
+
+// downloads schedules the downloads of every drive for the download limit,
+// separately from transfers since the two limits can differ.
+var downloads = newScheduler()
+
+// SetBandwidthLimit limits the combined speed of all uploads and downloads of
+// file content, in bytes per second (0 for no limit). With prioritizeReads,
+// downloads that a program is waiting on get most of the bandwidth while they
+// run. Can be changed at any time.
+func SetBandwidthLimit(bytesPerSecond uint64, prioritizeReads bool) {
+	transfers.setLimit(bytesPerSecond, prioritizeReads)
+}
+
+// BandwidthLimit returns the current bandwidth limit in bytes per second.
+func BandwidthLimit() uint64 {
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+	return transfers.limit
+}
+
+// SetUploadLimit limits the combined speed of all uploads of file content, in
+// bytes per second (0 for no limit), on top of the limit set by
+// SetBandwidthLimit. Can be changed at any time.
+func SetUploadLimit(bytesPerSecond uint64) {
+	uploadLimiter.setRate(bytesPerSecond)
+}
+
+// UploadLimit returns the current upload limit in bytes per second.
+func UploadLimit() uint64 {
+	uploadLimiter.mutex.Lock()
+	defer uploadLimiter.mutex.Unlock()
+	return uploadLimiter.rate
+}
+
+// SetDownloadLimit limits the combined speed of all downloads of file content,
+// in bytes per second (0 for no limit), on top of the limit set by
+// SetBandwidthLimit. Downloads that a program is waiting on always get most of
+// it, so that prefetching and readahead cannot hold up opening a file. Can be
+// changed at any time.
+func SetDownloadLimit(bytesPerSecond uint64) {
+	downloads.setLimit(bytesPerSecond, true)
+}
+
+// DownloadLimit returns the current download limit in bytes per second.
+func DownloadLimit() uint64 {
+	downloads.mutex.Lock()
+	defer downloads.mutex.Unlock()
+	return downloads.limit
+}
+
+// limited returns whether transfers in a direction are slowed down by a limit.
+func limited(direction Direction) bool {
+	return BandwidthLimit() > 0 ||
+		(direction == Upload && UploadLimit() > 0) ||
+		(direction == Download && DownloadLimit() > 0)
+}
+
+func (s *scheduler) setLimit(limit uint64, prioritize bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.limit = limit
+	s.prioritize = prioritize
+}
+
+// wait blocks until n bytes of bandwidth have been granted to a flow.
+func (s *scheduler) wait(key transferKey, priority Priority, n int) {
+	s.mutex.Lock()
+	if s.limit == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	t := s.enqueue(key, priority, n)
+	if !s.running {
+		s.running = true
+		go s.dispatch()
+	}
+	s.mutex.Unlock()
+	<-t.ready
+}
+
+// enqueue adds a ticket to a flow's line. Must be called with the mutex held.
+func (s *scheduler) enqueue(key transferKey, priority Priority, n int) *ticket {
+	f, exists := s.flows[key]
+	if !exists {
+		f = &flow{key: key, priority: priority}
+		s.flows[key] = f
+		s.waiting = append(s.waiting, f)
+	}
+	if priority > f.priority {
+		f.priority = priority
+	}
+	t := &ticket{n: n, ready: make(chan struct{})}
+	f.tickets = append(f.tickets, t)
+	return t
+}
+
+// dispatch grants bandwidth to waiting flows at the rate of the limit, until
+// nothing is waiting anymore.
+func (s *scheduler) dispatch() {
+	for {
+		s.mutex.Lock()
+		if s.limit > 0 {
+			if wait := time.Until(s.next); wait > 0 {
+				s.mutex.Unlock()
+				time.Sleep(wait)
+				s.mutex.Lock()
+			}
+		}
+		t := s.grant()
+		if t == nil {
+			s.running = false
+			s.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		if s.next.Before(now) {
+			// bandwidth that went unused is not saved up for later
+			s.next = now
+		}
+		if s.limit > 0 {
+			s.next = s.next.Add(time.Duration(uint64(t.n) * uint64(time.Second) / s.limit))
+		}
+		s.mutex.Unlock()
+		close(t.ready)
+	}
+}
+
+// grant picks the ticket to serve next. Must be called with the mutex held.
+func (s *scheduler) grant() *ticket {
+	if len(s.waiting) == 0 {
+		return nil
+	}
+	priority := PriorityBackground
+	if s.prioritize && s.has(PriorityInteractive, nil) &&
+		(s.interactive < interactiveShare || !s.has(PriorityBackground, nil)) {
+		priority = PriorityInteractive
+	}
+	if !s.prioritize || !s.has(priority, nil) {
+		priority = -1 // any
+	}
+	direction := Upload
+	if s.last == Upload {
+		direction = Download
+	}
+	if !s.has(priority, &direction) {
+		direction = s.last
+	}
+
+	for i, f := range s.waiting {
+		if (priority >= 0 && f.priority != priority) || f.key.direction != direction {
+			continue
+		}
+		t := f.tickets[0]
+		f.tickets = f.tickets[1:]
+		// the flow goes to the back of the line
+		s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+		if len(f.tickets) > 0 {
+			s.waiting = append(s.waiting, f)
+		} else {
+			delete(s.flows, f.key)
+		}
+		s.last = direction
+		if f.priority == PriorityInteractive {
+			s.interactive++
+		} else {
+			s.interactive = 0
+		}
+		return t
+	}
+	return nil
+}
+
+// has returns whether any flow with a priority (-1 for any) and direction (nil
+// for any) is waiting.
+func (s *scheduler) has(priority Priority, direction *Direction) bool {
+	for _, f := range s.waiting {
+		if (priority < 0 || f.priority == priority) &&
+			(direction == nil || f.key.direction == *direction) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBucket limits a rate to a number of bytes per second, allowing bursts of
+// up to one transferQuantum.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   uint64  // bytes per second, 0 for unlimited
+	tokens float64 // bytes that may be sent right away, negative if owed
+	last   time.Time
+}
+
+// uploadLimiter applies the upload limit to every upload of every drive.
+var uploadLimiter = &tokenBucket{}
+
+func (b *tokenBucket) setRate(rate uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rate = rate
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+// wait blocks until n bytes may be sent. Callers that arrive while the bucket
+// is empty reserve their bytes in turn, so each waits for the ones before it.
+func (b *tokenBucket) wait(n int) {
+	b.mutex.Lock()
+	if b.rate == 0 {
+		b.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > transferQuantum {
+		b.tokens = transferQuantum
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.mutex.Unlock()
+	time.Sleep(wait)
+}
+
+// transferReader paces reads from a reader according to the scheduler.
+type transferReader struct {
+	reader   io.Reader
+	key      transferKey
+	priority Priority
+}
+
+// TransferReader wraps the content of an upload or the body of a download of
+// an item so that it is read at the pace the bandwidth limit allows, sharing
+// the bandwidth fairly with other transfers.
+func TransferReader(reader io.Reader, direction Direction, id string, priority Priority) io.Reader {
+	return &transferReader{
+		reader:   reader,
+		key:      transferKey{direction: direction, id: id},
+		priority: priority,
+	}
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if len(p) > transferQuantum {
+		p = p[:transferQuantum]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if r.key.direction == Upload {
+			uploadLimiter.wait(n)
+		} else {
+			downloads.wait(r.key, r.priority, n)
+		}
+		transfers.wait(r.key, r.priority, n)
+	}
+	return n, err
+}
+
+// wrap returns a copy of a download that reads from reader instead, or reader
+// itself if there is no download to schedule.
+func (r *transferReader) wrap(reader io.Reader) io.Reader {
+	if r == nil {
+		return reader
+	}
+	return &transferReader{reader: reader, key: r.key, priority: r.priority}
+}
+
+// size returns how much is left to read, or -1 if unknown.
+func (r *transferReader) size() int64 {
+	if sized, ok := r.reader.(interface{ Len() int }); ok {
+		return int64(sized.Len())
+	}
+	return -1
+}
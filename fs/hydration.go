@@ -0,0 +1,556 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Files are not downloaded when they are opened. Instead, each read fetches
+// only the part of the file it needs (rounded out to whole hydrationBlocks)
+// into the cached content, which is a sparse file of the full size until all of
+// it has been read. Which parts are present is kept in its own bucket (keyed by
+// item ID) for as long as the file is incomplete, so that partly downloaded
+// content survives remounts without ever being mistaken for the whole file.
+var bucketHydration = []byte("hydration")
+
+// hydrationBlock is the smallest part of a file that is downloaded for a read.
+// Small reads next to each other, like those of a program reading a header,
+// are served by the same request.
+const hydrationBlock = 1024 * 1024
+
+// DefaultReadahead is how much of a file is downloaded ahead of a program
+// reading it sequentially by default.
+const DefaultReadahead = 8 * 1024 * 1024
+
+// extent is a range of the content of a file, from Start up to End.
+type extent struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// extents are sorted ranges of content that do not overlap or touch.
+type extents []extent
+
+// add returns the extents with a range added.
+func (e extents) add(start uint64, end uint64) extents {
+	if start >= end {
+		return e
+	}
+	merged := make(extents, 0, len(e)+1)
+	for _, x := range e {
+		if x.End < start || x.Start > end {
+			merged = append(merged, x)
+			continue
+		}
+		// overlaps or touches the new range, which swallows it
+		if x.Start < start {
+			start = x.Start
+		}
+		if x.End > end {
+			end = x.End
+		}
+	}
+	merged = append(merged, extent{Start: start, End: end})
+	for i := len(merged) - 1; i > 0 && merged[i].Start < merged[i-1].Start; i-- {
+		merged[i], merged[i-1] = merged[i-1], merged[i]
+	}
+	return merged
+}
+
+// missing returns the parts of a range that are not in the extents.
+func (e extents) missing(start uint64, end uint64) []extent {
+	gaps := make([]extent, 0)
+	for _, x := range e {
+		if x.End <= start {
+			continue
+		}
+		if x.Start >= end {
+			break
+		}
+		if x.Start > start {
+			gaps = append(gaps, extent{Start: start, End: x.Start})
+		}
+		start = x.End
+	}
+	if start < end {
+		gaps = append(gaps, extent{Start: start, End: end})
+	}
+	return gaps
+}
+
+// clip returns the extents with everything at or past size removed.
+func (e extents) clip(size uint64) extents {
+	clipped := make(extents, 0, len(e))
+	for _, x := range e {
+		if x.Start >= size {
+			break
+		}
+		if x.End > size {
+			x.End = size
+		}
+		clipped = append(clipped, x)
+	}
+	return clipped
+}
+
+// seek returns where the next extent (or the next gap between them, if hole is
+// set) starts at or after off, in content of size bytes. The end of the content
+// counts as a gap. Returns false if there is none, or off is past the end.
+func (e extents) seek(off uint64, size uint64, hole bool) (uint64, bool) {
+	if off >= size {
+		return 0, false
+	}
+	if hole {
+		if gaps := e.missing(off, size); len(gaps) > 0 {
+			return gaps[0].Start, true
+		}
+		return size, true
+	}
+	for _, x := range e.clip(size) {
+		if x.End > off {
+			if x.Start > off {
+				return x.Start, true
+			}
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// hydration is what is cached of the content of a file that has not been
+// entirely downloaded.
+type hydration struct {
+	CTag    string  `json:"cTag"` // version of the server's content being downloaded
+	Size    uint64  `json:"size"`
+	Extents extents `json:"extents"` // parts that are cached
+}
+
+// complete returns whether all of the content is cached.
+func (h *hydration) complete() bool {
+	return len(h.Extents.missing(0, h.Size)) == 0
+}
+
+// cached returns how much of the content is cached.
+func (h *hydration) cached() uint64 {
+	var total uint64
+	for _, x := range h.Extents {
+		total += x.End - x.Start
+	}
+	return total
+}
+
+// resize updates the hydration for the file being truncated or extended.
+// Anything past the old size is zeroes rather than the server's content, so it
+// counts as cached.
+func (h *hydration) resize(size uint64) {
+	if size < h.Size {
+		h.Extents = h.Extents.clip(size)
+	} else {
+		h.Extents = h.Extents.add(h.Size, size)
+	}
+	h.Size = size
+}
+
+// written updates the hydration for a write to the file. The content written
+// is newer than the server's, and so is anything skipped over past the end.
+func (h *hydration) written(offset uint64, end uint64) {
+	if offset > h.Size {
+		offset = h.Size
+	}
+	h.Extents = h.Extents.add(offset, end)
+	if end > h.Size {
+		h.Size = end
+	}
+}
+
+// getHydration returns what is cached of the partly downloaded content of an
+// item, or nil if its content is either all cached or not at all.
+func (c *Cache) getHydration(id string) *hydration {
+	var h *hydration
+	c.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketHydration).Get([]byte(id)); v != nil {
+			h = &hydration{}
+			if json.Unmarshal(v, h) != nil {
+				h = nil
+			}
+		}
+		return nil
+	})
+	return h
+}
+
+// setHydration stores what is cached of the content of an item, forgetting it
+// if the content is complete.
+func (c *Cache) setHydration(id string, h *hydration) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHydration)
+		if h == nil || h.complete() {
+			return b.Delete([]byte(id))
+		}
+		v, _ := json.Marshal(h)
+		return b.Put([]byte(id), v)
+	})
+}
+
+// hydrationIDs returns the IDs of all items whose content is partly cached.
+func (c *Cache) hydrationIDs() []string {
+	ids := make([]string, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHydration).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids
+}
+
+// downloadProgress returns how much of the content of a file is cached and its
+// size, as long as it is only partly downloaded.
+func (i *Inode) downloadProgress() (uint64, uint64, bool) {
+	i.mutex.RLock()
+	if h := i.hydration; h != nil {
+		defer i.mutex.RUnlock()
+		return h.cached(), h.Size, true
+	}
+	id := i.DriveItem.ID
+	i.mutex.RUnlock()
+	// not open, but maybe read partway before it was closed
+	if h := i.GetCache().getHydration(id); h != nil {
+		return h.cached(), h.Size, true
+	}
+	return 0, 0, false
+}
+
+// startHydration opens the content of a file as an empty sparse file of the
+// file's size, to be filled in as it is read. Must be called with the mutex
+// held.
+func (i *Inode) startHydration() error {
+	id := i.DriveItem.ID
+	if err := i.cache.DeleteContent(id); err != nil {
+		return err
+	}
+	if err := i.openContent(); err != nil {
+		return err
+	}
+	if err := i.content.Truncate(int64(i.DriveItem.Size)); err != nil {
+		i.closeContent()
+		return err
+	}
+	h := &hydration{CTag: i.DriveItem.CTag, Size: i.DriveItem.Size}
+	if h.complete() {
+		return nil // nothing to download
+	}
+	i.hydration = h
+	return i.cache.setHydration(id, h)
+}
+
+// hydrate downloads whatever is missing from the content of a file from start
+// to end. Does nothing if the file is not open or all of its content is cached.
+// Parts that are already being downloaded for someone else are waited for
+// instead of downloaded again (see downloadManager).
+func (i *Inode) hydrate(ctx context.Context, start uint64, end uint64,
+	priority graph.Priority) error {
+	downloads := i.GetCache().downloads
+	for {
+		i.mutex.RLock()
+		h := i.hydration
+		id := i.DriveItem.ID
+		var size uint64
+		var gaps []extent
+		if h != nil {
+			size = h.Size
+			if end > size {
+				end = size
+			}
+			gaps = h.Extents.missing(start, end)
+		}
+		stale := i.remoteChange != nil
+		i.mutex.RUnlock()
+		if len(gaps) == 0 {
+			return nil
+		}
+		if stale {
+			// the server only has the new version
+			return errStaleContent
+		}
+
+		waits := make([]chan struct{}, 0)
+		for _, gap := range gaps {
+			gap.Start -= gap.Start % hydrationBlock
+			if rem := gap.End % hydrationBlock; rem != 0 {
+				gap.End += hydrationBlock - rem
+			}
+			if gap.End > size {
+				gap.End = size
+			}
+			runs, others := downloads.claim(id, gap.Start, gap.End)
+			waits = append(waits, others...)
+			for k, run := range runs {
+				n, err := i.hydrateRun(ctx, h, id, run, priority)
+				downloads.release(id, run)
+				if err != nil || n == 0 {
+					downloads.release(id, runs[k+1:]...)
+					return err
+				}
+			}
+		}
+		if len(waits) == 0 {
+			return nil
+		}
+		// whatever the others could not download is claimed on the next pass
+		if err := downloads.wait(ctx, waits); err != nil {
+			return err
+		}
+	}
+}
+
+// hydrateRun downloads a run of blocks claimed from the downloadManager for
+// hydrate. Returns how much was downloaded, which is 0 if the file was closed
+// or replaced in the meantime.
+func (i *Inode) hydrateRun(ctx context.Context, h *hydration, id string, run extent,
+	priority graph.Priority) (uint64, error) {
+	downloads := i.GetCache().downloads
+	if err := downloads.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer downloads.giveBack()
+	var total uint64
+	for offset := run.Start; offset < run.End; {
+		n, err := i.hydrateRange(ctx, h, id, offset, run.End-offset, priority)
+		if err != nil || n == 0 {
+			return total, err
+		}
+		offset += n
+		total += n
+	}
+	return total, nil
+}
+
+// maxHydrationRequest is the most content downloaded by one request while
+// hydrating, since it is held in memory until it is written to the cache.
+const maxHydrationRequest = 16 * hydrationBlock
+
+// hydrateRange downloads part of the content of a file for hydrate, and fills
+// in whatever is still missing from it. Returns how much was downloaded, which
+// is 0 if the file was closed or replaced in the meantime.
+func (i *Inode) hydrateRange(ctx context.Context, h *hydration, id string,
+	offset uint64, length uint64, priority graph.Priority) (uint64, error) {
+	// downloaded into memory first, so that the file stays writable in the
+	// meantime
+	cache := i.GetCache()
+	var buffer bytes.Buffer
+	n, _, err := cache.Drive().GetItemContentRange(ctx, id, offset, length, &buffer,
+		priority, cache.GetAuth())
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("server has no content at offset %d", offset)
+	}
+	downloaded := buffer.Bytes()
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.hydration != h || i.content == nil {
+		return 0, nil
+	}
+	end := offset + n
+	if end > h.Size {
+		// truncated in the meantime
+		end = h.Size
+	}
+	// only what is still missing is filled in, anything written since is newer
+	// than the server's content
+	for _, hole := range h.Extents.missing(offset, end) {
+		if _, err = i.content.WriteAt(downloaded[hole.Start-offset:hole.End-offset],
+			int64(hole.Start)); err != nil {
+			return 0, err
+		}
+	}
+	// on disk before it is recorded as cached, or a crash could leave holes
+	// that are never downloaded
+	if err = i.content.Sync(); err != nil {
+		return 0, err
+	}
+	h.Extents = h.Extents.add(offset, end)
+	if h.complete() {
+		i.hydration = nil
+		go i.checkHydrated(h)
+	}
+	log.WithFields(log.Fields{
+		"id":     id,
+		"offset": offset,
+		"size":   n,
+	}).Trace("Downloaded part of file.")
+	cache.requestEviction()
+	return n, cache.setHydration(id, h)
+}
+
+// checkHydrated checks the content of a file against the server's hash once
+// all of it has been downloaded, since the parts downloaded for each read cannot
+// be checked on their own. Content that does not match is downloaded again as it
+// is read, up to downloadAttempts times in a row.
+func (i *Inode) checkHydrated(h *hydration) {
+	cache := i.GetCache()
+	checksum := i.checksum()
+	if checksum == "" || cache.opts.SkipHashVerification {
+		return
+	}
+	i.mutex.RLock()
+	id := i.DriveItem.ID
+	i.mutex.RUnlock()
+	hash, _, err := cache.hashContent(id)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if err != nil || i.hasChanges || i.hydration != nil || i.DriveItem.CTag != h.CTag {
+		return // changed in the meantime, so the hash is of something else
+	}
+	if strings.EqualFold(hash, checksum) {
+		i.badDownloads = 0
+		return
+	}
+	i.badDownloads++
+	fields := log.Fields{
+		"id":       id,
+		"name":     i.DriveItem.Name,
+		"attempt":  i.badDownloads,
+		"hash":     hash,
+		"checksum": checksum,
+	}
+	if i.badDownloads >= downloadAttempts {
+		log.WithFields(fields).Error("Downloaded content did not match the server's " +
+			"hash again, giving up.")
+		return
+	}
+	log.WithFields(fields).Warn("Downloaded content did not match the server's hash, " +
+		"downloading it again.")
+	if i.content == nil {
+		// downloaded again the next time it is opened
+		cache.DeleteContent(id)
+		return
+	}
+	i.hydration = &hydration{CTag: h.CTag, Size: h.Size}
+	cache.setHydration(id, i.hydration)
+}
+
+// hydrateAll downloads whatever is missing from the content of a file, which is
+// needed before all of it can be hashed or uploaded.
+func (i *Inode) hydrateAll(ctx context.Context) error {
+	return i.hydrate(ctx, 0, i.Size(), graph.PriorityInteractive)
+}
+
+// readahead downloads the part of a file after a read in the background when the
+// file is being read sequentially, like by a video player, so that the next
+// reads find their content already cached instead of waiting on the network.
+// Only one readahead runs at a time for each file, and each one tops up the
+// window (see Options.Readahead) ahead of the latest read.
+func (i *Inode) readahead(offset uint64, end uint64) {
+	cache := i.GetCache()
+	window := cache.opts.Readahead
+	if cache.SyncPaused() {
+		window = 0
+	}
+	i.mutex.Lock()
+	// the first read of a file is not sequential yet, since many programs only
+	// read its header
+	sequential := offset > 0 && offset == i.readEnd
+	i.readEnd = end
+	h := i.hydration
+	if window == 0 || !sequential || h == nil || i.stopReadahead != nil {
+		i.mutex.Unlock()
+		return
+	}
+	ahead := end + window
+	if ahead > h.Size {
+		ahead = h.Size
+	}
+	if end >= ahead || len(h.Extents.missing(end, ahead)) == 0 {
+		i.mutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	i.stopReadahead = cancel
+	id := i.DriveItem.ID
+	i.mutex.Unlock()
+
+	go func() {
+		// nothing is waiting on it yet, so it gives way to reads that are (see
+		// graph.SetDownloadLimit)
+		err := i.hydrate(ctx, end, ahead, graph.PriorityBackground)
+		if err != nil && ctx.Err() == nil {
+			log.WithFields(log.Fields{
+				"id":     id,
+				"offset": end,
+				"err":    err,
+			}).Warn("Could not read ahead of a sequential read.")
+		}
+		i.mutex.Lock()
+		if ctx.Err() == nil {
+			// still the current readahead, a canceled one was replaced already
+			i.cancelReadahead()
+		}
+		i.mutex.Unlock()
+	}()
+}
+
+// cancelReadahead stops the readahead downloading in the background, if any,
+// once nobody is reading the file anymore. Must be called with the mutex held.
+func (i *Inode) cancelReadahead() {
+	if i.stopReadahead != nil {
+		i.stopReadahead()
+		i.stopReadahead = nil
+	}
+}
+
+// whence of lseek(2) for finding data and holes, which the syscall package does
+// not define
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Lseek finds data and holes in a file for SEEK_DATA and SEEK_HOLE. A file is
+// all data as far as programs are concerned, even if parts of it were not
+// downloaded yet, since those are downloaded when they are read. With
+// Options.HydrationHoles, the parts of a partly downloaded file that are not
+// cached are reported as holes instead.
+func (i *Inode) Lseek(ctx context.Context, f fs.FileHandle, off uint64,
+	whence uint32) (uint64, syscall.Errno) {
+	if whence != seekData && whence != seekHole {
+		return 0, syscall.EINVAL
+	}
+	cache := i.GetCache()
+	i.mutex.RLock()
+	id := i.DriveItem.ID
+	size := i.DriveItem.Size
+	h := i.hydration
+	var cached extents
+	if h != nil {
+		size = h.Size
+		cached = append(cached, h.Extents...)
+	}
+	i.mutex.RUnlock()
+	if h == nil && cache.opts.HydrationHoles {
+		// not open, but maybe read partway before it was closed
+		if h = cache.getHydration(id); h != nil {
+			cached = h.Extents
+		}
+	}
+	if h == nil || !cache.opts.HydrationHoles {
+		cached = extents{{Start: 0, End: size}}
+	}
+	if offset, ok := cached.seek(off, size, whence == seekHole); ok {
+		return offset, 0
+	}
+	return 0, syscall.ENXIO
+}
@@ -1,9 +1,12 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
 	"net/url"
@@ -35,11 +38,24 @@ type Inode struct {
 	mutex sync.RWMutex // used to be a pointer, but fs.Inode also embeds a mutex :(
 	graph.DriveItem
 	cache      *Cache
-	children   []string // a slice of ids, nil when uninitialized
-	data       *[]byte  // empty by default
-	hasChanges bool     // used to trigger an upload on flush
-	subdir     uint32   // used purely by NLink()
-	mode       uint32   // do not set manually
+	children   []string     // a slice of ids, nil when uninitialized
+	content    *contentFile // the cached content while the file is open
+	hydration  *hydration   // what is cached of the content, nil if all of it is
+	hasChanges bool         // used to trigger an upload on flush
+	subdir     uint32       // used purely by NLink()
+	mode       uint32       // do not set manually
+
+	readEnd       uint64             // where the last read ended, to spot sequential reads
+	stopReadahead context.CancelFunc // of the readahead downloading in the background, if any
+	badDownloads  int                // downloads in a row that did not match the server's hash
+
+	blocked   string    // why the server refused to let us download this item
+	blockedAt time.Time // when the server last refused
+
+	owner *fuse.Owner // set by chown, nil for the mounting user
+
+	opens        int              // open file handles, see Open and Release
+	remoteChange *graph.DriveItem // changes from the server held back while open
 }
 
 // SerializeableInode is like a Inode, but can be serialized for local storage
@@ -63,8 +79,7 @@ func NewInode(name string, mode uint32, parent *Inode) *Inode {
 		parent.mutex.RUnlock()
 	}
 
-	var empty []byte
-	currentTime := time.Now()
+	currentTime := graph.ServerNow()
 	return &Inode{
 		DriveItem: graph.DriveItem{
 			ID:      localID(),
@@ -73,7 +88,6 @@ func NewInode(name string, mode uint32, parent *Inode) *Inode {
 			ModTime: &currentTime,
 		},
 		children: make([]string, 0),
-		data:     &empty,
 		mode:     mode,
 	}
 }
@@ -184,12 +198,13 @@ func (i *Inode) GetCache() *Cache {
 // quotas and storage limits.
 func (i *Inode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 	log.WithFields(log.Fields{"path": i.Path()}).Debug()
-	drive, err := graph.GetDrive(i.GetCache().GetAuth())
+	cache := i.GetCache()
+	drive, err := graph.GetDriveID(cache.Drive().ID, cache.GetAuth())
 	if err != nil {
 		return syscall.EREMOTEIO
 	}
 
-	if drive.DriveType == graph.DriveTypePersonal {
+	if !cache.Capabilities().FileCount {
 		log.Warn("Personal OneDrive accounts do not show number of files, " +
 			"inode counts reported by onedriver will be bogus.")
 	} else if drive.Quota.Total == 0 { // <-- check for if microsoft ever fixes their API
@@ -220,6 +235,7 @@ func (i *Inode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	}).Debug()
 
 	cache := i.GetCache()
+	cache.recordAccess(i.ID())
 	// directories are always created with a remote graph id
 	children, err := cache.GetChildrenID(i.ID(), cache.GetAuth())
 	if err != nil {
@@ -237,9 +253,16 @@ func (i *Inode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		entry := fuse.DirEntry{
 			Name: child.Name(),
 			Mode: child.Mode(),
+			Ino:  cache.Ino(child.ID()),
 		}
 		entries = append(entries, entry)
 	}
+	if i.ID() == cache.root {
+		entries = append(entries, fuse.DirEntry{Name: favoritesDirName, Mode: fuse.S_IFDIR})
+		if cache.opts.SpecialFolders {
+			entries = append(entries, fuse.DirEntry{Name: specialDirName, Mode: fuse.S_IFDIR})
+		}
+	}
 	return fs.NewListDirStream(entries), 0
 }
 
@@ -252,12 +275,23 @@ func (i *Inode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*f
 	}).Trace()
 
 	cache := i.GetCache()
+	if name == favoritesDirName && i.ID() == cache.root {
+		out.Attr = virtualDirAttr()
+		return i.favoritesDir(ctx), 0
+	}
+	if name == specialDirName && i.ID() == cache.root && cache.opts.SpecialFolders {
+		out.Attr = virtualDirAttr()
+		return i.specialDir(ctx), 0
+	}
 	child, _ := cache.GetChild(i.ID(), strings.ToLower(name), cache.GetAuth())
 	if child == nil {
 		return nil, syscall.ENOENT
 	}
 	out.Attr = child.makeattr()
-	return i.NewInode(ctx, child, fs.StableAttr{Mode: child.Mode() & fuse.S_IFDIR}), 0
+	return i.NewInode(ctx, child, fs.StableAttr{
+		Mode: child.Mode() & fuse.S_IFDIR,
+		Ino:  cache.Ino(child.ID()),
+	}), 0
 }
 
 // RemoteID uploads an empty file to obtain a Onedrive ID if it doesn't already
@@ -274,20 +308,51 @@ func (i *Inode) RemoteID(auth *graph.Auth) (string, error) {
 
 	originalID := i.ID()
 	if isLocalID(originalID) && auth.AccessToken != "" {
+		// a new file that is being uploaded gets its ID once the upload
+		// completes, creating it here as well would make two of it
+		uploaded := i.cache.uploads.WaitUpload(originalID) == nil
+		if id := i.ID(); !isLocalID(id) {
+			return id, nil
+		} else if !uploaded {
+			// the upload failed, the content is uploaded again the next time
+			// the file is flushed, once it has been created here
+			i.cache.uploads.CancelUpload(originalID)
+		}
+
 		i.mutex.Lock()
-		uploadPath := fmt.Sprintf(
-			"/me/drive/items/%s:/%s:/content",
-			i.DriveItem.Parent.ID,
-			url.PathEscape(i.DriveItem.Name),
-		)
-		var uploadReader *strings.Reader
-		if i.DriveItem.Size < 4*1024*1024 {
-			// we upload the current data
-			uploadReader = strings.NewReader(string(*i.data))
+		drive := i.cache.Drive()
+		behavior := string(i.cache.opts.ConflictBehavior)
+		// we use a new DriveItem to unmarshal things into or it will fuck
+		// with the existing object (namely its size)
+		var created *graph.DriveItem
+		var err error
+		if i.DriveItem.Size == 0 {
+			// empty files (like lock files) are created without uploading
+			// anything
+			created, err = drive.CreateEmptyFile(i.DriveItem.Name, i.DriveItem.Parent.ID,
+				behavior, auth)
 		} else {
-			uploadReader = strings.NewReader("")
+			uploadPath := fmt.Sprintf(
+				"%s:/%s:/content",
+				drive.IDPath(i.DriveItem.Parent.ID),
+				url.PathEscape(i.DriveItem.Name),
+			)
+			if behavior != "" {
+				uploadPath += "?@microsoft.graph.conflictBehavior=" + behavior
+			}
+			var uploadReader *bytes.Reader
+			if i.DriveItem.Size < 4*1024*1024 {
+				// we upload the current data
+				uploadReader = bytes.NewReader(i.cache.GetContent(i.DriveItem.ID))
+			} else {
+				uploadReader = bytes.NewReader(nil)
+			}
+			var resp []byte
+			if resp, err = graph.Put(uploadPath, auth, uploadReader); err == nil {
+				created = &graph.DriveItem{}
+				err = json.Unmarshal(resp, created)
+			}
 		}
-		resp, err := graph.Put(uploadPath, auth, uploadReader)
 		if err != nil {
 			if strings.Contains(err.Error(), "nameAlreadyExists") {
 				// This likely got fired off just as an initial upload completed.
@@ -300,7 +365,7 @@ func (i *Inode) RemoteID(auth *graph.Auth) (string, error) {
 				}
 
 				// does the server have it?
-				latest, err := graph.GetItemPath(i.cache.InodePath(i.EmbeddedInode()), auth)
+				latest, err := i.cache.getRemoteChild(i.DriveItem.Parent.ID, i.DriveItem.Name, auth)
 				if err == nil {
 					// hooray!
 					i.mutex.Unlock()
@@ -312,20 +377,22 @@ func (i *Inode) RemoteID(auth *graph.Auth) (string, error) {
 			i.mutex.Unlock()
 			return originalID, err
 		}
-		// we just successfully uploaded a copy, no need to do it again
-		i.hasChanges = false
+		// we just successfully uploaded a copy, no need to do it again (unless
+		// an upload of its content failed above)
+		i.hasChanges = !uploaded
 		name := i.DriveItem.Name
 		i.mutex.Unlock()
 
-		// we use a new DriveItem to unmarshal things into or it will fuck
-		// with the existing object (namely its size)
-		unsafe := NewInode(name, 0644, nil)
-		err = json.Unmarshal(resp, unsafe)
-		if err != nil {
-			return originalID, err
+		if renamed := created.Name; renamed != name {
+			// an item with the same name already existed (see ConflictRename)
+			i.SetName(renamed)
+			log.WithFields(log.Fields{
+				"name":    name,
+				"renamed": renamed,
+			}).Warn("File already existed on the server, the new file was renamed.")
 		}
 		// this is all we really wanted from this transaction
-		newID := unsafe.ID()
+		newID := created.ID
 		err = i.GetCache().MoveID(originalID, newID)
 		log.WithFields(log.Fields{
 			"name":     name,
@@ -337,6 +404,31 @@ func (i *Inode) RemoteID(auth *graph.Auth) (string, error) {
 	return originalID, nil
 }
 
+// getRemoteChild fetches an item from the server by its name in a folder. Folders
+// made offline that were not created on the server yet only have a local ID, so
+// items in them are looked up by their path from the closest folder above them
+// that has an ID on the server instead.
+func (c *Cache) getRemoteChild(parentID string, name string, auth *graph.Auth) (*graph.DriveItem, error) {
+	if !isLocalID(parentID) {
+		return c.drive.GetItemChild(parentID, name, auth)
+	}
+	segments := []string{url.PathEscape(name)}
+	for isLocalID(parentID) {
+		parent := c.GetID(parentID)
+		if parent == nil {
+			return nil, errors.New("parent folder is not in the cache")
+		}
+		segments = append([]string{url.PathEscape(parent.Name())}, segments...)
+		parentID = parent.ParentID()
+	}
+	resp, err := graph.Get(c.drive.IDPath(parentID)+":/"+strings.Join(segments, "/"), auth)
+	if err != nil {
+		return nil, err
+	}
+	item := &graph.DriveItem{}
+	return item, json.Unmarshal(resp, item)
+}
+
 // Path returns an inode's full Path
 func (i *Inode) Path() string {
 	// special case when it's the root item
@@ -355,24 +447,98 @@ func (i *Inode) Path() string {
 	return strings.Replace(prepath, "//", "/", -1)
 }
 
+// setDescription updates the description of an item on the server.
+func (i *Inode) setDescription(description string) syscall.Errno {
+	cache := i.GetCache()
+	if cache.IsOffline() {
+		return syscall.EROFS
+	}
+	auth := cache.GetAuth()
+	id, err := i.RemoteID(auth)
+	if err != nil || isLocalID(id) {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": i.Path(),
+			"err":  err,
+		}).Error("Could not obtain remote ID to set description.")
+		return syscall.EREMOTEIO
+	}
+
+	patch := map[string]interface{}{"description": description}
+	if _, err := cache.Drive().UpdateItem(id, patch, auth); err != nil {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": i.Path(),
+			"err":  err,
+		}).Error("Failed to update item description.")
+		return syscall.EREMOTEIO
+	}
+	i.mutex.Lock()
+	i.DriveItem.Description = description
+	i.mutex.Unlock()
+	return 0
+}
+
 // Read from an Inode like a file
 func (i *Inode) Read(ctx context.Context, f fs.FileHandle, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if stream, ok := f.(*streamHandle); ok && !i.HasContent() {
+		return stream.read(ctx, i, buf, off)
+	}
 	path := i.Path()
 	if !i.HasContent() {
+		// like when a file that was closed is still mapped into memory
 		log.WithFields(log.Fields{
 			"id":   i.ID(),
 			"path": path,
-		}).Warn("Read called on a closed file descriptor! Reopening file for op.")
-		i.Open(ctx, 0)
+		}).Debug("Read called on a closed file, reopening it.")
+		i.open(ctx, 0, false)
 	}
 
+	if err := i.hydrate(ctx, uint64(off), uint64(off)+uint64(len(buf)),
+		graph.PriorityInteractive); err != nil {
+		if ctx.Err() != nil {
+			// the program reading gave up, like a cp stopped with ctrl-c, and
+			// whatever it was reading ahead for it is not needed either
+			log.WithFields(log.Fields{
+				"id":     i.ID(),
+				"path":   path,
+				"offset": off,
+			}).Debug("Read was interrupted, no longer downloading it.")
+			i.mutex.Lock()
+			i.cancelReadahead()
+			i.mutex.Unlock()
+			return fuse.ReadResultData(make([]byte, 0)), syscall.EINTR
+		}
+		if errors.Is(err, errStaleContent) {
+			log.WithFields(log.Fields{
+				"id":     i.ID(),
+				"path":   path,
+				"offset": off,
+			}).Warn("Part of the file being read was not downloaded before it " +
+				"changed on the server, it is no longer available.")
+			return fuse.ReadResultData(make([]byte, 0)), syscall.ESTALE
+		}
+		log.WithFields(log.Fields{
+			"id":     i.ID(),
+			"path":   path,
+			"offset": off,
+			"err":    err,
+		}).Error("Could not download the part of the file being read.")
+		return fuse.ReadResultData(make([]byte, 0)), syscall.EREMOTEIO
+	}
+	i.readahead(uint64(off), uint64(off)+uint64(len(buf)))
+
 	// we are locked for the remainder of this op
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
+	if i.content == nil {
+		// could not be reopened
+		return fuse.ReadResultData(make([]byte, 0)), syscall.EIO
+	}
 
 	end := int(off) + int(len(buf))
 	oend := end
-	size := len(*i.data) // worse than using i.size(), but some edge cases require it
+	size := int(i.DriveItem.Size)
 	if int(off) > size {
 		log.WithFields(log.Fields{
 			"id":        i.DriveItem.ID,
@@ -394,7 +560,16 @@ func (i *Inode) Read(ctx context.Context, f fs.FileHandle, buf []byte, off int64
 		"file_size":        size,
 		"offset":           off,
 	}).Trace("Read file")
-	return fuse.ReadResultData((*i.data)[off:end]), 0
+	n, err := i.content.ReadAt(buf[:end-int(off)], off)
+	if err != nil && err != io.EOF {
+		log.WithFields(log.Fields{
+			"id":   i.DriveItem.ID,
+			"path": path,
+			"err":  err,
+		}).Error("Could not read cached content.")
+		return fuse.ReadResultData(make([]byte, 0)), syscall.EIO
+	}
+	return fuse.ReadResultData(buf[:n]), 0
 }
 
 // Write to an Inode like a file. Note that changes are 100% local until
@@ -413,23 +588,38 @@ func (i *Inode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int
 		log.WithFields(log.Fields{
 			"id":   i.ID(),
 			"path": i.Path(),
-		}).Warn("Write called on a closed file descriptor! Reopening file for write op.")
-		i.Open(ctx, 0)
+		}).Debug("Write called on a closed file, reopening it.")
+		i.open(ctx, 0, false)
+	}
+
+	if errno := i.checkFileSize(uint64(offset + nWrite)); errno != 0 {
+		return 0, errno
 	}
 
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
-	if offset+nWrite > int(i.DriveItem.Size)-1 {
-		// we've exceeded the file size, overwrite via append
-		*i.data = append((*i.data)[:offset], data...)
-	} else {
-		// writing inside the current file, overwrite in place
-		copy((*i.data)[offset:], data)
+	if i.content == nil {
+		// could not be reopened
+		return 0, syscall.EIO
+	}
+	n, err := i.content.WriteAt(data, off)
+	if i.hydration != nil {
+		i.hydration.written(uint64(offset), uint64(offset+n))
+	}
+	if end := uint64(offset + n); end > i.DriveItem.Size {
+		i.DriveItem.Size = end
+	}
+	if n > 0 {
+		i.hasChanges = true
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   i.DriveItem.ID,
+			"path": i.Path(),
+			"err":  err,
+		}).Error("Could not write to cached content.")
+		return uint32(n), syscall.EIO
 	}
-	// probably a better way to do this, but whatever
-	i.DriveItem.Size = uint64(len(*i.data))
-	i.hasChanges = true
-
 	return uint32(nWrite), 0
 }
 
@@ -437,7 +627,7 @@ func (i *Inode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int
 func (i *Inode) HasContent() bool {
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
-	return i.data != nil
+	return i.content != nil
 }
 
 // HasChanges returns true if the file has local changes that haven't been
@@ -456,25 +646,102 @@ func (i *Inode) HasChildren() bool {
 }
 
 // Fsync is a signal to ensure writes to the Inode are flushed to stable
-// storage. This method is used to trigger uploads of file content.
+// storage. This method is used to trigger uploads of file content, unless the
+// upload policy only uploads files when they are closed or periodically, in
+// which case the content is only saved to the local cache.
 func (i *Inode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
 	log.WithFields(log.Fields{
 		"id":   i.ID(),
 		"path": i.Path(),
 	}).Debug()
+	switch i.GetCache().uploadPolicy(i) {
+	case UploadOnClose:
+		i.saveContent()
+		return 0
+	case UploadOnInterval:
+		i.saveContent()
+		i.GetCache().markDirty(i)
+		return 0
+	}
+	return i.upload()
+}
+
+// saveContent writes the content of a file with changes to the local cache,
+// along with its new hashes, without uploading it.
+func (i *Inode) saveContent() {
+	if err := i.hydrateAll(context.Background()); err != nil {
+		log.WithFields(log.Fields{
+			"id":  i.ID(),
+			"err": err,
+		}).Error("Could not download the rest of a changed file, not saving it.")
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if !i.hasChanges || i.content == nil {
+		return
+	}
+	i.rehash()
+}
+
+// upload queues the content of a file for upload if it has changed, and waits
+// for the upload to finish in write-through mode.
+func (i *Inode) upload() syscall.Errno {
 	if i.HasChanges() {
+		if errno := i.checkFileSize(i.Size()); errno != 0 {
+			return errno
+		}
+		// only whole files can be uploaded
+		if err := i.hydrateAll(context.Background()); err != nil {
+			log.WithFields(log.Fields{
+				"id":   i.ID(),
+				"name": i.Name(),
+				"err":  err,
+			}).Error("Could not download the rest of a changed file before uploading it.")
+			return syscall.EREMOTEIO
+		}
 		i.mutex.Lock()
 		i.hasChanges = false
 
-		// recompute hashes when saving new content
-		i.DriveItem.File = &graph.File{}
-		if i.DriveItem.Parent.DriveType == graph.DriveTypePersonal {
-			i.DriveItem.File.Hashes.SHA1Hash = graph.SHA1Hash(i.data)
-		} else {
-			i.DriveItem.File.Hashes.QuickXorHash = graph.QuickXORHash(i.data)
+		// recompute hashes when saving new content (the hashes of content that
+		// is only in the cache were computed when it was saved there)
+		if i.content != nil {
+			i.rehash()
 		}
+		mtime := i.DriveItem.ModTime
 		i.mutex.Unlock()
 
+		if isLocalID(i.ID()) && i.Size() == 0 {
+			// new empty files (like lock files) are created on the server
+			// without uploading anything
+			if id, err := i.RemoteID(i.cache.GetAuth()); err != nil || isLocalID(id) {
+				log.WithFields(log.Fields{
+					"id":   id,
+					"name": i.Name(),
+					"err":  err,
+				}).Error("Could not create empty file on the server.")
+				return syscall.EREMOTEIO
+			}
+			return 0
+		}
+
+		if remote := i.unchangedRemote(); remote != nil {
+			// like after touch(1), or saving without changing anything. Anything
+			// still queued from before is out of date.
+			log.WithFields(log.Fields{
+				"id":   i.ID(),
+				"name": i.Name(),
+			}).Debug("Server already has this content, only updating modification time.")
+			i.cache.uploads.CancelUpload(i.ID())
+			i.mutex.Lock()
+			i.DriveItem.CTag = remote.CTag
+			i.mutex.Unlock()
+			if mtime != nil {
+				i.patchModTime(*mtime)
+			}
+			return 0
+		}
+
 		if err := i.cache.uploads.QueueUpload(i); err != nil {
 			log.WithFields(log.Fields{
 				"id":   i.ID(),
@@ -483,27 +750,109 @@ func (i *Inode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscal
 			}).Error("Error creating upload session.")
 			return syscall.EREMOTEIO
 		}
+		if i.GetCache().isWriteThrough(i) {
+			if err := i.cache.uploads.WaitUpload(i.ID()); err != nil {
+				log.WithFields(log.Fields{
+					"id":   i.ID(),
+					"name": i.Name(),
+					"err":  err,
+				}).Error("Upload failed in write-through mode.")
+				return syscall.EREMOTEIO
+			}
+		}
 		return 0
 	}
 	return 0
 }
 
-// Flush is called when a file descriptor is closed. Uses Fsync to perform file
-// uploads.
+// unchangedRemote returns the server's copy of a file if it already has exactly
+// the file's content, or nil if the content needs to be uploaded. Must be called
+// after the file's hashes are computed.
+func (i *Inode) unchangedRemote() *graph.DriveItem {
+	id := i.ID()
+	cache := i.GetCache()
+	if isLocalID(id) || cache.IsOffline() {
+		return nil
+	}
+	remote, err := cache.Drive().GetItem(id, cache.GetAuth())
+	if err != nil || !remote.HasHashes() {
+		return nil
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if remote.Size != i.DriveItem.Size ||
+		!i.VerifyChecksum(cache.Capabilities().Checksum(remote.File.Hashes)) {
+		return nil
+	}
+	return remote
+}
+
+// checkFileSize returns EFBIG if a file of the given size could not be
+// uploaded to OneDrive.
+func (i *Inode) checkFileSize(size uint64) syscall.Errno {
+	if max := i.GetCache().MaxFileSize(); size > max {
+		log.WithFields(log.Fields{
+			"id":      i.ID(),
+			"path":    i.Path(),
+			"size":    size,
+			"maxSize": max,
+		}).Error("File is larger than the maximum file size allowed by OneDrive, " +
+			"refusing to write it.")
+		return syscall.EFBIG
+	}
+	return 0
+}
+
+// Flush is called when a file descriptor is closed, and uploads the file if it
+// has changed (unless the upload policy only uploads files periodically).
 func (i *Inode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"id":   i.ID(),
 	}).Debug()
-	i.Fsync(ctx, f, 0)
+	var errno syscall.Errno
+	if i.GetCache().uploadPolicy(i) == UploadOnInterval {
+		i.saveContent()
+		i.GetCache().markDirty(i)
+	} else {
+		errno = i.upload()
+	}
 
-	// wipe data from memory to avoid mem bloat over time
+	// the content is already in the cache, only the file is closed
 	i.mutex.Lock()
-	if i.data != nil {
-		i.cache.InsertContent(i.DriveItem.ID, *i.data)
-		i.data = nil
+	i.closeContent()
+	i.mutex.Unlock()
+
+	if i.GetCache().isWriteThrough(i) {
+		// in write-back mode, errors are only reported in the logs
+		return errno
+	}
+	return 0
+}
+
+// Release is called once a file handle is no longer used anywhere, which
+// includes being mapped into memory. Programs writing to a shared mapping (like
+// sqlite) can keep doing so after they close the file, and those writes arrive
+// after Flush, when the mapping is synced or unmapped, so they are uploaded
+// here. Changes from the server held back while the file was open are applied
+// once the last handle is released.
+func (i *Inode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	if i.HasChanges() {
+		i.Flush(ctx, f)
+	}
+	i.mutex.Lock()
+	var remote *graph.DriveItem
+	if i.opens > 0 {
+		i.opens--
+	}
+	if i.opens == 0 {
+		remote = i.remoteChange
+		i.remoteChange = nil
 	}
 	i.mutex.Unlock()
+	if remote != nil {
+		i.GetCache().applyHeldChange(i, remote)
+	}
 	return 0
 }
 
@@ -512,17 +861,84 @@ func (i *Inode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
 func (i *Inode) makeattr() fuse.Attr {
 	mtime := i.ModTime()
 	return fuse.Attr{
-		Size:  i.Size(),
-		Nlink: i.NLink(),
-		Mtime: mtime,
-		Atime: mtime,
-		Ctime: mtime,
-		Mode:  i.Mode(),
-		Owner: fuse.Owner{
-			Uid: uint32(os.Getuid()),
-			Gid: uint32(os.Getgid()),
-		},
+		Size:   i.Size(),
+		Blocks: i.blocks(),
+		Nlink:  i.NLink(),
+		Mtime:  mtime,
+		Atime:  mtime,
+		Ctime:  mtime,
+		Mode:   i.Mode(),
+		Owner:  i.Owner(),
+	}
+}
+
+// blocks returns how many 512-byte blocks the cached content of a file takes
+// up on disk. Files that were not downloaded yet take up none, even though
+// their size is their size on the server, so that du shows how much is stored
+// locally while ls -l shows the real sizes.
+func (i *Inode) blocks() uint64 {
+	cache := i.GetCache()
+	if cache == nil || i.IsDir() {
+		return 0
+	}
+	info, err := os.Stat(cache.contentPath(i.ID()))
+	if err != nil {
+		return 0
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Blocks)
+	}
+	return (uint64(info.Size()) + 511) / 512
+}
+
+// Owner returns the user and group that own the item.
+func (i *Inode) Owner() fuse.Owner {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if i.owner != nil {
+		return *i.owner
+	}
+	return fuse.Owner{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+}
+
+// chown changes the owner of an item, following the rules of chown(2): only
+// root can give an item away, and only its owner (or root) can change its group.
+// Since OneDrive has no concept of ownership, this only changes what stat
+// reports.
+func (i *Inode) chown(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
+	uid, uidValid := in.GetUID()
+	gid, gidValid := in.GetGID()
+	if !uidValid && !gidValid {
+		return 0
+	}
+	owner := i.Owner()
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		caller = &fuse.Caller{Owner: fuse.Owner{Uid: uint32(os.Getuid())}}
+	}
+	if uidValid && uid != owner.Uid && caller.Uid != 0 {
+		return syscall.EPERM
 	}
+	if gidValid && gid != owner.Gid && caller.Uid != 0 && caller.Uid != owner.Uid {
+		return syscall.EPERM
+	}
+	if uidValid {
+		owner.Uid = uid
+	}
+	if gidValid {
+		owner.Gid = gid
+	}
+
+	i.mutex.Lock()
+	i.owner = &owner
+	i.mutex.Unlock()
+	if err := i.GetCache().storeOwner(i.ID(), &owner); err != nil {
+		return syscall.EIO
+	}
+	return 0
 }
 
 // Getattr returns a the Inode as a UNIX stat. Holds the read mutex for all of
@@ -537,23 +953,54 @@ func (i *Inode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 }
 
 // Setattr is the workhorse for setting filesystem attributes. Does the work of
-// operations like Utimens, Chmod, Chown (not implemented), and Truncate.
+// operations like Utimens, Chmod, Chown, and Truncate.
 func (i *Inode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	log.WithFields(log.Fields{
 		"path": i.Path(),
 		"id":   i.ID(),
 	}).Trace()
 
+	if size, valid := in.GetSize(); valid {
+		if errno := i.checkFileSize(size); errno != 0 {
+			return errno
+		}
+	}
+	if errno := i.chown(ctx, in); errno != 0 {
+		return errno
+	}
+	wasOpen := i.HasContent()
+	if size, valid := in.GetSize(); valid && size > 0 && !wasOpen {
+		// what is left after truncating needs to be downloaded first, since it
+		// is hashed once the file is truncated
+		if _, _, errno := i.open(ctx, 0, false); errno != 0 {
+			return errno
+		}
+		if err := i.hydrate(ctx, 0, size, graph.PriorityInteractive); err != nil {
+			log.WithFields(log.Fields{
+				"id":  i.ID(),
+				"err": err,
+			}).Error("Could not download file content before truncating it.")
+			return syscall.EREMOTEIO
+		}
+	}
+
 	isDir := i.IsDir() // holds an rlock
 	i.mutex.Lock()
 
 	// utimens
-	if mtime, valid := in.GetMTime(); valid {
+	mtime, mtimeValid := in.GetMTime()
+	if mtimeValid {
+		if in.Valid&fuse.FATTR_MTIME_NOW != 0 {
+			// "now" is corrected to match the server's clock, other times are
+			// kept as-is (like when preserving timestamps with "cp -p")
+			mtime = graph.ServerNow()
+		}
 		i.DriveItem.ModTime = &mtime
 	}
 
 	// chmod
-	if mode, valid := in.GetMode(); valid {
+	mode, modeValid := in.GetMode()
+	if modeValid {
 		if isDir {
 			i.mode = fuse.S_IFDIR | mode
 		} else {
@@ -563,22 +1010,102 @@ func (i *Inode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn
 
 	// truncate
 	if size, valid := in.GetSize(); valid {
-		if size > i.DriveItem.Size {
-			// unlikely to be hit, but implementing just in case
-			extra := make([]byte, size-i.DriveItem.Size)
-			*i.data = append(*i.data, extra...)
-		} else {
-			*i.data = (*i.data)[:size]
+		err := i.openContent()
+		if err == nil && !wasOpen && i.hydration == nil {
+			// content that was partly downloaded before is cut short too
+			i.hydration = i.cache.getHydration(i.DriveItem.ID)
+		}
+		if err == nil {
+			err = i.content.Truncate(int64(size))
+		}
+		if err != nil {
+			if !wasOpen {
+				i.closeContent()
+			}
+			i.mutex.Unlock()
+			log.WithFields(log.Fields{
+				"id":   i.DriveItem.ID,
+				"size": size,
+				"err":  err,
+			}).Error("Could not truncate cached content.")
+			return syscall.EIO
 		}
 		i.DriveItem.Size = size
 		i.hasChanges = true
+		if i.hydration != nil {
+			if i.hydration.resize(size); i.hydration.complete() {
+				i.hydration = nil
+				i.cache.setHydration(i.DriveItem.ID, nil)
+			}
+		}
+		if !wasOpen {
+			// the file is not open, so it is not hashed when it is flushed
+			i.rehash()
+			i.closeContent()
+		}
 	}
 
+	contentChanged := i.hasChanges
+	id := i.DriveItem.ID
 	i.mutex.Unlock()
+
+	if _, truncated := in.GetSize(); truncated {
+		// whatever was being uploaded is out of date now, the new content is
+		// uploaded once the file is flushed
+		i.GetCache().uploads.CancelUpload(id)
+	}
+
+	if modeValid {
+		// OneDrive cannot store permissions, so we remember them ourselves
+		i.GetCache().storeMode(i.ID(), mode, isDir)
+	}
+
+	if mtimeValid && !contentChanged {
+		// metadata-only change (like touch), no need to reupload the content
+		i.patchModTime(mtime)
+	}
 	out.Attr = i.makeattr()
 	return 0
 }
 
+// patchModTime updates only the modification time of an item on the server.
+// Failures are not fatal, the local copy still has the new time.
+func (i *Inode) patchModTime(mtime time.Time) {
+	id := i.ID()
+	cache := i.GetCache()
+	if isLocalID(id) || cache.IsOffline() {
+		// will be set when the item is first uploaded (or not at all offline)
+		return
+	}
+	patch := map[string]interface{}{
+		"fileSystemInfo": map[string]interface{}{
+			"lastModifiedDateTime": mtime.UTC(),
+		},
+	}
+	if _, err := cache.Drive().UpdateItem(id, patch, cache.GetAuth()); err != nil {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": i.Path(),
+			"err":  err,
+		}).Warn("Could not update modification time on server.")
+	}
+}
+
+// blockedRetryInterval is how long we wait before trying to download an item
+// the server refused to let us download again, in case its policy changed.
+const blockedRetryInterval = time.Hour
+
+// blockedReason returns why the server refused to let us download this item,
+// or "" if it has not done so recently.
+func (i *Inode) blockedReason() string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if i.blocked == "" || time.Since(i.blockedAt) > blockedRetryInterval {
+		return ""
+	}
+	return i.blocked
+}
+
 // IsDir returns if it is a directory (true) or file (false).
 func (i *Inode) IsDir() bool {
 	// 0 if the dir bit is not set
@@ -641,13 +1168,21 @@ func (i *Inode) Create(ctx context.Context, name string, flags uint32, mode uint
 	path := i.Path()
 	id := i.ID()
 	cache := i.GetCache()
-	if cache.IsOffline() {
-		// nope, we are refusing op to avoid data loss later
+	if cache.isExcluded(i, name, false) {
+		// would replace what is on the server without a way to see it first
+		log.WithFields(log.Fields{
+			"path": path,
+			"name": name,
+		}).Warn("Refusing Create() of an excluded item.")
+		return nil, nil, uint32(0), syscall.EPERM
+	}
+	offline := cache.IsOffline()
+	if offline && !changeableOffline(i) {
 		log.WithFields(log.Fields{
 			"id":   id,
 			"path": path,
 			"name": name,
-		}).Warn("We are offline. Refusing Create() to avoid data loss later.")
+		}).Warn("We are offline and the folder's contents were never fetched. Refusing Create().")
 		return nil, nil, uint32(0), syscall.EROFS
 	}
 
@@ -661,9 +1196,17 @@ func (i *Inode) Create(ctx context.Context, name string, flags uint32, mode uint
 			"name":    name,
 			"mode":    Octal(mode),
 		}).Debug("Child inode already exists, truncating.")
-		child.data = nil
+		cache.uploads.CancelUpload(child.ID())
+		child.mutex.Lock()
+		defer child.mutex.Unlock()
+		if err := child.openContent(); err != nil || child.content.Truncate(0) != nil {
+			return nil, nil, uint32(0), syscall.EIO
+		}
+		child.hydration = nil
+		cache.setHydration(child.DriveItem.ID, nil)
 		child.DriveItem.Size = 0
 		child.hasChanges = true
+		child.opens++
 		return child.EmbeddedInode(), nil, uint32(0), 0
 	}
 
@@ -675,8 +1218,29 @@ func (i *Inode) Create(ctx context.Context, name string, flags uint32, mode uint
 		"name":    name,
 		"mode":    Octal(mode),
 	}).Debug("Creating inode.")
+	// created on the server when flushed, even if nothing is written to it
+	inode.hasChanges = true
+	cache.storeMode(inode.ID(), mode, false)
 	cache.InsertChild(id, inode)
-	return i.NewInode(ctx, inode, fs.StableAttr{Mode: fuse.S_IFREG}), nil, uint32(0), 0
+	if offline {
+		cache.saveMetadata(inode, i)
+	}
+	inode.mutex.Lock()
+	err := inode.openContent()
+	inode.opens++
+	inode.mutex.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   inode.ID(),
+			"path": path,
+			"err":  err,
+		}).Error("Could not create cached content.")
+		return nil, nil, uint32(0), syscall.EIO
+	}
+	return i.NewInode(ctx, inode, fs.StableAttr{
+		Mode: fuse.S_IFREG,
+		Ino:  cache.Ino(inode.ID()),
+	}), nil, uint32(0), 0
 }
 
 // Mkdir creates a directory.
@@ -688,9 +1252,26 @@ func (i *Inode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.E
 	}).Debug()
 	cache := i.GetCache()
 	auth := cache.GetAuth()
+	if cache.isExcluded(i, name, true) {
+		log.WithFields(log.Fields{
+			"path": i.Path(),
+			"name": name,
+		}).Warn("Refusing Mkdir() of an excluded folder.")
+		return nil, syscall.EPERM
+	}
+	if cache.IsOffline() {
+		inode, errno := cache.mkdirOffline(i, name, mode)
+		if errno != 0 {
+			return nil, errno
+		}
+		return i.NewInode(ctx, inode, fs.StableAttr{
+			Mode: fuse.S_IFDIR,
+			Ino:  cache.Ino(inode.ID()),
+		}), 0
+	}
 
 	// create a new folder on the server
-	item, err := graph.Mkdir(name, i.ID(), auth)
+	item, err := cache.Drive().Mkdir(name, i.ID(), auth)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"path": name,
@@ -699,8 +1280,12 @@ func (i *Inode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.E
 		return nil, syscall.EREMOTEIO
 	}
 	inode := NewInodeDriveItem(item)
+	cache.storeMode(inode.ID(), mode, true)
 	cache.InsertChild(i.ID(), inode)
-	return i.NewInode(ctx, inode, fs.StableAttr{Mode: fuse.S_IFDIR}), 0
+	return i.NewInode(ctx, inode, fs.StableAttr{
+		Mode: fuse.S_IFDIR,
+		Ino:  cache.Ino(inode.ID()),
+	}), 0
 }
 
 // Unlink a child file.
@@ -718,14 +1303,18 @@ func (i *Inode) Unlink(ctx context.Context, name string) syscall.Errno {
 		return syscall.ENOENT
 	}
 	if cache.IsOffline() {
-		return syscall.EROFS
+		return cache.removeOffline(i, child)
 	}
 
+	// stop uploading the file first, so that its content cannot land on the
+	// server after it was deleted there
+	id := child.ID()
+	cache.uploads.CancelUpload(id)
+
 	// if no ID, the item is local-only, and does not need to be deleted on the
 	// server
-	id := child.ID()
 	if !isLocalID(id) {
-		if err := graph.Remove(id, cache.GetAuth()); err != nil {
+		if err := cache.Drive().Remove(id, cache.GetAuth()); err != nil {
 			log.WithFields(log.Fields{
 				"err":  err,
 				"id":   id,
@@ -737,6 +1326,7 @@ func (i *Inode) Unlink(ctx context.Context, name string) syscall.Errno {
 
 	cache.DeleteID(id)
 	cache.DeleteContent(id)
+	cache.setLocalAttrs(id, localAttrs{})
 	return 0
 }
 
@@ -749,6 +1339,15 @@ func (i *Inode) Rmdir(ctx context.Context, name string) syscall.Errno {
 func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	// we don't fully trust DriveItem.Parent.Path from the Graph API
 	cache := i.GetCache()
+	if dest, ok := newParent.(*Inode); !ok || dest.GetCache() != cache {
+		// items cannot be moved between drives (or into a DriveDir)
+		return syscall.EXDEV
+	}
+	if child, _ := cache.GetChild(i.ID(), name, nil); child != nil &&
+		cache.isExcluded(newParent.(*Inode), newName, child.IsDir()) {
+		// it would disappear from the filesystem
+		return syscall.EPERM
+	}
 	path := filepath.Join(cache.InodePath(i.EmbeddedInode()), name)
 	dest := filepath.Join(cache.InodePath(newParent.EmbeddedInode()), newName)
 	log.WithFields(log.Fields{
@@ -756,6 +1355,9 @@ func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbed
 		"dest": dest,
 		"id":   i.ID(),
 	}).Debug("Renaming inode.")
+	if cache.IsOffline() {
+		return cache.renameOffline(i, name, newParent.(*Inode), newName)
+	}
 
 	auth := cache.GetAuth()
 	inode, _ := cache.GetChild(i.ID(), name, auth)
@@ -791,7 +1393,25 @@ func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbed
 		return syscall.EBADF
 	}
 
-	if err = graph.Rename(id, filepath.Base(dest), parentID, auth); err != nil {
+	// journal the rename in case we crash partway through
+	err = cache.journalRename(renameIntent{
+		ID:          id,
+		OldName:     inode.Name(),
+		OldParentID: inode.ParentID(),
+		NewName:     filepath.Base(dest),
+		NewParentID: parentID,
+		Time:        time.Now(),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":  id,
+			"err": err,
+		}).Error("Failed to journal rename.")
+		return syscall.EIO
+	}
+	defer cache.finishRename(id)
+
+	if err = cache.Drive().Rename(id, filepath.Base(dest), parentID, auth); err != nil {
 		log.WithFields(log.Fields{
 			"id":       id,
 			"parentID": parentID,
@@ -809,59 +1429,83 @@ func (i *Inode) Rename(ctx context.Context, name string, newParent fs.InodeEmbed
 		}).Error("Failed to rename local item.")
 		return syscall.EIO
 	}
+	// the upload of the item (if any) carries on where the item is now
+	cache.uploads.MoveUpload(id, filepath.Base(dest), parentID)
 
 	// whew! item renamed
 	return 0
 }
 
-// Open fetches a Inodes's content and initializes the .Data field with actual
-// data from the server. Data is loaded into memory on Open, and persisted to
-// disk on Flush.
+// Open opens a Inode's cached content for I/O until the file is flushed.
+// Content that is not cached is downloaded as it is read (see hydrate), or read
+// straight from the server for files that are streamed (see Cache.isStreamed).
 func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	fh, fuseFlags, errno = i.open(ctx, flags, true)
+	if errno == 0 {
+		i.mutex.Lock()
+		i.opens++
+		i.mutex.Unlock()
+	}
+	return fh, fuseFlags, errno
+}
+
+// open is Open, except that files are only streamed if stream is set, since
+// reopening a file for a read or write after it was closed must open its
+// content.
+func (i *Inode) open(ctx context.Context, flags uint32, stream bool) (fs.FileHandle, uint32, syscall.Errno) {
 	path := i.Path()
 	id := i.ID()
 	f := int(flags)
-	if f&os.O_RDWR+f&os.O_WRONLY > 0 && i.GetCache().offline {
-		log.WithFields(log.Fields{
-			"path":  path,
-			"id":    id,
-			"flags": flags,
-		}).Debug("Refusing Open() with write flag, FS is offline.")
-		return nil, uint32(0), syscall.EROFS
-	}
-
 	log.WithFields(log.Fields{
 		"path": path,
 		"id":   id,
 	}).Debug("Opening file for I/O.")
 
+	cache := i.GetCache()
+	// folders whose files are used count as used, even if they are never listed
+	cache.recordAccess(i.ParentID())
+	cache.counters.touch()
 	if i.HasContent() {
 		// we already have data, likely the file is already opened somewhere
 		return nil, uint32(0), 0
 	}
 
-	// try grabbing from disk
-	cache := i.GetCache()
-	if content := cache.GetContent(id); content != nil {
+	// try grabbing from disk, even if another mount cached it
+	h := cache.getHydration(id)
+	if h == nil && !cache.hasContent(id) {
+		i.mutex.RLock()
+		cTag := i.DriveItem.CTag
+		i.mutex.RUnlock()
+		cache.linkShared(id, cTag)
+	}
+	if h != nil {
+		// partly downloaded before, the rest is downloaded as it is read
+		i.mutex.Lock()
+		if h.CTag == i.DriveItem.CTag && i.openContent() == nil {
+			i.hydration = h
+			i.DriveItem.Size = h.Size
+			i.mutex.Unlock()
+			return nil, uint32(0), 0
+		}
+		i.mutex.Unlock()
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": path,
+		}).Info("Not using partly downloaded content, the file changed on the server.")
+	} else if cache.hasContent(id) {
 		// verify content against what we're supposed to have
 		var hashMatch bool
 		i.mutex.RLock()
-		driveType := i.DriveItem.Parent.DriveType
 		if isLocalID(id) && i.DriveItem.File == nil {
 			// only check hashes if the file has been uploaded before, otherwise
 			// we just accept the cached content.
 			hashMatch = true
-		} else if driveType == graph.DriveTypePersonal {
-			hashMatch = i.VerifyChecksum(graph.SHA1Hash(&content))
-		} else if driveType == graph.DriveTypeBusiness || driveType == graph.DriveTypeSharepoint {
-			hashMatch = i.VerifyChecksum(graph.QuickXORHash(&content))
+		} else if cache.opts.SkipHashVerification {
+			size, err := cache.contentSize(id)
+			hashMatch = err == nil && size == i.DriveItem.Size
 		} else {
-			hashMatch = true
-			log.WithFields(log.Fields{
-				"path":      path,
-				"driveType": driveType,
-				"id":        id,
-			}).Warn("Could not determine drive type, not checking hashes.")
+			hash, _, err := cache.hashContent(id)
+			hashMatch = err == nil && i.VerifyChecksum(hash)
 		}
 		i.mutex.RUnlock()
 
@@ -871,26 +1515,39 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 				"path": path,
 				"id":   id,
 			}).Info("Found content in cache.")
+			cache.counters.opened(true)
 
 			i.mutex.Lock()
 			defer i.mutex.Unlock()
+			if err := i.openContent(); err != nil {
+				return nil, uint32(0), syscall.EIO
+			}
 			// this check is here in case the API file sizes are WRONG (it happens)
-			i.DriveItem.Size = uint64(len(content))
-			i.data = &content
+			if size, err := i.content.Size(); err == nil {
+				i.DriveItem.Size = size
+			}
 			return nil, uint32(0), 0
 		}
 		log.WithFields(log.Fields{
-			"id":        id,
-			"path":      path,
-			"drivetype": driveType,
+			"id":   id,
+			"path": path,
 		}).Info("Not using cached item due to file hash mismatch.")
 	}
 
-	// didn't have it on disk, now try api
+	// didn't have it on disk, now try api (unless we know it will refuse)
+	if reason := i.blockedReason(); reason != "" {
+		log.WithFields(log.Fields{
+			"id":     id,
+			"path":   path,
+			"reason": reason,
+		}).Debug("Not downloading item, the server recently refused to let us.")
+		return nil, uint32(0), syscall.EACCES
+	}
 	log.WithFields(log.Fields{
 		"id":   id,
 		"path": path,
 	}).Info("Fetching remote content for item from API.")
+	cache.counters.opened(false)
 
 	auth := cache.GetAuth()
 	id, err := i.RemoteID(auth)
@@ -903,7 +1560,47 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 		return nil, uint32(0), syscall.EREMOTEIO
 	}
 
-	body, err := graph.GetItemContent(id, auth)
+	if stream && f&(os.O_RDWR|os.O_WRONLY) == 0 && cache.isStreamed(i) {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": path,
+		}).Info("Streaming file content instead of caching it.")
+		return &streamHandle{id: id}, uint32(0), 0
+	}
+
+	// nothing is downloaded until it is read, except for the start of the
+	// file, which also tells us right away if the server refuses to serve it
+	i.mutex.Lock()
+	if i.content == nil {
+		err = i.startHydration()
+	}
+	i.mutex.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"id":   id,
+			"path": path,
+		}).Error("Failed to create cached content.")
+		return nil, uint32(0), syscall.EIO
+	}
+	err = i.hydrate(ctx, 0, hydrationBlock, graph.PriorityInteractive)
+	if err != nil {
+		i.mutex.Lock()
+		i.closeContent()
+		i.mutex.Unlock()
+	}
+	if graph.IsBlocked(err) {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"id":   id,
+			"path": path,
+		}).Warn("Item is protected and cannot be downloaded.")
+		i.mutex.Lock()
+		i.blocked = err.Error()
+		i.blockedAt = time.Now()
+		i.mutex.Unlock()
+		return nil, uint32(0), syscall.EACCES
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err":  err,
@@ -912,11 +1609,5 @@ func (i *Inode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseF
 		}).Error("Failed to fetch remote content.")
 		return nil, uint32(0), syscall.EREMOTEIO
 	}
-
-	i.mutex.Lock()
-	defer i.mutex.Unlock()
-	// this check is here in case the API file sizes are WRONG (it happens)
-	i.DriveItem.Size = uint64(len(body))
-	i.data = &body
 	return nil, uint32(0), 0
 }
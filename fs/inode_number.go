@@ -0,0 +1,91 @@
+package fs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Inode numbers are derived from item IDs the first time an item is seen, then
+// stored so that the same item always has the same inode number, even across
+// remounts. NFS and Samba rely on this when re-exporting the mountpoint, as do
+// backup tools and indexers that track files by inode number. Numbers 0 and 1
+// are reserved (1 is the root), and go-fuse hands out numbers of 2^63 and up to
+// virtual directories.
+const inoMask = 1<<63 - 1
+
+var (
+	bucketInodes   = []byte("inodes")    // item ID -> inode number
+	bucketInodeIDs = []byte("inode_ids") // inode number -> item ID
+)
+
+// hashIno derives an inode number from an item ID.
+func hashIno(driveID string, id string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(driveID))
+	hash.Write([]byte{0})
+	hash.Write([]byte(id))
+	ino := hash.Sum64() & inoMask
+	if ino < 2 {
+		ino += 2
+	}
+	return ino
+}
+
+func inoKey(ino uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, ino)
+	return key
+}
+
+// Ino returns the inode number of an item, assigning it one if it does not have
+// one yet. Items keep their inode number when their ID changes after being
+// uploaded for the first time.
+func (c *Cache) Ino(id string) uint64 {
+	if ino, exists := c.inos.Load(id); exists {
+		return ino.(uint64)
+	}
+
+	var ino uint64
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		inodes := tx.Bucket(bucketInodes)
+		if v := inodes.Get([]byte(id)); len(v) == 8 {
+			ino = binary.BigEndian.Uint64(v)
+			return nil
+		}
+		// on the off chance that the hash is already taken, use the next free
+		// number instead
+		ids := tx.Bucket(bucketInodeIDs)
+		ino = hashIno(c.drive.ID, id)
+		for ids.Get(inoKey(ino)) != nil {
+			ino = (ino + 1) & inoMask
+			if ino < 2 {
+				ino = 2
+			}
+		}
+		if err := inodes.Put([]byte(id), inoKey(ino)); err != nil {
+			return err
+		}
+		return ids.Put(inoKey(ino), []byte(id))
+	})
+	if err != nil {
+		// still stable for this session, just not across remounts
+		ino = hashIno(c.drive.ID, id)
+	}
+	c.inos.Store(id, ino)
+	return ino
+}
+
+// moveIno makes an item keep its inode number after its ID changes.
+func (c *Cache) moveIno(oldID string, newID string) {
+	ino := c.Ino(oldID)
+	c.db.Update(func(tx *bolt.Tx) error {
+		inodes := tx.Bucket(bucketInodes)
+		inodes.Delete([]byte(oldID))
+		inodes.Put([]byte(newID), inoKey(ino))
+		return tx.Bucket(bucketInodeIDs).Put(inoKey(ino), []byte(newID))
+	})
+	c.inos.Store(newID, ino)
+	c.inos.Delete(oldID)
+}
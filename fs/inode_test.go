@@ -4,6 +4,7 @@ import (
 	"context"
 	"io/ioutil"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -108,3 +109,25 @@ func TestDoubleCreate(t *testing.T) {
 		)
 	}
 }
+
+// Writes past the maximum file size should fail with EFBIG instead of failing
+// later during upload.
+func TestMaxFileSize(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_max_file_size.db", &Options{MaxFileSize: 10})
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	inode := NewInode("too_big.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertID(inode.ID(), inode)
+
+	ctx := context.Background()
+	if n, errno := inode.Write(ctx, nil, []byte("0123456789"), 0); errno != 0 || n != 10 {
+		t.Fatalf("Write within size limit failed: %d bytes, %v\n", n, errno)
+	}
+	if _, errno := inode.Write(ctx, nil, []byte("a"), 10); errno != syscall.EFBIG {
+		t.Fatalf("Expected EFBIG writing past size limit, got %v\n", errno)
+	}
+	if inode.Size() != 10 {
+		t.Fatalf("File size changed after failed write: %d\n", inode.Size())
+	}
+}
@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	bolt "go.etcd.io/bbolt"
+)
+
+// OneDrive has nowhere to store POSIX metadata like permission bits, ownership,
+// or arbitrary extended attributes, so it is kept locally in its own bucket
+// (keyed by item ID, so it follows items when they are renamed) and re-applied
+// whenever an item is fetched from the server again. This way an executable
+// script stays executable across remounts and remote changes.
+var bucketLocalAttrs = []byte("local_attrs")
+
+// localAttrs are the attributes of an item that OneDrive cannot store. The zero
+// value means "use the defaults".
+type localAttrs struct {
+	Mode   uint32            `json:"mode,omitempty"`   // permission bits
+	Owner  *fuse.Owner       `json:"owner,omitempty"`  // nil for the mounting user
+	Xattrs map[string][]byte `json:"xattrs,omitempty"` // see isLocalXattr
+}
+
+func (a localAttrs) isEmpty() bool {
+	return a.Mode == 0 && a.Owner == nil && len(a.Xattrs) == 0
+}
+
+// isLocalXattr returns whether an extended attribute is stored in localAttrs.
+// Any "user." attribute is, except for the ones onedriver handles itself.
+func isLocalXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") &&
+		!strings.HasPrefix(name, "user.onedrive.") &&
+		!strings.HasPrefix(name, "user.onedriver.")
+}
+
+// defaultPermissions are the permission bits of items with no stored mode.
+func defaultPermissions(isDir bool) uint32 {
+	if isDir {
+		return 0755
+	}
+	return 0644
+}
+
+// getLocalAttrs returns the stored attributes of an item.
+func (c *Cache) getLocalAttrs(id string) localAttrs {
+	var attrs localAttrs
+	c.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketLocalAttrs).Get([]byte(id)); v != nil {
+			json.Unmarshal(v, &attrs)
+		}
+		return nil
+	})
+	return attrs
+}
+
+// setLocalAttrs stores the attributes of an item, removing them if they are
+// the defaults.
+func (c *Cache) setLocalAttrs(id string, attrs localAttrs) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLocalAttrs)
+		if attrs.isEmpty() {
+			return b.Delete([]byte(id))
+		}
+		v, _ := json.Marshal(attrs)
+		return b.Put([]byte(id), v)
+	})
+}
+
+// storeMode remembers the permission bits of an item.
+func (c *Cache) storeMode(id string, mode uint32, isDir bool) error {
+	attrs := c.getLocalAttrs(id)
+	attrs.Mode = mode & 07777
+	if attrs.Mode == defaultPermissions(isDir) {
+		attrs.Mode = 0
+	}
+	return c.setLocalAttrs(id, attrs)
+}
+
+// storeOwner remembers the owner of an item.
+func (c *Cache) storeOwner(id string, owner *fuse.Owner) error {
+	attrs := c.getLocalAttrs(id)
+	attrs.Owner = owner
+	return c.setLocalAttrs(id, attrs)
+}
+
+// storeXattr sets (or removes, if value is nil) an extended attribute of an
+// item.
+func (c *Cache) storeXattr(id string, name string, value []byte) error {
+	attrs := c.getLocalAttrs(id)
+	if value == nil {
+		delete(attrs.Xattrs, name)
+	} else {
+		if attrs.Xattrs == nil {
+			attrs.Xattrs = make(map[string][]byte)
+		}
+		attrs.Xattrs[name] = value
+	}
+	return c.setLocalAttrs(id, attrs)
+}
+
+// restoreLocalAttrs applies the stored attributes of an item to an inode that
+// was just fetched from the server. Extended attributes are read from the
+// database when needed instead.
+func (c *Cache) restoreLocalAttrs(inode *Inode) {
+	attrs := c.getLocalAttrs(inode.ID())
+	if attrs.Mode == 0 && attrs.Owner == nil {
+		return
+	}
+	inode.mutex.Lock()
+	defer inode.mutex.Unlock()
+	if attrs.Owner != nil {
+		inode.owner = attrs.Owner
+	}
+	if attrs.Mode == 0 || inode.mode != 0 {
+		return // default, or set locally since it was fetched
+	}
+	if inode.DriveItem.Folder != nil {
+		inode.mode = fuse.S_IFDIR | attrs.Mode
+	} else {
+		inode.mode = fuse.S_IFREG | attrs.Mode
+	}
+}
+
+// moveLocalAttrs carries over an item's attributes when its ID changes.
+func (c *Cache) moveLocalAttrs(oldID string, newID string) {
+	if attrs := c.getLocalAttrs(oldID); !attrs.isEmpty() {
+		c.setLocalAttrs(newID, attrs)
+		c.setLocalAttrs(oldID, localAttrs{})
+	}
+}
@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// When a file is deleted on the server, its cached content is moved to a local
+// trash instead of being removed right away, and kept there for
+// Options.TrashRetention. Files deleted by mistake (or by something malicious)
+// on another device can be restored from there even if they are no longer in
+// OneDrive's recycle bin. Each trashed file is recorded here by its trash ID,
+// and its content is kept in the trash directory under the same name, as it
+// was in the content cache (so encrypted if the content cache is).
+var bucketTrash = []byte("trash")
+
+// TrashedFile is a file deleted on the server whose content was kept in the
+// local trash.
+type TrashedFile struct {
+	ID      string // the trash ID, not the ID the file had on the server
+	Path    string // where the file was
+	Size    uint64
+	Mode    uint32
+	Deleted time.Time
+}
+
+// trashDir returns the directory that holds the content of trashed files.
+func trashDir(db *bolt.DB) string {
+	return db.Path() + ".trash"
+}
+
+// trashLocal moves the cached content of a file deleted on the server, or of
+// every file in a deleted folder, to the local trash. Files that were only
+// partly downloaded are left to be removed along with the item.
+func (c *Cache) trashLocal(inode *Inode) {
+	if c.opts.TrashRetention <= 0 {
+		return
+	}
+	for _, item := range c.subtree(inode) {
+		id := item.ID()
+		if item.IsDir() || !c.hasContent(id) || c.getHydration(id) != nil {
+			continue
+		}
+		trashed := TrashedFile{
+			ID:      fmt.Sprintf("%s-%d", id, time.Now().UnixNano()),
+			Path:    item.Path(),
+			Size:    item.Size(),
+			Mode:    item.Mode(),
+			Deleted: time.Now(),
+		}
+		err := os.MkdirAll(trashDir(c.db), 0700)
+		if err == nil {
+			err = os.Rename(c.contentPath(id), filepath.Join(trashDir(c.db), trashed.ID))
+		}
+		if err == nil {
+			contents, _ := json.Marshal(trashed)
+			err = c.db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(bucketTrash).Put([]byte(trashed.ID), c.sealer.seal(contents))
+			})
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":   id,
+				"path": trashed.Path,
+				"err":  err,
+			}).Error("Could not move file deleted on the server to the local trash.")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":    id,
+			"path":  trashed.Path,
+			"trash": trashed.ID,
+		}).Info("Moved file deleted on the server to the local trash.")
+	}
+	c.PurgeTrash()
+}
+
+// Trash lists the files in the local trash, most recently deleted first.
+func (c *Cache) Trash() []TrashedFile {
+	trash := make([]TrashedFile, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).ForEach(func(k, v []byte) error {
+			var trashed TrashedFile
+			if v, err := c.sealer.open(v); err == nil && json.Unmarshal(v, &trashed) == nil {
+				trash = append(trash, trashed)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(trash, func(i, j int) bool {
+		return trash[i].Deleted.After(trash[j].Deleted)
+	})
+	return trash
+}
+
+// removeTrash deletes a file from the local trash for good.
+func (c *Cache) removeTrash(trashID string) {
+	os.Remove(filepath.Join(trashDir(c.db), trashID))
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).Delete([]byte(trashID))
+	})
+}
+
+// PurgeTrash deletes the files that have been in the local trash for longer
+// than Options.TrashRetention, or all of them if the trash is disabled.
+func (c *Cache) PurgeTrash() {
+	for _, trashed := range c.Trash() {
+		if time.Since(trashed.Deleted) >= c.opts.TrashRetention {
+			log.WithFields(log.Fields{
+				"path":  trashed.Path,
+				"trash": trashed.ID,
+			}).Debug("Removing file from the local trash.")
+			c.removeTrash(trashed.ID)
+		}
+	}
+}
+
+// EmptyTrash deletes every file in the local trash, returning how many.
+func (c *Cache) EmptyTrash() int {
+	trash := c.Trash()
+	for _, trashed := range trash {
+		c.removeTrash(trashed.ID)
+	}
+	return len(trash)
+}
+
+// RestoreTrash puts a file from the local trash back where it was (or in the
+// root folder, if that folder is gone too) as a new file, which is then
+// uploaded. If something else has its name now, "(restored)" is added to it.
+// Returns the path of the restored file.
+func (c *Cache) RestoreTrash(trashID string, auth *graph.Auth) (string, error) {
+	var trashed *TrashedFile
+	for _, file := range c.Trash() {
+		if file.ID == trashID {
+			trashed = &file
+			break
+		}
+	}
+	if trashed == nil {
+		return "", fmt.Errorf("no file with ID \"%s\" in the local trash", trashID)
+	}
+
+	parent, err := c.GetPath(path.Dir(trashed.Path), auth)
+	if err != nil || !parent.IsDir() {
+		parent = c.GetID(c.root)
+	}
+	name := path.Base(trashed.Path)
+	for n := 1; ; n++ {
+		if child, _ := c.GetChild(parent.ID(), name, auth); child == nil {
+			break
+		}
+		name = restoredName(path.Base(trashed.Path), n)
+	}
+	if c.isExcluded(parent, name, false) {
+		return "", errors.New("cannot restore a file where it is excluded")
+	}
+
+	inode := NewInode(name, trashed.Mode, parent)
+	id := inode.ID()
+	if err = os.Rename(filepath.Join(trashDir(c.db), trashID), c.contentPath(id)); err != nil {
+		return "", err
+	}
+	hash, size, err := c.hashContent(id)
+	if err != nil {
+		c.DeleteContent(id)
+		return "", err
+	}
+	c.removeTrash(trashID)
+	inode.mutex.Lock()
+	inode.DriveItem.Size = size
+	inode.DriveItem.File = &graph.File{Hashes: c.Capabilities().HashesOf(hash)}
+	inode.hasChanges = true
+	inode.mutex.Unlock()
+	c.storeMode(id, trashed.Mode, false)
+	c.InsertChild(parent.ID(), inode)
+	c.notifyAdded(parent.ID(), name)
+	log.WithFields(log.Fields{
+		"trash": trashID,
+		"path":  inode.Path(),
+	}).Info("Restored file from the local trash.")
+	if errno := inode.upload(); errno != 0 {
+		return inode.Path(), fmt.Errorf("restored, but could not upload it: %s", errno)
+	}
+	return inode.Path(), nil
+}
+
+// restoredName returns the name of the n-th file restored from the local trash
+// with the same name as an existing file, like "notes (restored 2).txt".
+func restoredName(name string, n int) string {
+	ext := filepath.Ext(name)
+	restored := "restored"
+	if n > 1 {
+		restored = fmt.Sprintf("restored %d", n)
+	}
+	return fmt.Sprintf("%s (%s)%s", strings.TrimSuffix(name, ext), restored, ext)
+}
@@ -64,45 +64,86 @@ func TestOfflineBagelContents(t *testing.T) {
 	}
 }
 
-// Creating a file should fail
+// Files created offline should be saved locally until they can be uploaded.
 func TestOfflineFileCreation(t *testing.T) {
 	t.Parallel()
-	if ioutil.WriteFile(filepath.Join(TestDir, "donuts"), []byte("fail me"), 0644) == nil {
-		t.Fatal("Writing a file while offline should fail.")
+	fname := filepath.Join(TestDir, "donuts")
+	if err := ioutil.WriteFile(fname, []byte("saved offline"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, []byte("saved offline")) {
+		t.Fatalf("Expected \"saved offline\", got %s instead", string(contents))
 	}
 }
 
-// Modifying a file offline should fail.
+// Modifying a file offline should work with its cached content.
 func TestOfflineFileModification(t *testing.T) {
 	t.Parallel()
-	if ioutil.WriteFile(filepath.Join(TestDir, "bagels"), []byte("fail me too"), 0644) == nil {
-		t.Fatal("Modifying a file while offline should fail.")
+	fname := filepath.Join(TestDir, "empty")
+	if err := ioutil.WriteFile(fname, []byte("not empty anymore"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, []byte("not empty anymore")) {
+		t.Fatalf("Expected \"not empty anymore\", got %s instead", string(contents))
 	}
 }
 
-// Deleting a file offline should fail.
+// Files deleted offline should be gone right away.
 func TestOfflineFileDeletion(t *testing.T) {
 	t.Parallel()
-	if os.Remove(filepath.Join(TestDir, "write.txt")) == nil {
-		t.Fatal("Deleting a file while offline should fail.")
+	fname := filepath.Join(TestDir, "write.txt")
+	if err := os.Remove(fname); err != nil {
+		t.Fatal(err)
 	}
-	if os.Remove(filepath.Join(TestDir, "empty")) == nil {
-		t.Fatal("Deleting an empty file while offline should fail.")
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Fatal("File deleted offline still exists.")
 	}
 }
 
-// Creating a directory offline should fail.
+// Folders created offline can be used like any other.
 func TestOfflineMkdir(t *testing.T) {
 	t.Parallel()
-	if os.Mkdir(filepath.Join(TestDir, "offline_dir"), 0755) == nil {
-		t.Fatal("Creating a directory should have failed offline.")
+	dir := filepath.Join(TestDir, "offline_dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "inside"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir, filepath.Join(TestDir, "offline_dir_renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(TestDir, "offline_dir_renamed", "inside")); err != nil {
+		t.Fatal(err)
 	}
 }
 
-// Deleting a directory offline should fail.
+// Folders can only be deleted offline once they are empty.
 func TestOfflineRmdir(t *testing.T) {
 	t.Parallel()
-	if os.Remove(filepath.Join(TestDir, "folder1")) == nil {
-		t.Fatal("Removing a directory should have failed offline.")
+	dir := filepath.Join(TestDir, "offline_rmdir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "inside")
+	if err := ioutil.WriteFile(fname, []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if os.Remove(dir) == nil {
+		t.Fatal("Removing a folder with files in it should have failed.")
+	}
+	if err := os.Remove(fname); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
 	}
 }
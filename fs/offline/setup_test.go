@@ -44,7 +44,7 @@ func TestMain(m *testing.M) {
 	log.Info("Setup offline tests ------------------------------")
 
 	// reuses the cached data from the previous tests
-	cache := odfs.NewCache(auth, "test.db")
+	cache := odfs.NewCache(auth, "test.db", nil)
 	root, _ := cache.GetPath("/", auth)
 	go cache.DeltaLoop(5 * time.Second)
 	second := time.Second
@@ -54,7 +54,7 @@ func TestMain(m *testing.M) {
 		MountOptions: fuse.MountOptions{
 			Name:          "onedriver",
 			FsName:        "onedriver",
-			DisableXAttrs: true,
+			DisableXAttrs: false,
 			MaxBackground: 1024,
 		},
 	})
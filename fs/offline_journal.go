@@ -0,0 +1,434 @@
+package fs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// While offline, files are saved to the local cache when they are closed and
+// uploaded once the server can be reached again, like with UploadOnInterval
+// (see markDirty). Changes to folders (new folders, renames and deletions) are
+// recorded in this journal in the order they were made, and replayed against
+// the server before those uploads start. Entries stay in the journal until they
+// are replayed, so they survive restarts. Where the server's copy changed in the
+// meantime, the server's copy wins, except for files changed locally and
+// deleted on the server, which are uploaded again instead of being lost.
+var bucketJournal = []byte("journal")
+
+// journaled operations
+const (
+	journalMkdir  = "mkdir"
+	journalRename = "rename"
+	journalDelete = "delete"
+)
+
+// journalEntry is a change to a folder made while offline.
+type journalEntry struct {
+	seq         uint64
+	Op          string    `json:"op"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ParentID    string    `json:"parentId"`
+	NewName     string    `json:"newName,omitempty"`
+	NewParentID string    `json:"newParentId,omitempty"`
+	CTag        string    `json:"cTag,omitempty"` // of deleted files, as last synced
+	Time        time.Time `json:"time"`
+}
+
+// journal records a change made while offline, after the changes before it.
+func (c *Cache) journal(entry journalEntry) error {
+	entry.Time = time.Now()
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJournal)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		contents, _ := json.Marshal(entry)
+		return b.Put(key, c.sealer.seal(contents))
+	})
+}
+
+// journalEntries returns the changes waiting to be replayed, in order.
+func (c *Cache) journalEntries() []journalEntry {
+	entries := make([]journalEntry, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJournal).ForEach(func(k, v []byte) error {
+			var entry journalEntry
+			if v, err := c.sealer.open(v); err == nil && json.Unmarshal(v, &entry) == nil {
+				entry.seq = binary.BigEndian.Uint64(k)
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	return entries
+}
+
+// finishEntry removes a change that was replayed from the journal.
+func (c *Cache) finishEntry(entry journalEntry) {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, entry.seq)
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJournal).Delete(key)
+	})
+}
+
+// rewriteJournal points the changes waiting to be replayed that refer to a
+// folder created offline at the ID it got on the server.
+func (c *Cache) rewriteJournal(oldID string, newID string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJournal)
+		return b.ForEach(func(k, v []byte) error {
+			var entry journalEntry
+			v, err := c.sealer.open(v)
+			if err != nil || json.Unmarshal(v, &entry) != nil {
+				return nil
+			}
+			if entry.ID != oldID && entry.ParentID != oldID && entry.NewParentID != oldID {
+				return nil
+			}
+			for _, id := range []*string{&entry.ID, &entry.ParentID, &entry.NewParentID} {
+				if *id == oldID {
+					*id = newID
+				}
+			}
+			contents, _ := json.Marshal(entry)
+			return b.Put(k, c.sealer.seal(contents))
+		})
+	})
+}
+
+// saveMetadata writes the metadata of items changed while offline to disk,
+// which SerializeAll only does once the cache is back online.
+func (c *Cache) saveMetadata(inodes ...*Inode) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMetadata)
+		for _, inode := range inodes {
+			id := inode.ID()
+			contents := c.sealer.seal(inode.AsJSON())
+			b.Put([]byte(id), contents)
+			if id == c.root {
+				b.Put([]byte("root"), contents)
+			}
+		}
+		return nil
+	})
+}
+
+// forgetMetadata removes the metadata of an item from disk, so that GetID does
+// not bring back items deleted while offline.
+func (c *Cache) forgetMetadata(id string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).Delete([]byte(id))
+	})
+}
+
+// changeableOffline returns whether a folder can be changed while offline,
+// which depends on knowing what is in it. Adding to a folder whose children
+// were never fetched would make it look like it only has the new item in it.
+func changeableOffline(dir *Inode) bool {
+	dir.mutex.RLock()
+	defer dir.mutex.RUnlock()
+	return dir.children != nil
+}
+
+// mkdirOffline creates a folder while offline, which is created on the server
+// once the journal is replayed.
+func (c *Cache) mkdirOffline(parent *Inode, name string, mode uint32) (*Inode, syscall.Errno) {
+	if !changeableOffline(parent) {
+		return nil, syscall.EROFS
+	}
+	inode := NewInode(name, mode|fuse.S_IFDIR, parent)
+	inode.DriveItem.Folder = &graph.Folder{}
+	err := c.journal(journalEntry{
+		Op:       journalMkdir,
+		ID:       inode.ID(),
+		Name:     name,
+		ParentID: parent.ID(),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name": name,
+			"err":  err,
+		}).Error("Could not journal offline folder creation.")
+		return nil, syscall.EIO
+	}
+	c.storeMode(inode.ID(), mode, true)
+	c.InsertChild(parent.ID(), inode)
+	c.saveMetadata(inode, parent)
+	return inode, 0
+}
+
+// removeOffline deletes an item while offline. Items that were never uploaded
+// are only deleted locally.
+func (c *Cache) removeOffline(parent *Inode, child *Inode) syscall.Errno {
+	if !changeableOffline(parent) || (child.IsDir() && !changeableOffline(child)) {
+		return syscall.EROFS
+	}
+	if child.HasChildren() {
+		return syscall.ENOTEMPTY
+	}
+	id := child.ID()
+	c.uploads.CancelUpload(id)
+	if !isLocalID(id) {
+		child.mutex.RLock()
+		entry := journalEntry{
+			Op:       journalDelete,
+			ID:       id,
+			Name:     child.DriveItem.Name,
+			ParentID: parent.ID(),
+			CTag:     child.DriveItem.CTag,
+		}
+		child.mutex.RUnlock()
+		if err := c.journal(entry); err != nil {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"err": err,
+			}).Error("Could not journal offline deletion.")
+			return syscall.EIO
+		}
+	}
+	c.DeleteID(id)
+	c.DeleteContent(id)
+	c.setLocalAttrs(id, localAttrs{})
+	c.clearDirty(id)
+	c.forgetMetadata(id)
+	c.saveMetadata(parent)
+	return 0
+}
+
+// renameOffline moves an item while offline. Items that were never uploaded are
+// only moved locally, they are uploaded to wherever they end up.
+func (c *Cache) renameOffline(parent *Inode, name string, dest *Inode, newName string) syscall.Errno {
+	inode, _ := c.GetChild(parent.ID(), name, nil)
+	if inode == nil {
+		return syscall.ENOENT
+	}
+	if !changeableOffline(parent) || !changeableOffline(dest) {
+		return syscall.EROFS
+	}
+	if existing, _ := c.GetChild(dest.ID(), newName, nil); existing != nil &&
+		existing.ID() != inode.ID() {
+		// replaced, like rename(2) does
+		if errno := c.removeOffline(dest, existing); errno != 0 {
+			return errno
+		}
+	}
+
+	id := inode.ID()
+	if !isLocalID(id) {
+		err := c.journal(journalEntry{
+			Op:          journalRename,
+			ID:          id,
+			Name:        inode.Name(),
+			ParentID:    parent.ID(),
+			NewName:     newName,
+			NewParentID: dest.ID(),
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"err": err,
+			}).Error("Could not journal offline rename.")
+			return syscall.EIO
+		}
+	}
+	c.DeleteID(id)
+	inode.SetName(newName)
+	c.InsertChild(dest.ID(), inode)
+	c.uploads.MoveUpload(id, newName, dest.ID())
+	c.saveMetadata(inode, parent, dest)
+	return 0
+}
+
+// replayJournal applies the changes made while offline to the server, in the
+// order they were made. Replaying stops if the server cannot be reached, and
+// picks up from there the next time. Returns whether anything was replayed.
+func (c *Cache) replayJournal(auth *graph.Auth) bool {
+	entries := c.journalEntries()
+	if len(entries) == 0 {
+		return false
+	}
+	for i, entry := range entries {
+		var err error
+		switch entry.Op {
+		case journalMkdir:
+			err = c.replayMkdir(entry.ID, auth)
+		case journalRename:
+			err = c.replayRename(entry, auth)
+		case journalDelete:
+			err = c.replayDelete(entry, auth)
+		}
+		if graph.IsOffline(err) {
+			return i > 0
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"op":   entry.Op,
+				"id":   entry.ID,
+				"name": entry.Name,
+				"time": entry.Time,
+				"err":  err,
+			}).Warn("Could not replay change made while offline, keeping the server's copy.")
+		}
+		c.finishEntry(entry)
+	}
+	log.WithField("changes", len(entries)).Info("Replayed changes made while offline.")
+	return true
+}
+
+// replayMkdir creates a folder that was created offline on the server, where it
+// is now. If a folder with the same name was created on the server in the
+// meantime, the two are merged.
+func (c *Cache) replayMkdir(id string, auth *graph.Auth) error {
+	inode := c.GetID(id)
+	if inode == nil || !isLocalID(id) {
+		// deleted again, or already created along with a folder in it
+		return nil
+	}
+	parentID := inode.ParentID()
+	if isLocalID(parentID) {
+		// moved into another folder created offline after it was created
+		if err := c.replayMkdir(parentID, auth); err != nil {
+			return err
+		}
+		parentID = inode.ParentID()
+	}
+	name := inode.Name()
+	item, err := c.drive.Mkdir(name, parentID, auth)
+	if err != nil {
+		if graph.IsOffline(err) {
+			return err
+		}
+		existing, getErr := c.drive.GetItemChild(parentID, name, auth)
+		if getErr != nil || existing.Folder == nil {
+			return err
+		}
+		item = existing
+	}
+
+	if err = c.MoveID(id, item.ID); err != nil {
+		return err
+	}
+	c.forgetMetadata(id)
+	c.rewriteJournal(id, item.ID)
+	inode.mutex.Lock()
+	inode.DriveItem.ETag = item.ETag
+	children := inode.children
+	inode.mutex.Unlock()
+	for _, childID := range children {
+		if child := c.GetID(childID); child != nil {
+			child.mutex.Lock()
+			child.DriveItem.Parent.ID = item.ID
+			child.mutex.Unlock()
+		}
+	}
+	log.WithFields(log.Fields{
+		"id":   item.ID,
+		"name": name,
+	}).Info("Created folder made while offline.")
+	return nil
+}
+
+// replayRename moves an item on the server like it was moved offline, unless it
+// was moved on the server as well.
+func (c *Cache) replayRename(entry journalEntry, auth *graph.Auth) error {
+	remote, err := c.drive.GetItem(entry.ID, auth)
+	if err != nil {
+		return err
+	}
+	if remote.Name != entry.Name || remote.Parent == nil || remote.Parent.ID != entry.ParentID {
+		c.restoreRemote(remote)
+		return errors.New("item was moved on the server as well")
+	}
+	if err = c.drive.Rename(entry.ID, entry.NewName, entry.NewParentID, auth); err != nil {
+		if !graph.IsOffline(err) {
+			c.restoreRemote(remote)
+		}
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":      entry.ID,
+		"name":    entry.Name,
+		"newName": entry.NewName,
+	}).Info("Moved item that was moved while offline.")
+	return nil
+}
+
+// replayDelete deletes an item on the server that was deleted offline, unless
+// it changed on the server since.
+func (c *Cache) replayDelete(entry journalEntry, auth *graph.Auth) error {
+	remote, err := c.drive.GetItem(entry.ID, auth)
+	if err != nil {
+		if graph.IsOffline(err) {
+			return err
+		}
+		// deleted on the server as well
+		return nil
+	}
+	if remote.Folder != nil && remote.Folder.ChildCount > 0 {
+		c.restoreRemote(remote)
+		return errors.New("items were added to the folder on the server")
+	}
+	if remote.Folder == nil && remote.CTag != entry.CTag {
+		c.restoreRemote(remote)
+		return errors.New("file was changed on the server")
+	}
+	if err = c.drive.Remove(entry.ID, auth); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"id":   entry.ID,
+		"name": entry.Name,
+	}).Info("Deleted item that was deleted while offline.")
+	return nil
+}
+
+// restoreRemote puts the server's copy of an item back where it is on the
+// server, after a change made offline could not be replayed.
+func (c *Cache) restoreRemote(remote *graph.DriveItem) {
+	if remote.Parent == nil {
+		return
+	}
+	inode := c.GetID(remote.ID)
+	if inode == nil {
+		inode = NewInodeDriveItem(remote)
+	} else {
+		c.DeleteID(remote.ID)
+		inode.SetName(remote.Name)
+	}
+	c.InsertChild(remote.Parent.ID, inode)
+}
+
+// keepDeleted gives a file that was changed locally but deleted on the server a
+// new local ID, so that it is uploaded as a new file instead of its changes
+// being lost.
+func (c *Cache) keepDeleted(inode *Inode) {
+	id := inode.ID()
+	newID := localID()
+	c.clearDirty(id)
+	if err := c.MoveID(id, newID); err != nil {
+		return
+	}
+	inode.mutex.Lock()
+	inode.DriveItem.ETag = ""
+	inode.DriveItem.CTag = ""
+	inode.hasChanges = true
+	inode.mutex.Unlock()
+	c.markDirty(inode)
+	log.WithFields(log.Fields{
+		"id":   id,
+		"name": inode.Name(),
+	}).Warn("File changed locally was deleted on the server, uploading it again.")
+}
@@ -0,0 +1,234 @@
+package fs
+
+import "time"
+
+// DefaultMaxFileSize is the largest file OneDrive currently accepts (250GB).
+const DefaultMaxFileSize uint64 = 250 * 1024 * 1024 * 1024
+
+// UploadPolicy decides when changed files are uploaded.
+type UploadPolicy string
+
+// upload policies
+const (
+	// UploadOnFlush uploads files whenever they are closed or fsync()ed.
+	UploadOnFlush UploadPolicy = "flush"
+	// UploadOnClose uploads files when they are closed. fsync() only saves
+	// them to the local cache.
+	UploadOnClose UploadPolicy = "close"
+	// UploadOnInterval saves files to the local cache when they are closed or
+	// fsync()ed, and uploads them periodically with Cache.WritebackLoop.
+	UploadOnInterval UploadPolicy = "interval"
+)
+
+// ConflictBehavior decides what happens when a file being uploaded already
+// exists, or changed on the server since it was last synced.
+type ConflictBehavior string
+
+// conflict behaviors, as the API names them
+const (
+	// ConflictFail refuses the upload.
+	ConflictFail ConflictBehavior = "fail"
+	// ConflictReplace overwrites whatever is on the server.
+	ConflictReplace ConflictBehavior = "replace"
+	// ConflictRename keeps what is on the server, and saves the upload under
+	// another name (as a conflict copy, for files changed on both sides).
+	ConflictRename ConflictBehavior = "rename"
+)
+
+// ConflictStrategy decides which version of a file is kept when it was changed
+// both locally and on the server since it was last synced.
+type ConflictStrategy string
+
+// conflict strategies
+const (
+	// ConflictKeepBoth keeps the server's version under the file's name, and
+	// saves the local changes as a conflict copy next to it.
+	ConflictKeepBoth ConflictStrategy = "keep-both"
+	// ConflictLocalWins uploads the local changes over the server's version.
+	ConflictLocalWins ConflictStrategy = "local-wins"
+	// ConflictRemoteWins replaces the local changes with the server's version.
+	ConflictRemoteWins ConflictStrategy = "remote-wins"
+	// ConflictPrompt keeps both versions as they are until the user picks one
+	// (see Cache.Conflicts and Cache.ResolveConflict).
+	ConflictPrompt ConflictStrategy = "prompt"
+)
+
+// EvictionPolicy decides which content is evicted first when the content cache
+// grows past Options.MaxCacheSize.
+type EvictionPolicy string
+
+// eviction policies
+const (
+	// EvictLRU evicts the content that was used the longest time ago first.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the content that was opened the fewest times first, so
+	// that files used often stay cached through a burst of files that are
+	// only used once. Counts are halved on every startup, so that files that
+	// are no longer used eventually go too.
+	EvictLFU EvictionPolicy = "lfu"
+	// EvictSize evicts large content that was not used lately first, by
+	// weighing how long ago content was used by how much space it takes up,
+	// so that one huge file makes way for many small ones.
+	EvictSize EvictionPolicy = "size"
+)
+
+// Options are user-configurable settings that change how a Cache behaves. A nil
+// *Options (or the zero value of any field) means "use the default behavior".
+type Options struct {
+	// Root is the path of a folder on the drive to use as the filesystem root
+	// instead of the root of the drive itself. Only items in this subtree are
+	// exposed at the mountpoint. A special folder can be selected by name
+	// instead, like "special:photos".
+	Root string
+
+	// RootID is the ID of a folder to use as the filesystem root. Takes
+	// precedence over Root when set.
+	RootID string
+
+	// DriveID is the ID of the drive to mount. Defaults to the user's own drive.
+	DriveID string
+
+	// Exclude leaves items matching any of these patterns (and everything in
+	// them) out of the filesystem: they are not listed, downloaded, or synced,
+	// and nothing can be created in their place. Patterns use the syntax of
+	// path.Match and ignore case. Patterns with a slash in them (other than at
+	// the end) match paths relative to the filesystem root, like
+	// "Photos/2010*", others match names anywhere, like "*.iso". Patterns
+	// ending with a slash only match folders, like "Backups/".
+	Exclude []string
+
+	// MaxFileSize is the largest file size (in bytes) that can be written.
+	// Defaults to DefaultMaxFileSize.
+	MaxFileSize uint64
+
+	// PrefetchDirs is the number of most frequently used directories to
+	// prefetch on startup and while idle (see Cache.WarmLoop). Directory usage
+	// is not tracked when this is 0.
+	PrefetchDirs int
+
+	// PrefetchFileSize is the size (in bytes) of the largest file whose
+	// content gets prefetched along with its directory. 0 disables content
+	// prefetching.
+	PrefetchFileSize uint64
+
+	// MaxCacheSize is how much disk space (in bytes) the cached content of
+	// files may take up. The least recently used content is evicted when the
+	// cache grows past it, unless it is open or not uploaded yet. Metadata is
+	// always kept. 0 means no limit.
+	MaxCacheSize uint64
+
+	// EvictionPolicy decides what is evicted first when the content cache is
+	// over MaxCacheSize. Defaults to EvictLRU.
+	EvictionPolicy EvictionPolicy
+
+	// MaxDownloads is how many parts of files are downloaded at once while
+	// they are read. Programs reading the same part of a file share one
+	// download. Defaults to DefaultMaxDownloads.
+	MaxDownloads int
+
+	// Readahead is how much of a file (in bytes) is downloaded in the
+	// background ahead of a program reading it sequentially, so that its reads
+	// do not wait on the network. 0 disables readahead.
+	Readahead uint64
+
+	// StreamSize is the size (in bytes) of the smallest file that is read
+	// straight from the server when it is opened for reading only, without
+	// storing any of it in the cache. Meant for huge files like videos. 0
+	// disables streaming by size.
+	StreamSize uint64
+
+	// StreamDirs streams files opened for reading only in these directories
+	// (and everything inside them) like StreamSize, whatever their size. Paths
+	// are relative to the filesystem root.
+	StreamDirs []string
+
+	// HydrationHoles reports the parts of partly downloaded files that are not
+	// cached yet as holes to SEEK_HOLE and SEEK_DATA. Programs that skip holes
+	// when copying files (like cp) copy zeroes instead of those parts.
+	HydrationHoles bool
+
+	// WriteThrough makes fsync() and close() wait until a file has been
+	// uploaded instead of returning immediately and uploading in the
+	// background (write-back).
+	WriteThrough bool
+
+	// WriteThroughDirs enables write-through mode for only these directories
+	// (and everything inside them). Paths are relative to the filesystem root.
+	WriteThroughDirs []string
+
+	// MaxUploads is how many files are uploaded at once. Other uploads wait
+	// in a queue. Defaults to DefaultMaxUploads.
+	MaxUploads int
+
+	// UploadDelay is how long a file must go without changes before it is
+	// uploaded, so that files saved repeatedly in quick succession are only
+	// uploaded once. Files are uploaded right away if this is 0.
+	UploadDelay time.Duration
+
+	// ChunkSize is how much of a large file is uploaded per request, rounded
+	// down to a multiple of 320KiB. Defaults to DefaultChunkSize.
+	ChunkSize uint64
+
+	// AdaptiveChunkSize grows the chunk size of uploads (up to 60MiB) while
+	// chunks are uploaded quickly, and shrinks it when they are slow or fail.
+	AdaptiveChunkSize bool
+
+	// RetryPolicy limits how hard uploads are retried before they are marked
+	// as failed. Defaults to DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+
+	// UploadPolicy decides when changed files are uploaded. Defaults to
+	// UploadOnFlush. Files in write-through mode always use UploadOnFlush.
+	UploadPolicy UploadPolicy
+
+	// ConflictBehavior is used for every upload and new file when set.
+	// Otherwise files replace what is on the server, unless they changed on
+	// the server since they were last synced, in which case the local changes
+	// are saved as a conflict copy (like ConflictRename).
+	ConflictBehavior ConflictBehavior
+
+	// ConflictStrategy decides which version is kept of files changed both
+	// locally and on the server, both when changes from the server are applied
+	// and when the local changes are uploaded. Defaults to ConflictKeepBoth.
+	// Uploads with ConflictFail or ConflictReplace do not check for conflicts,
+	// and so ignore it.
+	ConflictStrategy ConflictStrategy
+
+	// TrashRetention is how long the cached content of files deleted on the
+	// server is kept in the local trash, from which they can be restored (see
+	// Cache.RestoreTrash). 0 disables the local trash.
+	TrashRetention time.Duration
+
+	// MetadataKey encrypts the metadata stored in the cache database (like the
+	// names of items) with AES-256 when set. Must be MetadataKeySize bytes.
+	MetadataKey []byte
+
+	// ContentKey encrypts the cached content of files (and of uploads in
+	// progress) with AES-256 when set. Must be ContentKeySize bytes.
+	ContentKey []byte
+
+	// SharedContentDir is a directory where mounts of the same account (each
+	// with its own cache) share the content they cache, so that it is stored
+	// once. Must be on the same filesystem as the caches, since content is
+	// shared with hard links. Nothing is shared if empty.
+	SharedContentDir string
+
+	// CompressContent stores the cached content of files compressed with zstd
+	// once they are closed, and decompresses it when they are opened again.
+	// Content that hardly compresses (like most media) is left as it is.
+	CompressContent bool
+
+	// SkipHashVerification skips comparing hashes after uploading or
+	// downloading a file and when opening cached content, which takes a while
+	// for very large files.
+	// Only sizes (and the eTags of uploads) are checked instead.
+	SkipHashVerification bool
+
+	// EmulateHardLinks makes link() copy the target on the server instead of
+	// failing. The "link" is an independent copy of the file.
+	EmulateHardLinks bool
+
+	// SpecialFolders adds a ".special" folder at the root of the filesystem
+	// with a symlink to each of the drive's special folders (like Photos).
+	SpecialFolders bool
+}
@@ -0,0 +1,33 @@
+package fs
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// While sync is paused, nothing happens in the background: changes are not
+// fetched from the server (see DeltaLoop), nothing is uploaded, and nothing is
+// prefetched, read ahead, or verified. Files can still be opened, and files that
+// are not cached are still downloaded when they are read. Changes made in the
+// meantime are queued and uploaded once sync is resumed.
+
+// PauseSync stops all syncing in the background until ResumeSync is called.
+func (c *Cache) PauseSync() {
+	log.WithField("drive", c.drive.ID).Info("Pausing sync.")
+	c.syncPause.set(true)
+	c.uploads.Pause()
+}
+
+// ResumeSync continues syncing stopped by PauseSync, starting with fetching what
+// changed on the server in the meantime. Uploads paused on their own (see
+// UploadManager.Pause) are resumed too.
+func (c *Cache) ResumeSync() {
+	log.WithField("drive", c.drive.ID).Info("Resuming sync.")
+	c.syncPause.set(false)
+	c.uploads.Resume()
+	c.NotifyChanged()
+}
+
+// SyncPaused returns whether syncing is paused (see PauseSync).
+func (c *Cache) SyncPaused() bool {
+	return c.syncPause.isPaused()
+}
@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jstaf/onedriver/fs/graph"
+)
+
+// PendingChange is a change that has not been synced yet, see Cache.Pending.
+type PendingChange struct {
+	Path   string
+	Change string // what is waiting to happen, like "queued" or "deleted"
+	Error  string // why the last attempt failed, if any
+}
+
+// Pending is everything on a drive that is not in sync with the server.
+type Pending struct {
+	Drive     string
+	Local     []PendingChange // changes that have not been uploaded yet
+	Conflicts []Conflict      // files waiting for a version to be picked
+	Remote    []PendingChange // changes on the server that were not applied yet
+	Checked   bool            // whether the server was asked for changes
+}
+
+// Pending reports what has not been synced yet, without changing anything: files
+// waiting to be uploaded (or still open with unsaved changes), changes to folders
+// made offline that were not replayed, conflicts, and changes on the server
+// that were not applied yet. Changes on the server are only looked up if
+// online, and are fetched like DeltaLoop would, but without applying them or
+// moving on to the next changes.
+func (c *Cache) Pending(auth *graph.Auth) (Pending, error) {
+	pending := Pending{
+		Drive:     c.drive.Path(),
+		Local:     make([]PendingChange, 0),
+		Conflicts: c.Conflicts(),
+		Remote:    make([]PendingChange, 0),
+	}
+	seen := make(map[string]bool)
+	for _, upload := range c.uploads.List() {
+		seen[upload.ID] = true
+		pending.Local = append(pending.Local, PendingChange{
+			Path:   c.pathOf(upload.ID, upload.Name),
+			Change: upload.State,
+			Error:  upload.Error,
+		})
+	}
+	for _, id := range c.dirtyIDs() {
+		if !seen[id] {
+			seen[id] = true
+			pending.Local = append(pending.Local, PendingChange{
+				Path:   c.pathOf(id, id),
+				Change: "saved",
+			})
+		}
+	}
+	for _, entry := range c.journalEntries() {
+		pending.Local = append(pending.Local, PendingChange{
+			Path:   c.pathOf(entry.ID, entry.Name),
+			Change: entry.Op,
+		})
+	}
+	c.metadata.Range(func(key, value interface{}) bool {
+		inode := value.(*Inode)
+		id := key.(string)
+		if !seen[id] && !inode.IsDir() && inode.HasChanges() {
+			pending.Local = append(pending.Local, PendingChange{
+				Path:   inode.Path(),
+				Change: "unsaved",
+			})
+		}
+		inode.mutex.RLock()
+		held := inode.remoteChange != nil
+		inode.mutex.RUnlock()
+		if held {
+			pending.Remote = append(pending.Remote, PendingChange{
+				Path:   inode.Path(),
+				Change: "modified (applied once closed)",
+			})
+		}
+		return true
+	})
+
+	if !c.IsOffline() && c.deltaLink != "" {
+		remote, err := c.pendingDeltas(auth)
+		if err != nil {
+			return pending, err
+		}
+		pending.Remote = append(pending.Remote, remote...)
+		pending.Checked = true
+	}
+	for _, changes := range [][]PendingChange{pending.Local, pending.Remote} {
+		sort.SliceStable(changes, func(i, j int) bool {
+			return changes[i].Path < changes[j].Path
+		})
+	}
+	return pending, nil
+}
+
+// pathOf returns the path of an item, or name if it is not in the cache.
+func (c *Cache) pathOf(id string, name string) string {
+	if inode := c.GetID(id); inode != nil {
+		return inode.Path()
+	}
+	return name
+}
+
+// pendingDeltas fetches the changes on the server since the last delta, and
+// returns the ones that would change the cache, without applying them.
+func (c *Cache) pendingDeltas(auth *graph.Auth) ([]PendingChange, error) {
+	latest := make(map[string]*Inode)
+	order := make([]string, 0)
+	link := c.deltaLink
+	for link != "" {
+		resp, err := graph.Get(link, auth)
+		if err != nil {
+			return nil, err
+		}
+		page := deltaResponse{}
+		if err = json.Unmarshal(resp, &page); err != nil {
+			return nil, err
+		}
+		for _, delta := range page.Values {
+			// only the last change to each item counts, like in DeltaLoop
+			if _, exists := latest[delta.ID()]; !exists {
+				order = append(order, delta.ID())
+			}
+			latest[delta.ID()] = delta
+		}
+		link = strings.TrimPrefix(page.NextLink, graph.GraphURL)
+	}
+
+	changes := make([]PendingChange, 0)
+	for _, id := range order {
+		if change, ok := c.pendingDelta(latest[id]); ok {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// pendingDelta describes what applying a delta would change in the cache, if
+// anything.
+func (c *Cache) pendingDelta(delta *Inode) (PendingChange, bool) {
+	local := c.GetID(delta.ID())
+	if delta.Deleted != nil {
+		if local == nil {
+			return PendingChange{}, false
+		}
+		return PendingChange{Path: local.Path(), Change: "deleted"}, true
+	}
+
+	parent := c.GetID(delta.ParentID())
+	name := delta.Name()
+	if local == nil {
+		if parent == nil || c.isExcluded(parent, name, delta.IsDir()) {
+			return PendingChange{}, false
+		}
+		return PendingChange{Path: path.Join(parent.Path(), name), Change: "created"}, true
+	}
+	if local.ParentID() != delta.ParentID() || local.Name() != name {
+		change := "moved"
+		if parent != nil {
+			change = "moved to " + path.Join(parent.Path(), name)
+		}
+		return PendingChange{Path: local.Path(), Change: change}, true
+	}
+	if !delta.IsDir() {
+		local.mutex.RLock()
+		modified := local.DriveItem.CTag != delta.DriveItem.CTag
+		local.mutex.RUnlock()
+		if modified {
+			return PendingChange{Path: local.Path(), Change: "modified"}, true
+		}
+	}
+	return PendingChange{}, false
+}
@@ -0,0 +1,276 @@
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucketAccess tracks how many times each directory has been listed, keyed by
+// directory ID.
+var bucketAccess = []byte("access")
+
+// recordAccess increments the access count of a directory.
+func (c *Cache) recordAccess(id string) {
+	if c.opts.PrefetchDirs <= 0 || id == "" || isLocalID(id) {
+		return
+	}
+	// batched since this is called for every directory listing
+	go c.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAccess)
+		var count uint64
+		if v := b.Get([]byte(id)); len(v) == 8 {
+			count = binary.BigEndian.Uint64(v)
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, count+1)
+		return b.Put([]byte(id), value)
+	})
+}
+
+// hotDirs returns the IDs of the n most frequently accessed directories. With
+// decay, counts are halved afterwards so that directories that are no longer
+// used gradually fall out of the list.
+func (c *Cache) hotDirs(n int, decay bool) []string {
+	type dirCount struct {
+		id    string
+		count uint64
+	}
+	counts := make([]dirCount, 0)
+	c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAccess)
+		b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				counts = append(counts, dirCount{string(k), binary.BigEndian.Uint64(v)})
+			}
+			return nil
+		})
+		if !decay {
+			return nil
+		}
+		for _, dir := range counts {
+			if dir.count <= 1 {
+				b.Delete([]byte(dir.id))
+				continue
+			}
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, dir.count/2)
+			b.Put([]byte(dir.id), value)
+		}
+		return nil
+	})
+
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].count > counts[j].count
+	})
+	ids := make([]string, 0, n)
+	for i := 0; i < len(counts) && i < n; i++ {
+		ids = append(ids, counts[i].id)
+	}
+	return ids
+}
+
+// PrefetchHotDirs fetches the contents of the most frequently used directories
+// so that they are already cached when first accessed. Files no larger than
+// Options.PrefetchFileSize have their content fetched as well. Does nothing
+// unless Options.PrefetchDirs is set or if offline.
+func (c *Cache) PrefetchHotDirs() {
+	if c.opts.PrefetchDirs <= 0 || c.IsOffline() || c.SyncPaused() {
+		return
+	}
+	c.prefetchDirs(c.hotDirs(c.opts.PrefetchDirs, true))
+}
+
+// idleTime is how long no file must have been opened for before the cache is
+// warmed, see WarmLoop.
+const idleTime = time.Minute
+
+// WarmLoop prefetches the most frequently used directories like
+// PrefetchHotDirs every interval while onedriver is idle: nothing was opened
+// for idleTime, and nothing is being downloaded or uploaded. Files that changed
+// on the server or were evicted since are then downloaded in the background
+// instead of when they are next opened. Access counts only decay on startup, so
+// they are not worn down by warming.
+func (c *Cache) WarmLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if c.opts.PrefetchDirs > 0 && c.idle() {
+			log.Debug("Warming the cache of frequently used directories.")
+			c.prefetchDirs(c.hotDirs(c.opts.PrefetchDirs, false))
+		}
+	}
+}
+
+// idle returns whether nothing is using the network on behalf of a program.
+func (c *Cache) idle() bool {
+	return !c.IsOffline() && !c.SyncPaused() &&
+		time.Since(c.counters.lastOpened()) >= idleTime &&
+		len(c.downloads.active()) == 0 &&
+		len(c.uploads.List()) == 0
+}
+
+// nearlyFull returns whether the content cache is close enough to
+// Options.MaxCacheSize that prefetching would evict content that was used.
+func (c *Cache) nearlyFull() bool {
+	if c.opts.MaxCacheSize == 0 {
+		return false
+	}
+	_, size := c.contentUsage()
+	return size >= c.opts.MaxCacheSize/10*9
+}
+
+// prefetchDirs fetches the contents of directories, along with the content of
+// files no larger than Options.PrefetchFileSize.
+func (c *Cache) prefetchDirs(ids []string) {
+	auth := c.GetAuth()
+	for _, id := range ids {
+		inode := c.GetID(id)
+		if inode == nil {
+			continue
+		}
+		path, ok := c.relativePath(inode)
+		if !ok {
+			continue
+		}
+		// fetched by path so that all parents end up in the cache too
+		children, err := c.GetChildrenPath("/"+path, auth)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":   id,
+				"path": path,
+				"err":  err,
+			}).Debug("Could not prefetch directory, it may have been moved or deleted.")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"path":     path,
+			"children": len(children),
+		}).Debug("Prefetched directory.")
+
+		if c.opts.PrefetchFileSize == 0 || c.nearlyFull() {
+			continue
+		}
+		for _, child := range children {
+			childID := child.ID()
+			if child.IsDir() ||
+				child.Size() > c.opts.PrefetchFileSize ||
+				isLocalID(childID) || c.hasContent(childID) {
+				continue
+			}
+			download, _, err := c.fetchContent(context.Background(), childID,
+				child.checksum(), graph.PriorityBackground, auth)
+			if err == nil {
+				err = c.installContent(download, childID)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":   childID,
+					"name": child.Name(),
+					"err":  err,
+				}).Warn("Could not prefetch file content.")
+				continue
+			}
+		}
+	}
+}
+
+// PrefetchMetadata adds every folder on the drive that has not been listed yet
+// to the cache along with its contents, so that the whole tree can be browsed
+// while offline. Instead of listing each folder, the whole drive is enumerated
+// with a delta query started from scratch, which only takes a request per page
+// of items. Folders that were already listed are kept up to date by DeltaLoop
+// and left alone, and no file content is downloaded. Returns how many items
+// were added.
+func (c *Cache) PrefetchMetadata(auth *graph.Auth) (int, error) {
+	if c.deltaStart == "" {
+		return 0, errors.New("the drive has not been reached since it was mounted")
+	}
+
+	// the same query as DeltaLoop, without a token to get every item
+	link := strings.TrimSuffix(c.deltaStart, "?token=latest")
+	byParent := make(map[string][]*Inode)
+	for link != "" {
+		resp, err := graph.Get(link, auth)
+		if err != nil {
+			return 0, err
+		}
+		page := deltaResponse{}
+		if err = json.Unmarshal(resp, &page); err != nil {
+			return 0, err
+		}
+		for _, item := range page.Values {
+			if parentID := item.ParentID(); item.Deleted == nil && parentID != "" {
+				byParent[parentID] = append(byParent[parentID], item)
+			}
+		}
+		link = strings.TrimPrefix(page.NextLink, graph.GraphURL)
+	}
+
+	// walked from the root, so that items outside of the mounted part of the
+	// drive (or inside excluded folders) are never added
+	added := 0
+	queue := []string{c.root}
+	for len(queue) > 0 {
+		dir := c.GetID(queue[0])
+		queue = queue[1:]
+		if dir == nil || !dir.IsDir() {
+			continue
+		}
+		dirID := dir.ID()
+		dir.mutex.RLock()
+		listed := dir.children != nil
+		dir.mutex.RUnlock()
+
+		if !listed {
+			children := make([]*Inode, 0, len(byParent[dirID]))
+			for _, child := range byParent[dirID] {
+				// items already cached somewhere else were moved since
+				// the enumeration, and are left to DeltaLoop
+				if c.GetID(child.ID()) == nil &&
+					!c.isExcluded(dir, child.Name(), child.IsDir()) {
+					children = append(children, child)
+				}
+			}
+			dir.mutex.Lock()
+			if dir.children == nil { // could have been listed in the meantime
+				dir.children = make([]string, 0, len(children))
+				for _, child := range children {
+					child.cache = c
+					c.restoreLocalAttrs(child)
+					c.metadata.Store(child.DriveItem.ID, child)
+					dir.children = append(dir.children, child.DriveItem.ID)
+					if child.IsDir() {
+						dir.subdir++
+					}
+				}
+				added += len(children)
+			}
+			dir.mutex.Unlock()
+		}
+
+		dir.mutex.RLock()
+		childIDs := append([]string(nil), dir.children...)
+		dir.mutex.RUnlock()
+		for _, id := range childIDs {
+			if child := c.GetID(id); child != nil && child.IsDir() {
+				queue = append(queue, id)
+			}
+		}
+	}
+
+	// kept for the next time onedriver is started offline
+	c.SerializeAll()
+	log.WithFields(log.Fields{
+		"drive": c.drive.ID,
+		"items": added,
+	}).Info("Prefetched the metadata of the whole drive.")
+	return added, nil
+}
@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Renames are journaled before they are sent to the server and removed from the
+// journal once both the remote and local copies have been updated. Anything left
+// in the journal on startup was interrupted partway through.
+var bucketRenames = []byte("renames")
+
+// renameIntent records the state of an item before and after a rename.
+type renameIntent struct {
+	ID          string    `json:"id"`
+	OldName     string    `json:"oldName"`
+	OldParentID string    `json:"oldParentId"`
+	NewName     string    `json:"newName"`
+	NewParentID string    `json:"newParentId"`
+	Time        time.Time `json:"time"`
+}
+
+// journalRename persists a rename before it is performed.
+func (c *Cache) journalRename(intent renameIntent) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		contents, _ := json.Marshal(intent)
+		return tx.Bucket(bucketRenames).Put([]byte(intent.ID), c.sealer.seal(contents))
+	})
+}
+
+// finishRename removes a rename from the journal.
+func (c *Cache) finishRename(id string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRenames).Delete([]byte(id))
+	})
+}
+
+// forgetChildren discards the cached list of a directory's children so that it
+// is fetched again from the server the next time it is needed.
+func (c *Cache) forgetChildren(id string) {
+	if inode := c.GetID(id); inode != nil && inode.IsDir() {
+		inode.mutex.Lock()
+		inode.children = nil
+		inode.subdir = 0
+		inode.mutex.Unlock()
+	}
+}
+
+// reconcileRenames checks any renames that were interrupted by a crash against
+// the server. The server's copy always wins: the local copy of the item is
+// updated to match and the affected directories are refetched.
+func (c *Cache) reconcileRenames(auth *graph.Auth) {
+	intents := make([]renameIntent, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRenames).ForEach(func(k, v []byte) error {
+			var intent renameIntent
+			if v, err := c.sealer.open(v); err == nil && json.Unmarshal(v, &intent) == nil {
+				intents = append(intents, intent)
+			}
+			return nil
+		})
+	})
+
+	for _, intent := range intents {
+		logger := log.WithFields(log.Fields{
+			"id":          intent.ID,
+			"oldName":     intent.OldName,
+			"oldParentID": intent.OldParentID,
+			"newName":     intent.NewName,
+			"newParentID": intent.NewParentID,
+		})
+
+		item, err := c.drive.GetItem(intent.ID, auth)
+		if err != nil {
+			if graph.IsOffline(err) {
+				return // try again next time
+			}
+			logger.WithField("err", err).Warn(
+				"Item from interrupted rename no longer exists on the server.")
+		} else {
+			parentID := ""
+			if item.Parent != nil {
+				parentID = item.Parent.ID
+			}
+			switch {
+			case item.Name == intent.NewName && parentID == intent.NewParentID:
+				logger.Info("Interrupted rename completed on the server, updating local copy.")
+			case item.Name == intent.OldName && parentID == intent.OldParentID:
+				logger.Info("Interrupted rename never reached the server, reverting local copy.")
+			default:
+				logger.WithFields(log.Fields{
+					"name":     item.Name,
+					"parentID": parentID,
+				}).Warn("Item from interrupted rename was changed on the server, using server copy.")
+			}
+			if inode := c.GetID(intent.ID); inode != nil {
+				inode.mutex.Lock()
+				inode.DriveItem.Name = item.Name
+				if inode.DriveItem.Parent != nil {
+					inode.DriveItem.Parent.ID = parentID
+				}
+				inode.mutex.Unlock()
+			}
+		}
+		c.forgetChildren(intent.OldParentID)
+		c.forgetChildren(intent.NewParentID)
+		c.finishRename(intent.ID)
+	}
+}
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// ResyncResult describes what Cache.Resync changed.
+type ResyncResult struct {
+	Refreshed int      // items whose metadata was replaced with the server's
+	Added     int      // items that were missing from the cache
+	Removed   int      // items that are no longer on the server
+	Kept      []string // paths of items with local changes, which were left alone
+}
+
+// Resync replaces the metadata of inode and everything cached under it with
+// what is on the server, for when the cache no longer matches the server and
+// syncing does not fix it. Items are updated in place, so that the kernel keeps
+// finding them, and folders that were listed before are listed again. Items no
+// longer on the server are removed from the cache, and the cached content of
+// files that changed is dropped, or of every file if content is set. Files with
+// local changes that were not uploaded yet are left alone, since their changes
+// would be lost otherwise.
+func (c *Cache) Resync(inode *Inode, content bool, auth *graph.Auth) (ResyncResult, error) {
+	result := ResyncResult{Kept: make([]string, 0)}
+	if !inode.IsDir() && c.changedLocally(inode) {
+		result.Kept = append(result.Kept, inode.Path())
+		return result, nil
+	}
+	if !isLocalID(inode.ID()) {
+		item, err := c.drive.GetItem(inode.ID(), auth)
+		if err != nil {
+			return result, err
+		}
+		c.refreshLocal(inode, item, content)
+		result.Refreshed++
+	}
+	if inode.IsDir() {
+		if err := c.resyncDir(inode, content, auth, &result); err != nil {
+			return result, err
+		}
+	}
+
+	// or a restart would bring back what was on disk before
+	c.SerializeAll()
+	log.WithFields(log.Fields{
+		"path":      inode.Path(),
+		"refreshed": result.Refreshed,
+		"added":     result.Added,
+		"removed":   result.Removed,
+		"kept":      len(result.Kept),
+	}).Info("Resynced metadata with the server.")
+	return result, nil
+}
+
+// resyncDir lists a folder from the server again, and updates the cache to
+// match. Folders whose children were never fetched are left that way.
+func (c *Cache) resyncDir(dir *Inode, content bool, auth *graph.Auth, result *ResyncResult) error {
+	dir.mutex.RLock()
+	listed := dir.children != nil
+	previous := append([]string{}, dir.children...)
+	dir.mutex.RUnlock()
+	if !listed || isLocalID(dir.ID()) {
+		return nil
+	}
+
+	fetched, err := c.drive.GetItemChildren(dir.ID(), auth)
+	if err != nil {
+		return err
+	}
+	dirID := dir.ID()
+	onServer := make(map[string]bool)
+	for _, item := range fetched {
+		onServer[item.ID] = true
+		local := c.GetID(item.ID)
+		if local == nil {
+			child := NewInodeDriveItem(item)
+			if c.isExcluded(dir, child.Name(), child.IsDir()) {
+				continue
+			}
+			c.InsertChild(dirID, child)
+			c.notifyAdded(dirID, child.Name())
+			result.Added++
+			continue
+		}
+		if local.ParentID() != dirID || local.Name() != item.Name {
+			c.moveLocal(local, dirID, item.Name)
+		}
+		if !local.IsDir() && c.changedLocally(local) {
+			result.Kept = append(result.Kept, local.Path())
+			continue
+		}
+		c.refreshLocal(local, item, content)
+		result.Refreshed++
+		if local.IsDir() {
+			if err = c.resyncDir(local, content, auth, result); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, id := range previous {
+		child := c.GetID(id)
+		if child == nil || onServer[id] || child.ParentID() != dirID {
+			continue
+		}
+		if isLocalID(id) || c.changedLocally(child) {
+			result.Kept = append(result.Kept, child.Path())
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": child.Path(),
+		}).Info("Item is no longer on the server, removing it from the cache.")
+		c.trashLocal(child)
+		c.deleteLocal(child)
+		result.Removed++
+	}
+	return nil
+}
+
+// refreshLocal replaces the metadata of a local item with the server's in place.
+// Its cached content is dropped if it does not match the server's, or if
+// content is set.
+func (c *Cache) refreshLocal(local *Inode, remote *graph.DriveItem, content bool) {
+	id := local.ID()
+	isDir := local.IsDir()
+	local.mutex.Lock()
+	if !isDir && remote.File != nil &&
+		!local.VerifyChecksum(c.Capabilities().Checksum(remote.File.Hashes)) {
+		content = true
+	}
+	local.DriveItem = *remote
+	local.hasChanges = false
+	local.blocked = ""
+	local.badDownloads = 0
+	if content {
+		local.closeContent() // reopened from the server by Read/Write if in use
+	}
+	local.mutex.Unlock()
+
+	if content && !isDir {
+		c.DeleteContent(id)
+	}
+	notifyModified(local)
+}
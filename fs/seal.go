@@ -0,0 +1,161 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MetadataKeySize is the size of the key used to encrypt metadata (AES-256).
+const MetadataKeySize = 32
+
+// sealedPrefix marks values in the database that have been encrypted.
+var sealedPrefix = []byte("sealed1:")
+
+// sealer encrypts values stored in the database that reveal the names of items
+// (metadata, the rename journal, and unsynced items), so that the cache does not
+// reveal the structure of the drive without the key. A nil sealer stores values
+// as-is.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealer creates a sealer from a key, or returns nil if key is empty.
+func newSealer(key []byte) (*sealer, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal encrypts a value to be stored in the database.
+func (s *sealer) seal(value []byte) []byte {
+	if s == nil {
+		return value
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	io.ReadFull(rand.Reader, nonce)
+	sealed := append(append([]byte{}, sealedPrefix...), nonce...)
+	return s.aead.Seal(sealed, nonce, value, nil)
+}
+
+// open decrypts a value read from the database. Values stored before encryption
+// was enabled are returned unchanged, and are encrypted the next time they are
+// written.
+func (s *sealer) open(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	if s == nil {
+		return nil, errors.New("value is encrypted, but no metadata key was provided")
+	}
+	value = value[len(sealedPrefix):]
+	if len(value) < s.aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	nonce := value[:s.aead.NonceSize()]
+	return s.aead.Open(nil, nonce, value[len(nonce):], nil)
+}
+
+// LoadMetadataKey reads the key used to encrypt metadata from path, generating
+// a new one if the file does not exist yet.
+func LoadMetadataKey(path string) ([]byte, error) {
+	return loadKeyFile(path, MetadataKeySize)
+}
+
+// loadKeyFile reads a key of size bytes from path, generating a new one if the
+// file does not exist yet.
+func loadKeyFile(path string, size int) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, size)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		return key, ioutil.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("key must be exactly %d bytes", size)
+	}
+	return key, nil
+}
+
+// sealExisting encrypts any values that were stored before encryption was
+// enabled.
+func (c *Cache) sealExisting() {
+	if c.sealer == nil {
+		return
+	}
+	c.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketMetadata, bucketRenames, bucketUnsynced,
+			bucketUploads, bucketJournal, bucketTrash} {
+			b := tx.Bucket(name)
+			if b == nil {
+				continue // uploads are only created once needed
+			}
+			plain := make(map[string][]byte)
+			b.ForEach(func(k, v []byte) error {
+				if !bytes.HasPrefix(v, sealedPrefix) {
+					plain[string(k)] = append([]byte{}, v...)
+				}
+				return nil
+			})
+			for k, v := range plain {
+				b.Put([]byte(k), c.sealer.seal(v))
+			}
+		}
+		b := tx.Bucket(bucketDelta)
+		if root := b.Get([]byte("root")); root != nil && !bytes.HasPrefix(root, sealedPrefix) {
+			b.Put([]byte("root"), c.sealer.seal(root))
+		}
+		return nil
+	})
+}
+
+// WriteSealed writes data to path, encrypted with a metadata key (see
+// LoadMetadataKey) unless key is empty. For files outside the database that
+// reveal names, like the layout of drives.
+func WriteSealed(path string, data []byte, key []byte) error {
+	s, err := newSealer(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, s.seal(data), 0600)
+}
+
+// ReadSealed reads a file written by WriteSealed. Files written before
+// encryption was enabled are read as-is.
+func ReadSealed(path string, key []byte) ([]byte, error) {
+	s, err := newSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(data)
+}
@@ -52,13 +52,14 @@ func TestMain(m *testing.M) {
 	toDelete, _ := filepath.Glob("test*.db")
 	for _, db := range toDelete {
 		os.Remove(db)
+		os.RemoveAll(db + ".content")
 	}
 
 	f := logger.LogTestSetup()
 	defer f.Close()
 
 	auth = graph.Authenticate(".auth_tokens.json")
-	fsCache = NewCache(auth, "test.db")
+	fsCache = NewCache(auth, "test.db", nil)
 
 	second := time.Second
 	root, _ := fsCache.GetPath("/", auth)
@@ -68,7 +69,7 @@ func TestMain(m *testing.M) {
 		MountOptions: fuse.MountOptions{
 			Name:          "onedriver",
 			FsName:        "onedriver",
-			DisableXAttrs: true,
+			DisableXAttrs: false,
 			MaxBackground: 1024,
 		},
 	})
@@ -0,0 +1,176 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// When the same account is mounted more than once (each mount with its own
+// cache directory), the content of a file would be stored once per mount. With
+// Options.SharedContentDir, content that is complete and unchanged is hard
+// linked into a store that every mount shares, named after the item's ID and
+// cTag (which, unlike the eTag, only changes when the content does). Mounts that
+// need content look there before downloading it, and link it into their own
+// cache, so it is stored once. Content from the store is checked like any other
+// cached content before it is used. A file that is linked is copied before it
+// is changed (see contentFile.unshare), so that the change stays in its mount.
+
+// sharedDir returns the directory of the shared content store used by the
+// cache, or "" if it does not use one. Content is only shared between mounts
+// that encrypt it with the same key, or not at all.
+func (c *Cache) sharedDir() string {
+	if c.opts.SharedContentDir == "" {
+		return ""
+	}
+	keyName := "plain"
+	if len(c.opts.ContentKey) > 0 {
+		sum := sha256.Sum256(c.opts.ContentKey)
+		keyName = "key-" + hex.EncodeToString(sum[:8])
+	}
+	return filepath.Join(c.opts.SharedContentDir, keyName)
+}
+
+// sharedPath returns the path of the content of a version of an item in the
+// shared content store.
+func (c *Cache) sharedPath(id string, cTag string) string {
+	sum := sha256.Sum256([]byte(cTag))
+	return filepath.Join(c.sharedDir(), url.PathEscape(id)+"."+hex.EncodeToString(sum[:8]))
+}
+
+// shareContent links the cached content of a closed file into the shared
+// content store, unless it is there already.
+func (c *Cache) shareContent(i *Inode) {
+	dir := c.sharedDir()
+	if dir == "" {
+		return
+	}
+	// locked so that the file cannot be opened (and changed) while it is linked
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	id := i.DriveItem.ID
+	cTag := i.DriveItem.CTag
+	if i.content != nil || i.hydration != nil || i.hasChanges || cTag == "" || isLocalID(id) {
+		return
+	}
+	path := c.contentPath(id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	shared := c.sharedPath(id, cTag)
+	if other, err := os.Stat(shared); err == nil && os.SameFile(info, other) {
+		return
+	}
+	if err = os.MkdirAll(dir, 0700); err == nil {
+		temp := filepath.Join(dir, downloadPrefix+filepath.Base(shared)+"-"+
+			strconv.Itoa(os.Getpid()))
+		if err = os.Link(path, temp); err == nil {
+			if err = os.Rename(temp, shared); err != nil {
+				os.Remove(temp)
+			}
+		}
+	}
+	if err != nil {
+		// like when the store is on another filesystem
+		log.WithFields(log.Fields{
+			"id":  id,
+			"err": err,
+		}).Debug("Could not share cached content with other mounts.")
+	}
+}
+
+// linkShared links the content of a version of an item from the shared content
+// store into the cache, if another mount stored it there. Returns whether it
+// did.
+func (c *Cache) linkShared(id string, cTag string) bool {
+	if c.sharedDir() == "" || cTag == "" || isLocalID(id) {
+		return false
+	}
+	temp := filepath.Join(contentDir(c.db), downloadPrefix+id+"-shared")
+	if err := os.Link(c.sharedPath(id, cTag), temp); err != nil {
+		return false
+	}
+	if err := os.Rename(temp, c.contentPath(id)); err != nil {
+		os.Remove(temp)
+		return false
+	}
+	log.WithField("id", id).Debug("Found content cached by another mount.")
+	return true
+}
+
+// pruneShared removes content from the shared content store that no mount uses
+// anymore, along with links that were left halfway.
+func (c *Cache) pruneShared() {
+	dir := c.sharedDir()
+	if dir == "" {
+		return
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		stat, ok := entry.Sys().(*syscall.Stat_t)
+		if strings.HasPrefix(entry.Name(), downloadPrefix) || (ok && stat.Nlink <= 1) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// isLinked returns whether an open file has other links, like one in the shared
+// content store.
+func isLinked(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Nlink > 1
+}
+
+// unshare replaces a file of content that is linked elsewhere with a copy of
+// its own before it is changed, so that the change does not reach the other
+// links. Must be called with the mutex held.
+func (f *contentFile) unshare() error {
+	if !f.linked {
+		return nil
+	}
+	original := f.current()
+	path := original.Name()
+	temp, err := ioutil.TempFile(filepath.Dir(path), downloadPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	info, err := original.Stat()
+	if err == nil {
+		_, err = io.Copy(temp, io.NewSectionReader(original, 0, info.Size()))
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	// reads can still be using the original, so it is closed with the file
+	f.fileMutex.Lock()
+	f.replaced = append(f.replaced, f.file)
+	f.file = file
+	f.fileMutex.Unlock()
+	f.linked = false
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/logger"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,3 +25,23 @@ func UnmountHandler(signal <-chan os.Signal, server *fuse.Server) {
 
 	os.Exit(128)
 }
+
+// DumpEventsHandler should be used as a goroutine that writes the recent log
+// entries in events to a file at path every time a signal is received.
+func DumpEventsHandler(signal <-chan os.Signal, events *logger.RingBuffer, path string) {
+	for range signal {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err == nil {
+			err = events.Dump(file, logger.LogrusFormatter(), 0)
+			file.Close()
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path": path,
+				"err":  err,
+			}).Error("Could not write recent events to disk.")
+			continue
+		}
+		log.WithField("path", path).Info("Wrote recent events to disk.")
+	}
+}
@@ -0,0 +1,141 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// specialDirName is the name of the virtual folder at the root of the
+// filesystem that links to the drive's special folders, if enabled with
+// Options.SpecialFolders.
+const specialDirName = ".special"
+
+// specialRootPrefix selects a special folder as the filesystem root instead of
+// a path, as in "--root special:photos".
+const specialRootPrefix = "special:"
+
+// getSpecialRoot fetches a special folder to use as the filesystem root.
+func getSpecialRoot(drive graph.Drive, name string, auth *graph.Auth) (*graph.DriveItem, error) {
+	info, err := graph.GetDriveID(drive.ID, auth)
+	if err != nil {
+		return nil, err
+	}
+	caps, _ := graph.CapabilitiesOf(info.DriveType)
+	name = graph.NormalizeSpecialFolder(name)
+	if !caps.HasSpecialFolder(name) {
+		return nil, caps.Unsupported(fmt.Sprintf("the \"%s\" special folder", name))
+	}
+	return drive.GetSpecialFolder(name, auth)
+}
+
+// drivePath returns the path of an item relative to the root of its drive,
+// according to its parent reference.
+func drivePath(item *graph.DriveItem) (string, bool) {
+	if item.Parent == nil {
+		return "", false
+	}
+	// looks like "/drive/root:/some/folder"
+	parent := item.Parent.Path
+	start := strings.Index(parent, "root:")
+	if start < 0 {
+		return "", false
+	}
+	parent = parent[start+len("root:"):]
+	if unescaped, err := url.PathUnescape(parent); err == nil {
+		parent = unescaped
+	}
+	return filepath.Join("/", parent, item.Name), true
+}
+
+// specialFolder finds one of the drive's special folders in the cache,
+// fetching it (and the folders leading up to it) the first time. Returns nil if
+// the folder does not exist or is not part of the filesystem.
+func (c *Cache) specialFolder(name string) *Inode {
+	if id, exists := c.special.Load(name); exists {
+		if inode := c.GetID(id.(string)); inode != nil {
+			return inode
+		}
+	}
+	if c.IsOffline() || !isDriveRoot(&c.opts) {
+		return nil
+	}
+	item, err := c.drive.GetSpecialFolder(name, c.GetAuth())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name": name,
+			"err":  err,
+		}).Debug("Could not fetch special folder.")
+		return nil
+	}
+	path, ok := drivePath(item)
+	if !ok {
+		return nil
+	}
+	inode, err := c.GetPath(path, c.GetAuth())
+	if err != nil {
+		return nil
+	}
+	c.special.Store(name, inode.ID())
+	return inode
+}
+
+// SpecialDir is a read-only virtual directory containing a symlink to each of
+// the drive's special folders (like Photos), wherever they are on the drive.
+type SpecialDir struct {
+	fs.Inode
+
+	cache *Cache
+}
+
+// links maps the name of each symlink in the SpecialDir to its target.
+func (s *SpecialDir) links() map[string]string {
+	links := make(map[string]string)
+	for _, name := range s.cache.Capabilities().SpecialFolders {
+		if name == "approot" {
+			continue // fetching it creates it
+		}
+		inode := s.cache.specialFolder(name)
+		if inode == nil {
+			continue
+		}
+		if path, ok := s.cache.relativePath(inode); ok {
+			links[graph.SpecialFolderNames[name]] = "../" + path
+		}
+	}
+	return links
+}
+
+// Readdir lists the symlinks in the SpecialDir.
+func (s *SpecialDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return readdirLinks(s.links()), 0
+}
+
+// Lookup fetches a single symlink from the SpecialDir.
+func (s *SpecialDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return lookupLink(ctx, &s.Inode, s.links(), name, out)
+}
+
+// Getattr reports the SpecialDir as a read-only directory.
+func (s *SpecialDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = virtualDirAttr()
+	return 0
+}
+
+// specialDir returns the SpecialDir for an Inode's filesystem, creating it on
+// first use. Must only be called on the root Inode.
+func (i *Inode) specialDir(ctx context.Context) *fs.Inode {
+	if child := i.EmbeddedInode().GetChild(specialDirName); child != nil {
+		return child
+	}
+	dir := &SpecialDir{cache: i.GetCache()}
+	return i.NewPersistentInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR})
+}
@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamChunk is how much of a streamed file is downloaded at once. Programs
+// read much less than this at a time, so the rest is kept in memory for the
+// reads that follow.
+const streamChunk = 4 * hydrationBlock
+
+// streamHandle is a file opened for reading whose content is read straight
+// from the server instead of through the cache (see Cache.isStreamed), so that
+// huge files can be read without taking up any disk space.
+type streamHandle struct {
+	mutex  sync.Mutex
+	id     string
+	offset uint64 // of the buffer in the file
+	buffer []byte
+}
+
+// read reads part of a streamed file, downloading the streamChunk it is in
+// unless it was downloaded for the last read.
+func (s *streamHandle) read(ctx context.Context, i *Inode, buf []byte,
+	off int64) (fuse.ReadResult, syscall.Errno) {
+	size := i.Size()
+	start := uint64(off)
+	if start >= size {
+		return fuse.ReadResultData(make([]byte, 0)), 0
+	}
+	end := start + uint64(len(buf))
+	if end > size {
+		end = size
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if start < s.offset || end > s.offset+uint64(len(s.buffer)) {
+		length := uint64(streamChunk)
+		if end-start > length {
+			length = end - start
+		}
+		if start+length > size {
+			length = size - start
+		}
+		cache := i.GetCache()
+		var buffer bytes.Buffer
+		if _, _, err := cache.Drive().GetItemContentRange(ctx, s.id, start, length,
+			&buffer, graph.PriorityInteractive, cache.GetAuth()); err != nil {
+			log.WithFields(log.Fields{
+				"id":     s.id,
+				"path":   i.Path(),
+				"offset": off,
+				"err":    err,
+			}).Error("Could not stream the part of the file being read.")
+			s.buffer = nil
+			return fuse.ReadResultData(make([]byte, 0)), syscall.EREMOTEIO
+		}
+		s.offset, s.buffer = start, buffer.Bytes()
+	}
+	data := s.buffer[start-s.offset:]
+	if uint64(len(data)) > end-start {
+		data = data[:end-start]
+	}
+	return fuse.ReadResultData(buf[:copy(buf, data)]), 0
+}
@@ -0,0 +1,170 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// subscriptionLifetime is how long subscriptions are made to last. They are
+// renewed halfway through, and expire on their own shortly after onedriver
+// stops.
+const subscriptionLifetime = 24 * time.Hour
+
+// NotifyChanged tells the cache that something changed on the server, so that
+// the changes are fetched right away instead of at the next polling interval.
+// Notifications that arrive while changes are being fetched make it fetch
+// again afterwards, in case it just missed them.
+func (c *Cache) NotifyChanged() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+		// one is waiting already
+	}
+}
+
+// ChangeNotifier delivers notifications from the server that something changed
+// on a drive, so that changes show up within seconds instead of at the next
+// poll. However notifications are delivered, polling continues as a fallback
+// for notifications that never arrive.
+type ChangeNotifier interface {
+	// Subscribe starts calling NotifyChanged on the cache whenever something
+	// changes on its drive, for as long as onedriver runs. If it fails, changes
+	// are only polled for.
+	Subscribe(c *Cache) error
+}
+
+// WebhookNotifier is a ChangeNotifier that receives notifications as HTTP
+// requests from the server, with Graph subscriptions. The server must be able
+// to reach it at URL, so it has to be served (see ServeHTTP) somewhere public,
+// usually behind a reverse proxy with a valid TLS certificate.
+type WebhookNotifier struct {
+	URL         string
+	clientState string
+
+	mutex  sync.RWMutex
+	caches map[string]*Cache // by subscription ID
+}
+
+// NewWebhookNotifier creates a WebhookNotifier for the public URL it is served
+// at.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	state := make([]byte, 16)
+	rand.Read(state)
+	return &WebhookNotifier{
+		URL:         url,
+		clientState: hex.EncodeToString(state),
+		caches:      make(map[string]*Cache),
+	}
+}
+
+// Subscribe subscribes to changes on the drive of the cache, and keeps the
+// subscription alive in the background.
+func (w *WebhookNotifier) Subscribe(c *Cache) error {
+	subscription, err := w.subscribe(c)
+	if err != nil {
+		return err
+	}
+	go w.renewLoop(c, subscription)
+	return nil
+}
+
+// subscribe creates a new subscription for the cache.
+func (w *WebhookNotifier) subscribe(c *Cache) (*graph.Subscription, error) {
+	subscription, err := c.Drive().Subscribe(w.URL, w.clientState,
+		time.Now().Add(subscriptionLifetime), c.GetAuth())
+	if err != nil {
+		return nil, err
+	}
+	w.mutex.Lock()
+	w.caches[subscription.ID] = c
+	w.mutex.Unlock()
+	log.WithFields(log.Fields{
+		"id":      subscription.ID,
+		"expires": subscription.ExpirationDateTime,
+	}).Info("Subscribed to change notifications.")
+	return subscription, nil
+}
+
+// renewLoop renews a subscription before it expires, or replaces it if it
+// cannot be renewed (like after being offline for too long).
+func (w *WebhookNotifier) renewLoop(c *Cache, subscription *graph.Subscription) {
+	for {
+		time.Sleep(time.Until(subscription.ExpirationDateTime) / 2)
+		renewed, err := graph.RenewSubscription(subscription.ID,
+			time.Now().Add(subscriptionLifetime), c.GetAuth())
+		if err == nil {
+			subscription = renewed
+			continue
+		}
+		if time.Now().Before(subscription.ExpirationDateTime) && graph.IsOffline(err) {
+			// try again once the network is back
+			time.Sleep(time.Minute)
+			continue
+		}
+		w.mutex.Lock()
+		delete(w.caches, subscription.ID)
+		w.mutex.Unlock()
+		replaced, err := w.subscribe(c)
+		if err == nil {
+			subscription = replaced
+			continue
+		}
+		log.WithField("err", err).Warn("Could not renew subscription to change " +
+			"notifications, falling back to polling for changes.")
+		// changes missed in the meantime are still polled for, so there is
+		// no hurry
+		subscription = &graph.Subscription{
+			ID:                 subscription.ID,
+			ExpirationDateTime: time.Now().Add(20 * time.Minute),
+		}
+	}
+}
+
+// ServeHTTP answers the requests the server sends to the notification URL:
+// validation requests while subscribing, and notifications afterwards.
+func (w *WebhookNotifier) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if token := r.URL.Query().Get("validationToken"); token != "" {
+		// the server checks that we really want notifications sent here
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte(token))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, 1024*1024))
+	var notifications graph.Notifications
+	if err == nil {
+		err = json.Unmarshal(body, &notifications)
+	}
+	if err != nil {
+		http.Error(rw, "", http.StatusBadRequest)
+		return
+	}
+	// accepted before fetching any changes, the server gives up on slow
+	// notification URLs
+	rw.WriteHeader(http.StatusAccepted)
+	for _, notification := range notifications.Value {
+		if notification.ClientState != w.clientState {
+			log.WithField("subscription", notification.SubscriptionID).Warn(
+				"Ignoring change notification that did not come from the server.")
+			continue
+		}
+		w.mutex.RLock()
+		cache, ok := w.caches[notification.SubscriptionID]
+		w.mutex.RUnlock()
+		if ok {
+			cache.NotifyChanged()
+		}
+	}
+}
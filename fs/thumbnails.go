@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"sync"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxThumbnails is how many thumbnails are kept in memory at most, which is
+// enough for a file manager showing a large folder.
+const maxThumbnails = 512
+
+// thumbnail is a thumbnail of one version of an item's content. data is nil if
+// the server could not render one.
+type thumbnail struct {
+	cTag string
+	data []byte
+}
+
+// thumbnailCache keeps thumbnails fetched from the server in memory, since
+// programs reading an extended attribute usually ask for its size first and
+// then for its value. The zero value is ready to use.
+type thumbnailCache struct {
+	sync.Mutex
+	entries map[string]thumbnail // by item ID and size
+}
+
+// get returns the thumbnail of an item in one of graph's thumbnail sizes, or nil
+// if there is none. Thumbnails of files that have not been uploaded yet are never
+// available.
+func (t *thumbnailCache) get(c *Cache, id string, cTag string, size string) []byte {
+	if isLocalID(id) || c.IsOffline() {
+		return nil
+	}
+	key := id + "/" + size
+	t.Lock()
+	cached, exists := t.entries[key]
+	t.Unlock()
+	if exists && cached.cTag == cTag {
+		return cached.data
+	}
+
+	data, err := c.drive.GetThumbnail(id, size, c.GetAuth())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":   id,
+			"size": size,
+			"err":  err,
+		}).Debug("Could not fetch thumbnail.")
+		if graph.IsOffline(err) {
+			return nil // may be available later
+		}
+		data = nil
+	}
+	if len(data) == 0 {
+		data = nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.entries == nil || len(t.entries) >= maxThumbnails {
+		t.entries = make(map[string]thumbnail)
+	}
+	t.entries[key] = thumbnail{cTag: cTag, data: data}
+	return data
+}
@@ -1,7 +1,15 @@
 package fs
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/jstaf/onedriver/fs/graph"
@@ -9,26 +17,91 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-const maxUploadsInFlight = 5
+// DefaultMaxUploads is how many files are uploaded at once by default.
+const DefaultMaxUploads = 5
+
+// DefaultUploadDelay is how long a file must go without changes before it is
+// uploaded by default.
+const DefaultUploadDelay = 5 * time.Second
 
 var bucketUploads = []byte("uploads")
 
+// RetryPolicy limits how hard uploads are retried before they are marked as
+// failed, after which they wait to be retried with "onedriver queue retry".
+type RetryPolicy struct {
+	// MaxRetries is how many times an upload is started over after an error.
+	MaxRetries int
+
+	// MaxBackoff caps how long to wait before sending a chunk that the server
+	// failed to accept again. The wait doubles after every failure. 0 for no
+	// cap.
+	MaxBackoff time.Duration
+
+	// Budget is how long an upload may keep failing before it is marked as
+	// failed, no matter how many retries it has left. 0 for no limit.
+	Budget time.Duration
+}
+
+// DefaultRetryPolicy is how uploads are retried by default.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	MaxBackoff: 5 * time.Minute,
+	Budget:     time.Hour,
+}
+
+// backoff caps a wait between retries at MaxBackoff.
+func (p RetryPolicy) backoff(wait time.Duration) time.Duration {
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return wait
+}
+
 // UploadManager is used to manage and retry uploads.
 type UploadManager struct {
 	queue         chan *UploadSession
 	deletionQueue chan string
+	control       chan func() // runs functions on the upload loop's goroutine
 	sessions      map[string]*UploadSession
-	inFlight      uint8 // number of sessions in flight
+	waiters       map[string][]chan error // notified when an upload is finished
+	inFlight      int                     // number of sessions in flight
+	maxInFlight   int                     // see SetMaxUploads
+	throttled     time.Time               // no uploads are started until then
+	delay         time.Duration           // see SetUploadDelay
+	chunkSize     uint64                  // see SetChunkSize
+	cipher        *contentCipher          // see setCipher
+	sealer        *sealer                 // encrypts sessions stored on disk
+	adaptive      bool                    // see SetChunkSize
+	retry         RetryPolicy             // see SetRetryPolicy
+	pause         *pauseGate              // see Pause
+	activity      activityLog             // recently completed uploads
 	auth          *graph.Auth
 	db            *bolt.DB
+
+	completed  func(id string, remote *graph.DriveItem) // see OnComplete
+	conflicted func(session *UploadSession)             // see OnConflict
 }
 
 // NewUploadManager creates a new queue/thread for uploads
 func NewUploadManager(duration time.Duration, db *bolt.DB, auth *graph.Auth) *UploadManager {
+	return newUploadManager(duration, db, auth, nil)
+}
+
+// newUploadManager creates an UploadManager whose sessions are stored on disk
+// encrypted with sealer, since they hold the names of files.
+func newUploadManager(duration time.Duration, db *bolt.DB, auth *graph.Auth,
+	sealer *sealer) *UploadManager {
 	manager := UploadManager{
 		queue:         make(chan *UploadSession),
 		deletionQueue: make(chan string),
+		control:       make(chan func()),
 		sessions:      make(map[string]*UploadSession),
+		waiters:       make(map[string][]chan error),
+		maxInFlight:   DefaultMaxUploads,
+		chunkSize:     DefaultChunkSize,
+		retry:         DefaultRetryPolicy,
+		pause:         newPauseGate(),
+		sealer:        sealer,
 		auth:          auth,
 		db:            db,
 	}
@@ -43,21 +116,44 @@ func NewUploadManager(duration time.Duration, db *bolt.DB, auth *graph.Auth) *Up
 		}
 		return b.ForEach(func(key []byte, val []byte) error {
 			session := &UploadSession{}
-			err := json.Unmarshal(val, session)
+			val, err := sealer.open(val)
+			if err == nil {
+				err = json.Unmarshal(val, session)
+			}
 			if err != nil {
 				log.WithField(
 					"err", err,
 				).Error("Error while restoring upload sessions from disk.")
 				return err
 			}
-			if session.getState() != uploadNotStarted {
-				manager.inFlight++
+			if session.Snapshot == "" {
+				// sessions used to store their content in the database
+				var legacy struct {
+					Data []byte `json:"data"`
+				}
+				json.Unmarshal(val, &legacy)
+				session.Snapshot, err = writeSnapshot(uploadDir(db), session.ID, nil,
+					bytes.NewReader(legacy.Data))
+				if err != nil {
+					log.WithFields(log.Fields{
+						"id":  session.ID,
+						"err": err,
+					}).Error("Could not move upload content out of the database.")
+					return nil
+				}
 			}
-			session.cancel(auth) // uploads are currently non-resumable
+			// large uploads resume from where they left off, since the API
+			// upload session (if any) is kept
+			session.persist = manager.persistIfCurrent
 			manager.sessions[session.ID] = session
 			return nil
 		})
 	})
+	manager.removeOrphanedSnapshots()
+	for _, session := range manager.sessions {
+		// sessions moved out of the database above need saving
+		manager.persist(session)
+	}
 	go manager.uploadLoop(duration)
 	return &manager
 }
@@ -70,60 +166,144 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 		case session := <-u.queue: // new sessions
 			// deduplicate sessions for the same item
 			if old, exists := u.sessions[session.ID]; exists {
+				state := old.getState()
+				if state == uploadComplete {
+					// the old content made it to the server before the loop
+					// got to it, which the new content must build on
+					u.complete(old)
+					session.follow(old.getUploaded())
+					if session.ID != old.ID {
+						// anyone waiting on the file now waits on its new ID
+						u.forget(old.ID)
+						u.waiters[session.ID] = append(u.waiters[session.ID],
+							u.waiters[old.ID]...)
+						delete(u.waiters, old.ID)
+					}
+				}
+				// the old content is stale, stop sending it
+				old.stop()
 				old.cancel(u.auth)
+				old.removeSnapshot()
+				session.Priority = old.Priority
+				if state != uploadNotStarted && state != uploadFailed {
+					u.inFlight--
+				}
+				delete(u.sessions, old.ID)
+				if isLocalID(session.ID) && state != uploadNotStarted {
+					// the old content may have created the new file already,
+					// in which case it is ours to replace
+					session.ConflictBehavior = ConflictReplace
+				}
 			}
-			u.db.Update(func(tx *bolt.Tx) error {
-				// persist to disk in case the user shuts off their computer or
-				// kills onedriver prematurely
-				contents, _ := json.Marshal(session)
-				b, _ := tx.CreateBucketIfNotExists(bucketUploads)
-				return b.Put([]byte(session.ID), contents)
-			})
+			session.queued = time.Now()
+			// persist to disk in case the user shuts off their computer or
+			// kills onedriver prematurely
+			session.persist = u.persistIfCurrent
+			u.persist(session)
 			u.sessions[session.ID] = session
 
 		case cancelID := <-u.deletionQueue: // remove uploads for deleted items
 			u.finishUpload(cancelID)
 
+		case f := <-u.control: // requests from Control
+			f()
+
 		case <-ticker.C: // periodically start uploads, or remove them if done/failed
-			for _, session := range u.sessions {
-				switch session.getState() {
+			large := u.largeInFlight()
+			for _, session := range u.sortedSessions() {
+				state := session.getState()
+				if state != uploadStarted && session.applyMove() {
+					u.persist(session)
+				}
+				switch state {
 				case uploadNotStarted:
 					// max active upload sessions are capped at this limit for faster
 					// uploads of individual files and also to prevent possible server-
 					// side throttling that can cause errors
-					if u.inFlight < maxUploadsInFlight {
+					if time.Since(session.queued) < u.delay {
+						// wait for the file to stop changing
+						continue
+					}
+					if u.canStart(session, large) {
 						u.inFlight++
+						if session.isLargeSession() {
+							large++
+						}
+						session.chunkSize = u.chunkSize
+						session.cipher = u.cipher
+						session.adaptive = u.adaptive
+						session.retry = u.retry
+						session.pause = u.pause
 						go session.Upload(u.auth)
 					}
 
 				case uploadErrored:
+					if errors.Is(session.error, graph.ErrPreconditionFailed) {
+						fields := log.Fields{
+							"id":   session.ID,
+							"name": session.Name,
+						}
+						if u.conflicted != nil && session.ConflictBehavior != ConflictFail {
+							log.WithFields(fields).Warning("File changed on the server " +
+								"since it was last synced, keeping both versions.")
+							u.conflicted(session)
+							u.finishUpload(session.ID)
+							continue
+						}
+						log.WithFields(fields).Error("File changed on the server since " +
+							"it was last synced, not uploading it (see --conflict-behavior).")
+						session.cancel(u.auth)
+						session.setState(uploadFailed, session.error)
+						u.inFlight--
+						u.notify(session.ID, session.error)
+						continue
+					}
+					if wait, throttled := graph.IsThrottled(session.error); throttled {
+						// the server applies its limits to all of our uploads, so
+						// all of them wait, and this does not count as a failure
+						log.WithFields(log.Fields{
+							"id":   session.ID,
+							"name": session.Name,
+							"wait": wait,
+						}).Warning("Upload was throttled by the server, pausing uploads.")
+						if until := time.Now().Add(wait); until.After(u.throttled) {
+							u.throttled = until
+						}
+						session.setState(uploadNotStarted, nil)
+						u.inFlight--
+						continue
+					}
 					session.retries++
-					if session.retries > 5 {
+					if session.retries > session.retry.MaxRetries || session.outOfBudget() {
 						log.WithFields(log.Fields{
 							"id":      session.ID,
 							"name":    session.Name,
 							"err":     session.Error(),
 							"retries": session.retries,
+							"failing": session.failingFor().Round(time.Second),
 						}).Error(
-							"Upload session failed too many times, cancelling session. " +
-								"This is a bug - please file a bug report!",
+							"Upload session failed too many times, giving up until it is " +
+								"retried with \"onedriver queue retry\".",
 						)
-						u.finishUpload(session.ID)
+						session.cancel(u.auth)
+						session.setState(uploadFailed, session.error)
+						u.inFlight--
+						u.notify(session.ID, session.error)
+						continue
 					}
 
+					// large sessions continue from wherever the server says they
+					// left off, if it still has them (see resumeOffset)
 					log.WithFields(log.Fields{
 						"id":   session.ID,
 						"name": session.Name,
 						"err":  session.Error(),
-					}).Warning("Upload session failed, will retry from beginning.")
-					session.cancel(u.auth) // cancel large sessions
+					}).Warning("Upload session failed, will retry.")
 					session.setState(uploadNotStarted, nil)
+					u.inFlight-- // counted again when the session is restarted
 
 				case uploadComplete:
-					log.WithFields(log.Fields{
-						"id":   session.ID,
-						"name": session.Name,
-					}).Debug("Upload completed!")
+					u.complete(session)
 					u.finishUpload(session.ID)
 				}
 			}
@@ -131,6 +311,18 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 	}
 }
 
+// complete records that an upload made it to the server.
+func (u *UploadManager) complete(session *UploadSession) {
+	log.WithFields(log.Fields{
+		"id":   session.ID,
+		"name": session.Name,
+	}).Debug("Upload completed!")
+	u.activity.add("uploaded", session.Name)
+	if u.completed != nil {
+		u.completed(session.ID, session.getUploaded())
+	}
+}
+
 // QueueUpload queues an item for upload.
 func (u *UploadManager) QueueUpload(inode *Inode) error {
 	session, err := NewUploadSession(inode, u.auth)
@@ -140,6 +332,23 @@ func (u *UploadManager) QueueUpload(inode *Inode) error {
 	return err
 }
 
+// MoveUpload tells the upload manager that an item was renamed or moved, so
+// that its upload follows it instead of being lost. Uploads go to the item
+// itself rather than its path, but an upload that is already running moves the
+// item again once it is done, in case the server put it back where it was.
+func (u *UploadManager) MoveUpload(id string, name string, parentID string) {
+	u.do(func() {
+		session, exists := u.sessions[id]
+		if !exists {
+			return
+		}
+		session.move(name, parentID)
+		if session.getState() != uploadStarted && session.applyMove() {
+			u.persist(session)
+		}
+	})
+}
+
 // CancelUpload is used to kill any pending uploads for a session
 func (u *UploadManager) CancelUpload(id string) {
 	u.deletionQueue <- id
@@ -149,22 +358,433 @@ func (u *UploadManager) CancelUpload(id string) {
 // completed. It cancels the session if one was in progress, and then deletes
 // it from both memory and disk.
 func (u *UploadManager) finishUpload(id string) {
-	if session, exists := u.sessions[id]; exists {
-		session.cancel(u.auth)
+	session, exists := u.sessions[id]
+	if !exists {
+		return
+	}
+	session.stop()
+	session.cancel(u.auth)
+	session.removeSnapshot()
+	u.forget(id)
+	state := session.getState()
+	if state == uploadComplete {
+		u.notify(id, nil)
+	} else {
+		u.notify(id, errors.New("upload was cancelled"))
 	}
+	if state != uploadNotStarted && state != uploadFailed {
+		// only sessions that were started count towards the in-flight limit
+		if u.inFlight == 0 {
+			log.WithFields(log.Fields{
+				"id":       id,
+				"inFlight": u.inFlight,
+			}).Warn("Files in flight cannot be less than 0")
+		} else {
+			u.inFlight--
+		}
+	}
+	delete(u.sessions, id)
+}
+
+// notify tells anyone waiting on an upload that it has finished.
+func (u *UploadManager) notify(id string, err error) {
+	for _, waiter := range u.waiters[id] {
+		waiter <- err
+	}
+	delete(u.waiters, id)
+}
+
+// WaitUpload blocks until the upload of an item has finished, returning an error
+// if it failed or was cancelled. Returns immediately if there is no upload in
+// progress for the item, or if it has already failed.
+func (u *UploadManager) WaitUpload(id string) error {
+	waiter := make(chan error, 1)
+	u.do(func() {
+		session, exists := u.sessions[id]
+		if !exists {
+			waiter <- nil
+			return
+		}
+		if session.getState() == uploadFailed {
+			// nothing happens until it is retried or cancelled
+			waiter <- session.error
+			return
+		}
+		session.queued = time.Time{} // no point in waiting for more changes
+		u.waiters[id] = append(u.waiters[id], waiter)
+	})
+	return <-waiter
+}
+
+// sortedSessions returns all sessions in the order they should be uploaded: the
+// highest priority sessions first, then small files before large ones (which
+// would hold them up for a long time), then the oldest first.
+func (u *UploadManager) sortedSessions() []*UploadSession {
+	sessions := make([]*UploadSession, 0, len(u.sessions))
+	for _, session := range u.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		a, b := sessions[i], sessions[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.isLargeSession() != b.isLargeSession() {
+			return !a.isLargeSession()
+		}
+		return a.queued.Before(b.queued)
+	})
+	return sessions
+}
+
+// largeInFlight counts the large files being uploaded.
+func (u *UploadManager) largeInFlight() int {
+	large := 0
+	for _, session := range u.sessions {
+		if state := session.getState(); session.isLargeSession() &&
+			(state == uploadStarted || state == uploadErrored) {
+			large++
+		}
+	}
+	return large
+}
+
+// canStart returns whether a session can start uploading, with large uploads
+// in flight already. Large files may not take up the last upload slot, so that
+// files saved while large ones are uploading do not have to wait for them to
+// finish.
+func (u *UploadManager) canStart(session *UploadSession, large int) bool {
+	if u.inFlight >= u.maxInFlight || !time.Now().After(u.throttled) || u.pause.isPaused() {
+		return false
+	}
+	return !session.isLargeSession() || u.maxInFlight == 1 || large < u.maxInFlight-1
+}
+
+// removeOrphanedSnapshots deletes content snapshots that no session uses, which
+// are left behind if onedriver exits while a session is being replaced.
+func (u *UploadManager) removeOrphanedSnapshots() {
+	used := make(map[string]bool)
+	for _, session := range u.sessions {
+		used[session.Snapshot] = true
+	}
+	dir := uploadDir(u.db)
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !used[path] {
+			os.Remove(path)
+		}
+	}
+}
+
+// forget removes a session from disk.
+func (u *UploadManager) forget(id string) {
 	u.db.Update(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(bucketUploads); b != nil {
 			b.Delete([]byte(id))
 		}
 		return nil
 	})
-	if u.inFlight == 0 {
-		log.WithFields(log.Fields{
-			"id":       id,
-			"inFlight": u.inFlight,
-		}).Warn("Files in flight cannot be less than 0")
+}
+
+// persist saves a session to disk.
+func (u *UploadManager) persist(session *UploadSession) {
+	u.db.Update(func(tx *bolt.Tx) error {
+		contents, _ := json.Marshal(session)
+		b, _ := tx.CreateBucketIfNotExists(bucketUploads)
+		return b.Put([]byte(session.ID), u.sealer.seal(contents))
+	})
+}
+
+// SetMaxUploads changes how many files are uploaded at once. Other uploads wait
+// in the queue until one of them finishes. Uploads that are already running are
+// not interrupted if the limit is lowered.
+func (u *UploadManager) SetMaxUploads(max int) {
+	if max < 1 {
+		max = 1
+	}
+	u.do(func() {
+		u.maxInFlight = max
+	})
+}
+
+// SetUploadDelay makes uploads wait until a file has not changed for delay, so
+// that a file saved many times in a row (like by an editor's autosave) is only
+// uploaded once, with its final content. Uploads that something is waiting on
+// (see WaitUpload) start right away.
+func (u *UploadManager) SetUploadDelay(delay time.Duration) {
+	u.do(func() {
+		u.delay = delay
+	})
+}
+
+// SetChunkSize changes how much of a large file is uploaded per request, which
+// is rounded down to a multiple of 320KiB (the API's requirement). With
+// adaptive, the size of each chunk grows on fast connections and shrinks on
+// slow or unreliable ones, starting from size. Applies to uploads started
+// afterwards.
+func (u *UploadManager) SetChunkSize(size uint64, adaptive bool) {
+	u.do(func() {
+		u.chunkSize = alignChunkSize(size)
+		u.adaptive = adaptive
+	})
+}
+
+// setCipher makes uploads read the snapshots of their content through cipher,
+// which uploads started afterwards use (see Options.ContentKey).
+func (u *UploadManager) setCipher(cipher *contentCipher) {
+	u.do(func() {
+		u.cipher = cipher
+	})
+}
+
+// OnComplete calls f with the ID of every item whose upload completes, along
+// with what the item now looks like on the server. The remote item has a
+// different ID if the file was new (see UploadSession.itemPath). f runs on the
+// upload loop, and must not call back into the UploadManager.
+func (u *UploadManager) OnComplete(f func(id string, remote *graph.DriveItem)) {
+	u.do(func() {
+		u.completed = f
+	})
+}
+
+// OnConflict calls f with every upload that was refused because the item
+// changed on the server since it was last synced, right before the session is
+// removed from the queue. Without f (or with ConflictFail) such uploads fail
+// until they are retried or cancelled. f runs on the upload loop, and must not
+// call back into the UploadManager.
+func (u *UploadManager) OnConflict(f func(session *UploadSession)) {
+	u.do(func() {
+		u.conflicted = f
+	})
+}
+
+// SetRetryPolicy changes how hard uploads are retried before they are marked as
+// failed. Applies to uploads started afterwards.
+func (u *UploadManager) SetRetryPolicy(policy RetryPolicy) {
+	u.do(func() {
+		u.retry = policy
+	})
+}
+
+// pauseGate holds up uploads (or other work) while they are paused.
+type pauseGate struct {
+	mutex   sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed when uploads are resumed
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{resumed: make(chan struct{})}
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.paused
+}
+
+func (g *pauseGate) set(paused bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if paused == g.paused {
+		return
+	}
+	g.paused = paused
+	if paused {
+		g.resumed = make(chan struct{})
 	} else {
-		u.inFlight--
+		close(g.resumed)
 	}
-	delete(u.sessions, id)
+}
+
+// wait blocks while paused, unless ctx is cancelled, in which case
+// its error is returned. A nil pauseGate is never paused.
+func (g *pauseGate) wait(ctx context.Context) error {
+	if g != nil {
+		g.mutex.Lock()
+		resumed, paused := g.resumed, g.paused
+		g.mutex.Unlock()
+		if paused {
+			select {
+			case <-resumed:
+			case <-ctx.Done():
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// Pause stops uploads until Resume is called. Queued uploads are not started,
+// and large uploads in progress stop after their current chunk, keeping their
+// upload sessions on the server so that they can continue where they left off.
+// Small uploads in progress are allowed to finish.
+func (u *UploadManager) Pause() {
+	log.Info("Pausing uploads.")
+	u.pause.set(true)
+}
+
+// Resume continues uploads stopped by Pause.
+func (u *UploadManager) Resume() {
+	log.Info("Resuming uploads.")
+	u.pause.set(false)
+}
+
+// Paused returns whether uploads are paused.
+func (u *UploadManager) Paused() bool {
+	return u.pause.isPaused()
+}
+
+// persistIfCurrent saves a session to disk from another goroutine, unless it
+// has finished or been replaced in the meantime.
+func (u *UploadManager) persistIfCurrent(session *UploadSession) {
+	u.do(func() {
+		if u.sessions[session.ID] == session {
+			u.persist(session)
+		}
+	})
+}
+
+// UploadStatus is a snapshot of an upload session, used for reporting.
+type UploadStatus struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     uint64 `json:"size"`
+	State    string `json:"state"`
+	Priority int    `json:"priority,omitempty"`
+	Retries  int    `json:"retries,omitempty"`
+	Sent     uint64 `json:"sent"` // bytes of the content sent so far
+	Error    string `json:"error,omitempty"`
+}
+
+var uploadStateNames = map[int]string{
+	uploadNotStarted: "queued",
+	uploadStarted:    "uploading",
+	uploadComplete:   "complete",
+	uploadErrored:    "errored",
+	uploadFailed:     "failed",
+}
+
+// do runs a function on the upload loop's goroutine and waits for it to
+// finish, so that it can safely access the upload manager's state.
+func (u *UploadManager) do(f func()) {
+	done := make(chan struct{})
+	u.control <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// List returns the status of every upload session, highest priority first.
+func (u *UploadManager) List() []UploadStatus {
+	statuses := make([]UploadStatus, 0)
+	u.do(func() {
+		for _, session := range u.sortedSessions() {
+			session.mutex.Lock()
+			status := UploadStatus{
+				ID:       session.ID,
+				Name:     session.Name,
+				Size:     session.Size,
+				State:    uploadStateNames[session.state],
+				Priority: session.Priority,
+				Retries:  session.retries,
+				Sent:     session.sent,
+			}
+			if session.error != nil {
+				status.Error = session.error.Error()
+			}
+			session.mutex.Unlock()
+			statuses = append(statuses, status)
+		}
+	})
+	return statuses
+}
+
+// errNoSession is returned when operating on an upload that does not exist.
+var errNoSession = errors.New("no upload session for this item")
+
+// Progress returns how much of an item's content has been uploaded so far and
+// the total size of the upload, or false if the item is not being uploaded.
+func (u *UploadManager) Progress(id string) (uint64, uint64, bool) {
+	var sent, size uint64
+	var exists bool
+	u.do(func() {
+		var session *UploadSession
+		if session, exists = u.sessions[id]; exists {
+			sent, size = session.getSent(), session.Size
+		}
+	})
+	return sent, size, exists
+}
+
+// state returns the state of an item's upload, or false if it is not being
+// uploaded.
+func (u *UploadManager) state(id string) (int, bool) {
+	state := uploadNotStarted
+	var exists bool
+	u.do(func() {
+		var session *UploadSession
+		if session, exists = u.sessions[id]; exists {
+			state = session.getState()
+		}
+	})
+	return state, exists
+}
+
+// Retry restarts a failed or errored upload from the beginning.
+func (u *UploadManager) Retry(id string) error {
+	err := errNoSession
+	u.do(func() {
+		session, exists := u.sessions[id]
+		if !exists {
+			return
+		}
+		err = nil
+		if state := session.getState(); state == uploadFailed || state == uploadErrored {
+			session.cancel(u.auth)
+			if state == uploadErrored {
+				u.inFlight--
+			}
+			session.retries = 0
+			session.resetFailing()
+			session.setState(uploadNotStarted, nil)
+		}
+	})
+	return err
+}
+
+// Cancel stops an upload and removes it from the queue. The item's local
+// content is kept, but will not match the server until it is modified again.
+func (u *UploadManager) Cancel(id string) error {
+	err := errNoSession
+	u.do(func() {
+		if _, exists := u.sessions[id]; exists {
+			log.WithField("id", id).Warn("Upload cancelled by user.")
+			u.finishUpload(id)
+			err = nil
+		}
+	})
+	return err
+}
+
+// Prioritize moves an upload ahead of all other queued uploads.
+func (u *UploadManager) Prioritize(id string) error {
+	err := errNoSession
+	u.do(func() {
+		session, exists := u.sessions[id]
+		if !exists {
+			return
+		}
+		max := 0
+		for _, other := range u.sessions {
+			if other.Priority > max {
+				max = other.Priority
+			}
+		}
+		session.Priority = max + 1
+		u.persist(session)
+		err = nil
+	})
+	return err
 }
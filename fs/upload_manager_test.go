@@ -2,10 +2,15 @@ package fs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"testing"
@@ -39,7 +44,10 @@ func TestUploadDiskSerialization(t *testing.T) {
 		return json.Unmarshal(diskSession, &session)
 	}))
 
-	// kill the session before it gets uploaded
+	// kill the session before it gets uploaded (which removes its snapshot, so
+	// keep a copy of the content for the "restarted" session)
+	content, err := ioutil.ReadFile(session.Snapshot)
+	failOnErr(t, err)
 	fsCache.uploads.CancelUpload(session.ID)
 
 	// confirm that the file didn't get uploaded yet (just in case!)
@@ -55,6 +63,8 @@ func TestUploadDiskSerialization(t *testing.T) {
 	// into its db and confirm that the file gets uploaded
 	db, err := bolt.Open("test_upload_disk_serialization.db", 0644, nil)
 	failOnErr(t, err)
+	session.Snapshot, err = writeSnapshot(uploadDir(db), session.ID, nil, bytes.NewReader(content))
+	failOnErr(t, err)
 	db.Update(func(tx *bolt.Tx) error {
 		b, _ := tx.CreateBucket(bucketUploads)
 		payload, _ := json.Marshal(&session)
@@ -72,6 +82,242 @@ func TestUploadDiskSerialization(t *testing.T) {
 	}
 }
 
+// Upload sessions should upload a snapshot of the content saved to disk, which
+// is unaffected by later changes and removed once the upload is done.
+func TestUploadSnapshot(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	content := []byte("snapshot me")
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:      "upload-snapshot",
+		Name:    "upload_snapshot.txt",
+		Size:    uint64(len(content)),
+		ModTime: &now,
+		File:    &graph.File{Hashes: graph.Hashes{SHA1Hash: graph.SHA1Hash(&content)}},
+	})
+	inode.cache = fsCache
+	failOnErr(t, fsCache.InsertContent(inode.ID(), content))
+
+	session, err := NewUploadSession(inode, auth)
+	failOnErr(t, err)
+	failOnErr(t, fsCache.InsertContent(inode.ID(), []byte("Snapshot me")))
+	snapshot, err := session.readSnapshot(0, session.Size)
+	failOnErr(t, err)
+	if string(snapshot) != "snapshot me" {
+		t.Fatalf("Snapshot changed along with the file: \"%s\"\n", snapshot)
+	}
+	if chunk, _ := session.readSnapshot(9, 2); string(chunk) != "me" {
+		t.Fatalf("Read \"%s\" from the middle of the snapshot.\n", chunk)
+	}
+	if _, err = session.readSnapshot(9, 5); err == nil {
+		t.Fatal("Reading past the end of the snapshot did not fail.")
+	}
+
+	if session.Checksum != fsCache.Capabilities().Hash(&snapshot) {
+		t.Fatal("Upload checksum was not computed from the snapshot.")
+	}
+
+	session.removeSnapshot()
+	if _, err = session.readSnapshot(0, session.Size); err == nil {
+		t.Fatal("Snapshot was not removed.")
+	}
+}
+
+// New files are uploaded by their path, since they do not have an ID on the
+// server yet.
+func TestNewFileItemPath(t *testing.T) {
+	t.Parallel()
+	session := &UploadSession{ID: localID(), ParentID: "parent", Name: "new file.txt"}
+	if path := session.itemPath(); path != "/me/drive/items/parent:/new%20file.txt:" {
+		t.Fatalf("New file was uploaded to \"%s\".\n", path)
+	}
+	session.ID = "existing"
+	if path := session.itemPath(); path != "/me/drive/items/existing" {
+		t.Fatalf("Existing file was uploaded to \"%s\".\n", path)
+	}
+}
+
+// Interrupted upload sessions should continue from where the server says it
+// left off.
+func TestResumeOffset(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"expirationDateTime":"2099-01-01T00:00:00Z",` +
+			`"nextExpectedRanges":["20971520-"]}`))
+	}))
+	defer server.Close()
+
+	session := &UploadSession{
+		ID:                 "resume-offset",
+		Size:               50 * 1024 * 1024,
+		UploadURL:          server.URL,
+		ExpirationDateTime: time.Now().Add(time.Hour),
+	}
+	offset, err := session.resumeOffset()
+	failOnErr(t, err)
+	if offset != 20*1024*1024 {
+		t.Fatalf("Expected to resume at 20MB, got offset %d.\n", offset)
+	}
+
+	session.ExpirationDateTime = time.Now().Add(-time.Hour)
+	if _, err = session.resumeOffset(); err == nil {
+		t.Fatal("Resumed an expired upload session.")
+	}
+}
+
+// Empty files have no chunks to upload.
+func TestUploadEmptyChunk(t *testing.T) {
+	t.Parallel()
+	session := &UploadSession{ID: "empty-chunk", UploadURL: "http://localhost"}
+	if _, _, _, err := session.uploadChunk(auth, 0, DefaultChunkSize); err == nil {
+		t.Fatal("Uploaded a chunk of an empty file.")
+	}
+}
+
+// A chunk upload that is cut off partway through should continue from where the
+// server says it got to, without starting the file over.
+func TestResumeInterruptedChunk(t *testing.T) {
+	t.Parallel()
+	content := bytes.Repeat([]byte("resume me "), 500*1024)
+	var received []byte
+	var puts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprintf(w, `{"nextExpectedRanges":["%d-"]}`, len(received))
+			return
+		}
+		puts++
+		if puts == 1 {
+			// drop the connection after the first megabyte
+			chunk := make([]byte, 1024*1024)
+			n, _ := io.ReadFull(r.Body, chunk)
+			received = append(received, chunk[:n]...)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		expected := fmt.Sprintf("bytes %d-%d/%d", len(received), len(content)-1, len(content))
+		if r.Header.Get("Content-Range") != expected {
+			t.Errorf("Expected Content-Range \"%s\", got \"%s\"\n", expected,
+				r.Header.Get("Content-Range"))
+		}
+		rest, _ := ioutil.ReadAll(r.Body)
+		received = append(received, rest...)
+		fmt.Fprintf(w, `{"size":%d,"eTag":"1"}`, len(received))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "onedriver-resume")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	snapshot, err := writeSnapshot(dir, "resume-interrupted", nil, bytes.NewReader(content))
+	failOnErr(t, err)
+	session := &UploadSession{
+		ID:                 "resume-interrupted",
+		Size:               uint64(len(content)),
+		Snapshot:           snapshot,
+		UploadURL:          server.URL,
+		ExpirationDateTime: time.Now().Add(time.Hour),
+		SkipVerification:   true,
+	}
+	failOnErr(t, session.Upload(auth))
+	if puts != 2 || !bytes.Equal(received, content) {
+		t.Fatalf("Upload was not resumed correctly: %d requests, %d of %d bytes\n",
+			puts, len(received), len(content))
+	}
+	if sent := session.getSent(); sent != session.Size {
+		t.Fatalf("Progress was %d/%d after the upload finished.\n", sent, session.Size)
+	}
+}
+
+// Large files are sent a chunk at a time straight from their snapshot, each with
+// the length of the chunk.
+func TestUploadChunks(t *testing.T) {
+	t.Parallel()
+	content := bytes.Repeat([]byte("chunk me "), 100*1024)
+	var received []byte
+	var puts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprintf(w, `{"nextExpectedRanges":["%d-"]}`, len(received))
+			return
+		}
+		puts++
+		chunk, _ := ioutil.ReadAll(r.Body)
+		if r.ContentLength != int64(len(chunk)) || uint64(len(chunk)) > chunkAlign {
+			t.Errorf("Chunk had Content-Length %d, but was %d bytes.\n",
+				r.ContentLength, len(chunk))
+		}
+		received = append(received, chunk...)
+		fmt.Fprintf(w, `{"size":%d,"eTag":"1"}`, len(received))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "onedriver-chunks")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	snapshot, err := writeSnapshot(dir, "upload-chunks", nil, bytes.NewReader(content))
+	failOnErr(t, err)
+	session := &UploadSession{
+		ID:                 "upload-chunks",
+		Size:               uint64(len(content)),
+		Snapshot:           snapshot,
+		UploadURL:          server.URL,
+		ExpirationDateTime: time.Now().Add(time.Hour),
+		SkipVerification:   true,
+		chunkSize:          chunkAlign,
+	}
+	failOnErr(t, session.Upload(auth))
+	chunks := (len(content) + int(chunkAlign) - 1) / int(chunkAlign)
+	if puts != chunks || !bytes.Equal(received, content) {
+		t.Fatalf("Upload was not sent in chunks: %d requests, %d of %d bytes\n",
+			puts, len(received), len(content))
+	}
+}
+
+// Stopping an upload (like when its file is deleted) should interrupt the chunk
+// being sent instead of letting the stale content finish uploading.
+func TestStopUpload(t *testing.T) {
+	t.Parallel()
+	content := bytes.Repeat([]byte("stop me "), 1024*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"nextExpectedRanges":["0-"]}`)
+			return
+		}
+		<-r.Context().Done() // never finishes on its own
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "onedriver-stop")
+	failOnErr(t, err)
+	defer os.RemoveAll(dir)
+	snapshot, err := writeSnapshot(dir, "stop-upload", nil, bytes.NewReader(content))
+	failOnErr(t, err)
+	session := &UploadSession{
+		ID:                 "stop-upload",
+		Size:               uint64(len(content)),
+		Snapshot:           snapshot,
+		UploadURL:          server.URL,
+		ExpirationDateTime: time.Now().Add(time.Hour),
+		SkipVerification:   true,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Upload(auth)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	session.stop()
+	select {
+	case err := <-done:
+		if err == nil || session.getState() != uploadErrored {
+			t.Fatal("Stopped upload did not fail.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload was not interrupted when it was stopped.")
+	}
+}
+
 // Make sure that uploading the same file multiple times works exactly as it should.
 func TestRepeatedUploads(t *testing.T) {
 	t.Parallel()
@@ -91,3 +337,315 @@ func TestRepeatedUploads(t *testing.T) {
 		}
 	}
 }
+
+// Uploads in the queue can be listed, prioritized and cancelled.
+func TestUploadQueueControl(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open("test_upload_queue_control.db", 0644, nil)
+	failOnErr(t, err)
+	// long interval so that nothing actually gets uploaded
+	manager := NewUploadManager(time.Hour, db, auth)
+	manager.queue <- &UploadSession{ID: "first", Name: "first.txt"}
+	manager.queue <- &UploadSession{ID: "second", Name: "second.txt"}
+
+	failOnErr(t, manager.Prioritize("second"))
+	uploads := manager.List()
+	if len(uploads) != 2 || uploads[0].ID != "second" || uploads[0].State != "queued" {
+		t.Fatalf("Prioritized upload was not listed first: %+v\n", uploads)
+	}
+
+	failOnErr(t, manager.Cancel("second"))
+	if uploads = manager.List(); len(uploads) != 1 || uploads[0].ID != "first" {
+		t.Fatalf("Cancelled upload was still in queue: %+v\n", uploads)
+	}
+	if err := manager.Retry("second"); err != errNoSession {
+		t.Fatalf("Expected errNoSession retrying a cancelled upload, got %v\n", err)
+	}
+}
+
+// A file changed again right after its upload finished (but before the upload
+// loop noticed) should still have the finished upload recorded, and the new
+// upload should replace what was uploaded instead of conflicting with it.
+func TestQueueAfterComplete(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open("test_queue_after_complete.db", 0644, nil)
+	failOnErr(t, err)
+	manager := NewUploadManager(time.Hour, db, auth)
+	completed := make(map[string]*graph.DriveItem)
+	manager.OnComplete(func(id string, remote *graph.DriveItem) {
+		completed[id] = remote
+	})
+
+	localID := "local-queue-after-complete"
+	first := &UploadSession{ID: localID, Name: "first.txt", CTag: "old"}
+	manager.queue <- first
+	manager.do(func() { manager.inFlight++ }) // as if it was started
+	first.setUploaded(&graph.DriveItem{ID: "queue-after-complete", CTag: "uploaded"})
+	first.setState(uploadComplete, nil)
+	manager.queue <- &UploadSession{ID: localID, Name: "first.txt", CTag: "old"}
+
+	uploads := manager.List()
+	if remote := completed[localID]; remote == nil || remote.ID != "queue-after-complete" {
+		t.Fatalf("Finished upload was not recorded: %+v\n", completed)
+	}
+	if len(uploads) != 1 || uploads[0].ID != "queue-after-complete" {
+		t.Fatalf("New upload did not take the ID of the uploaded file: %+v\n", uploads)
+	}
+	manager.do(func() {
+		session := manager.sessions["queue-after-complete"]
+		if session.ifMatch() != "uploaded" {
+			t.Errorf("New upload would conflict with the finished one, If-Match: \"%s\"\n",
+				session.ifMatch())
+		}
+	})
+	failOnErr(t, manager.Cancel("queue-after-complete"))
+}
+
+// Moving an item that is queued for upload should keep its upload, under the
+// item's new name.
+func TestMoveUpload(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open("test_move_upload.db", 0644, nil)
+	failOnErr(t, err)
+	manager := NewUploadManager(time.Hour, db, auth)
+	manager.queue <- &UploadSession{ID: "moved", Name: "before.txt", ParentID: "a"}
+	manager.MoveUpload("moved", "after.txt", "b")
+	uploads := manager.List()
+	if len(uploads) != 1 || uploads[0].Name != "after.txt" {
+		t.Fatalf("Upload did not follow its item: %+v\n", uploads)
+	}
+	failOnErr(t, manager.Cancel("moved"))
+}
+
+// A file renamed right after it was written should end up on the server under
+// its new name, with the new content.
+func TestRenameDuringUpload(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "rename_during_upload.txt")
+	content := []byte("renamed while it was being uploaded")
+	failOnErr(t, ioutil.WriteFile(fname, []byte("initial content"), 0644))
+	inode, err := fsCache.GetPath("/onedriver_tests/rename_during_upload.txt", auth)
+	failOnErr(t, err)
+	failOnErr(t, fsCache.uploads.WaitUpload(inode.ID()))
+
+	failOnErr(t, ioutil.WriteFile(fname, content, 0644))
+	failOnErr(t, os.Rename(fname, filepath.Join(TestDir, "renamed_during_upload.txt")))
+	failOnErr(t, fsCache.uploads.WaitUpload(inode.ID()))
+
+	item, err := graph.GetItemPath("/onedriver_tests/renamed_during_upload.txt", auth)
+	failOnErr(t, err)
+	if item.ID != inode.ID() {
+		t.Fatalf("Renamed item has ID %s on the server, expected %s\n", item.ID, inode.ID())
+	}
+	remote, err := graph.GetItemContent(item.ID, auth)
+	failOnErr(t, err)
+	if !bytes.Equal(remote, content) {
+		t.Fatalf("Upload was lost in the rename - got \"%s\", wanted \"%s\"", remote, content)
+	}
+}
+
+// Uploads should not start until their file has stopped changing for the
+// upload delay.
+func TestUploadDelay(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open("test_upload_delay.db", 0644, nil)
+	failOnErr(t, err)
+	manager := NewUploadManager(10*time.Millisecond, db, auth)
+	manager.SetUploadDelay(time.Hour)
+	manager.queue <- &UploadSession{ID: "delayed", Name: "delayed.txt"}
+	time.Sleep(100 * time.Millisecond)
+	if uploads := manager.List(); len(uploads) != 1 || uploads[0].State != "queued" {
+		t.Fatalf("Upload started before the upload delay was up: %+v\n", uploads)
+	}
+	failOnErr(t, manager.Cancel("delayed"))
+}
+
+// Small files should be uploaded before large ones, and should not have to wait
+// for large ones to finish.
+func TestUploadOrder(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	manager := &UploadManager{
+		sessions: map[string]*UploadSession{
+			"bulk":     {ID: "bulk", Size: 20 << 30, queued: now.Add(-time.Hour)},
+			"newer":    {ID: "newer", Size: 10, queued: now},
+			"document": {ID: "document", Size: 10, queued: now.Add(-time.Minute)},
+			"urgent":   {ID: "urgent", Size: 10 << 20, queued: now, Priority: 1},
+		},
+		maxInFlight: 2,
+	}
+	order := []string{}
+	for _, session := range manager.sortedSessions() {
+		order = append(order, session.ID)
+	}
+	if got := fmt.Sprint(order); got != "[urgent document newer bulk]" {
+		t.Fatalf("Uploads were not sorted correctly: %s\n", got)
+	}
+
+	manager.inFlight = 1
+	if manager.canStart(manager.sessions["bulk"], 1) {
+		t.Fatal("Large uploads took up the last upload slot.")
+	}
+	if !manager.canStart(manager.sessions["document"], 1) {
+		t.Fatal("Small upload had to wait for a large one.")
+	}
+}
+
+// Paused uploads should not start or continue until they are resumed.
+func TestPauseUploads(t *testing.T) {
+	t.Parallel()
+	manager := &UploadManager{maxInFlight: 1, pause: newPauseGate()}
+	manager.Pause()
+	if manager.canStart(&UploadSession{ID: "paused"}, 0) {
+		t.Fatal("Upload started while uploads were paused.")
+	}
+
+	resumed := make(chan struct{})
+	go func() {
+		manager.pause.wait(context.Background())
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("Upload continued while uploads were paused.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	manager.Resume()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("Upload did not continue after uploads were resumed.")
+	}
+}
+
+// Chunk sizes must stay multiples of 320KiB no larger than 60MiB as they adapt.
+func TestAdaptChunkSize(t *testing.T) {
+	t.Parallel()
+	if size := alignChunkSize(1000 * 1000); size != 3*chunkAlign {
+		t.Fatalf("Expected 1MB to round down to 960KiB, got %d\n", size)
+	}
+	if size := adaptChunkSize(40*1024*1024, time.Second, false); size != maxChunkSize {
+		t.Fatalf("Fast chunks should grow to at most 60MiB, got %d\n", size)
+	}
+	if size := adaptChunkSize(DefaultChunkSize, 10*time.Second, false); size != DefaultChunkSize {
+		t.Fatalf("Chunks of a reasonable speed should stay the same size, got %d\n", size)
+	}
+	if size := adaptChunkSize(DefaultChunkSize, time.Second, true); size != DefaultChunkSize/2 {
+		t.Fatalf("Retried chunks should shrink, got %d\n", size)
+	}
+	if size := adaptChunkSize(chunkAlign, 2*time.Minute, false); size != chunkAlign {
+		t.Fatalf("Chunks should not shrink below 320KiB, got %d\n", size)
+	}
+}
+
+// With hash verification turned off, uploads should be accepted based on size
+// and eTag alone.
+func TestSkipVerification(t *testing.T) {
+	t.Parallel()
+	session := &UploadSession{ID: "skip-verification", Size: 5, SkipVerification: true}
+	uploaded := &graph.DriveItem{Size: 5, ETag: "1"}
+	if err := session.matchesUpload(uploaded, &graph.DriveItem{Size: 5, ETag: "1"}); err != nil {
+		t.Fatal("Upload with matching size and eTag was rejected:", err)
+	}
+	if session.matchesUpload(uploaded, &graph.DriveItem{Size: 5, ETag: "2"}) == nil {
+		t.Fatal("Upload replaced on the server by content of the same size was accepted.")
+	}
+	if session.verifyRemoteChecksum([]byte(`{"size":4,"eTag":"1"}`), auth) == nil {
+		t.Fatal("Upload with the wrong size was accepted.")
+	}
+	if session.verifyRemoteChecksum([]byte(`{"size":5}`), auth) == nil {
+		t.Fatal("Upload without an eTag was accepted.")
+	}
+}
+
+// Uploads should use the configured conflict behavior, and only be made
+// conditional on the item not changing remotely unless told to replace it.
+func TestConflictBehavior(t *testing.T) {
+	t.Parallel()
+	session := &UploadSession{ID: "conflict-behavior", CTag: "1", ConflictBehavior: ConflictFail}
+	if behavior := session.conflictBehavior(); behavior != ConflictFail {
+		t.Fatalf("Configured conflict behavior was ignored, got \"%s\".\n", behavior)
+	}
+	if tag := session.ifMatch(); tag != "1" {
+		t.Fatalf("Upload should be conditional on cTag \"1\", got \"%s\".\n", tag)
+	}
+	session = &UploadSession{ID: "conflict-behavior", CTag: "1"}
+	if behavior := session.conflictBehavior(); behavior != ConflictReplace {
+		t.Fatalf("Default conflict behavior should be replace, got \"%s\".\n", behavior)
+	}
+	if tag := session.ifMatch(); tag != "1" {
+		t.Fatalf("Upload should be conditional on cTag \"1\", got \"%s\".\n", tag)
+	}
+	session.ConflictBehavior = ConflictReplace
+	if tag := session.ifMatch(); tag != "" {
+		t.Fatalf("Upload with ConflictReplace should not be conditional, got \"%s\".\n", tag)
+	}
+}
+
+func TestConflictCopyName(t *testing.T) {
+	t.Parallel()
+	date := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	if name := conflictCopyName("notes.txt", 1, "laptop", date); name !=
+		"notes (conflicted copy from laptop, 2021-03-14).txt" {
+		t.Fatalf("Unexpected conflict copy name \"%s\".\n", name)
+	}
+	if name := conflictCopyName("Makefile", 3, "laptop", date); name !=
+		"Makefile (conflicted copy 3 from laptop, 2021-03-14)" {
+		t.Fatalf("Unexpected conflict copy name \"%s\".\n", name)
+	}
+}
+
+// With ConflictPrompt, files with a conflict should keep their local version
+// until the user picks one.
+func TestPromptConflict(t *testing.T) {
+	t.Parallel()
+	cache := NewCache(auth, "test_prompt_conflict.db", &Options{ConflictStrategy: ConflictPrompt})
+	root, err := cache.GetPath("/", auth)
+	failOnErr(t, err)
+	file := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "prompt-conflict",
+		Name:   "prompt_conflict.txt",
+		Parent: &graph.DriveItemParent{ID: root.ID()},
+		File:   &graph.File{},
+	})
+	cache.InsertChild(root.ID(), file)
+
+	cache.uploadConflict(&UploadSession{ID: file.ID(), Name: file.Name()})
+	if !cache.hasLocalChanges(file) {
+		t.Fatal("File waiting for a version to be picked could be overwritten.")
+	}
+	conflicts := cache.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Path != "/prompt_conflict.txt" {
+		t.Fatalf("Unexpected conflicts: %+v\n", conflicts)
+	}
+	if err = cache.ResolveConflict(file.ID(), "neither", auth); err == nil {
+		t.Fatal("Resolving a conflict with an unknown choice should fail.")
+	}
+	if !cache.hasConflict(file.ID()) {
+		t.Fatal("Failing to resolve a conflict should not forget it.")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+	policy := RetryPolicy{MaxBackoff: time.Minute, Budget: time.Hour}
+	if wait := policy.backoff(2 * time.Minute); wait != time.Minute {
+		t.Fatalf("Backoff was not capped, got %s\n", wait)
+	}
+	if wait := (RetryPolicy{}).backoff(2 * time.Minute); wait != 2*time.Minute {
+		t.Fatalf("Backoff was capped without a MaxBackoff, got %s\n", wait)
+	}
+
+	session := &UploadSession{ID: "retry-policy", retry: policy}
+	if session.outOfBudget() {
+		t.Fatal("Upload ran out of retry budget as soon as it started failing.")
+	}
+	session.failing = time.Now().Add(-2 * time.Hour)
+	if !session.outOfBudget() {
+		t.Fatal("Upload failing for longer than its budget was not out of budget.")
+	}
+	session.retry.Budget = 0
+	if session.outOfBudget() {
+		t.Fatal("Upload without a retry budget ran out of it.")
+	}
+}
@@ -2,12 +2,15 @@ package fs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,10 +18,33 @@ import (
 
 	"github.com/jstaf/onedriver/fs/graph"
 	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 )
 
-// 10MB is the recommended upload size according to the graph API docs
-const chunkSize uint64 = 10 * 1024 * 1024
+// Upload chunks must be a multiple of 320KiB, and no more than 60MiB. 10MiB is
+// the recommended size according to the graph API docs.
+// https://docs.microsoft.com/en-us/graph/api/driveitem-createuploadsession#upload-bytes-to-the-upload-session
+const (
+	chunkAlign       uint64 = 320 * 1024
+	maxChunkSize     uint64 = 60 * 1024 * 1024
+	DefaultChunkSize uint64 = 10 * 1024 * 1024
+)
+
+// Adaptive chunk sizes double when a chunk is uploaded faster than
+// fastChunkTime, and halve when one takes longer than slowChunkTime or has to
+// be retried.
+const (
+	fastChunkTime = 5 * time.Second
+	slowChunkTime = time.Minute
+)
+
+// chunkResumeAttempts is how many times an upload session tries to pick up
+// where it left off after a chunk fails to upload, before giving up.
+const chunkResumeAttempts = 5
+
+// maxThrottleRetries is how many more times a small upload is tried after being
+// throttled, on top of the retries made by graph.Put itself.
+const maxThrottleRetries = 5
 
 // upload states
 const (
@@ -26,27 +52,55 @@ const (
 	uploadStarted
 	uploadComplete
 	uploadErrored
+	uploadFailed // errored too many times, waiting for the user to retry/cancel
 )
 
 // UploadSession contains a snapshot of the file we're uploading. We have to
 // take the snapshot or the file may have changed on disk during upload (which
-// would break the upload). It is not recommended to directly deserialize into
-// this structure from API responses in case Microsoft ever adds a size, data,
+// would break the upload). The snapshot is a temporary file, so that uploads
+// are streamed from disk a chunk at a time instead of keeping a second copy of
+// the file in memory. It is not recommended to directly deserialize into this
+// structure from API responses in case Microsoft ever adds a size, snapshot,
 // or modTime field to the response.
 type UploadSession struct {
-	ID                 string    `json:"id"`
-	Name               string    `json:"name"`
-	UploadURL          string    `json:"uploadUrl"`
-	ExpirationDateTime time.Time `json:"expirationDateTime"`
-	Size               uint64    `json:"size,omitempty"`
-	Data               []byte    `json:"data,omitempty"`
-	Checksum           string    `json:"checksum,omitempty"`
-	ModTime            time.Time `json:"modTime,omitempty"`
+	ID                 string           `json:"id"`
+	DriveID            string           `json:"driveId,omitempty"`
+	Name               string           `json:"name"`
+	ParentID           string           `json:"parentId,omitempty"`
+	UploadURL          string           `json:"uploadUrl"`
+	ExpirationDateTime time.Time        `json:"expirationDateTime"`
+	Size               uint64           `json:"size,omitempty"`
+	Snapshot           string           `json:"snapshot,omitempty"` // path of the content snapshot
+	Checksum           string           `json:"checksum,omitempty"`
+	ModTime            time.Time        `json:"modTime,omitempty"`
+	Priority           int              `json:"priority,omitempty"`
+	SkipVerification   bool             `json:"skipVerification,omitempty"`
+	CTag               string           `json:"cTag,omitempty"` // of the content when it was last synced
+	ConflictBehavior   ConflictBehavior `json:"conflictBehavior,omitempty"`
 	retries            int
+	queued             time.Time // when the content was last replaced, see SetUploadDelay
+	chunkSize          uint64    // DefaultChunkSize if 0, see SetChunkSize
+	adaptive           bool      // whether chunkSize adapts to the connection
+	pause              *pauseGate
+	cipher             *contentCipher // encrypts the snapshot, may be nil
+
+	retry   RetryPolicy // see SetRetryPolicy
+	failing time.Time   // when the upload started failing, guarded by mutex
+
+	// persist saves the session, so that it can be resumed after a restart
+	// once the API upload session has been created. May be nil.
+	persist func(*UploadSession)
 
 	mutex sync.Mutex
 	state int
 	error // embedded error tracks errors that killed an upload
+
+	sent     uint64           // how much of the content has been sent so far
+	uploaded *graph.DriveItem // the item on the server once the upload is complete
+	moved    *itemLocation    // where the item was moved during the upload, see move
+
+	ctx   context.Context // cancelled by stop, see context
+	abort context.CancelFunc
 }
 
 // MarshalJSON implements a custom JSON marshaler to avoid race conditions
@@ -72,6 +126,17 @@ type FileSystemInfo struct {
 	LastModifiedDateTime time.Time `json:"lastModifiedDateTime,omitempty"`
 }
 
+// itemPath returns the API resource path of the item being uploaded. New files
+// that do not have an ID on the server yet are addressed by their name in their
+// parent folder instead, which creates them when the upload completes.
+func (u *UploadSession) itemPath() string {
+	drive := graph.Drive{ID: u.DriveID}
+	if isLocalID(u.ID) {
+		return fmt.Sprintf("%s:/%s:", drive.IDPath(u.ParentID), url.PathEscape(u.Name))
+	}
+	return drive.IDPath(u.ID)
+}
+
 // isLargeSession returns whether or not this is a formal upload session that
 // must be registered with the API (over 4MB, according to the documentation).
 func (u *UploadSession) isLargeSession() bool {
@@ -94,96 +159,512 @@ func (u *UploadSession) setState(state int, err error) error {
 	return err
 }
 
-// NewUploadSession wraps an upload of a file into an UploadSession struct
-// responsible for performing uploads for a file.
-func NewUploadSession(inode *Inode, auth *graph.Auth) (*UploadSession, error) {
-	id, err := inode.RemoteID(auth)
-	if err != nil || isLocalID(id) {
+// setSent records how much of the content has been sent.
+func (u *UploadSession) setSent(sent uint64) {
+	u.mutex.Lock()
+	u.sent = sent
+	u.mutex.Unlock()
+}
+
+// getSent returns how much of the content has been sent.
+func (u *UploadSession) getSent() uint64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.sent
+}
+
+// context returns the context of the upload, which is cancelled when the
+// upload is stopped.
+func (u *UploadSession) context() context.Context {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.ctx == nil {
+		u.ctx, u.abort = context.WithCancel(context.Background())
+	}
+	return u.ctx
+}
+
+// stop abandons the upload for good, like when the file was deleted or its
+// content replaced: whatever the upload is doing is interrupted, and nothing
+// more of the content is sent. Unlike cancel, the session cannot be retried.
+func (u *UploadSession) stop() {
+	u.context()
+	u.mutex.Lock()
+	u.abort()
+	u.mutex.Unlock()
+}
+
+// sleep waits for d, returning early with an error if the upload is stopped.
+func (u *UploadSession) sleep(d time.Duration) error {
+	ctx := u.context()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// outOfBudget marks the upload as failing (if it was not already), and returns
+// whether it has been failing for longer than its RetryPolicy allows.
+func (u *UploadSession) outOfBudget() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.failing.IsZero() {
+		u.failing = time.Now()
+	}
+	return u.retry.Budget > 0 && time.Since(u.failing) > u.retry.Budget
+}
+
+// failingFor returns how long the upload has been failing, or 0 if it is not.
+func (u *UploadSession) failingFor() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.failing.IsZero() {
+		return 0
+	}
+	return time.Since(u.failing)
+}
+
+// resetFailing records that the upload is no longer failing.
+func (u *UploadSession) resetFailing() {
+	u.mutex.Lock()
+	u.failing = time.Time{}
+	u.mutex.Unlock()
+}
+
+// setUploaded records what the item looks like on the server after the upload.
+func (u *UploadSession) setUploaded(remote *graph.DriveItem) {
+	u.mutex.Lock()
+	u.uploaded = remote
+	u.mutex.Unlock()
+}
+
+// getUploaded returns what the item looks like on the server after the upload,
+// once complete.
+func (u *UploadSession) getUploaded() *graph.DriveItem {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.uploaded
+}
+
+// itemLocation is where an item is on the server.
+type itemLocation struct {
+	name     string
+	parentID string
+}
+
+// move records that the item was renamed or moved after it was queued for
+// upload. Name and ParentID are left alone until the upload is no longer
+// running (see applyMove), and a running upload finds out with movedTo.
+func (u *UploadSession) move(name string, parentID string) {
+	u.mutex.Lock()
+	u.moved = &itemLocation{name: name, parentID: parentID}
+	u.mutex.Unlock()
+}
+
+// movedTo returns where the item was moved to since the upload started, if it
+// was.
+func (u *UploadSession) movedTo() (itemLocation, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.moved == nil {
+		return itemLocation{}, false
+	}
+	return *u.moved, true
+}
+
+// applyMove updates Name and ParentID after the item was moved, returning
+// whether it was. Must not be called while the upload is running.
+func (u *UploadSession) applyMove() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.moved == nil {
+		return false
+	}
+	u.Name = u.moved.name
+	u.ParentID = u.moved.parentID
+	u.moved = nil
+	return true
+}
+
+// retarget puts an uploaded item back where it was moved to during the upload,
+// in case the server committed the content where the item used to be. response
+// is the server's response to the final request of the upload.
+func (u *UploadSession) retarget(response []byte, auth *graph.Auth) {
+	dest, moved := u.movedTo()
+	remote := &graph.DriveItem{}
+	if !moved || json.Unmarshal(response, remote) != nil || remote.ID == "" ||
+		remote.Parent == nil {
+		return
+	}
+	if remote.Name == dest.name && remote.Parent.ID == dest.parentID {
+		return
+	}
+	log.WithFields(log.Fields{
+		"id":        u.ID,
+		"name":      remote.Name,
+		"parentID":  remote.Parent.ID,
+		"newName":   dest.name,
+		"newParent": dest.parentID,
+	}).Info("Item was moved while it was being uploaded, moving the upload after it.")
+	err := graph.Drive{ID: u.DriveID}.Rename(remote.ID, dest.name, dest.parentID, auth)
+	if err != nil {
 		log.WithFields(log.Fields{
-			"id":   id,
-			"name": inode.Name(),
-			"err":  err,
-		}).Errorf("Could not obtain remote ID for upload.")
-		return nil, err
+			"id":  u.ID,
+			"err": err,
+		}).Error("Could not move uploaded item to where it was moved during the upload.")
+	}
+}
+
+// conflictBehavior returns the conflictBehavior to upload with. Content that
+// changed on the server since it was last synced is not replaced unless
+// ConflictReplace was configured, see ifMatch.
+func (u *UploadSession) conflictBehavior() ConflictBehavior {
+	if u.ConflictBehavior != "" {
+		return u.ConflictBehavior
 	}
+	return ConflictReplace
+}
+
+// ifMatch returns the cTag the item must still have on the server for the
+// upload to go ahead, or "" to upload regardless. If someone else changed the
+// content in the meantime, the upload fails with graph.ErrPreconditionFailed
+// instead of overwriting their changes.
+func (u *UploadSession) ifMatch() string {
+	if u.ConflictBehavior == ConflictReplace {
+		return ""
+	}
+	return u.CTag
+}
+
+// follow makes an upload that replaces a completed one build on what it
+// uploaded: new files now have an ID on the server, and the content to replace
+// is the uploaded one.
+func (u *UploadSession) follow(remote *graph.DriveItem) {
+	if remote == nil {
+		return
+	}
+	if isLocalID(u.ID) && remote.ID != "" {
+		u.ID = remote.ID
+	}
+	if remote.CTag != "" {
+		u.CTag = remote.CTag
+	}
+}
+
+// alignChunkSize rounds an upload chunk size down to a size the API accepts.
+func alignChunkSize(size uint64) uint64 {
+	if size > maxChunkSize {
+		size = maxChunkSize
+	}
+	if size < chunkAlign {
+		return chunkAlign
+	}
+	return size - size%chunkAlign
+}
+
+// adaptChunkSize picks the size of the next chunk of an upload from how long
+// the last one took, and whether it had to be retried.
+func adaptChunkSize(size uint64, elapsed time.Duration, retried bool) uint64 {
+	if retried || elapsed > slowChunkTime {
+		return alignChunkSize(size / 2)
+	} else if elapsed < fastChunkTime {
+		return alignChunkSize(size * 2)
+	}
+	return size
+}
 
+// progressReader records the progress of an upload as its content is read by
+// the HTTP client, from offset up to end.
+type progressReader struct {
+	io.Reader
+	session *UploadSession
+	offset  uint64
+	end     uint64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.offset += uint64(n)
+	r.session.setSent(r.offset)
+	return n, err
+}
+
+// Len returns how much is left to read, which tells the HTTP client the length
+// of the request.
+func (r *progressReader) Len() int {
+	return int(r.end - r.offset)
+}
+
+// NewUploadSession wraps an upload of a file into an UploadSession struct
+// responsible for performing uploads for a file. Files that are new do not need
+// an ID on the server first, they are uploaded by path and get one once the
+// upload completes (see itemPath).
+func NewUploadSession(inode *Inode, auth *graph.Auth) (*UploadSession, error) {
 	inode.mutex.RLock()
 	defer inode.mutex.RUnlock()
 
 	// create a generic session for all files
 	session := UploadSession{
 		ID:      inode.DriveItem.ID,
+		DriveID: inode.cache.Drive().ID,
 		Name:    inode.DriveItem.Name,
 		Size:    inode.DriveItem.Size,
-		Data:    make([]byte, inode.DriveItem.Size),
 		ModTime: *inode.DriveItem.ModTime,
+
+		CTag:             inode.DriveItem.CTag,
+		ConflictBehavior: inode.cache.opts.ConflictBehavior,
+		SkipVerification: inode.cache.opts.SkipHashVerification,
+	}
+	if inode.DriveItem.Parent != nil {
+		session.ParentID = inode.DriveItem.Parent.ID
+	}
+	if isLocalID(session.ID) && (session.ParentID == "" || isLocalID(session.ParentID)) {
+		log.WithFields(log.Fields{
+			"id":       session.ID,
+			"name":     session.Name,
+			"parentID": session.ParentID,
+		}).Error("Cannot upload a new file into a folder that is not on the server.")
+		return nil, errors.New("parent folder has no remote ID")
+	}
+	if inode.hydration != nil || inode.cache.getHydration(session.ID) != nil {
+		log.WithFields(log.Fields{
+			"id":   inode.DriveItem.ID,
+			"name": inode.DriveItem.Name,
+		}).Error("Cannot upload a file that was only partly downloaded.")
+		return nil, errors.New("content was only partly downloaded")
 	}
-	if inode.data == nil {
+	// open or not, the content is in the cache
+	session.cipher = inode.cache.cipher
+	content, err := inode.cache.openReader(inode.cache.contentPath(session.ID))
+	if err != nil {
 		log.WithFields(log.Fields{
 			"id":   inode.DriveItem.ID,
 			"name": inode.DriveItem.Name,
-		}).Error("Tried to dereference a nil pointer.")
-		return nil, errors.New("inode data was nil")
+			"err":  err,
+		}).Error("File has no content to upload.")
+		return nil, err
 	}
-	copy(session.Data, *inode.data)
+	defer content.Close()
 
-	if inode.DriveItem.File.Hashes.SHA1Hash != "" {
-		session.Checksum = inode.DriveItem.File.Hashes.SHA1Hash
-	} else if inode.DriveItem.File.Hashes.QuickXorHash != "" {
-		session.Checksum = inode.DriveItem.File.Hashes.QuickXorHash
-	} else {
+	if session.Snapshot, err = writeSnapshot(uploadDir(inode.cache.db), session.ID,
+		session.cipher, io.LimitReader(content, int64(session.Size))); err != nil {
 		log.WithFields(log.Fields{
 			"id":   inode.DriveItem.ID,
 			"name": inode.DriveItem.Name,
-		}).Error("both inode checksums were nil!")
-		return nil, errors.New("both inode checksums were nil")
+			"err":  err,
+		}).Error("Could not snapshot file content for upload.")
+		return nil, err
+	}
+	if !session.SkipVerification {
+		// the upload is checked against the content actually being uploaded,
+		// hashed the way the drive hashes it (QuickXorHash on business drives),
+		// instead of whatever hashes the inode happens to have
+		if session.Checksum, _, err = inode.cache.hashFile(session.Snapshot); err != nil {
+			session.removeSnapshot()
+			return nil, err
+		}
 	}
 	return &session, nil
 }
 
+// uploadDir returns the directory that holds the content snapshots of the
+// uploads of the cache using db.
+func uploadDir(db *bolt.DB) string {
+	return db.Path() + ".uploads"
+}
+
+// writeSnapshot saves a copy of the content of an item to upload in dir,
+// encrypted with cipher, and returns its path.
+func writeSnapshot(dir string, id string, cipher *contentCipher, content io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(dir, id+"-")
+	if err != nil {
+		return "", err
+	}
+	snapshot, err := cipher.wrap(file, true)
+	if err == nil {
+		_, err = snapshot.readFrom(content, false)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// removeSnapshot deletes the content snapshot of an upload once it is no longer
+// needed. An upload still reading from it can finish, since it keeps the file
+// open.
+func (u *UploadSession) removeSnapshot() {
+	if u.Snapshot != "" {
+		os.Remove(u.Snapshot)
+	}
+}
+
+// openSnapshot opens the content to upload for reading a chunk at a time. The
+// caller must close it.
+func (u *UploadSession) openSnapshot() (*contentFile, error) {
+	file, err := u.cipher.openFile(u.Snapshot, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if size, err := file.Size(); err != nil || size < u.Size {
+		file.Close()
+		return nil, fmt.Errorf("upload snapshot is shorter than the upload (%d bytes)", u.Size)
+	}
+	return file, nil
+}
+
+// readSnapshot reads length bytes of the content to upload, starting at offset.
+func (u *UploadSession) readSnapshot(offset uint64, length uint64) ([]byte, error) {
+	file, err := u.cipher.openFile(u.Snapshot, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content := make([]byte, length)
+	if n, err := file.ReadAt(content, int64(offset)); uint64(n) < length {
+		return nil, fmt.Errorf("could not read upload snapshot: %v", err)
+	}
+	return content, nil
+}
+
+// getUploadURL returns the URL of the API upload session, and when it expires.
+func (u *UploadSession) getUploadURL() (string, time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.UploadURL, u.ExpirationDateTime
+}
+
+// setUploadURL records the URL of the API upload session, and when it expires.
+func (u *UploadSession) setUploadURL(url string, expires time.Time) {
+	u.mutex.Lock()
+	u.UploadURL = url
+	u.ExpirationDateTime = expires
+	u.mutex.Unlock()
+}
+
 // cancel the upload session by deleting the temp file at the endpoint.
 func (u *UploadSession) cancel(auth *graph.Auth) {
 	// is it an actual API upload session?
-	if u.isLargeSession() {
-		state := u.getState()
-		if state == uploadStarted || state == uploadErrored {
-			// dont care about result, this is purely us being polite to the server
-			go graph.Delete(u.UploadURL, auth)
-		}
+	url, _ := u.getUploadURL()
+	if u.isLargeSession() && url != "" && u.getState() != uploadComplete {
+		// dont care about result, this is purely us being polite to the server
+		go graph.Delete(url, auth)
+		u.setUploadURL("", time.Time{})
 	}
 }
 
+// resumeOffset asks the server how much of the file it already has from a
+// previous attempt at this upload session, and returns the offset to continue
+// from. https://docs.microsoft.com/en-us/graph/api/driveitem-createuploadsession#resuming-an-in-progress-upload
+func (u *UploadSession) resumeOffset() (uint64, error) {
+	url, expires := u.getUploadURL()
+	if url == "" || !time.Now().Before(expires) {
+		return 0, errors.New("upload session has expired")
+	}
+	// no Authorization header, like uploadChunk
+	request, err := http.NewRequestWithContext(u.context(), "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("HTTP %d while checking upload session", resp.StatusCode)
+	}
+	var status struct {
+		NextExpectedRanges []string `json:"nextExpectedRanges"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+	if len(status.NextExpectedRanges) == 0 {
+		return 0, errors.New("server does not expect any more content")
+	}
+	// ranges look like "12345-" or "12345-67890"
+	start := strings.SplitN(status.NextExpectedRanges[0], "-", 2)[0]
+	offset, err := strconv.ParseUint(start, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if offset >= u.Size {
+		return 0, fmt.Errorf("server expects content at %d, past the end of the file", offset)
+	}
+	return offset, nil
+}
+
+// contentReader returns a reader for the content of a small upload, which
+// shares the bandwidth limit with other transfers.
+func (u *UploadSession) contentReader() (io.Reader, error) {
+	content, err := u.readSnapshot(0, u.Size)
+	if err != nil {
+		return nil, err
+	}
+	u.setSent(0)
+	progress := &progressReader{Reader: bytes.NewReader(content), session: u, end: u.Size}
+	return graph.TransferReader(progress, graph.Upload, u.ID, graph.PriorityBackground), nil
+}
+
 // Internal method used for uploading individual chunks of a DriveItem. We have
 // to make things this way because the internal Put func doesn't work all that
 // well when we need to add custom headers. Will return without an error if
 // irrespective of HTTP status (errors are reserved for stuff that prevented
-// the HTTP request at all).
-func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, int, error) {
-	if u.UploadURL == "" {
-		return nil, -1, errors.New("UploadSession UploadURL cannot be empty")
+// the HTTP request at all). The chunk is up to length bytes long.
+func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64, length uint64) ([]byte, int, http.Header, error) {
+	url, _ := u.getUploadURL()
+	if url == "" {
+		return nil, -1, nil, errors.New("UploadSession UploadURL cannot be empty")
 	}
 
-	// how much of the file are we going to upload?
-	end := offset + chunkSize
-	var reqChunkSize uint64
+	// how much of the file are we going to upload? (empty files have no
+	// chunks, and are created without an upload session)
+	if offset >= u.Size {
+		return nil, -1, nil, errors.New("offset must be less than DriveItem size")
+	}
+	end := offset + length
 	if end > u.Size {
 		end = u.Size
-		reqChunkSize = end - offset + 1
 	}
-	if offset > u.Size {
-		return nil, -1, errors.New("offset cannot be larger than DriveItem size")
+
+	// the chunk is streamed from the snapshot as it is sent, so that no more
+	// than a buffer's worth of it is in memory at once
+	snapshot, err := u.openSnapshot()
+	if err != nil {
+		return nil, -1, nil, err
 	}
+	defer snapshot.Close()
 
 	auth.Refresh()
 
 	client := &http.Client{}
-	request, _ := http.NewRequest(
+	request, _ := http.NewRequestWithContext(
+		u.context(),
 		"PUT",
-		u.UploadURL,
-		bytes.NewReader((u.Data)[offset:end]),
+		url,
+		graph.TransferReader(&progressReader{
+			Reader:  io.NewSectionReader(snapshot, int64(offset), int64(end-offset)),
+			session: u,
+			offset:  offset,
+			end:     end,
+		}, graph.Upload, u.ID, graph.PriorityBackground),
 	)
+	request.ContentLength = int64(end - offset)
 	// no Authorization header - it will throw a 401 if present
-	request.Header.Add("Content-Length", strconv.Itoa(int(reqChunkSize)))
 	frags := fmt.Sprintf("bytes %d-%d/%d", offset, end-1, u.Size)
 	log.WithField("id", u.ID).Info("Uploading ", frags)
 	request.Header.Add("Content-Range", frags)
@@ -191,107 +672,282 @@ func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, in
 	resp, err := client.Do(request)
 	if err != nil {
 		// this is a serious error, not simply one with a non-200 return code
-		return nil, -1, err
+		return nil, -1, nil, err
 	}
 	defer resp.Body.Close()
 	response, _ := ioutil.ReadAll(resp.Body)
-	return response, resp.StatusCode, nil
+	return response, resp.StatusCode, resp.Header, nil
 }
 
+// How many times and how long to wait between fetching an uploaded item's
+// metadata when the server did not include its hashes in the upload response.
+const (
+	hashPollAttempts = 5
+	hashPollInterval = 2 * time.Second
+)
+
 // verifyRemoteChecksum confirms that the newly-uploaded remote file matches the
-// local checksum. Returns false if there is a mismatch.
-func (u *UploadSession) verifyRemoteChecksum(response []byte) error {
-	remote := graph.DriveItem{}
-	if err := json.Unmarshal(response, &remote); err != nil {
+// local checksum. The final upload response sometimes lacks the item's hashes,
+// in which case we poll the item's metadata until they show up. If they never
+// do, the upload is accepted as long as the size matches and the item has not
+// changed (same eTag) since it was uploaded. With SkipVerification, only the
+// size and eTag are checked, against the item's current metadata.
+func (u *UploadSession) verifyRemoteChecksum(response []byte, auth *graph.Auth) error {
+	remote := &graph.DriveItem{}
+	if err := json.Unmarshal(response, remote); err != nil {
 		return u.setState(uploadErrored, err)
 	}
+	uploaded := remote
+	id := u.ID
+	if isLocalID(id) {
+		// a new file, which only got an ID from the upload
+		id = uploaded.ID
+	}
+	if u.SkipVerification {
+		if err := u.matchesUpload(uploaded, uploaded); err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		// the item could have been replaced by content of the same size since
+		current, err := graph.Drive{ID: u.DriveID}.GetItem(id, auth)
+		if err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		if err = u.matchesUpload(uploaded, current); err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		u.setUploaded(uploaded)
+		return u.setState(uploadComplete, nil)
+	}
+
+	for i := 0; i < hashPollAttempts && !remote.HasHashes(); i++ {
+		log.WithFields(log.Fields{
+			"id":      u.ID,
+			"name":    u.Name,
+			"attempt": i + 1,
+		}).Debug("Upload response did not include hashes, fetching item metadata.")
+		if err := u.sleep(hashPollInterval); err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		item, err := graph.Drive{ID: u.DriveID}.GetItem(id, auth)
+		if err != nil {
+			if graph.IsOffline(err) {
+				return u.setState(uploadErrored, err)
+			}
+			continue
+		}
+		remote = item
+	}
+
+	if !remote.HasHashes() {
+		if remote.Size == u.Size && remote.ETag != "" && remote.ETag == uploaded.ETag {
+			log.WithFields(log.Fields{
+				"id":   u.ID,
+				"name": u.Name,
+				"size": u.Size,
+				"etag": remote.ETag,
+			}).Warn("Server never reported hashes for uploaded file, " +
+				"accepting upload since size and eTag match.")
+			u.setUploaded(remote)
+			return u.setState(uploadComplete, nil)
+		}
+		return u.setState(uploadErrored, errors.New("server did not report remote checksum"))
+	}
 	if !remote.VerifyChecksum(u.Checksum) {
 		return u.setState(uploadErrored, errors.New("remote checksum did not match"))
 	}
+	u.setUploaded(remote)
 	return u.setState(uploadComplete, nil)
 }
 
+// matchesUpload checks that remote (the item as the server has it) is what was
+// uploaded, going by its size and eTag.
+func (u *UploadSession) matchesUpload(uploaded *graph.DriveItem, remote *graph.DriveItem) error {
+	if remote.Size != u.Size || remote.ETag == "" || remote.ETag != uploaded.ETag {
+		return fmt.Errorf("uploaded %d bytes (eTag \"%s\"), but the server has %d (eTag \"%s\")",
+			u.Size, uploaded.ETag, remote.Size, remote.ETag)
+	}
+	return nil
+}
+
 // Upload copies the file's contents to the server. Should only be called as a
 // goroutine, or it can potentially block for a very long time. The uploadSession.error
 // field contains errors to be handled if called as a goroutine.
 func (u *UploadSession) Upload(auth *graph.Auth) error {
 	log.WithField("id", u.ID).Debug("Uploading file.")
 	u.setState(uploadStarted, nil)
+	ctx := u.context()
+	if err := ctx.Err(); err != nil {
+		return u.setState(uploadErrored, err)
+	}
 	if !u.isLargeSession() {
 		// small files handled in this block
-		remote, err := graph.Put(
-			fmt.Sprintf("/me/drive/items/%s/content", u.ID),
-			auth,
-			bytes.NewReader(u.Data),
-		)
+		content, err := u.contentReader()
+		if err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		resource := u.itemPath() + "/content?@microsoft.graph.conflictBehavior=" +
+			string(u.conflictBehavior())
+		remote, err := graph.PutIfMatch(resource, auth, content, u.ifMatch())
+		for attempt := 0; attempt < maxThrottleRetries; attempt++ {
+			wait, throttled := graph.IsThrottled(err)
+			if !throttled {
+				break
+			}
+			log.WithFields(log.Fields{
+				"id":   u.ID,
+				"name": u.Name,
+				"wait": wait,
+			}).Warn("Throttled by the server, retrying upload later.")
+			if err = u.sleep(wait); err != nil {
+				break
+			}
+			if content, err = u.contentReader(); err == nil {
+				remote, err = graph.PutIfMatch(resource, auth, content, u.ifMatch())
+			}
+		}
 		if err != nil && strings.Contains(err.Error(), "resourceModified") {
 			// retry the request after a second, likely the server is having issues
-			time.Sleep(time.Second)
-			remote, err = graph.Put(
-				fmt.Sprintf("/me/drive/items/%s/content", u.ID),
-				auth,
-				bytes.NewReader(u.Data),
-			)
+			if err = u.sleep(time.Second); err == nil {
+				content, err = u.contentReader()
+			}
+			if err == nil {
+				remote, err = graph.PutIfMatch(resource, auth, content, u.ifMatch())
+			}
 		}
 		if err != nil {
 			return u.setState(uploadErrored, err)
 		}
-		return u.verifyRemoteChecksum(remote)
-	}
-
-	// must create a formal upload session with the API for large sessions
-	sessionPostData, _ := json.Marshal(UploadSessionPost{
-		ConflictBehavior: "replace",
-		FileSystemInfo: FileSystemInfo{
-			LastModifiedDateTime: u.ModTime,
-		},
-	})
-	resp, err := graph.Post(
-		fmt.Sprintf("/me/drive/items/%s/createUploadSession", u.ID),
-		auth,
-		bytes.NewReader(sessionPostData),
-	)
-	if err != nil {
-		return u.setState(uploadErrored, err)
+		return u.finish(remote, auth)
 	}
-	// populate UploadURL/expiration - we unmarshal into a fresh session here
-	// just in case the API does something silly at a later date and overwrites
-	// a field it shouldn't.
-	tmp := UploadSession{}
-	if err = json.Unmarshal(resp, &tmp); err != nil {
-		return u.setState(uploadErrored, err)
+
+	// a session left over from before a restart can pick up where it left off
+	var offset uint64
+	var resp []byte
+	var err error
+	if url, _ := u.getUploadURL(); url != "" {
+		if offset, err = u.resumeOffset(); err == nil {
+			log.WithFields(log.Fields{
+				"id":     u.ID,
+				"name":   u.Name,
+				"offset": offset,
+			}).Info("Resuming upload session.")
+		} else {
+			log.WithFields(log.Fields{
+				"id":   u.ID,
+				"name": u.Name,
+				"err":  err,
+			}).Warn("Could not resume upload session, starting over.")
+			u.cancel(auth)
+			offset = 0
+		}
+	}
+
+	if url, _ := u.getUploadURL(); url == "" {
+		// must create a formal upload session with the API for large sessions
+		sessionPostData, _ := json.Marshal(UploadSessionPost{
+			ConflictBehavior: string(u.conflictBehavior()),
+			FileSystemInfo: FileSystemInfo{
+				LastModifiedDateTime: u.ModTime,
+			},
+		})
+		resp, err = graph.PostIfMatch(
+			u.itemPath()+"/createUploadSession",
+			auth,
+			bytes.NewReader(sessionPostData),
+			u.ifMatch(),
+		)
+		if err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		// populate UploadURL/expiration - we unmarshal into a fresh session here
+		// just in case the API does something silly at a later date and overwrites
+		// a field it shouldn't.
+		tmp := UploadSession{}
+		if err = json.Unmarshal(resp, &tmp); err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		u.setUploadURL(tmp.UploadURL, tmp.ExpirationDateTime)
+		if u.persist != nil {
+			u.persist(u)
+		}
 	}
-	u.UploadURL = tmp.UploadURL
-	u.ExpirationDateTime = tmp.ExpirationDateTime
 
 	// api upload session created successfully, now do actual content upload
 	var status int
-	nchunks := int(math.Ceil(float64(u.Size) / float64(chunkSize)))
-	for i := 0; i < nchunks; i++ {
-		resp, status, err = u.uploadChunk(auth, uint64(i)*chunkSize)
+	var header http.Header
+	chunkSize := u.chunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	for offset < u.Size {
+		if err = u.pause.wait(ctx); err != nil {
+			return u.setState(uploadErrored, err)
+		}
+		started := time.Now()
+		retried := false
+		resp, status, header, err = u.uploadChunk(auth, offset, chunkSize)
+		for attempt := 1; err != nil && attempt <= chunkResumeAttempts; attempt++ {
+			// the connection dropped partway through a chunk, continue from
+			// wherever the server says it got to instead of starting over
+			retried = true
+			wait := time.Duration(attempt*attempt) * time.Second
+			log.WithFields(log.Fields{
+				"id":     u.ID,
+				"name":   u.Name,
+				"offset": offset,
+				"err":    err,
+			}).Warnf("Chunk upload was interrupted, resuming in %s.", wait)
+			if err = u.sleep(wait); err != nil {
+				break
+			}
+			resumed, resumeErr := u.resumeOffset()
+			if resumeErr != nil {
+				err = resumeErr
+				continue
+			}
+			offset = resumed
+			resp, status, header, err = u.uploadChunk(auth, offset, chunkSize)
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
-				"id":      u.ID,
-				"name":    u.Name,
-				"chunk":   i,
-				"nchunks": nchunks,
-				"err":     err,
+				"id":     u.ID,
+				"name":   u.Name,
+				"offset": offset,
+				"size":   chunkSize,
+				"err":    err,
 			}).Error("Error during chunk upload.")
 			return u.setState(uploadErrored, err)
 		}
 
-		// retry server-side failures with an exponential back-off strategy. Will not
-		// exit this loop unless it receives a non 5xx error or serious failure
-		for backoff := 1; status >= 500; backoff *= 2 {
-			log.WithFields(log.Fields{
-				"id":      u.ID,
-				"name":    u.Name,
-				"chunk":   i,
-				"nchunks": nchunks,
-				"status":  status,
-			}).Errorf("The OneDrive server is having issues, retrying chunk upload in %ds.", backoff)
-			time.Sleep(time.Duration(backoff) * time.Second)
-			resp, status, err = u.uploadChunk(auth, uint64(i)*chunkSize)
+		// retry server-side failures with an exponential back-off strategy, and
+		// wait as long as the server asks when throttled. Will not exit this loop
+		// unless it receives a non 5xx/429 response, a serious failure, or the
+		// retry budget runs out
+		backoff := time.Second
+		for status >= 500 || status == http.StatusTooManyRequests {
+			retried = true
+			if u.outOfBudget() {
+				return u.setState(uploadErrored, fmt.Errorf(
+					"server kept failing chunk uploads with HTTP %d", status))
+			}
+			fields := log.Fields{
+				"id":     u.ID,
+				"name":   u.Name,
+				"offset": offset,
+				"status": status,
+			}
+			wait := backoff
+			if graph.Throttled(status, header) {
+				wait = graph.RetryAfter(header)
+				log.WithFields(fields).Warnf("Throttled by the server, retrying chunk upload in %s.", wait)
+			} else {
+				log.WithFields(fields).Errorf("The OneDrive server is having issues, retrying chunk upload in %s.", backoff)
+			}
+			if err = u.sleep(wait); err != nil {
+				return u.setState(uploadErrored, err)
+			}
+			backoff = u.retry.backoff(2 * backoff)
+			resp, status, header, err = u.uploadChunk(auth, offset, chunkSize)
 			if err != nil { // a serious, non 4xx/5xx error
 				log.WithFields(log.Fields{
 					"id":     u.ID,
@@ -307,6 +963,27 @@ func (u *UploadSession) Upload(auth *graph.Auth) error {
 		if status >= 400 {
 			return u.setState(uploadErrored, errors.New(string(resp)))
 		}
+
+		offset += chunkSize
+		if u.adaptive {
+			if next := adaptChunkSize(chunkSize, time.Since(started), retried); next != chunkSize {
+				log.WithFields(log.Fields{
+					"id":   u.ID,
+					"name": u.Name,
+					"size": next,
+				}).Debug("Changing upload chunk size.")
+				chunkSize = next
+			}
+		}
 	}
-	return u.verifyRemoteChecksum(resp)
+	return u.finish(resp, auth)
+}
+
+// finish makes sure an item whose content was sent ends up wherever it was moved
+// in the meantime, and verifies the upload from the server's response to its
+// final request. The item must be moved before the upload is marked complete,
+// after which the upload loop may forget about the move.
+func (u *UploadSession) finish(response []byte, auth *graph.Auth) error {
+	u.retarget(response, auth)
+	return u.verifyRemoteChecksum(response, auth)
 }
@@ -0,0 +1,323 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// Correction describes cached content that no longer matched the server and
+// was discarded.
+type Correction struct {
+	ID     string
+	Path   string
+	Reason string
+}
+
+// discardContent removes an item's content from memory and disk, so that it is
+// downloaded again the next time it is opened.
+func (c *Cache) discardContent(inode *Inode) {
+	inode.mutex.Lock()
+	inode.closeContent()
+	inode.mutex.Unlock()
+	c.DeleteContent(inode.ID())
+}
+
+// VerifyCache compares the content of every file cached on disk against the
+// hashes on the server. Cached content that no longer matches (for instance,
+// because of a remote change that delta missed) is discarded and the item's
+// metadata is updated, so that the server's copy is downloaded the next time it
+// is opened. Files with changes that have not been uploaded and files that were
+// only partly downloaded are skipped.
+func (c *Cache) VerifyCache(auth *graph.Auth) []Correction {
+	pending := make(map[string]bool)
+	for _, upload := range c.uploads.List() {
+		pending[upload.ID] = true
+	}
+
+	corrections := make([]Correction, 0)
+	for _, id := range c.cachedIDs() {
+		inode := c.GetID(id)
+		if inode == nil || isLocalID(id) || pending[id] || inode.HasChanges() ||
+			c.getHydration(id) != nil {
+			continue
+		}
+		path := inode.Path()
+
+		remote, err := c.drive.GetItem(id, auth)
+		if err != nil {
+			if graph.IsOffline(err) {
+				log.Warn("Went offline while verifying cached content, stopping.")
+				break
+			}
+			if strings.HasPrefix(err.Error(), "HTTP 404") {
+				// delta will remove the item itself, but we don't need its content
+				c.discardContent(inode)
+				corrections = append(corrections, Correction{
+					ID:     id,
+					Path:   path,
+					Reason: "item no longer exists on the server",
+				})
+				continue
+			}
+			log.WithFields(log.Fields{
+				"id":   id,
+				"path": path,
+				"err":  err,
+			}).Warn("Could not fetch item to verify its cached content.")
+			continue
+		}
+
+		hash, _, err := c.hashContent(id)
+		if err != nil || !remote.HasHashes() || remote.VerifyChecksum(hash) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": path,
+		}).Warn("Cached content did not match server, discarding it.")
+		inode.mutex.Lock()
+		inode.DriveItem.Size = remote.Size
+		inode.DriveItem.ModTime = remote.ModTime
+		inode.DriveItem.CTag = remote.CTag
+		inode.DriveItem.File = remote.File
+		inode.mutex.Unlock()
+		c.discardContent(inode)
+		corrections = append(corrections, Correction{
+			ID:     id,
+			Path:   path,
+			Reason: "cached content did not match the server's copy",
+		})
+	}
+	log.WithField("corrections", len(corrections)).Info("Finished verifying cached content.")
+	return corrections
+}
+
+// VerifyLoop verifies the cached content against the server (see VerifyCache)
+// every interval. Should be called as a goroutine.
+func (c *Cache) VerifyLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !c.IsOffline() && !c.SyncPaused() {
+			c.VerifyCache(c.GetAuth())
+		}
+	}
+}
+
+// CheckContent looks for cached content that was damaged, for instance by a
+// crash or power loss while it was being written, without contacting the
+// server. Content whose size does not match the file's, and records of partly
+// downloaded content that is gone, are discarded so that the file is downloaded
+// again. Hashes are not checked here, since that means reading the entire cache:
+// complete content is hashed when it is opened instead. Files with changes that
+// have not been uploaded and open files are skipped. Meant to run in the
+// background on startup.
+func (c *Cache) CheckContent() []Correction {
+	keep := make(map[string]bool)
+	for _, upload := range c.uploads.List() {
+		keep[upload.ID] = true
+	}
+	for _, id := range c.dirtyIDs() {
+		keep[id] = true
+	}
+
+	corrections := make([]Correction, 0)
+	for _, id := range c.hydrationIDs() {
+		if !c.hasContent(id) {
+			// nothing to fill in, the file starts over when it is opened
+			c.setHydration(id, nil)
+		}
+	}
+	for _, id := range c.cachedIDs() {
+		inode := c.GetID(id)
+		if inode == nil || isLocalID(id) || keep[id] {
+			continue
+		}
+		inode.mutex.Lock()
+		if inode.content != nil || inode.hasChanges {
+			inode.mutex.Unlock()
+			continue
+		}
+		expected := inode.DriveItem.Size
+		if h := c.getHydration(id); h != nil {
+			expected = h.Size
+		}
+		size, err := c.contentSize(id)
+		if err != nil || size == expected {
+			inode.mutex.Unlock()
+			continue
+		}
+		c.DeleteContent(id)
+		inode.mutex.Unlock()
+
+		path := inode.Path()
+		log.WithFields(log.Fields{
+			"id":       id,
+			"path":     path,
+			"size":     size,
+			"expected": expected,
+		}).Warn("Cached content was damaged, discarding it.")
+		corrections = append(corrections, Correction{
+			ID:     id,
+			Path:   path,
+			Reason: fmt.Sprintf("cached content was %d bytes instead of %d", size, expected),
+		})
+	}
+	log.WithField("corrections", len(corrections)).Info("Finished checking cached content.")
+	return corrections
+}
+
+// Mismatch describes a file whose local content differs from the server's copy.
+type Mismatch struct {
+	ID         string
+	Path       string
+	Reason     string
+	LocalHash  string
+	LocalSize  uint64
+	RemoteHash string
+	RemoteSize uint64
+}
+
+// Which side of a Mismatch to keep.
+const (
+	KeepLocal  = "local"
+	KeepRemote = "remote"
+)
+
+// VerifyPath recomputes the hashes of the local content of inode (and every file
+// under it, if it is a folder) and compares them against the server. Unlike
+// VerifyCache, this also checks open files and files with changes that have not
+// been uploaded, and nothing is changed: mismatches are reported so that they
+// can be settled one way or the other with Resolve. Files with no local content
+// (or only part of it) and files that were never uploaded are skipped.
+func (c *Cache) VerifyPath(inode *Inode, auth *graph.Auth) ([]Mismatch, error) {
+	pending := make(map[string]bool)
+	for _, upload := range c.uploads.List() {
+		pending[upload.ID] = true
+	}
+
+	caps := c.Capabilities()
+	mismatches := make([]Mismatch, 0)
+	for _, file := range c.subtree(inode) {
+		id := file.ID()
+		if file.IsDir() || isLocalID(id) || c.getHydration(id) != nil {
+			continue
+		}
+		// open files write straight to the cache, so this is their content too
+		hash, size, err := c.hashContent(id)
+		if err != nil {
+			continue
+		}
+		path := file.Path()
+
+		remote, err := c.drive.GetItem(id, auth)
+		if err != nil {
+			if graph.IsOffline(err) {
+				return nil, errors.New("cannot verify files while offline")
+			}
+			log.WithFields(log.Fields{
+				"id":   id,
+				"path": path,
+				"err":  err,
+			}).Warn("Could not fetch item to verify its content.")
+			continue
+		}
+		if remote.VerifyChecksum(hash) && size == remote.Size {
+			continue
+		}
+
+		mismatch := Mismatch{
+			ID:         id,
+			Path:       path,
+			Reason:     "local content does not match the server's copy",
+			LocalHash:  hash,
+			LocalSize:  size,
+			RemoteSize: remote.Size,
+		}
+		if remote.File != nil {
+			mismatch.RemoteHash = caps.Checksum(remote.File.Hashes)
+		}
+		if file.HasChanges() || pending[id] {
+			mismatch.Reason = "local changes have not been uploaded yet"
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+	return mismatches, nil
+}
+
+// Resolve settles a Mismatch by keeping one side. With KeepRemote, the local
+// content (including any changes that were not uploaded) is replaced with a fresh
+// download of the server's copy. With KeepLocal, the local content is uploaded
+// over the server's copy. Returns once the download or upload is done.
+func (c *Cache) Resolve(inode *Inode, keep string, auth *graph.Auth) error {
+	id := inode.ID()
+	if inode.IsDir() || isLocalID(id) {
+		return errors.New("only files that have been uploaded can be resolved")
+	}
+	switch keep {
+	case KeepRemote:
+		remote, err := c.drive.GetItem(id, auth)
+		if err != nil {
+			return err
+		}
+		if !remote.HasHashes() {
+			return errors.New("the server has no hash to check a download against")
+		}
+		download, size, err := c.fetchContent(context.Background(), id,
+			c.Capabilities().Checksum(remote.File.Hashes), graph.PriorityInteractive, auth)
+		if err != nil {
+			return err
+		}
+		c.uploads.Cancel(id)
+		inode.mutex.Lock()
+		inode.DriveItem.Size = size
+		inode.DriveItem.ModTime = remote.ModTime
+		inode.DriveItem.ETag = remote.ETag
+		inode.DriveItem.CTag = remote.CTag
+		inode.DriveItem.File = remote.File
+		inode.hasChanges = false
+		wasOpen := inode.content != nil
+		inode.closeContent()
+		if err = c.installContent(download, id); err == nil && wasOpen {
+			err = inode.openContent()
+		}
+		inode.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": inode.Path(),
+		}).Info("Replaced local content with the server's copy.")
+		return nil
+
+	case KeepLocal:
+		if c.getHydration(id) != nil {
+			return errors.New("the local content was only partly downloaded")
+		}
+		hash, size, err := c.hashContent(id)
+		if err != nil {
+			return errors.New("there is no local content to upload")
+		}
+		inode.mutex.Lock()
+		inode.DriveItem.Size = size
+		inode.DriveItem.File = &graph.File{Hashes: c.Capabilities().HashesOf(hash)}
+		inode.DriveItem.CTag = "" // replace the server's copy, even if it changed
+		inode.hasChanges = false
+		inode.mutex.Unlock()
+		if err := c.uploads.QueueUpload(inode); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"id":   id,
+			"path": inode.Path(),
+		}).Info("Uploading local content over the server's copy.")
+		return c.uploads.WaitUpload(id)
+	}
+	return fmt.Errorf("cannot keep \"%s\", must be \"%s\" or \"%s\"", keep, KeepLocal, KeepRemote)
+}
@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// With UploadOnInterval, files that were saved to the local cache but not
+// uploaded yet are tracked here, so that they are still uploaded if onedriver
+// exits before the next upload interval.
+var bucketDirty = []byte("dirty")
+
+// markDirty schedules a file with changes for the next periodic upload. While
+// offline, its metadata is saved as well, so that new files survive a restart.
+func (c *Cache) markDirty(inode *Inode) {
+	if !inode.HasChanges() {
+		return
+	}
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDirty).Put([]byte(inode.ID()), []byte{})
+	})
+	if c.IsOffline() {
+		c.saveMetadata(inode)
+	}
+}
+
+// clearDirty forgets that a file was waiting for the next periodic upload.
+func (c *Cache) clearDirty(id string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDirty).Delete([]byte(id))
+	})
+}
+
+// isDirty returns whether a file has changes waiting for the next periodic
+// upload.
+func (c *Cache) isDirty(id string) bool {
+	dirty := false
+	c.db.View(func(tx *bolt.Tx) error {
+		dirty = tx.Bucket(bucketDirty).Get([]byte(id)) != nil
+		return nil
+	})
+	return dirty
+}
+
+// hasLocalChanges returns whether a file has changes that have not made it to
+// the server yet: unsaved, waiting for the next periodic upload, being
+// uploaded, or waiting for the user to pick a version (see ConflictPrompt).
+func (c *Cache) hasLocalChanges(inode *Inode) bool {
+	id := inode.ID()
+	if inode.HasChanges() || c.isDirty(id) || c.hasConflict(id) {
+		return true
+	}
+	_, _, uploading := c.uploads.Progress(id)
+	return uploading
+}
+
+// dirtyIDs returns the IDs of all files waiting for the next periodic upload.
+func (c *Cache) dirtyIDs() []string {
+	ids := make([]string, 0)
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDirty).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids
+}
+
+// UploadDirty queues every file saved since the last periodic upload for
+// upload.
+func (c *Cache) UploadDirty() {
+	for _, id := range c.dirtyIDs() {
+		if inode := c.GetID(id); inode != nil && !inode.IsDir() {
+			if isLocalID(inode.ParentID()) {
+				// in a folder created offline, uploaded once the folder is
+				// created (see replayJournal)
+				continue
+			}
+			// changes left over from before a restart are not flagged in memory,
+			// and their metadata may not have been saved
+			inode.mutex.Lock()
+			inode.hasChanges = true
+			if inode.content == nil {
+				if hash, size, err := c.hashContent(id); err == nil {
+					inode.DriveItem.Size = size
+					inode.DriveItem.File = &graph.File{Hashes: c.Capabilities().HashesOf(hash)}
+				}
+			}
+			inode.mutex.Unlock()
+			if errno := inode.upload(); errno != 0 {
+				log.WithFields(log.Fields{
+					"id":    id,
+					"path":  inode.Path(),
+					"errno": errno,
+				}).Error("Could not queue file for periodic upload.")
+				continue
+			}
+		}
+		// the IDs of new files change once they are uploaded, so the old ID is
+		// removed either way
+		c.clearDirty(id)
+	}
+}
+
+// WritebackLoop uploads the files saved since the last upload every interval
+// (see UploadOnInterval). Files left over from a previous run are uploaded
+// right away. Should be called as a goroutine.
+func (c *Cache) WritebackLoop(interval time.Duration) {
+	for {
+		if !c.IsOffline() {
+			c.UploadDirty()
+		}
+		time.Sleep(interval)
+	}
+}
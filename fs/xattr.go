@@ -0,0 +1,304 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	log "github.com/sirupsen/logrus"
+)
+
+// Extended attributes in the "user.onedrive." namespace mirror metadata stored
+// on OneDrive itself, while "user.onedriver." attributes describe local state.
+// Any other "user." attributes are only stored locally (see localAttrs).
+const (
+	xattrDescription = "user.onedrive.description"
+	xattrFavorite    = "user.onedriver.favorite"
+	xattrBlocked     = "user.onedriver.blocked"
+	xattrProgress    = "user.onedriver.progress"
+	xattrDownload    = "user.onedriver.download"
+	xattrEvict       = "user.onedriver.evict"
+	xattrState       = "user.onedriver.state"
+
+	xattrThumbnail = "user.onedrive.thumbnail." // followed by the size
+)
+
+// Values of the user.onedriver.state attribute, from the most to the least
+// pressing when more than one applies.
+const (
+	stateConflict  = "conflict"   // waiting for a version to be picked
+	stateError     = "error"      // the upload gave up, or the server refused to serve it
+	stateUploading = "uploading"  // waiting to be or being uploaded
+	stateDirty     = "dirty"      // changed locally, not queued for upload yet
+	statePartial   = "partial"    // only partly downloaded
+	stateHydrated  = "hydrated"   // downloaded (or listed, for folders)
+	stateCloudOnly = "cloud-only" // only on the server
+)
+
+// syncState returns what is on disk of an item compared to the server, for
+// file managers and scripts.
+func (i *Inode) syncState() string {
+	cache := i.GetCache()
+	id := i.ID()
+	if i.IsDir() {
+		i.mutex.RLock()
+		listed := i.children != nil
+		i.mutex.RUnlock()
+		switch {
+		case isLocalID(id):
+			return stateDirty
+		case listed:
+			return stateHydrated
+		}
+		return stateCloudOnly
+	}
+
+	if cache.hasConflict(id) {
+		return stateConflict
+	}
+	if i.blockedReason() != "" {
+		return stateError
+	}
+	if state, uploading := cache.uploads.state(id); uploading {
+		if state == uploadFailed {
+			return stateError
+		}
+		return stateUploading
+	}
+	if i.HasChanges() || cache.isDirty(id) || isLocalID(id) {
+		return stateDirty
+	}
+	if _, _, partial := i.downloadProgress(); partial {
+		return statePartial
+	}
+	if cache.hasContent(id) {
+		return stateHydrated
+	}
+	return stateCloudOnly
+}
+
+// xattr describes how to read and (optionally) write a single extended
+// attribute. get should return nil if the attribute is not present on an inode.
+type xattr struct {
+	get func(i *Inode) []byte
+	set func(i *Inode, value []byte) syscall.Errno // nil for read-only attributes
+
+	// not listed by Listxattr, for attributes that are expensive to get
+	unlisted bool
+}
+
+// thumbnailXattr is the read-only attribute holding one of the sizes of
+// thumbnail the server renders of an item. Fetching it takes a request to the
+// server, which is why it is unlisted. Thumbnails too large for an attribute are
+// not available.
+func thumbnailXattr(size string) xattr {
+	return xattr{
+		get: func(i *Inode) []byte {
+			i.mutex.RLock()
+			id := i.DriveItem.ID
+			cTag := i.DriveItem.CTag
+			i.mutex.RUnlock()
+			cache := i.GetCache()
+			data := cache.thumbnails.get(cache, id, cTag, size)
+			if len(data) > maxXattrSize {
+				return nil
+			}
+			return data
+		},
+		unlisted: true,
+	}
+}
+
+var xattrs = map[string]xattr{
+	xattrDescription: {
+		get: func(i *Inode) []byte {
+			i.mutex.RLock()
+			defer i.mutex.RUnlock()
+			if i.DriveItem.Description == "" {
+				return nil
+			}
+			return []byte(i.DriveItem.Description)
+		},
+		set: func(i *Inode, value []byte) syscall.Errno {
+			return i.setDescription(string(value))
+		},
+	},
+	xattrFavorite: {
+		get: func(i *Inode) []byte {
+			if !i.GetCache().IsFavorite(i.ID()) {
+				return nil
+			}
+			return []byte("1")
+		},
+		set: func(i *Inode, value []byte) syscall.Errno {
+			// anything but an empty value or "0" marks the item as a favorite
+			v := string(value)
+			return i.setFavorite(v != "" && v != "0")
+		},
+	},
+	xattrBlocked: {
+		// why the item cannot be opened, if the server refused to serve it
+		get: func(i *Inode) []byte {
+			if reason := i.blockedReason(); reason != "" {
+				return []byte(reason)
+			}
+			return nil
+		},
+	},
+	xattrProgress: {
+		// "sent/size" in bytes, while the file is waiting to be or being uploaded
+		get: func(i *Inode) []byte {
+			sent, size, uploading := i.GetCache().uploads.Progress(i.ID())
+			if !uploading {
+				return nil
+			}
+			return []byte(fmt.Sprintf("%d/%d", sent, size))
+		},
+	},
+	xattrDownload: {
+		// "cached/size" in bytes, while the file is only partly downloaded
+		get: func(i *Inode) []byte {
+			cached, size, partial := i.downloadProgress()
+			if !partial {
+				return nil
+			}
+			return []byte(fmt.Sprintf("%d/%d", cached, size))
+		},
+	},
+	xattrState: {
+		get: func(i *Inode) []byte {
+			return []byte(i.syncState())
+		},
+	},
+	xattrEvict: {
+		// write-only, setting it removes the cached content like Dehydrate
+		get: func(i *Inode) []byte { return nil },
+		set: func(i *Inode, value []byte) syscall.Errno {
+			if _, _, err := i.GetCache().Dehydrate(i); err != nil {
+				log.WithFields(log.Fields{
+					"path": i.Path(),
+					"err":  err,
+				}).Warn("Could not evict cached content.")
+				return syscall.EBUSY
+			}
+			return 0
+		},
+	},
+	xattrThumbnail + graph.ThumbnailSmall:  thumbnailXattr(graph.ThumbnailSmall),
+	xattrThumbnail + graph.ThumbnailMedium: thumbnailXattr(graph.ThumbnailMedium),
+	xattrThumbnail + graph.ThumbnailLarge:  thumbnailXattr(graph.ThumbnailLarge),
+}
+
+// Flags for Setxattr, from <sys/xattr.h>.
+const (
+	xattrCreate  = 1 // fail if the attribute already exists
+	xattrReplace = 2 // fail if the attribute does not exist
+)
+
+// maxXattrSize is the largest value Linux allows for an extended attribute.
+const maxXattrSize = 64 * 1024
+
+// copyXattr copies an attribute value to dest following the getxattr(2)
+// convention of reporting the required size if dest is too small.
+func copyXattr(value []byte, dest []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+// Getxattr fetches the value of an extended attribute.
+func (i *Inode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	log.WithFields(log.Fields{
+		"path": i.Path(),
+		"attr": attr,
+	}).Trace()
+	var value []byte
+	if handler, exists := xattrs[attr]; exists {
+		value = handler.get(i)
+	} else if isLocalXattr(attr) {
+		value = i.GetCache().getLocalAttrs(i.ID()).Xattrs[attr]
+	}
+	if value == nil {
+		return 0, syscall.ENODATA
+	}
+	return copyXattr(value, dest)
+}
+
+// Listxattr lists the extended attributes present on an inode as a series of
+// null-terminated strings.
+func (i *Inode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []byte
+	for name, handler := range xattrs {
+		if !handler.unlisted && handler.get(i) != nil {
+			names = append(names, name...)
+			names = append(names, 0)
+		}
+	}
+	for name := range i.GetCache().getLocalAttrs(i.ID()).Xattrs {
+		names = append(names, name...)
+		names = append(names, 0)
+	}
+	return copyXattr(names, dest)
+}
+
+// Setxattr sets the value of an extended attribute.
+func (i *Inode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	log.WithFields(log.Fields{
+		"path": i.Path(),
+		"attr": attr,
+	}).Debug()
+	if isLocalXattr(attr) {
+		return i.setLocalXattr(attr, data, flags)
+	}
+	handler, exists := xattrs[attr]
+	if !exists || handler.set == nil {
+		return syscall.ENOTSUP
+	}
+	return handler.set(i, data)
+}
+
+// setLocalXattr sets an extended attribute that is only stored locally.
+func (i *Inode) setLocalXattr(attr string, data []byte, flags uint32) syscall.Errno {
+	if len(data) > maxXattrSize {
+		return syscall.E2BIG
+	}
+	cache := i.GetCache()
+	_, exists := cache.getLocalAttrs(i.ID()).Xattrs[attr]
+	if exists && flags&xattrCreate != 0 {
+		return syscall.EEXIST
+	} else if !exists && flags&xattrReplace != 0 {
+		return syscall.ENODATA
+	}
+	if data == nil {
+		data = []byte{} // nil removes the attribute
+	}
+	if err := cache.storeXattr(i.ID(), attr, data); err != nil {
+		return syscall.EIO
+	}
+	return 0
+}
+
+// Removexattr removes an extended attribute, which is equivalent to setting it
+// to an empty value.
+func (i *Inode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if isLocalXattr(attr) {
+		cache := i.GetCache()
+		if _, exists := cache.getLocalAttrs(i.ID()).Xattrs[attr]; !exists {
+			return syscall.ENODATA
+		}
+		if err := cache.storeXattr(i.ID(), attr, nil); err != nil {
+			return syscall.EIO
+		}
+		return 0
+	}
+	handler, exists := xattrs[attr]
+	if !exists || handler.set == nil {
+		return syscall.ENOTSUP
+	}
+	if handler.get(i) == nil {
+		return syscall.ENODATA
+	}
+	return handler.set(i, nil)
+}
@@ -2,12 +2,12 @@ module github.com/jstaf/onedriver
 
 require (
 	github.com/hanwen/go-fuse/v2 v2.0.3-0.20200103165319-0e3c45fc4899
+	github.com/klauspost/compress v1.13.6
 	github.com/kylelemons/godebug v1.1.0 // indirect
-	github.com/rclone/rclone v1.50.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/pflag v1.0.5
 	go.etcd.io/bbolt v1.3.5
-	golang.org/x/sys v0.0.0-20210511113859-b0526f3d8744 // indirect
+	golang.org/x/sys v0.0.0-20210511113859-b0526f3d8744
 )
 
 go 1.13
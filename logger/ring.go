@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RingBuffer is a logrus hook that keeps the most recent log entries in memory,
+// regardless of the log level used for output. This lets us include a precise
+// history of recent events in bug reports without logging at debug level all
+// the time.
+type RingBuffer struct {
+	mutex   sync.Mutex
+	entries []*log.Entry
+	next    int // index the next entry is written to
+	full    bool
+	level   log.Level
+}
+
+// NewRingBuffer creates a RingBuffer holding up to size entries of level or
+// higher severity.
+func NewRingBuffer(size int, level log.Level) *RingBuffer {
+	return &RingBuffer{
+		entries: make([]*log.Entry, size),
+		level:   level,
+	}
+}
+
+// Levels returns the log levels recorded by the RingBuffer.
+func (r *RingBuffer) Levels() []log.Level {
+	levels := make([]log.Level, 0)
+	for _, level := range log.AllLevels {
+		if level <= r.level {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// Fire records a log entry.
+func (r *RingBuffer) Fire(entry *log.Entry) error {
+	// entries get reused by logrus, so we keep our own copy
+	data := make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	saved := &log.Entry{
+		Logger:  entry.Logger,
+		Data:    data,
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Caller:  entry.Caller,
+		Message: entry.Message,
+	}
+
+	r.mutex.Lock()
+	r.entries[r.next] = saved
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+// Entries returns the recorded entries, oldest first.
+func (r *RingBuffer) Entries() []*log.Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.full {
+		return append([]*log.Entry{}, r.entries[:r.next]...)
+	}
+	return append(append([]*log.Entry{}, r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// Dump writes the last limit recorded entries (or all of them if limit is 0) to
+// w, oldest first.
+func (r *RingBuffer) Dump(w io.Writer, formatter log.Formatter, limit int) error {
+	entries := r.Entries()
+	if limit > 0 && limit < len(entries) {
+		entries = entries[len(entries)-limit:]
+	}
+	for _, entry := range entries {
+		line, err := formatter.Format(entry)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// levelFormatter only formats entries at or above a certain severity, so that
+// entries can be recorded by a RingBuffer without being written to the log.
+type levelFormatter struct {
+	log.Formatter
+	level log.Level
+}
+
+func (f levelFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if entry.Level > f.level {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// EnableRingBuffer starts recording log entries at debug level (or the current
+// log level, if more verbose) in a RingBuffer of the given size. Only entries
+// at the current log level are still written to the log output. Must be called
+// after the log level and formatter are set.
+func EnableRingBuffer(size int, formatter log.Formatter) *RingBuffer {
+	outputLevel := log.GetLevel()
+	ringLevel := log.DebugLevel
+	if outputLevel > ringLevel {
+		ringLevel = outputLevel
+	}
+	ring := NewRingBuffer(size, ringLevel)
+	log.SetFormatter(levelFormatter{Formatter: formatter, level: outputLevel})
+	log.SetLevel(ringLevel)
+	log.AddHook(ring)
+	return ring
+}
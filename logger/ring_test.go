@@ -0,0 +1,31 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Only the most recent entries should be kept, in order.
+func TestRingBufferWraps(t *testing.T) {
+	t.Parallel()
+	ring := NewRingBuffer(3, log.DebugLevel)
+	for _, msg := range []string{"one", "two", "three", "four"} {
+		ring.Fire(&log.Entry{Message: msg, Level: log.InfoLevel})
+	}
+
+	entries := ring.Entries()
+	if len(entries) != 3 || entries[0].Message != "two" || entries[2].Message != "four" {
+		t.Fatalf("Unexpected entries in ring buffer: %v\n", entries)
+	}
+
+	var buf bytes.Buffer
+	if err := ring.Dump(&buf, &log.TextFormatter{DisableTimestamp: true}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "four") || strings.Contains(out, "three") {
+		t.Fatalf("Dump with a limit of 1 returned \"%s\".\n", out)
+	}
+}
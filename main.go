@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -34,6 +37,44 @@ While offline, the filesystem will be read-only until connectivity is re-
 established.
 
 Usage: onedriver [options] <mountpoint>
+       onedriver [options] queue list|pause|resume
+       onedriver [options] queue retry|cancel|prioritize <id or name>
+       onedriver [options] events [count]
+       onedriver [options] status [watch]
+       onedriver [options] dehydrate|evict <path>...
+       onedriver [options] verify [path]...
+       onedriver [options] analyze [months]
+       onedriver [options] cache stats
+       onedriver [options] prefetch-metadata
+       onedriver [options] resync metadata|all [path]...
+       onedriver [options] pause|resume
+       onedriver [options] pending
+       onedriver [options] trash list|empty
+       onedriver [options] trash restore <id>...
+       onedriver [options] cp <source> <dest>
+       onedriver [options] upload-limit [KB/s]
+       onedriver [options] download-limit [KB/s]
+
+The queue commands manage the uploads of an already running instance of
+onedriver (using the same cache directory). The events command prints its most
+recent log messages (including debug messages), and the status command shows
+the progress of syncing with the server. The dehydrate (or evict) command frees
+up space by removing the downloaded copies of files from the cache, and the
+verify command checks the cached files (or the files at each path) against the
+server, asking which copy to keep when they differ. The analyze command lists the
+largest, duplicate, and long-unmodified files to help free up space on OneDrive.
+The cache stats command shows how much space the cache uses and how often it is
+used, to help choose --max-cache-size. The prefetch-metadata command lists every
+folder so that the whole drive can be browsed offline, and the resync command
+fetches everything cached (or under each path) from the server again, in case the
+cache no longer matches it. The pause command stops all syncing in the
+background (fetching changes, uploads, and prefetching) until the resume
+command, while files stay readable, and the pending command lists everything
+that is not synced yet. The trash commands list, restore, or remove the files
+deleted on the server that are kept in the local trash (see --trash-retention).
+The cp command copies files and folders on the server, without downloading them.
+The upload-limit and download-limit commands show or change how fast files are
+uploaded and downloaded.
 
 Valid options:
 `)
@@ -52,6 +93,178 @@ func main() {
 	wipeCache := flag.BoolP("wipe-cache", "w", false,
 		"Delete the existing onedriver cache directory and then exit. "+
 			"Equivalent to resetting the program.")
+	configPath := flag.String("config-file", "",
+		"Read additional settings from this file instead of the default location "+
+			"(~/.config/onedriver/config.json).")
+	rootPath := flag.StringP("root", "r", "/",
+		"Mount a subfolder of your OneDrive as the filesystem root instead of "+
+			"the entire drive (for instance, \"/Documents/Projects\"). Special "+
+			"folders can be mounted by name, like \"special:photos\".")
+	allDrives := flag.BoolP("all-drives", "A", false,
+		"Mount every drive available to your account (as well as folders shared "+
+			"with you) as top-level directories of the mountpoint.")
+	allowOther := flag.Bool("allow-other", false,
+		"Let other users (like an NFS or Samba server re-exporting the mountpoint) "+
+			"access the filesystem. Requires user_allow_other in /etc/fuse.conf.")
+	attrTimeout := flag.Duration("attr-timeout", time.Second,
+		"How long the kernel may cache file attributes (size, timestamps, etc.).")
+	entryTimeout := flag.Duration("entry-timeout", time.Second,
+		"How long the kernel may cache the results of looking up a filename.")
+	negativeTimeout := flag.Duration("negative-timeout", 0,
+		"How long the kernel may cache failed filename lookups. Files created "+
+			"remotely may not appear for this long. Disabled by default.")
+	maxFileSize := flag.Uint64("max-file-size", odfs.DefaultMaxFileSize/(1024*1024*1024),
+		"Largest file size (in GB) that can be written. Writes past this size "+
+			"fail with \"File too large\". Only change this if OneDrive's limits change.")
+	prefetchDirs := flag.Int("prefetch-dirs", 10,
+		"Number of your most frequently used directories to fetch in the "+
+			"background on startup. Set to 0 to disable.")
+	prefetchMetadata := flag.Bool("prefetch-metadata", false,
+		"Fetch the metadata of every file and folder in the background on "+
+			"startup, so that the whole drive can be browsed offline.")
+	prefetchFileSize := flag.Uint64("prefetch-file-size", 0,
+		"Also prefetch the content of files up to this size (in KB) in "+
+			"prefetched directories. Disabled by default.")
+	maxCacheSize := flag.Uint64("max-cache-size", 0,
+		"Largest amount of disk space (in MB) that cached file content may use. "+
+			"The least recently used files are removed from the cache past this "+
+			"size. Disabled by default.")
+	maxDownloads := flag.Int("max-downloads", odfs.DefaultMaxDownloads,
+		"Number of parts of files to download at once while they are read. "+
+			"Other reads wait their turn.")
+	readahead := flag.Uint64("readahead", odfs.DefaultReadahead/(1024*1024),
+		"Download this much (in MB) ahead of programs reading a file from start "+
+			"to end, like video players, so that reads do not wait on the "+
+			"network. Set to 0 to disable.")
+	streamSize := flag.Uint64("stream-size", 0,
+		"Read files of at least this size (in MB) straight from the server "+
+			"when they are opened for reading only, without caching them. "+
+			"Disabled by default.")
+	streamDirs := flag.StringArray("stream-dir", nil,
+		"Stream files opened for reading in this directory (relative to the "+
+			"mountpoint) like --stream-size, whatever their size. Can be used "+
+			"more than once.")
+	hydrationHoles := flag.Bool("hydration-holes", false,
+		"Report the parts of partly downloaded files that are not cached yet "+
+			"as holes to SEEK_HOLE and SEEK_DATA. Programs that skip holes "+
+			"when copying files will copy zeroes instead of those parts.")
+	bandwidthLimit := flag.Uint64("bandwidth-limit", 0,
+		"Limit the combined speed of all uploads and downloads (in KB/s). "+
+			"Transfers share the limit fairly. Disabled by default.")
+	downloadSegments := flag.Int("download-segments", graph.DefaultDownloadSegments,
+		"Download large files in this many parts at the same time. Set to 1 "+
+			"to download files from start to end.")
+	prioritizeReads := flag.Bool("prioritize-reads", true,
+		"When bandwidth is limited, give most of it to files being opened "+
+			"instead of uploads and prefetching.")
+	requestRate := flag.Int("request-rate", 10,
+		"Send at most this many requests per second for metadata, like "+
+			"listing folders. Requests are spaced out further when the server "+
+			"throttles them. Set to 0 for no limit.")
+	trashRetention := flag.Duration("trash-retention", 7*24*time.Hour,
+		"Keep the cached copies of files deleted on the server in a local "+
+			"trash for this long, to restore them with \"onedriver trash\". "+
+			"Set to 0 to disable.")
+	maxUploads := flag.Int("max-uploads", odfs.DefaultMaxUploads,
+		"Number of files to upload at once. Other uploads wait their turn, "+
+			"which avoids getting throttled when saving many files at once.")
+	uploadDelay := flag.Duration("upload-delay", odfs.DefaultUploadDelay,
+		"Wait until a file has not changed for this long before uploading it, "+
+			"so that files saved repeatedly are only uploaded once. Set to 0 to "+
+			"upload right away.")
+	chunkSize := flag.Uint64("chunk-size", odfs.DefaultChunkSize/(1024*1024),
+		"How much of a large file to upload per request (in MB, up to 60). "+
+			"Larger chunks upload faster on fast connections, smaller ones waste "+
+			"less when a slow connection drops.")
+	adaptiveChunkSize := flag.Bool("adaptive-chunk-size", false,
+		"Grow the upload chunk size while uploads are fast, and shrink it when "+
+			"they are slow or fail, starting from --chunk-size.")
+	uploadPolicy := flag.String("upload-policy", string(odfs.UploadOnFlush),
+		"When to upload changed files: \"flush\" (when closed or fsync()ed), "+
+			"\"close\" (only when closed), or \"interval\" (periodically, see "+
+			"--upload-interval).")
+	uploadInterval := flag.Duration("upload-interval", time.Minute,
+		"How often to upload changed files with --upload-policy=interval.")
+	refreshInterval := flag.Duration("refresh-interval", 30*time.Second,
+		"How often to fetch what changed on the server, so that directories "+
+			"stay up to date whether or not they are being browsed.")
+	notificationURL := flag.String("notification-url", "",
+		"Public URL at which the server can reach --notification-listen, to be "+
+			"notified of changes as they happen instead of only polling for "+
+			"them every --refresh-interval.")
+	notificationListen := flag.String("notification-listen", "localhost:8721",
+		"Address to listen for change notifications on with --notification-url.")
+	uploadRetries := flag.Int("upload-retries", odfs.DefaultRetryPolicy.MaxRetries,
+		"How many times to retry an upload that failed before giving up on it "+
+			"until it is retried with \"onedriver queue retry\".")
+	uploadMaxBackoff := flag.Duration("upload-max-backoff", odfs.DefaultRetryPolicy.MaxBackoff,
+		"Longest time to wait before sending part of a file that the server "+
+			"failed to accept again. Set to 0 for no limit.")
+	uploadRetryBudget := flag.Duration("upload-retry-budget", odfs.DefaultRetryPolicy.Budget,
+		"Give up on an upload that has kept failing for this long, however many "+
+			"retries it has left. Set to 0 for no limit.")
+	conflictBehavior := flag.String("conflict-behavior", "",
+		"What to do when uploading a file that already exists or has changed on "+
+			"the server: \"fail\", \"replace\", or \"rename\" (keep both). By "+
+			"default, files are replaced unless they changed on the server since "+
+			"they were last synced, in which case they are renamed.")
+	conflictStrategy := flag.String("conflict-strategy", string(odfs.ConflictKeepBoth),
+		"Which version to keep of a file changed both locally and on the server: "+
+			"\"keep-both\" (saves the local changes as a conflicted copy), "+
+			"\"local-wins\", \"remote-wins\", or \"prompt\" (keep both until one "+
+			"is picked with \"onedriver conflicts\").")
+	writeThrough := flag.Bool("write-through", false,
+		"Make fsync() and closing a file wait until it has been uploaded, "+
+			"instead of uploading changes in the background.")
+	writeThroughDirs := flag.StringArray("write-through-dir", nil,
+		"Use write-through mode (see --write-through) only for this directory "+
+			"(relative to the mountpoint). Can be used more than once.")
+	fsck := flag.Bool("fsck", false,
+		"Retry uploading files from previous sessions that never made it to "+
+			"the server, list any that still could not be uploaded, and then exit.")
+	discardUnsynced := flag.Bool("discard-unsynced", false,
+		"Delete files that could not be uploaded (see --fsck) from the local "+
+			"cache, and then exit.")
+	eventBuffer := flag.Int("event-buffer", 5000,
+		"Number of recent log messages (including debug messages) to keep in "+
+			"memory for \"onedriver events\". Set to 0 to disable.")
+	dumpOnQuit := flag.Bool("dump-on-sigquit", false,
+		"Write recent log messages to events.log in the cache directory when "+
+			"receiving SIGQUIT instead of exiting.")
+	metadataKeyFile := flag.String("metadata-key-file", "",
+		"Encrypt the names and other metadata of items stored in the cache with "+
+			"the key in this file (generated if it does not exist). Store the key "+
+			"somewhere other than the cache directory.")
+	contentKeyFile := flag.String("content-key-file", "",
+		"Encrypt the content of files stored in the cache with the key in this "+
+			"file (generated if it does not exist), with a key in the kernel "+
+			"keyring given as \"keyring:<description>\", or with a key stored "+
+			"with libsecret given as \"secret:<name>\".")
+	sharedCacheDir := flag.String("shared-cache-dir", "",
+		"Share the content of cached files through this directory with other "+
+			"mounts of the same account that use it too, so that it is stored "+
+			"once. Must be on the same filesystem as the cache directories.")
+	compressCache := flag.Bool("compress-cache", false,
+		"Compress the content of files stored in the cache (with zstd) while "+
+			"they are not open, to fit more in less disk space. Files are "+
+			"decompressed when they are opened.")
+	verifyInterval := flag.Duration("verify-interval", 24*time.Hour,
+		"How often to check the content of cached files against the server, "+
+			"discarding any that no longer match. Set to 0 to disable.")
+	warmInterval := flag.Duration("warm-interval", 15*time.Minute,
+		"How often to prefetch the most used directories again while idle, "+
+			"so that the files in them are cached before they are opened. Set "+
+			"to 0 to disable.")
+	verifyHashes := flag.Bool("verify-hashes", true,
+		"Compare hashes after uploading and downloading files and when opening "+
+			"cached files. Use --verify-hashes=false to only compare sizes, "+
+			"which is faster for very large files.")
+	emulateHardLinks := flag.Bool("emulate-hard-links", false,
+		"Make hard links by copying files on the server. OneDrive has no hard "+
+			"links, so the result is an independent copy, not a true link.")
+	specialFolders := flag.Bool("special-folders", false,
+		"Add a hidden .special folder with links to your Documents, Photos, "+
+			"Camera Roll, and Music folders, wherever they are.")
 	versionFlag := flag.BoolP("version", "v", false, "Display program version.")
 	debugOn := flag.BoolP("debug", "d", false, "Enable FUSE debug logging.")
 	flag.BoolP("help", "h", false, "Displays this help message.")
@@ -67,6 +280,60 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *attrTimeout < 0 || *entryTimeout < 0 || *negativeTimeout < 0 {
+		fmt.Println("Kernel cache timeouts cannot be negative.")
+		os.Exit(1)
+	}
+	if *verifyInterval < 0 {
+		fmt.Println("--verify-interval cannot be negative.")
+		os.Exit(1)
+	}
+	if *warmInterval < 0 {
+		fmt.Println("--warm-interval cannot be negative.")
+		os.Exit(1)
+	}
+	if *refreshInterval <= 0 {
+		fmt.Println("--refresh-interval must be positive.")
+		os.Exit(1)
+	}
+	if *chunkSize == 0 || *chunkSize > 60 {
+		fmt.Println("--chunk-size must be between 1 and 60MB.")
+		os.Exit(1)
+	}
+	switch odfs.UploadPolicy(*uploadPolicy) {
+	case odfs.UploadOnFlush, odfs.UploadOnClose:
+	case odfs.UploadOnInterval:
+		if *uploadInterval <= 0 {
+			fmt.Println("--upload-interval must be positive.")
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Unknown upload policy \"%s\".\n", *uploadPolicy)
+		os.Exit(1)
+	}
+	switch odfs.ConflictBehavior(*conflictBehavior) {
+	case "", odfs.ConflictFail, odfs.ConflictReplace, odfs.ConflictRename:
+	default:
+		fmt.Printf("Unknown conflict behavior \"%s\".\n", *conflictBehavior)
+		os.Exit(1)
+	}
+	switch odfs.ConflictStrategy(*conflictStrategy) {
+	case odfs.ConflictKeepBoth, odfs.ConflictLocalWins, odfs.ConflictRemoteWins,
+		odfs.ConflictPrompt:
+	default:
+		fmt.Printf("Unknown conflict strategy \"%s\".\n", *conflictStrategy)
+		os.Exit(1)
+	}
+	if *uploadDelay < 0 {
+		fmt.Println("--upload-delay cannot be negative.")
+		os.Exit(1)
+	}
+	if *uploadRetries < 0 || *uploadMaxBackoff < 0 || *uploadRetryBudget < 0 {
+		fmt.Println("--upload-retries, --upload-max-backoff, and --upload-retry-budget " +
+			"cannot be negative.")
+		os.Exit(1)
+	}
+
 	// determine cache directory and wipe if desired
 	dir := *cacheDir
 	if dir == "" {
@@ -78,18 +345,51 @@ func main() {
 		os.Exit(0)
 	}
 
+	if _, isCommand := commands[flag.Arg(0)]; isCommand {
+		// commands take precedence unless there's a mountpoint with the same name
+		if st, err := os.Stat(flag.Arg(0)); flag.NArg() > 1 || err != nil || !st.IsDir() {
+			runCommand(dir, flag.Arg(0), flag.Args()[1:])
+		}
+	} else if flag.NArg() > 1 {
+		flag.Usage()
+		fmt.Printf("\nUnknown command \"%s\", exiting.\n", flag.Arg(0))
+		os.Exit(1)
+	}
+
+	if *configPath == "" {
+		xdgConfigDir, _ := os.UserConfigDir()
+		*configPath = filepath.Join(xdgConfigDir, "onedriver", "config.json")
+	}
+	conf := loadConfig(*configPath)
+	switch odfs.EvictionPolicy(conf.EvictionPolicy) {
+	case "", odfs.EvictLRU, odfs.EvictLFU, odfs.EvictSize:
+	default:
+		fmt.Printf("Unknown eviction policy \"%s\" in config file.\n", conf.EvictionPolicy)
+		os.Exit(1)
+	}
+	for _, pattern := range conf.Exclude {
+		if !odfs.ValidExcludePattern(pattern) {
+			fmt.Printf("Invalid exclude pattern \"%s\" in config file.\n", pattern)
+			os.Exit(1)
+		}
+	}
+
 	// authenticate/re-authenticate if necessary
 	os.MkdirAll(dir, 0700)
 	authPath := filepath.Join(dir, "auth_tokens.json")
 	if *authOnly {
 		os.Remove(authPath)
-		graph.Authenticate(authPath)
+		graph.Authenticate(authPath, conf.Scopes...)
 		os.Exit(0)
 	}
 
 	log.SetLevel(logger.StringToLevel(*logLevel))
 	log.SetReportCaller(true)
 	log.SetFormatter(logger.LogrusFormatter())
+	var events *logger.RingBuffer
+	if *eventBuffer > 0 {
+		events = logger.EnableRingBuffer(*eventBuffer, logger.LogrusFormatter())
+	}
 
 	// determine and validate mountpoint
 	if len(flag.Args()) == 0 {
@@ -113,22 +413,124 @@ func main() {
 	}
 
 	// create a new filesystem and mount it
-	auth := graph.Authenticate(authPath)
-	cache := odfs.NewCache(auth, filepath.Join(dir, "onedriver.db"))
-	root, _ := cache.GetPath("/", auth)
-	go cache.DeltaLoop(30 * time.Second)
+	auth := graph.Authenticate(authPath, conf.Scopes...)
+	graph.SetBandwidthLimit(*bandwidthLimit*1024, *prioritizeReads)
+	graph.SetUploadLimit(conf.UploadLimit * 1024)
+	graph.SetDownloadLimit(conf.DownloadLimit * 1024)
+	graph.SetDownloadSegments(*downloadSegments)
+	graph.SetRequestRate(*requestRate)
+	opts := odfs.Options{
+		MaxFileSize:      *maxFileSize * 1024 * 1024 * 1024,
+		PrefetchDirs:     *prefetchDirs,
+		PrefetchFileSize: *prefetchFileSize * 1024,
+		MaxCacheSize:     *maxCacheSize * 1024 * 1024,
+		EvictionPolicy:   odfs.EvictionPolicy(conf.EvictionPolicy),
+		Exclude:          conf.Exclude,
+		MaxDownloads:     *maxDownloads,
+		Readahead:        *readahead * 1024 * 1024,
+		StreamSize:       *streamSize * 1024 * 1024,
+		StreamDirs:       *streamDirs,
+		HydrationHoles:   *hydrationHoles,
+		WriteThrough:     *writeThrough,
+		WriteThroughDirs: *writeThroughDirs,
+		MaxUploads:       *maxUploads,
+		UploadDelay:      *uploadDelay,
+		ChunkSize:        *chunkSize * 1024 * 1024,
+		UploadPolicy:     odfs.UploadPolicy(*uploadPolicy),
+		ConflictBehavior: odfs.ConflictBehavior(*conflictBehavior),
+		ConflictStrategy: odfs.ConflictStrategy(*conflictStrategy),
+		TrashRetention:   *trashRetention,
+		RetryPolicy: &odfs.RetryPolicy{
+			MaxRetries: *uploadRetries,
+			MaxBackoff: *uploadMaxBackoff,
+			Budget:     *uploadRetryBudget,
+		},
 
-	xdgVolumeInfo(cache, auth)
+		AdaptiveChunkSize:    *adaptiveChunkSize,
+		SharedContentDir:     *sharedCacheDir,
+		CompressContent:      *compressCache,
+		SkipHashVerification: !*verifyHashes,
+		EmulateHardLinks:     *emulateHardLinks,
+		SpecialFolders:       *specialFolders,
+	}
+	if *metadataKeyFile != "" {
+		if opts.MetadataKey, err = odfs.LoadMetadataKey(*metadataKeyFile); err != nil {
+			log.WithFields(log.Fields{
+				"path": *metadataKeyFile,
+				"err":  err,
+			}).Fatal("Could not load metadata key.")
+		}
+	}
+	if *contentKeyFile != "" {
+		if opts.ContentKey, err = odfs.LoadContentKey(*contentKeyFile); err != nil {
+			log.WithFields(log.Fields{
+				"path": *contentKeyFile,
+				"err":  err,
+			}).Fatal("Could not load content key.")
+		}
+	}
+	var root fs.InodeEmbedder
+	var caches []*odfs.Cache
+	if *allDrives {
+		if *rootPath != "/" {
+			log.Fatal("--root cannot be combined with --all-drives.")
+		}
+		root, caches = mountAllDrives(auth, dir, opts, *refreshInterval)
+	} else {
+		opts.Root = *rootPath
+		cache := odfs.NewCache(auth, filepath.Join(dir, "onedriver.db"), &opts)
+		root, _ = cache.GetPath("/", auth)
+		caches = append(caches, cache)
+		go cache.DeltaLoop(*refreshInterval)
+
+		xdgVolumeInfo(cache, auth)
+	}
+
+	for _, cache := range caches {
+		reconcileUnsynced(cache, auth, *discardUnsynced)
+	}
+	if *fsck || *discardUnsynced {
+		os.Exit(0)
+	}
+	for _, cache := range caches {
+		go cache.CheckContent()
+		go cache.PurgeTrash()
+		go cache.PrefetchHotDirs()
+		if *prefetchMetadata {
+			go prefetchAllMetadata(cache)
+		}
+		if *warmInterval > 0 {
+			go cache.WarmLoop(*warmInterval)
+		}
+		if *verifyInterval > 0 {
+			go cache.VerifyLoop(*verifyInterval)
+		}
+		if opts.UploadPolicy == odfs.UploadOnInterval {
+			go cache.WritebackLoop(*uploadInterval)
+		} else {
+			// files saved with --upload-policy=interval last time
+			go cache.UploadDirty()
+		}
+	}
+	if *notificationURL != "" {
+		subscribeChanges(*notificationURL, *notificationListen, caches)
+	}
+	absMountpoint, _ := filepath.Abs(mountpoint)
+	if _, err := odfs.ServeControl(controlSocket(dir), absMountpoint, root, events, caches...); err != nil {
+		log.WithField("err", err).Error("Could not start control socket, " +
+			"commands like \"onedriver queue\" will not work.")
+	}
 
-	second := time.Second
 	server, err := fs.Mount(mountpoint, root, &fs.Options{
-		EntryTimeout: &second,
-		AttrTimeout:  &second,
+		EntryTimeout:    entryTimeout,
+		AttrTimeout:     attrTimeout,
+		NegativeTimeout: negativeTimeout,
 		MountOptions: fuse.MountOptions{
 			Name:          "onedriver",
 			FsName:        "onedriver",
-			DisableXAttrs: true,
+			DisableXAttrs: false,
 			MaxBackground: 1024,
+			AllowOther:    *allowOther,
 		},
 	})
 	if err != nil {
@@ -140,12 +542,43 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go odfs.UnmountHandler(sigChan, server)
+	if *dumpOnQuit && events != nil {
+		quitChan := make(chan os.Signal, 1)
+		signal.Notify(quitChan, syscall.SIGQUIT)
+		go odfs.DumpEventsHandler(quitChan, events, filepath.Join(dir, "events.log"))
+	}
 
 	// serve filesystem
 	server.SetDebug(*debugOn)
 	server.Wait()
 }
 
+// subscribeChanges has the server notify onedriver of changes to the drives of
+// caches at notificationURL, which should lead to a server listening at listen.
+// Changes are only polled for if that fails.
+func subscribeChanges(notificationURL string, listen string, caches []*odfs.Cache) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"listen": listen,
+			"err":    err,
+		}).Error("Could not listen for change notifications, polling for changes instead.")
+		return
+	}
+	notifier := odfs.NewWebhookNotifier(notificationURL)
+	go http.Serve(listener, notifier)
+	for _, cache := range caches {
+		go func(cache *odfs.Cache) {
+			if err := notifier.Subscribe(cache); err != nil {
+				log.WithFields(log.Fields{
+					"url": notificationURL,
+					"err": err,
+				}).Error("Could not subscribe to change notifications, polling for changes instead.")
+			}
+		}(cache)
+	}
+}
+
 // xdgVolumeInfo createx .xdg-volume-info for a nice little onedrive logo in the
 // corner of the mountpoint and shows the account name in the nautilus sidebar
 func xdgVolumeInfo(cache *odfs.Cache, auth *graph.Auth) {
@@ -166,17 +599,189 @@ func xdgVolumeInfo(cache *odfs.Cache, auth *graph.Auth) {
 
 	// just upload directly and shove it in the cache
 	// (since the fs isn't mounted yet)
+	root, _ := cache.GetPath("/", auth) // cannot fail
 	resp, err := graph.Put(
-		graph.ResourcePath("/.xdg-volume-info")+":/content",
+		cache.Drive().IDPath(root.ID())+":/.xdg-volume-info:/content",
 		auth,
 		strings.NewReader(xdgVolumeInfo),
 	)
 	if err != nil {
 		log.Error(err)
 	}
-	root, _ := cache.GetPath("/", auth) // cannot fail
 	inode := odfs.NewInode(".xdg-volume-info", 0644, root)
 	if json.Unmarshal(resp, &inode) == nil {
 		cache.InsertID(inode.ID(), inode)
 	}
 }
+
+// prefetchAllMetadata adds the whole tree of a drive to its cache for
+// --prefetch-metadata. Skipped when starting offline, since there is nothing to
+// fetch it from.
+func prefetchAllMetadata(cache *odfs.Cache) {
+	if cache.IsOffline() {
+		log.Warn("Starting offline, not prefetching metadata.")
+		return
+	}
+	if _, err := cache.PrefetchMetadata(cache.GetAuth()); err != nil {
+		log.WithField("err", err).Error("Could not prefetch metadata.")
+	}
+}
+
+// reconcileUnsynced retries the upload of files that never made it to the
+// server during a previous session, and reports (or discards) any that still
+// could not be uploaded.
+func reconcileUnsynced(cache *odfs.Cache, auth *graph.Auth, discard bool) {
+	unsynced := cache.ReconcileLocalItems(auth)
+	if discard {
+		for _, item := range cache.DiscardUnsynced() {
+			fmt.Printf("Discarded %s\n", item.Path)
+		}
+		return
+	}
+	if len(unsynced) == 0 {
+		return
+	}
+	fmt.Printf("%d file(s) could not be uploaded and exist only in the local cache:\n",
+		len(unsynced))
+	for _, item := range unsynced {
+		fmt.Printf("  %s (%s)\n", item.Path, item.Reason)
+	}
+	fmt.Println("Copy them elsewhere, then run onedriver with --discard-unsynced to remove them.")
+}
+
+// driveEntry describes one of the drives (or shared folders) mounted with
+// --all-drives. The layout is saved to disk so that it can be restored when
+// starting offline.
+type driveEntry struct {
+	Name    string `json:"name"`
+	Shared  bool   `json:"shared,omitempty"`
+	Site    bool   `json:"site,omitempty"`
+	DriveID string `json:"driveId,omitempty"`
+	RootID  string `json:"rootId,omitempty"`
+}
+
+// listDrives determines which drives and shared folders are available to the
+// user. The user's own drive is always first. The layout is saved to layoutPath
+// (encrypted with key, if set) for offline starts.
+func listDrives(auth *graph.Auth, layoutPath string, key []byte) []driveEntry {
+	own, err := graph.GetDrive(auth)
+	if err != nil {
+		// likely offline, reuse the layout from last time
+		entries := make([]driveEntry, 0)
+		data, readErr := odfs.ReadSealed(layoutPath, key)
+		if readErr != nil || json.Unmarshal(data, &entries) != nil {
+			log.WithField("err", err).Fatal(
+				"Could not list drives and no layout from a previous session was found.")
+		}
+		return entries
+	}
+
+	entries := []driveEntry{{Name: "Personal"}}
+	drives, err := graph.GetDrives(auth)
+	if err != nil {
+		log.WithField("err", err).Error("Could not list additional drives.")
+	}
+	for _, drive := range drives {
+		if drive.ID == own.ID {
+			continue
+		}
+		name := drive.Name
+		if name == "" {
+			name = drive.ID
+		}
+		entries = append(entries, driveEntry{Name: name, DriveID: drive.ID})
+	}
+
+	shared, err := graph.GetSharedWithMe(auth)
+	if err != nil {
+		log.WithField("err", err).Error("Could not list items shared with you.")
+	}
+	for _, item := range shared {
+		remote := item.RemoteItem
+		if remote == nil || remote.Folder == nil || remote.Parent == nil {
+			// only shared folders can be mounted
+			continue
+		}
+		entries = append(entries, driveEntry{
+			Name:    item.Name,
+			Shared:  true,
+			DriveID: remote.Parent.DriveID,
+			RootID:  remote.ID,
+		})
+	}
+
+	sites, err := graph.GetFollowedSites(auth)
+	if _, missingScope := err.(*graph.ScopeError); missingScope {
+		log.Info(err)
+	} else if err != nil {
+		log.WithField("err", err).Error("Could not list SharePoint sites.")
+	}
+	for _, site := range sites {
+		drives, err := graph.GetSiteDrives(site.ID, auth)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"site": site.DisplayName,
+				"err":  err,
+			}).Error("Could not list document libraries of SharePoint site.")
+			continue
+		}
+		for _, drive := range drives {
+			entries = append(entries, driveEntry{
+				Name:    site.DisplayName + " - " + drive.Name,
+				Site:    true,
+				DriveID: drive.ID,
+			})
+		}
+	}
+
+	data, _ := json.Marshal(entries)
+	if err := odfs.WriteSealed(layoutPath, data, key); err != nil {
+		log.WithField("err", err).Warn("Could not save drive layout.")
+	}
+	return entries
+}
+
+// mountAllDrives creates a Cache for every drive available to the user and
+// returns a virtual directory containing each of them. opts are applied to every
+// drive.
+func mountAllDrives(auth *graph.Auth, dir string, opts odfs.Options,
+	refreshInterval time.Duration) (*odfs.DriveDir, []*odfs.Cache) {
+	root := odfs.NewDriveDir()
+	caches := make([]*odfs.Cache, 0)
+	shared := odfs.NewDriveDir()
+	sites := odfs.NewDriveDir()
+	hasShared, hasSites := false, false
+	for _, entry := range listDrives(auth, filepath.Join(dir, "drives.json"), opts.MetadataKey) {
+		dbPath := filepath.Join(dir, "onedriver.db")
+		if entry.DriveID != "" {
+			dbPath = filepath.Join(dir, fmt.Sprintf(
+				"onedriver-%s.db", url.PathEscape(entry.DriveID+"_"+entry.RootID),
+			))
+		}
+		driveOpts := opts
+		driveOpts.DriveID = entry.DriveID
+		driveOpts.RootID = entry.RootID
+		cache := odfs.NewCache(auth, dbPath, &driveOpts)
+		caches = append(caches, cache)
+		go cache.DeltaLoop(refreshInterval)
+
+		driveRoot, _ := cache.GetPath("/", auth)
+		switch {
+		case entry.Shared:
+			shared.AddDrive(entry.Name, driveRoot)
+			hasShared = true
+		case entry.Site:
+			sites.AddDrive(entry.Name, driveRoot)
+			hasSites = true
+		default:
+			root.AddDrive(entry.Name, driveRoot)
+		}
+	}
+	if hasShared {
+		root.AddDrive("SharedWithMe", shared)
+	}
+	if hasSites {
+		root.AddDrive("Sites", sites)
+	}
+	return root, caches
+}
@@ -0,0 +1,77 @@
+#!/bin/bash
+# A reference status indicator that shows whether onedriver is up to date in the
+# system tray, along with a menu of recently synced files. Requires yad and jq.
+# Any arguments (like --cache-dir) are passed to onedriver to locate the running
+# instance.
+set -eo pipefail
+
+if ! command -v yad > /dev/null || ! command -v jq > /dev/null; then
+    echo "onedriver-tray.sh requires yad and jq to be installed."
+    exit 1
+fi
+
+# yad reads icon and menu updates from this pipe
+PIPE=$(mktemp -u --tmpdir onedriver-tray.XXXXXX)
+mkfifo "$PIPE"
+exec 3<> "$PIPE"
+rm "$PIPE"
+trap 'kill $(jobs -p) 2> /dev/null' EXIT
+yad --notification --listen --image=folder-remote --text="onedriver" <&3 &
+YAD=$!
+
+EVENTS="sh -c 'onedriver $* events 100 | yad --text-info --title=onedriver --width=900 --height=500'"
+
+# "onedriver status watch" prints the status of each drive as JSON every time it
+# changes, and exits when onedriver does
+onedriver "$@" status watch | while read -r STATUS; do
+    kill -0 $YAD 2> /dev/null || exit 0 # quit from the menu
+    OFFLINE=$(jq '[.[] | select(.Offline)] | length' <<< "$STATUS")
+    SYNCING=$(jq '[.[] | select(.Delta.Running)] | length' <<< "$STATUS")
+    UPLOADS=$(jq '[.[].Uploads] | add // 0' <<< "$STATUS")
+    PAUSED=$(jq '[.[] | select(.Paused)] | length' <<< "$STATUS")
+    SYNC_PAUSED=$(jq '[.[] | select(.SyncPaused)] | length' <<< "$STATUS")
+    FAILED=$(jq '[.[].Failed] | add // 0' <<< "$STATUS")
+    CONFLICTS=$(jq '[.[].Conflicts[]?] | length' <<< "$STATUS")
+    # the first file being downloaded while it is read, with how much is done
+    DOWNLOAD=$(jq -r '[.[].Downloads[]?][0] // empty |
+        "\(.Path | split("/") | last) (\(.Cached * 100 / .Size | floor)%)"' <<< "$STATUS")
+    if [ "$OFFLINE" -gt 0 ]; then
+        ICON=network-offline
+        TEXT="onedriver is offline, files are read-only"
+    elif [ "$FAILED" -gt 0 ]; then
+        ICON=dialog-warning
+        TEXT="onedriver could not upload $FAILED files (see \"onedriver queue list\")"
+    elif [ "$CONFLICTS" -gt 0 ]; then
+        ICON=dialog-question
+        TEXT="$CONFLICTS files changed both locally and on the server (see \"onedriver conflicts\")"
+    elif [ "$SYNC_PAUSED" -gt 0 ]; then
+        ICON=media-playback-pause
+        TEXT="onedriver sync is paused ($UPLOADS uploads queued)"
+    elif [ "$PAUSED" -gt 0 ]; then
+        ICON=media-playback-pause
+        TEXT="onedriver uploads are paused ($UPLOADS uploads queued)"
+    elif [ -n "$DOWNLOAD" ]; then
+        ICON=emblem-downloads
+        TEXT="onedriver is downloading $DOWNLOAD"
+    elif [ "$SYNCING" -gt 0 ] || [ "$UPLOADS" -gt 0 ]; then
+        ICON=emblem-synchronizing
+        TEXT="onedriver is syncing ($UPLOADS uploads queued)"
+    else
+        ICON=emblem-default
+        TEXT="onedriver is up to date"
+    fi
+    # "!" and "|" separate yad menu entries, so they cannot appear in filenames
+    RECENT=$(jq -r '[.[].Recent[]] | sort_by(.Time) | reverse | .[:10] |
+        map("\(.Action) \(.Name | gsub("[!|]"; "_"))!true") | join("|")' <<< "$STATUS")
+
+    echo "icon:$ICON" >&3
+    echo "tooltip:$TEXT" >&3
+    if [ "$SYNC_PAUSED" -gt 0 ]; then
+        PAUSE="Resume sync!onedriver $* resume"
+    elif [ "$PAUSED" -gt 0 ]; then
+        PAUSE="Resume uploads!onedriver $* queue resume"
+    else
+        PAUSE="Pause sync!onedriver $* pause"
+    fi
+    echo "menu:${RECENT:+$RECENT|}$PAUSE|Show recent events!$EVENTS|Quit!quit" >&3
+done